@@ -0,0 +1,236 @@
+// Copyright (C) 2019 Nick Rosbrook
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package vici
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	// A bulk operation was given no sessions to use
+	errNoSessions = errors.New("vici: no sessions given")
+
+	// A bulk operation was given a nil session
+	errNilSession = errors.New("vici: nil session given")
+
+	// An owner was given different shared secrets of the same type
+	errDuplicateOwner = errors.New("vici: owner has conflicting shared secrets")
+
+	// Some shared secrets could not be loaded
+	errSharedFailed = errors.New("vici: shared secrets failed to load")
+)
+
+// InitiateTarget is an SA to initiate with BulkInitiate, named as for Session.Initiate.
+type InitiateTarget struct {
+	Child string
+	IKE   string
+}
+
+// InitiateResult is the outcome of initiating an InitiateTarget.
+type InitiateResult struct {
+	Target InitiateTarget
+
+	// Latency is how long the initiation took, and Err the error that occurred,
+	// if any.
+	Latency time.Duration
+	Err     error
+}
+
+// BulkInitiate initiates each of targets, and returns the result for each, in the same
+// order. Since a session handles one command at a time, targets are initiated concurrently
+// using one goroutine per session, so the parallelism is bounded by len(sessions). opts are
+// passed to each Session.Initiate. Once ctx is done, remaining targets fail with ctx.Err().
+//
+// BulkInitiate is intended for scale testing of gateways, e.g.:
+//
+//	sessions := make([]*vici.Session, 16)
+//	for i := range sessions {
+//		if sessions[i], err = vici.NewSession(); err != nil {
+//			return err
+//		}
+//	}
+//
+//	results, err := vici.BulkInitiate(ctx, sessions, targets)
+func BulkInitiate(ctx context.Context, sessions []*Session, targets []InitiateTarget, opts ...InitiateOption) ([]InitiateResult, error) {
+	if len(sessions) == 0 {
+		return nil, errNoSessions
+	}
+
+	for i, s := range sessions {
+		if s == nil {
+			return nil, fmt.Errorf("%v: sessions[%v]", errNilSession, i)
+		}
+	}
+
+	results := make([]InitiateResult, len(targets))
+	next := make(chan int)
+
+	var wg sync.WaitGroup
+
+	for _, s := range sessions {
+		wg.Add(1)
+
+		go func(s *Session) {
+			defer wg.Done()
+
+			for i := range next {
+				t := targets[i]
+				start := time.Now()
+
+				err := ctx.Err()
+				if err == nil {
+					err = s.Initiate(ctx, t.Child, t.IKE, opts...)
+				}
+
+				results[i] = InitiateResult{Target: t, Latency: time.Since(start), Err: err}
+			}
+		}(s)
+	}
+
+	for i := range targets {
+		next <- i
+	}
+	close(next)
+
+	wg.Wait()
+
+	return results, nil
+}
+
+// SharedResult is the outcome of loading a shared secret with LoadSharedBulk.
+type SharedResult struct {
+	// ID and Owners identify the secret, with duplicate owners removed.
+	ID     string
+	Owners []string
+
+	// Err is the error that occurred, if any.
+	Err error
+}
+
+// sharedBatch is a load-shared request for one or more shared secrets.
+type sharedBatch struct {
+	secret  SharedSecret
+	indices []int
+	seen    map[string]bool
+}
+
+// add adds the owners of secret i to the batch.
+func (b *sharedBatch) add(i int, owners []string) {
+	b.indices = append(b.indices, i)
+
+	for _, owner := range owners {
+		if !b.seen[owner] {
+			b.seen[owner] = true
+			b.secret.Owners = append(b.secret.Owners, owner)
+		}
+	}
+}
+
+// LoadSharedBulk loads a large number of shared secrets, e.g. the PSKs of thousands of
+// peers, and returns the result for each, in the same order. Duplicate owners of a secret
+// are removed, and secrets without an ID that have the same type and data are loaded with
+// a single load-shared command for all of their owners. A secret whose owner already has
+// a different secret of the same type fails, as the daemon would use either one. An error
+// is returned if any secret failed.
+func (s *Session) LoadSharedBulk(secrets []SharedSecret) ([]SharedResult, error) {
+	results := make([]SharedResult, len(secrets))
+
+	var (
+		batches []*sharedBatch
+		merged  = make(map[string]*sharedBatch)
+		owners  = make(map[string]string)
+	)
+
+	for i, secret := range secrets {
+		secret.Owners = uniqueStrings(secret.Owners)
+		results[i] = SharedResult{ID: secret.ID, Owners: secret.Owners}
+
+		for _, owner := range secret.Owners {
+			k := secret.Type + "\x00" + owner
+			if data, ok := owners[k]; ok && data != string(secret.Data) {
+				results[i].Err = fmt.Errorf("%v: %v", errDuplicateOwner, owner)
+			}
+		}
+
+		if results[i].Err != nil {
+			continue
+		}
+
+		for _, owner := range secret.Owners {
+			owners[secret.Type+"\x00"+owner] = string(secret.Data)
+		}
+
+		k := secret.Type + "\x00" + string(secret.Data)
+		if b, ok := merged[k]; ok && secret.ID == "" {
+			b.add(i, secret.Owners)
+			continue
+		}
+
+		b := &sharedBatch{secret: secret, seen: make(map[string]bool)}
+		b.secret.Owners = nil
+		b.add(i, secret.Owners)
+
+		if secret.ID == "" {
+			merged[k] = b
+		}
+		batches = append(batches, b)
+	}
+
+	for _, b := range batches {
+		err := s.LoadShared(b.secret)
+
+		for _, i := range b.indices {
+			results[i].Err = err
+		}
+	}
+
+	var failed int
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return results, fmt.Errorf("%v: %v of %v failed", errSharedFailed, failed, len(results))
+	}
+
+	return results, nil
+}
+
+// uniqueStrings returns list without duplicates, in order.
+func uniqueStrings(list []string) []string {
+	var unique []string
+
+	seen := make(map[string]bool, len(list))
+	for _, s := range list {
+		if !seen[s] {
+			seen[s] = true
+			unique = append(unique, s)
+		}
+	}
+
+	return unique
+}
@@ -0,0 +1,285 @@
+// Copyright (C) 2019 Nick Rosbrook
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package vici
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestBulkInitiate(t *testing.T) {
+	ok, err := NewMessageFromMap(map[string]interface{}{"success": "yes"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating message: %v", err)
+	}
+
+	failed, err := NewMessageFromMap(map[string]interface{}{"success": "no", "errmsg": "establishing CHILD_SA failed"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating message: %v", err)
+	}
+
+	client, srvr := net.Pipe()
+	defer client.Close()
+	defer srvr.Close()
+
+	s := &Session{ctr: &transport{conn: client}}
+
+	reqs := serveStreamedCommands(t, srvr, []streamedResponse{
+		{"control-log", nil, ok},
+		{"control-log", nil, failed},
+		{"control-log", nil, ok},
+		{"control-log", nil, failed},
+	})
+
+	var targets []InitiateTarget
+	for _, child := range []string{"a", "b", "c", "d"} {
+		targets = append(targets, InitiateTarget{Child: child, IKE: "gw"})
+	}
+
+	results, err := BulkInitiate(context.Background(), []*Session{s}, targets)
+	if err != nil {
+		t.Fatalf("Unexpected error initiating: %v", err)
+	}
+
+	for i, r := range results {
+		if r.Target != targets[i] {
+			t.Errorf("Unexpected target.\nExpected: %+v\nReceived: %+v", targets[i], r.Target)
+		}
+
+		if failed := i%2 == 1; (r.Err != nil) != failed {
+			t.Errorf("Unexpected result of %v: %v", r.Target.Child, r.Err)
+		}
+	}
+
+	var initiated []string
+	for p := range reqs {
+		initiated = append(initiated, stringField(p.msg, "child"))
+	}
+
+	expected := []string{"a", "b", "c", "d"}
+	if !reflect.DeepEqual(initiated, expected) {
+		t.Errorf("Unexpected initiated children.\nExpected: %v\nReceived: %v", expected, initiated)
+	}
+
+	if _, err := BulkInitiate(context.Background(), nil, targets); err == nil {
+		t.Errorf("Expected error without sessions")
+	}
+
+	if _, err := BulkInitiate(context.Background(), []*Session{s, nil}, targets); err == nil {
+		t.Errorf("Expected error with nil session")
+	}
+}
+
+// serveInitiates answers initiate requests received on conn until it is closed, and
+// fails those for children in failed. The initiated children are sent on the
+// returned channel.
+func serveInitiates(t *testing.T, conn net.Conn, failed map[string]bool) <-chan string {
+	children := make(chan string, 64)
+
+	go func() {
+		defer close(children)
+
+		tr := &transport{conn: conn}
+
+		confirm := func(p *packet, ptype uint8) bool {
+			if p.ptype != ptype || p.name != "control-log" {
+				t.Errorf("Unexpected event registration: %v %v", p.ptype, p.name)
+			}
+
+			if err := tr.send(newPacket(pktEventConfirm, "", nil)); err != nil {
+				t.Errorf("Unexpected error confirming event registration: %v", err)
+				return false
+			}
+
+			return true
+		}
+
+		for {
+			// The session is closed once all targets are initiated
+			p, err := tr.recv()
+			if err != nil || !confirm(p, pktEventRegister) {
+				return
+			}
+
+			p, err = tr.recv()
+			if err != nil {
+				t.Errorf("Unexpected error receiving request: %v", err)
+				return
+			}
+
+			child := stringField(p.msg, "child")
+			children <- child
+
+			resp := map[string]interface{}{"success": "yes"}
+			if failed[child] {
+				resp = map[string]interface{}{"success": "no", "errmsg": "establishing CHILD_SA failed"}
+			}
+
+			m, err := NewMessageFromMap(resp)
+			if err != nil {
+				t.Errorf("Unexpected error creating message: %v", err)
+				return
+			}
+
+			if err := tr.send(newPacket(pktCmdResponse, "", m)); err != nil {
+				t.Errorf("Unexpected error sending response: %v", err)
+				return
+			}
+
+			p, err = tr.recv()
+			if err != nil {
+				t.Errorf("Unexpected error receiving event registration: %v", err)
+				return
+			}
+
+			if !confirm(p, pktEventUnregister) {
+				return
+			}
+		}
+	}()
+
+	return children
+}
+
+func TestBulkInitiateSessions(t *testing.T) {
+	failed := map[string]bool{}
+
+	var targets []InitiateTarget
+	for i := 0; i < 32; i++ {
+		child := fmt.Sprintf("child-%02d", i)
+		if i%3 == 0 {
+			failed[child] = true
+		}
+
+		targets = append(targets, InitiateTarget{Child: child, IKE: "gw"})
+	}
+
+	var (
+		sessions []*Session
+		clients  []net.Conn
+		served   []<-chan string
+	)
+
+	for i := 0; i < 4; i++ {
+		client, srvr := net.Pipe()
+		defer srvr.Close()
+
+		clients = append(clients, client)
+		sessions = append(sessions, &Session{ctr: &transport{conn: client}})
+		served = append(served, serveInitiates(t, srvr, failed))
+	}
+
+	results, err := BulkInitiate(context.Background(), sessions, targets)
+	if err != nil {
+		t.Fatalf("Unexpected error initiating: %v", err)
+	}
+
+	for _, c := range clients {
+		c.Close()
+	}
+
+	if len(results) != len(targets) {
+		t.Fatalf("Unexpected number of results.\nExpected: %v\nReceived: %v", len(targets), len(results))
+	}
+
+	for i, r := range results {
+		if r.Target != targets[i] {
+			t.Errorf("Unexpected target.\nExpected: %+v\nReceived: %+v", targets[i], r.Target)
+		}
+
+		if (r.Err != nil) != failed[r.Target.Child] {
+			t.Errorf("Unexpected result of %v: %v", r.Target.Child, r.Err)
+		}
+	}
+
+	var initiated, expected []string
+	for _, children := range served {
+		for child := range children {
+			initiated = append(initiated, child)
+		}
+	}
+	for _, target := range targets {
+		expected = append(expected, target.Child)
+	}
+
+	sort.Strings(initiated)
+	if !reflect.DeepEqual(initiated, expected) {
+		t.Errorf("Unexpected initiated children.\nExpected: %v\nReceived: %v", expected, initiated)
+	}
+}
+
+func TestLoadSharedBulk(t *testing.T) {
+	client, srvr := net.Pipe()
+	defer client.Close()
+	defer srvr.Close()
+
+	s := &Session{ctr: &transport{conn: client}}
+
+	ok, err := NewMessageFromMap(map[string]interface{}{"success": "yes"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating message: %v", err)
+	}
+
+	reqs := serveCommands(t, srvr, []*Message{ok, ok})
+
+	secrets := []SharedSecret{
+		{Type: "IKE", Data: Secret("group"), Owners: []string{"a", "b", "a"}},
+		{ID: "c", Type: "IKE", Data: Secret("c-secret"), Owners: []string{"c"}},
+		{Type: "IKE", Data: Secret("group"), Owners: []string{"b", "d"}},
+		{Type: "IKE", Data: Secret("other"), Owners: []string{"d"}},
+	}
+
+	results, err := s.LoadSharedBulk(secrets)
+	if err == nil {
+		t.Errorf("Expected error when an owner has conflicting secrets")
+	}
+
+	if !reflect.DeepEqual(results[0].Owners, []string{"a", "b"}) {
+		t.Errorf("Unexpected owners.\nExpected: %v\nReceived: %v", []string{"a", "b"}, results[0].Owners)
+	}
+
+	for i, r := range results {
+		if failed := i == 3; (r.Err != nil) != failed {
+			t.Errorf("Unexpected result of secret %v: %v", i, r.Err)
+		}
+	}
+
+	var loaded []map[string]interface{}
+	for p := range reqs {
+		if p.name != "load-shared" {
+			t.Errorf("Expected command load-shared: received %v", p.name)
+		}
+		loaded = append(loaded, p.msg.ToMap())
+	}
+
+	expected := []map[string]interface{}{
+		{"type": "IKE", "data": "group", "owners": []string{"a", "b", "d"}},
+		{"id": "c", "type": "IKE", "data": "c-secret", "owners": []string{"c"}},
+	}
+
+	if !reflect.DeepEqual(loaded, expected) {
+		t.Errorf("Unexpected requests.\nExpected: %v\nReceived: %v", expected, loaded)
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright (C) 2019 Nick Rosbrook
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package vici
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ExpiringCert is a certificate or CRL found by a CertWatcher to expire within its
+// window.
+type ExpiringCert struct {
+	Cert Cert
+
+	// Name identifies the certificate, i.e. the subject of a certificate, or
+	// the issuer of a CRL.
+	Name string
+
+	// NotAfter is the expiry of a certificate, or the next update of a CRL,
+	// and Remaining is the time until then, which is negative once expired.
+	NotAfter  time.Time
+	Remaining time.Duration
+}
+
+// CertWatcher finds the certificates and CRLs loaded in the daemon that expire soon,
+// using list-certs, so that they can be rotated in time.
+type CertWatcher struct {
+	s      *Session
+	window time.Duration
+}
+
+// NewCertWatcher returns a new CertWatcher for the certificates of s, which reports
+// certificates and CRLs that expire within window.
+func NewCertWatcher(s *Session, window time.Duration) *CertWatcher {
+	return &CertWatcher{s: s, window: window}
+}
+
+// Check returns the certificates and CRLs that have expired, or expire within the window,
+// ordered by expiry. The list-certs request is aborted once ctx is done.
+func (w *CertWatcher) Check(ctx context.Context) ([]ExpiringCert, error) {
+	var expiring []ExpiringCert
+
+	now := time.Now()
+
+	err := w.s.EachCert(ctx, CertFilter{}, func(c Cert) error {
+		name, notAfter, err := certExpiry(c)
+		if err != nil || notAfter.IsZero() {
+			return err
+		}
+
+		if remaining := notAfter.Sub(now); remaining <= w.window {
+			expiring = append(expiring, ExpiringCert{
+				Cert:      c,
+				Name:      name,
+				NotAfter:  notAfter,
+				Remaining: remaining,
+			})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(expiring, func(i, j int) bool {
+		return expiring[i].NotAfter.Before(expiring[j].NotAfter)
+	})
+
+	return expiring, nil
+}
+
+// Run calls fn with the result of Check every interval, until ctx is done, and then
+// returns ctx.Err(). If the certificates cannot be checked, fn is called with the error
+// instead, unless the check was interrupted by ctx. An error is returned if interval is
+// not positive.
+func (w *CertWatcher) Run(ctx context.Context, interval time.Duration, fn func([]ExpiringCert, error)) error {
+	if interval <= 0 {
+		return fmt.Errorf("%v: %v", errInvalidInterval, interval)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		expiring, err := w.Check(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		fn(expiring, err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// certExpiry returns the name and expiry of c, or a zero time if c does not expire, e.g.
+// because it is not an X.509 certificate or CRL.
+func certExpiry(c Cert) (string, time.Time, error) {
+	switch c.Type {
+	case "X509":
+		if c.Certificate == nil {
+			return "", time.Time{}, nil
+		}
+
+		return c.Certificate.Subject.String(), c.Certificate.NotAfter, nil
+
+	case "X509_CRL":
+		crl, err := x509.ParseRevocationList(c.Data)
+		if err != nil {
+			return "", time.Time{}, fmt.Errorf("%v: %v", errInvalidCertificate, err)
+		}
+
+		return crl.Issuer.String(), crl.NextUpdate, nil
+	}
+
+	return "", time.Time{}, nil
+}
@@ -0,0 +1,148 @@
+// Copyright (C) 2019 Nick Rosbrook
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package vici
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCertWatcherCheck(t *testing.T) {
+	client, srvr := net.Pipe()
+	defer client.Close()
+	defer srvr.Close()
+
+	s := &Session{ctr: &transport{conn: client}}
+
+	ca, caKey := newTestCertificate(t, "strongSwan CA", true)
+	cert, _ := newTestCertificate(t, "moon.strongswan.org", false)
+
+	var events []*Message
+
+	for _, c := range []struct {
+		typ        string
+		nextUpdate time.Duration
+	}{
+		{"X509_CRL", 30 * time.Minute},
+		{"X509_CRL", 10 * 24 * time.Hour},
+		{"X509", 0},
+	} {
+		data := cert.Raw
+
+		if c.typ == "X509_CRL" {
+			template := &x509.RevocationList{
+				Number:     big.NewInt(1),
+				ThisUpdate: time.Now(),
+				NextUpdate: time.Now().Add(c.nextUpdate),
+			}
+
+			crl, err := x509.CreateRevocationList(rand.Reader, template, ca, caKey)
+			if err != nil {
+				t.Fatalf("Unexpected error creating CRL: %v", err)
+			}
+			data = crl
+		}
+
+		m, err := NewMessageFromMap(map[string]interface{}{"type": c.typ, "flag": "NONE", "data": data})
+		if err != nil {
+			t.Fatalf("Unexpected error creating message: %v", err)
+		}
+		events = append(events, m)
+	}
+
+	serveStreamedCommand(t, srvr, "list-cert", events, NewMessage())
+
+	expiring, err := NewCertWatcher(s, 2*time.Hour).Check(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error checking certificates: %v", err)
+	}
+
+	if len(expiring) != 2 {
+		t.Fatalf("Expected 2 expiring certificates: received %+v", expiring)
+	}
+
+	if e := expiring[0]; e.Cert.Type != "X509_CRL" || e.Name != "CN=strongSwan CA" || e.Remaining > 30*time.Minute {
+		t.Errorf("Unexpected expiring CRL: %+v", e)
+	}
+
+	if e := expiring[1]; e.Cert.Type != "X509" || e.Name != "CN=moon.strongswan.org" || !e.NotAfter.Equal(cert.NotAfter) {
+		t.Errorf("Unexpected expiring certificate: %+v", e)
+	}
+}
+
+func TestCertWatcherRunCanceled(t *testing.T) {
+	client, srvr := net.Pipe()
+	defer client.Close()
+	defer srvr.Close()
+
+	s := &Session{ctr: &transport{conn: client}}
+
+	// The list-certs request is received, but never answered
+	received := make(chan struct{})
+	go func() {
+		tr := &transport{conn: srvr}
+
+		if _, err := tr.recv(); err != nil {
+			t.Errorf("Unexpected error receiving event registration: %v", err)
+		}
+
+		if err := tr.send(newPacket(pktEventConfirm, "", nil)); err != nil {
+			t.Errorf("Unexpected error confirming event registration: %v", err)
+		}
+
+		if _, err := tr.recv(); err != nil {
+			t.Errorf("Unexpected error receiving request: %v", err)
+		}
+		close(received)
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-received
+		cancel()
+	}()
+
+	w := NewCertWatcher(s, time.Hour)
+
+	err := w.Run(ctx, time.Second, func([]ExpiringCert, error) {
+		t.Errorf("Unexpected check after cancellation")
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled: received %v", err)
+	}
+}
+
+func TestCertWatcherRunInvalidInterval(t *testing.T) {
+	w := NewCertWatcher(&Session{}, time.Hour)
+
+	err := w.Run(context.Background(), -time.Second, func([]ExpiringCert, error) {
+		t.Errorf("Unexpected check with invalid interval")
+	})
+	if err == nil {
+		t.Errorf("Expected error with negative interval")
+	}
+}
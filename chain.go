@@ -0,0 +1,172 @@
+// Copyright (C) 2019 Nick Rosbrook
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package vici
+
+import (
+	"crypto/x509"
+	"fmt"
+)
+
+// ChainError is returned by VerifyCertChain, and LoadCertPEMVerified, if a certificate
+// cannot be verified. It describes the first broken link of the certificate's chain.
+type ChainError struct {
+	// Cert is the certificate being verified, and Link the certificate whose
+	// issuer could not be found, or did not validly sign it. Link is Cert if the
+	// chain is complete but invalid for another reason, e.g. expiry.
+	Cert *x509.Certificate
+	Link *x509.Certificate
+
+	// Issuer is the issuer named by Link.
+	Issuer string
+
+	// Err is the error returned by crypto/x509.
+	Err error
+}
+
+func (e *ChainError) Error() string {
+	if e.Link == e.Cert {
+		return fmt.Sprintf("vici: failed to verify certificate %v: %v", e.Cert.Subject, e.Err)
+	}
+
+	return fmt.Sprintf("vici: failed to verify certificate %v: no valid link from %v to issuer %v: %v",
+		e.Cert.Subject, e.Link.Subject, e.Issuer, e.Err)
+}
+
+func (e *ChainError) Unwrap() error {
+	return e.Err
+}
+
+// VerifyCertChain verifies each X.509 certificate in the PEM or DER encoded data against
+// roots, using crypto/x509. Other certificates in data, e.g. intermediate CAs, may be used
+// to build chains. Certificates that are themselves in roots, and CRLs, are not verified.
+// A *ChainError is returned for the first certificate that cannot be verified.
+func VerifyCertChain(data []byte, roots []*x509.Certificate) error {
+	certs, err := parseLoadCerts(data)
+	if err != nil {
+		return err
+	}
+
+	var parsed []*x509.Certificate
+
+	for _, c := range certs {
+		if c.typ != "X509" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(c.data)
+		if err != nil {
+			return fmt.Errorf("%v: %v", errInvalidCertificate, err)
+		}
+		parsed = append(parsed, cert)
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         x509.NewCertPool(),
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+
+	for _, root := range roots {
+		opts.Roots.AddCert(root)
+	}
+
+	for _, cert := range parsed {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	for _, cert := range parsed {
+		if containsCert(roots, cert) {
+			continue
+		}
+
+		if _, err := cert.Verify(opts); err != nil {
+			return brokenLink(cert, append(parsed, roots...), roots, err)
+		}
+	}
+
+	return nil
+}
+
+// LoadCertPEMVerified behaves like LoadCertPEM, but first verifies the certificates in data
+// against roots with VerifyCertChain, so that a misconfigured PKI is found before it causes
+// authentication to fail. Nothing is loaded if verification fails.
+func (s *Session) LoadCertPEMVerified(data []byte, roots []*x509.Certificate) error {
+	if err := VerifyCertChain(data, roots); err != nil {
+		return err
+	}
+
+	return s.LoadCertPEM(data)
+}
+
+// brokenLink returns a *ChainError for cert, which failed to verify with err. The chain of
+// cert is followed through candidates, until an issuer is missing or did not sign the
+// certificate, or a root is reached.
+func brokenLink(cert *x509.Certificate, candidates, roots []*x509.Certificate, err error) *ChainError {
+	link := cert
+
+	// Bound the walk, in case of cycles among candidates.
+	for i := 0; i <= len(candidates); i++ {
+		if containsCert(roots, link) {
+			break
+		}
+
+		var (
+			issuer  *x509.Certificate
+			sigErr  error
+			matched bool
+		)
+
+		for _, c := range candidates {
+			if c.Equal(link) || string(c.RawSubject) != string(link.RawIssuer) {
+				continue
+			}
+			matched = true
+
+			if sigErr = link.CheckSignatureFrom(c); sigErr == nil {
+				issuer = c
+				break
+			}
+		}
+
+		if issuer == nil {
+			if matched {
+				err = sigErr
+			}
+
+			return &ChainError{Cert: cert, Link: link, Issuer: link.Issuer.String(), Err: err}
+		}
+
+		link = issuer
+	}
+
+	return &ChainError{Cert: cert, Link: cert, Issuer: cert.Issuer.String(), Err: err}
+}
+
+// containsCert returns true if cert is in certs.
+func containsCert(certs []*x509.Certificate, cert *x509.Certificate) bool {
+	for _, c := range certs {
+		if c.Equal(cert) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,96 @@
+// Copyright (C) 2019 Nick Rosbrook
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package vici
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"testing"
+	"time"
+)
+
+func encodeTestCertificates(certs ...*x509.Certificate) []byte {
+	var data []byte
+	for _, c := range certs {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+	}
+
+	return data
+}
+
+func TestVerifyCertChain(t *testing.T) {
+	root, rootKey := newTestCertificate(t, "strongSwan Root CA", true)
+	sub, subKey := newTestCertificate(t, "strongSwan Sub CA", true, issuedBy(root, rootKey))
+	leaf, _ := newTestCertificate(t, "moon.strongswan.org", false, issuedBy(sub, subKey))
+	expired, _ := newTestCertificate(t, "sun.strongswan.org", false, issuedBy(sub, subKey), validFor(-time.Hour))
+
+	roots := []*x509.Certificate{root}
+
+	if err := VerifyCertChain(encodeTestCertificates(root, sub, leaf), roots); err != nil {
+		t.Fatalf("Unexpected error verifying valid chain: %v", err)
+	}
+
+	tests := []struct {
+		data   []byte
+		cert   *x509.Certificate
+		link   *x509.Certificate
+		issuer string
+	}{
+		{
+			// The intermediate CA is missing
+			data:   encodeTestCertificates(leaf),
+			cert:   leaf,
+			link:   leaf,
+			issuer: "CN=strongSwan Sub CA",
+		},
+		{
+			data:   encodeTestCertificates(sub, expired),
+			cert:   expired,
+			link:   expired,
+			issuer: "CN=strongSwan Sub CA",
+		},
+	}
+
+	for _, tt := range tests {
+		err := VerifyCertChain(tt.data, roots)
+
+		var ce *ChainError
+		if !errors.As(err, &ce) {
+			t.Errorf("Expected *ChainError: received %v", err)
+			continue
+		}
+
+		if ce.Cert != nil && !ce.Cert.Equal(tt.cert) || ce.Link != nil && !ce.Link.Equal(tt.link) || ce.Issuer != tt.issuer {
+			t.Errorf("Unexpected broken link: %v", ce)
+		}
+	}
+
+	// The chain does not lead to the given roots
+	other, _ := newTestCertificate(t, "Other Root CA", true)
+
+	err := VerifyCertChain(encodeTestCertificates(sub, leaf), []*x509.Certificate{other})
+
+	var ce *ChainError
+	if !errors.As(err, &ce) || !ce.Link.Equal(sub) || ce.Issuer != "CN=strongSwan Root CA" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright (C) 2019 Nick Rosbrook
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package vici
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Config is a complete configuration to be loaded into the daemon, e.g. with LoadAll.
+type Config struct {
+	// Certs are PEM or DER encoded certificates and CRLs, loaded as described
+	// by LoadCertPEM.
+	Certs [][]byte
+
+	// Secrets are the shared secrets. Only secrets with an ID can be unloaded
+	// if loading fails.
+	Secrets []SharedSecret
+
+	// Pools and Conns are the pools and connections, keyed by name. Each value is
+	// either a *Message, or is marshaled with MarshalMessage, e.g. a Connection,
+	// or a type of the swanctl package.
+	Pools map[string]interface{}
+	Conns map[string]interface{}
+}
+
+// Validate checks each of the connections of c with ValidateConnection, without
+// contacting the daemon. A *SchemaError is returned describing the problems found in
+// all connections.
+func (c Config) Validate() error {
+	var problems []string
+
+	for _, name := range sortedKeys(c.Conns) {
+		err := ValidateConnection(name, c.Conns[name])
+
+		var se *SchemaError
+		switch {
+		case errors.As(err, &se):
+			problems = append(problems, se.Problems...)
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("%v: %v", name, err))
+		}
+	}
+
+	if len(problems) > 0 {
+		return &SchemaError{Problems: problems}
+	}
+
+	return nil
+}
+
+// LoadReport describes what LoadAll applied to the daemon.
+type LoadReport struct {
+	// Certs is the number of certificates loaded, and Secrets, Pools and Conns
+	// are the IDs and names of the secrets, pools and connections loaded.
+	Certs   int
+	Secrets []string
+	Pools   []string
+	Conns   []string
+
+	// Failed describes the item that failed to load, if any, e.g. conn gw.
+	Failed string
+
+	// RolledBack is true if the items loaded before the failure were unloaded
+	// again. RollbackErrors are the errors encountered while doing so.
+	RolledBack     bool
+	RollbackErrors []error
+}
+
+// LoadAll loads the configuration c as a unit. Certificates are loaded first, followed
+// by secrets, pools and connections, each in order of name. If anything fails to load,
+// the connections, pools and secrets that were loaded are unloaded again, in reverse
+// order, and the error is returned along with a report of what happened.
+//
+// This is not atomic: loading an item replaces an existing item of the same name, which
+// is unloaded rather than restored on rollback, and certificates cannot be unloaded
+// individually, so they are left in place.
+func (s *Session) LoadAll(c Config) (LoadReport, error) {
+	var report LoadReport
+
+	err := s.loadAll(c, &report)
+	if err != nil {
+		s.rollback(&report)
+	}
+
+	return report, err
+}
+
+func (s *Session) loadAll(c Config, report *LoadReport) error {
+	for i, data := range c.Certs {
+		if err := s.LoadCertPEM(data); err != nil {
+			report.Failed = fmt.Sprintf("cert %d", i)
+			return err
+		}
+		report.Certs++
+	}
+
+	for _, secret := range c.Secrets {
+		if err := s.LoadShared(secret); err != nil {
+			report.Failed = fmt.Sprintf("secret %v", secret.ID)
+			return err
+		}
+
+		if secret.ID != "" {
+			report.Secrets = append(report.Secrets, secret.ID)
+		}
+	}
+
+	for _, name := range sortedKeys(c.Pools) {
+		if err := s.loadNamed("load-pool", name, c.Pools[name]); err != nil {
+			report.Failed = fmt.Sprintf("pool %v", name)
+			return err
+		}
+		report.Pools = append(report.Pools, name)
+	}
+
+	for _, name := range sortedKeys(c.Conns) {
+		if err := s.loadNamed("load-conn", name, c.Conns[name]); err != nil {
+			report.Failed = fmt.Sprintf("conn %v", name)
+			return err
+		}
+		report.Conns = append(report.Conns, name)
+	}
+
+	return nil
+}
+
+// rollback unloads the connections, pools and secrets in report, in reverse order.
+func (s *Session) rollback(report *LoadReport) {
+	unload := func(cmd, key string, names []string) {
+		for i := len(names) - 1; i >= 0; i-- {
+			msg := NewMessage()
+			if err := msg.Set(key, names[i]); err != nil {
+				report.RollbackErrors = append(report.RollbackErrors, err)
+				continue
+			}
+
+			if _, err := s.CommandRequest(cmd, msg); err != nil {
+				report.RollbackErrors = append(report.RollbackErrors, fmt.Errorf("%v %v: %v", cmd, names[i], err))
+			}
+		}
+	}
+
+	unload("unload-conn", "name", report.Conns)
+	unload("unload-pool", "name", report.Pools)
+	unload("unload-shared", "id", report.Secrets)
+
+	report.RolledBack = true
+}
+
+// loadNamed sends cmd with v, named name, as its argument.
+func (s *Session) loadNamed(cmd, name string, v interface{}) error {
+	msg, err := marshalNamed(name, v)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.CommandRequest(cmd, msg)
+
+	return err
+}
+
+// marshalNamed returns a message containing v as the section name. v is either a *Message,
+// a Connection, or any other value accepted by MarshalMessage.
+func marshalNamed(name string, v interface{}) (*Message, error) {
+	var (
+		section *Message
+		err     error
+	)
+
+	switch v := v.(type) {
+	case *Message:
+		section = v
+	case Connection:
+		return marshalConnection(name, v)
+	case *Connection:
+		return marshalConnection(name, *v)
+	default:
+		section, err = MarshalMessage(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	msg := NewMessage()
+	if err := msg.Set(name, section); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// sortedKeys returns the keys of m in sorted order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,90 @@
+// Copyright (C) 2019 Nick Rosbrook
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package vici
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestLoadAllRollback(t *testing.T) {
+	client, srvr := net.Pipe()
+	defer client.Close()
+	defer srvr.Close()
+
+	s := &Session{ctr: &transport{conn: client}}
+
+	ok, err := NewMessageFromMap(map[string]interface{}{"success": "yes"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating message: %v", err)
+	}
+
+	failed, err := NewMessageFromMap(map[string]interface{}{"success": "no", "errmsg": "invalid proposal"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating message: %v", err)
+	}
+
+	reqs := serveCommands(t, srvr, []*Message{ok, ok, ok, failed, ok, ok, ok})
+
+	pool := NewMessage()
+	if err := pool.Set("addrs", "10.3.0.0/24"); err != nil {
+		t.Fatalf("Unexpected error setting key: %v", err)
+	}
+
+	report, err := s.LoadAll(Config{
+		Secrets: []SharedSecret{{ID: "ike-moon", Type: "IKE", Data: Secret("secret")}},
+		Pools:   map[string]interface{}{"rw": pool},
+		Conns: map[string]interface{}{
+			"a": Connection{Version: 2},
+			"b": &Connection{Version: 2, Proposals: []string{"bogus"}},
+		},
+	})
+	if err == nil {
+		t.Fatalf("Expected error loading configuration")
+	}
+
+	expected := LoadReport{
+		Secrets:    []string{"ike-moon"},
+		Pools:      []string{"rw"},
+		Conns:      []string{"a"},
+		Failed:     "conn b",
+		RolledBack: true,
+	}
+
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("Unexpected report.\nExpected: %+v\nReceived: %+v", expected, report)
+	}
+
+	var cmds []string
+	for p := range reqs {
+		cmds = append(cmds, p.name)
+	}
+
+	expectedCmds := []string{
+		"load-shared", "load-pool", "load-conn", "load-conn",
+		"unload-conn", "unload-pool", "unload-shared",
+	}
+
+	if !reflect.DeepEqual(cmds, expectedCmds) {
+		t.Errorf("Unexpected commands.\nExpected: %v\nReceived: %v", expectedCmds, cmds)
+	}
+}
@@ -0,0 +1,374 @@
+// Copyright (C) 2019 Nick Rosbrook
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package vici
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Conn is a connection loaded in the daemon, as reported by list-conns.
+type Conn struct {
+	// Name is the name of the connection.
+	Name string
+
+	LocalAddrs  []string      `vici:"local_addrs"`
+	RemoteAddrs []string      `vici:"remote_addrs"`
+	Version     string        `vici:"version"`
+	ReauthTime  time.Duration `vici:"reauth_time"`
+	RekeyTime   time.Duration `vici:"rekey_time"`
+	Unique      string        `vici:"unique"`
+	DPDDelay    time.Duration `vici:"dpd_delay"`
+	DPDTimeout  time.Duration `vici:"dpd_timeout"`
+	PPKID       string        `vici:"ppk_id"`
+	PPKRequired bool          `vici:"ppk_required"`
+
+	// LocalAuth and RemoteAuth are the local and remote authentication rounds,
+	// in the order they are performed.
+	LocalAuth  []ConnAuth
+	RemoteAuth []ConnAuth
+
+	// Children are the CHILD_SA configurations of the connection.
+	Children []ConnChild `vici:"children,key=name"`
+}
+
+// ConnAuth is a single authentication round of a Conn.
+type ConnAuth struct {
+	Class      string   `vici:"class"`
+	EAPType    string   `vici:"eap-type"`
+	EAPVendor  string   `vici:"eap-vendor"`
+	XAuth      string   `vici:"xauth"`
+	Revocation string   `vici:"revocation"`
+	ID         string   `vici:"id"`
+	AAAID      string   `vici:"aaa_id"`
+	EAPID      string   `vici:"eap_id"`
+	XAuthID    string   `vici:"xauth_id"`
+	Groups     []string `vici:"groups"`
+	CertPolicy []string `vici:"cert_policy"`
+	Certs      []string `vici:"certs"`
+	CACerts    []string `vici:"cacerts"`
+}
+
+// ConnChild is a CHILD_SA configuration of a Conn.
+type ConnChild struct {
+	Name         string        `vici:"name"`
+	Mode         string        `vici:"mode"`
+	Label        string        `vici:"label"`
+	RekeyTime    time.Duration `vici:"rekey_time"`
+	RekeyBytes   uint64        `vici:"rekey_bytes"`
+	RekeyPackets uint64        `vici:"rekey_packets"`
+	DPDAction    string        `vici:"dpd_action"`
+	CloseAction  string        `vici:"close_action"`
+	LocalTS      []string      `vici:"local-ts"`
+	RemoteTS     []string      `vici:"remote-ts"`
+	Interface    string        `vici:"interface"`
+	Priority     uint32        `vici:"priority"`
+}
+
+// ListConns returns the connections loaded in the daemon, using the list-conns command.
+func (s *Session) ListConns() ([]Conn, error) {
+	return s.listConns("")
+}
+
+// EachConn calls fn with each of the connections loaded in the daemon, using the
+// list-conns command, as they are received from the daemon. If ike is not empty, only the
+// connection with that name is enumerated. If fn returns an error, it is not called again,
+// and that error is returned. The request is aborted once ctx is done.
+func (s *Session) EachConn(ctx context.Context, ike string, fn func(Conn) error) error {
+	msg := NewMessage()
+
+	if ike != "" {
+		if err := msg.Set("ike", ike); err != nil {
+			return err
+		}
+	}
+
+	resp, err := s.StreamedCommandRequestFuncContext(ctx, "list-conns", "list-conn", msg, func(m *Message) error {
+		conns, err := parseConns(m)
+		if err != nil {
+			return err
+		}
+
+		for _, c := range conns {
+			if err := fn(c); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return resp.Err()
+}
+
+// listConns returns the connections loaded in the daemon. If ike is not empty, only the
+// connection with that name is returned.
+func (s *Session) listConns(ike string) ([]Conn, error) {
+	var conns []Conn
+
+	err := s.EachConn(context.Background(), ike, func(c Conn) error {
+		conns = append(conns, c)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return conns, nil
+}
+
+// parseConns parses the connections in m, which is keyed by connection name as in
+// list-conn messages.
+func parseConns(m *Message) ([]Conn, error) {
+	var conns []Conn
+
+	for _, name := range m.Keys() {
+		section, ok := m.GetSection(name)
+		if !ok {
+			continue
+		}
+
+		c, err := parseConn(name, section)
+		if err != nil {
+			return nil, err
+		}
+		conns = append(conns, c)
+	}
+
+	return conns, nil
+}
+
+func parseConn(name string, m *Message) (Conn, error) {
+	c := Conn{Name: name}
+
+	if err := UnmarshalMessage(m, &c); err != nil {
+		return c, err
+	}
+
+	// Auth rounds are named e.g. local-1, local-2, but the daemon may also
+	// report a single round as local.
+	for _, k := range m.Keys() {
+		section, ok := m.GetSection(k)
+		if !ok {
+			continue
+		}
+
+		var rounds *[]ConnAuth
+
+		switch {
+		case strings.HasPrefix(k, "local"):
+			rounds = &c.LocalAuth
+		case strings.HasPrefix(k, "remote"):
+			rounds = &c.RemoteAuth
+		default:
+			continue
+		}
+
+		var auth ConnAuth
+		if err := UnmarshalMessage(section, &auth); err != nil {
+			return c, err
+		}
+		*rounds = append(*rounds, auth)
+	}
+
+	return c, nil
+}
+
+// Connection is a connection definition, as loaded with the load-conn command. Its
+// elements correspond to those of a connection in swanctl.conf, and unset fields are
+// omitted so that the daemon applies its defaults. Bool options whose default is yes
+// are pointers, so that they can be explicitly disabled.
+type Connection struct {
+	Version       int           `vici:"version,omitempty"`
+	LocalAddrs    []string      `vici:"local_addrs,omitempty"`
+	RemoteAddrs   []string      `vici:"remote_addrs,omitempty"`
+	LocalPort     uint16        `vici:"local_port,omitempty"`
+	RemotePort    uint16        `vici:"remote_port,omitempty"`
+	Proposals     []string      `vici:"proposals,omitempty"`
+	VIPs          []string      `vici:"vips,omitempty"`
+	Aggressive    bool          `vici:"aggressive,omitempty"`
+	Pull          *bool         `vici:"pull,omitempty"`
+	DSCP          string        `vici:"dscp,omitempty"`
+	Encap         bool          `vici:"encap,omitempty"`
+	MOBIKE        *bool         `vici:"mobike,omitempty"`
+	DPDDelay      time.Duration `vici:"dpd_delay,omitempty"`
+	DPDTimeout    time.Duration `vici:"dpd_timeout,omitempty"`
+	Fragmentation string        `vici:"fragmentation,omitempty"`
+	Childless     string        `vici:"childless,omitempty"`
+	SendCertReq   *bool         `vici:"send_certreq,omitempty"`
+	SendCert      string        `vici:"send_cert,omitempty"`
+	PPKID         string        `vici:"ppk_id,omitempty"`
+	PPKRequired   bool          `vici:"ppk_required,omitempty"`
+	KeyingTries   *uint32       `vici:"keyingtries,omitempty"`
+	Unique        string        `vici:"unique,omitempty"`
+	ReauthTime    time.Duration `vici:"reauth_time,omitempty"`
+	RekeyTime     time.Duration `vici:"rekey_time,omitempty"`
+	OverTime      time.Duration `vici:"over_time,omitempty"`
+	RandTime      time.Duration `vici:"rand_time,omitempty"`
+	Pools         []string      `vici:"pools,omitempty"`
+	IfIDIn        string        `vici:"if_id_in,omitempty"`
+	IfIDOut       string        `vici:"if_id_out,omitempty"`
+	Mediation     bool          `vici:"mediation,omitempty"`
+	MediatedBy    string        `vici:"mediated_by,omitempty"`
+	MediationPeer string        `vici:"mediation_peer,omitempty"`
+
+	// LocalAuth and RemoteAuth are the local and remote authentication rounds.
+	// They are sent as local-1, local-2, etc., in order.
+	LocalAuth  []LocalAuth  `vici:"-"`
+	RemoteAuth []RemoteAuth `vici:"-"`
+
+	// Children are the CHILD_SA configurations of the connection, which are
+	// named by their Name field.
+	Children []ChildSAConfig `vici:"children,key=name,omitempty"`
+}
+
+// LocalAuth is a local authentication round of a Connection.
+type LocalAuth struct {
+	Round   int      `vici:"round,omitempty"`
+	Certs   []string `vici:"certs,omitempty"`
+	PubKeys []string `vici:"pubkeys,omitempty"`
+	Auth    string   `vici:"auth,omitempty"`
+	ID      string   `vici:"id,omitempty"`
+	EAPID   string   `vici:"eap_id,omitempty"`
+	AAAID   string   `vici:"aaa_id,omitempty"`
+	XAuthID string   `vici:"xauth_id,omitempty"`
+}
+
+// RemoteAuth is a remote authentication round of a Connection.
+type RemoteAuth struct {
+	Round      int      `vici:"round,omitempty"`
+	ID         string   `vici:"id,omitempty"`
+	EAPID      string   `vici:"eap_id,omitempty"`
+	Groups     []string `vici:"groups,omitempty"`
+	CertPolicy []string `vici:"cert_policy,omitempty"`
+	Certs      []string `vici:"certs,omitempty"`
+	CACerts    []string `vici:"cacerts,omitempty"`
+	CAID       string   `vici:"ca_id,omitempty"`
+	PubKeys    []string `vici:"pubkeys,omitempty"`
+	Revocation string   `vici:"revocation,omitempty"`
+	Auth       string   `vici:"auth,omitempty"`
+}
+
+// ChildSAConfig is a CHILD_SA configuration of a Connection. Its elements correspond
+// to those of a children section in swanctl.conf.
+type ChildSAConfig struct {
+	// Name is the name of the CHILD_SA.
+	Name string `vici:"name"`
+
+	AHProposals    []string      `vici:"ah_proposals,omitempty"`
+	ESPProposals   []string      `vici:"esp_proposals,omitempty"`
+	SHA256_96      bool          `vici:"sha256_96,omitempty"`
+	LocalTS        []string      `vici:"local_ts,omitempty"`
+	RemoteTS       []string      `vici:"remote_ts,omitempty"`
+	RekeyTime      time.Duration `vici:"rekey_time,omitempty"`
+	LifeTime       time.Duration `vici:"life_time,omitempty"`
+	RandTime       time.Duration `vici:"rand_time,omitempty"`
+	RekeyBytes     uint64        `vici:"rekey_bytes,omitempty"`
+	LifeBytes      uint64        `vici:"life_bytes,omitempty"`
+	RandBytes      uint64        `vici:"rand_bytes,omitempty"`
+	RekeyPackets   uint64        `vici:"rekey_packets,omitempty"`
+	LifePackets    uint64        `vici:"life_packets,omitempty"`
+	RandPackets    uint64        `vici:"rand_packets,omitempty"`
+	Updown         string        `vici:"updown,omitempty"`
+	HostAccess     bool          `vici:"hostaccess,omitempty"`
+	Mode           string        `vici:"mode,omitempty"`
+	Policies       *bool         `vici:"policies,omitempty"`
+	PoliciesFwdOut bool          `vici:"policies_fwd_out,omitempty"`
+	DPDAction      string        `vici:"dpd_action,omitempty"`
+	IPComp         bool          `vici:"ipcomp,omitempty"`
+	Inactivity     time.Duration `vici:"inactivity,omitempty"`
+	ReqID          uint32        `vici:"reqid,omitempty"`
+	Priority       uint32        `vici:"priority,omitempty"`
+	Interface      string        `vici:"interface,omitempty"`
+	MarkIn         string        `vici:"mark_in,omitempty"`
+	MarkInSA       bool          `vici:"mark_in_sa,omitempty"`
+	MarkOut        string        `vici:"mark_out,omitempty"`
+	SetMarkIn      string        `vici:"set_mark_in,omitempty"`
+	SetMarkOut     string        `vici:"set_mark_out,omitempty"`
+	IfIDIn         string        `vici:"if_id_in,omitempty"`
+	IfIDOut        string        `vici:"if_id_out,omitempty"`
+	Label          string        `vici:"label,omitempty"`
+	LabelMode      string        `vici:"label_mode,omitempty"`
+	TFCPadding     string        `vici:"tfc_padding,omitempty"`
+	ReplayWindow   *uint32       `vici:"replay_window,omitempty"`
+	HWOffload      string        `vici:"hw_offload,omitempty"`
+	CopyDF         *bool         `vici:"copy_df,omitempty"`
+	CopyECN        *bool         `vici:"copy_ecn,omitempty"`
+	CopyDSCP       string        `vici:"copy_dscp,omitempty"`
+	StartAction    string        `vici:"start_action,omitempty"`
+	CloseAction    string        `vici:"close_action,omitempty"`
+	PerCPUSAs      string        `vici:"per_cpu_sas,omitempty"`
+}
+
+// LoadConn loads the connection conn, named name, using the load-conn command.
+func (s *Session) LoadConn(name string, conn Connection) error {
+	msg, err := marshalConnection(name, conn)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.CommandRequest("load-conn", msg)
+
+	return err
+}
+
+// marshalConnection returns the load-conn message for conn, named name.
+func marshalConnection(name string, conn Connection) (*Message, error) {
+	c, err := MarshalMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, auth := range conn.LocalAuth {
+		if err := setSection(c, fmt.Sprintf("local-%d", i+1), auth); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, auth := range conn.RemoteAuth {
+		if err := setSection(c, fmt.Sprintf("remote-%d", i+1), auth); err != nil {
+			return nil, err
+		}
+	}
+
+	msg := NewMessage()
+	if err := msg.Set(name, c); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// setSection marshals v, and sets it as the section key of m.
+func setSection(m *Message, key string, v interface{}) error {
+	section, err := MarshalMessage(v)
+	if err != nil {
+		return err
+	}
+
+	return m.Set(key, section)
+}
@@ -0,0 +1,245 @@
+// Copyright (C) 2019 Nick Rosbrook
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package vici
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConns(t *testing.T) {
+	newSection := func(kv ...interface{}) *Message {
+		m := NewMessage()
+		for i := 0; i < len(kv); i += 2 {
+			if err := m.Set(kv[i].(string), kv[i+1]); err != nil {
+				t.Fatalf("Unexpected error setting key: %v", err)
+			}
+		}
+
+		return m
+	}
+
+	child := newSection(
+		"mode", "TUNNEL",
+		"rekey_time", "3600",
+		"rekey_bytes", "0",
+		"local-ts", []string{"10.0.1.0/24"},
+		"remote-ts", []string{"10.0.2.0/24"},
+		"priority", "0",
+	)
+	conn := newSection(
+		"local_addrs", []string{"192.0.2.1"},
+		"remote_addrs", []string{"192.0.2.2"},
+		"version", "IKEv2",
+		"reauth_time", "0",
+		"rekey_time", "14400",
+		"unique", "UNIQUE_NO",
+		"ppk_required", "no",
+		"local-1", newSection("class", "public key", "id", "moon", "certs", []string{"CN=moon"}),
+		"local-2", newSection("class", "EAP", "eap-type", "md5"),
+		"remote-1", newSection("class", "public key", "id", "sun"),
+		"children", newSection("net", child),
+	)
+	m := newSection("gw", conn)
+
+	conns, err := parseConns(m)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing conns: %v", err)
+	}
+
+	expected := []Conn{
+		{
+			Name:        "gw",
+			LocalAddrs:  []string{"192.0.2.1"},
+			RemoteAddrs: []string{"192.0.2.2"},
+			Version:     "IKEv2",
+			RekeyTime:   4 * time.Hour,
+			Unique:      "UNIQUE_NO",
+			LocalAuth: []ConnAuth{
+				{Class: "public key", ID: "moon", Certs: []string{"CN=moon"}},
+				{Class: "EAP", EAPType: "md5"},
+			},
+			RemoteAuth: []ConnAuth{
+				{Class: "public key", ID: "sun"},
+			},
+			Children: []ConnChild{
+				{
+					Name:      "net",
+					Mode:      "TUNNEL",
+					RekeyTime: time.Hour,
+					LocalTS:   []string{"10.0.1.0/24"},
+					RemoteTS:  []string{"10.0.2.0/24"},
+				},
+			},
+		},
+	}
+
+	if !reflect.DeepEqual(conns, expected) {
+		t.Errorf("Unexpected conns.\nExpected: %+v\nReceived: %+v", expected, conns)
+	}
+}
+
+func TestMarshalConnection(t *testing.T) {
+	no := false
+
+	conn := Connection{
+		Version:     2,
+		LocalAddrs:  []string{"192.0.2.1"},
+		RemoteAddrs: []string{"192.0.2.2"},
+		MOBIKE:      &no,
+		RekeyTime:   4 * time.Hour,
+		LocalAuth: []LocalAuth{
+			{Auth: "pubkey", Certs: []string{"moonCert.pem"}, ID: "moon"},
+		},
+		RemoteAuth: []RemoteAuth{
+			{Auth: "pubkey", ID: "sun"},
+			{Auth: "eap-md5"},
+		},
+		Children: []ChildSAConfig{
+			{
+				Name:        "net",
+				LocalTS:     []string{"10.0.1.0/24"},
+				RemoteTS:    []string{"10.0.2.0/24"},
+				Mode:        "tunnel",
+				StartAction: "trap",
+			},
+		},
+	}
+
+	m, err := marshalConnection("gw", conn)
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling connection: %v", err)
+	}
+
+	if err := Validate(m, ConnectionsSchema); err != nil {
+		t.Errorf("Unexpected error validating connection: %v", err)
+	}
+
+	expected := map[string]interface{}{
+		"gw": map[string]interface{}{
+			"version":      "2",
+			"local_addrs":  []string{"192.0.2.1"},
+			"remote_addrs": []string{"192.0.2.2"},
+			"mobike":       "no",
+			"rekey_time":   "4h",
+			"children": map[string]interface{}{
+				"net": map[string]interface{}{
+					"local_ts":     []string{"10.0.1.0/24"},
+					"remote_ts":    []string{"10.0.2.0/24"},
+					"mode":         "tunnel",
+					"start_action": "trap",
+				},
+			},
+			"local-1": map[string]interface{}{
+				"certs": []string{"moonCert.pem"},
+				"auth":  "pubkey",
+				"id":    "moon",
+			},
+			"remote-1": map[string]interface{}{
+				"id":   "sun",
+				"auth": "pubkey",
+			},
+			"remote-2": map[string]interface{}{
+				"auth": "eap-md5",
+			},
+		},
+	}
+
+	if !reflect.DeepEqual(m.ToMap(), expected) {
+		t.Errorf("Unexpected message.\nExpected: %v\nReceived: %v", expected, m.ToMap())
+	}
+}
+
+// fillValue sets every field of the struct rv, recursively, to a non-zero value. Slices
+// and maps are given a single element.
+func fillValue(rv reflect.Value) {
+	switch rv.Kind() {
+	case reflect.Struct:
+		for i := 0; i < rv.NumField(); i++ {
+			if rv.Type().Field(i).IsExported() {
+				fillValue(rv.Field(i))
+			}
+		}
+
+	case reflect.Ptr:
+		rv.Set(reflect.New(rv.Type().Elem()))
+		fillValue(rv.Elem())
+
+	case reflect.Slice:
+		rv.Set(reflect.MakeSlice(rv.Type(), 1, 1))
+		fillValue(rv.Index(0))
+
+	case reflect.Map:
+		e := reflect.New(rv.Type().Elem()).Elem()
+		fillValue(e)
+
+		rv.Set(reflect.MakeMap(rv.Type()))
+		rv.SetMapIndex(reflect.ValueOf("-1"), e)
+
+	case reflect.String:
+		rv.SetString("x")
+
+	case reflect.Bool:
+		rv.SetBool(true)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		rv.SetInt(1)
+
+		// Durations are marshaled in whole seconds
+		if rv.Type() == reflect.TypeOf(time.Duration(0)) {
+			rv.SetInt(int64(time.Second))
+		}
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		rv.SetUint(1)
+	}
+}
+
+func TestConnectionSchema(t *testing.T) {
+	// Connection is written by hand, so check that each of its options is known to
+	// ConnectionsSchema, and has the expected type.
+	var conn Connection
+	fillValue(reflect.ValueOf(&conn).Elem())
+
+	msg, err := marshalConnection("gw", conn)
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling connection: %v", err)
+	}
+
+	err = Validate(msg, ConnectionsSchema)
+	if err == nil {
+		return
+	}
+
+	se, ok := err.(*SchemaError)
+	if !ok {
+		t.Fatalf("Expected *SchemaError: received %v", err)
+	}
+
+	// Enum options are filled with arbitrary values, which are expected to be invalid
+	for _, p := range se.Problems {
+		if !strings.Contains(p, "invalid value") {
+			t.Errorf("Unexpected problem validating connection: %v", p)
+		}
+	}
+}
@@ -0,0 +1,485 @@
+// Copyright (C) 2019 Nick Rosbrook
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package vici
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"time"
+)
+
+var (
+	// Some CHILD SAs of a connection could not be brought up or down
+	errConnChildren = errors.New("vici: CHILD SAs of connection failed")
+)
+
+// InitiateOption configures Session.Initiate.
+type InitiateOption func(*initiateConfig)
+
+type initiateConfig struct {
+	log      func(*Message)
+	logLevel *int
+	noWait   bool
+	limits   bool
+}
+
+// InitiateLog calls fn with each control-log message received while the SA is initiated.
+func InitiateLog(fn func(*Message)) InitiateOption {
+	return func(c *initiateConfig) {
+		c.log = fn
+	}
+}
+
+// InitiateLogLevel sets the verbosity of the control-log messages sent by the daemon.
+// The default level is 1.
+func InitiateLogLevel(level int) InitiateOption {
+	return func(c *initiateConfig) {
+		c.logLevel = &level
+	}
+}
+
+// InitiateNoWait returns as soon as the initiation is started, instead of waiting for
+// the CHILD SA to be installed.
+func InitiateNoWait() InitiateOption {
+	return func(c *initiateConfig) {
+		c.noWait = true
+	}
+}
+
+// InitiateInitLimits causes the initiation to fail if the daemon's IKE_SA_INIT limits
+// are exceeded, instead of ignoring them.
+func InitiateInitLimits() InitiateOption {
+	return func(c *initiateConfig) {
+		c.limits = true
+	}
+}
+
+// Initiate initiates the CHILD SA child, using the initiate command. If child is empty,
+// only the IKE SA ike is initiated, and ike may be empty if child is unambiguous.
+//
+// By default, Initiate blocks until the daemon reports that the SA is established,
+// i.e. the CHILD SA is installed, or ctx is done. If ctx has a deadline, the daemon is
+// also told to give up once it expires. An error is returned if the SA could not be
+// established.
+func (s *Session) Initiate(ctx context.Context, child, ike string, opts ...InitiateOption) error {
+	var c initiateConfig
+	for _, opt := range opts {
+		opt(&c)
+	}
+
+	msg := NewMessage()
+
+	if child != "" {
+		if err := msg.Set("child", child); err != nil {
+			return err
+		}
+	}
+
+	if ike != "" {
+		if err := msg.Set("ike", ike); err != nil {
+			return err
+		}
+	}
+
+	if timeout := initiateTimeout(ctx, c.noWait); timeout != "" {
+		if err := msg.Set("timeout", timeout); err != nil {
+			return err
+		}
+	}
+
+	if c.limits {
+		if err := msg.Set("init-limits", "yes"); err != nil {
+			return err
+		}
+	}
+
+	if c.logLevel != nil {
+		if err := msg.Set("loglevel", strconv.Itoa(*c.logLevel)); err != nil {
+			return err
+		}
+	}
+
+	resp, err := s.StreamedCommandRequestFuncContext(ctx, "initiate", "control-log", msg, func(m *Message) error {
+		if c.log != nil {
+			c.log(m)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return resp.Err()
+}
+
+// initiateTimeout returns the timeout, in milliseconds, to send with an initiate command
+// under ctx. A negative timeout tells the daemon not to wait for the SA to be established.
+func initiateTimeout(ctx context.Context, noWait bool) string {
+	if noWait {
+		return "-1"
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return ""
+	}
+
+	ms := time.Until(deadline).Milliseconds()
+	if ms < 1 {
+		ms = 1
+	}
+
+	return strconv.FormatInt(ms, 10)
+}
+
+// TerminateOptions specifies the SAs to terminate with Session.Terminate, and how.
+type TerminateOptions struct {
+	// IKE and Child terminate SAs by configuration name, and IKEID and ChildID by
+	// unique ID. If Child or ChildID is set, only matching CHILD SAs are closed.
+	IKE     string `vici:"ike,omitempty"`
+	Child   string `vici:"child,omitempty"`
+	IKEID   uint32 `vici:"ike-id,omitempty"`
+	ChildID uint32 `vici:"child-id,omitempty"`
+
+	// Timeout is how long the daemon waits for the SAs to be closed before
+	// returning. If it is negative, the daemon does not wait.
+	Timeout time.Duration `vici:"-"`
+
+	// Force closes IKE SAs immediately, without sending a DELETE and waiting for
+	// a response from the peer. It requires strongSwan 5.5.2 or later, and a
+	// *VersionError is returned otherwise.
+	Force bool `vici:"force,omitempty"`
+
+	// Log, if set, is called with each control-log message received while the
+	// SAs are terminated.
+	Log func(*Message) `vici:"-"`
+}
+
+// TerminateResult is the outcome of Session.Terminate.
+type TerminateResult struct {
+	// Matches is the number of SAs that matched the request, and Terminated
+	// the number of those that were closed.
+	Matches    int `vici:"matches"`
+	Terminated int `vici:"terminated"`
+}
+
+// Terminate terminates SAs using the terminate command, and returns how many matched
+// and were closed. The request is aborted once ctx is done. An error is returned if not
+// all matching SAs were closed, in which case the result is still returned.
+func (s *Session) Terminate(ctx context.Context, opts TerminateOptions) (TerminateResult, error) {
+	var res TerminateResult
+
+	if opts.Force {
+		if err := s.requireFeature("terminate force option", minVersionTerminateForce); err != nil {
+			return res, err
+		}
+	}
+
+	msg, err := MarshalMessage(opts)
+	if err != nil {
+		return res, err
+	}
+
+	if opts.Timeout != 0 {
+		timeout := opts.Timeout.Milliseconds()
+		if timeout < 0 {
+			timeout = -1
+		}
+
+		if err := msg.Set("timeout", strconv.FormatInt(timeout, 10)); err != nil {
+			return res, err
+		}
+	}
+
+	resp, err := s.StreamedCommandRequestFuncContext(ctx, "terminate", "control-log", msg, func(m *Message) error {
+		if opts.Log != nil {
+			opts.Log(m)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return res, err
+	}
+
+	if err := UnmarshalMessage(resp, &res); err != nil {
+		return res, err
+	}
+
+	return res, resp.Err()
+}
+
+// TerminatePeer terminates each IKE SA whose remote identity or remote address is
+// peer, using list-sas to find them, and terminate by unique ID. The Timeout, Force and
+// Log fields of opts apply to each terminate command, and the others are ignored. The
+// results of all terminate commands are summed, and the first error is returned after
+// all have been attempted.
+func (s *Session) TerminatePeer(ctx context.Context, peer string, opts TerminateOptions) (TerminateResult, error) {
+	var total TerminateResult
+
+	ikes, err := s.listSAs("")
+	if err != nil {
+		return total, err
+	}
+
+	opts.IKE, opts.Child, opts.ChildID = "", "", 0
+
+	for _, ike := range ikes {
+		if !matchesPeer(ike, peer) {
+			continue
+		}
+
+		id, perr := strconv.ParseUint(ike.UniqueID, 10, 32)
+		if perr != nil {
+			continue
+		}
+		opts.IKEID = uint32(id)
+
+		res, terr := s.Terminate(ctx, opts)
+		total.Matches += res.Matches
+		total.Terminated += res.Terminated
+
+		if terr != nil && err == nil {
+			err = terr
+		}
+	}
+
+	return total, err
+}
+
+// matchesPeer returns true if the remote identity or remote address of ike is peer.
+func matchesPeer(ike IKESA, peer string) bool {
+	if ike.RemoteID == peer || ike.RemoteHost == peer {
+		return true
+	}
+
+	// Compare addresses in their canonical form, e.g. for IPv6.
+	addr, err := netip.ParseAddr(peer)
+	if err != nil {
+		return false
+	}
+
+	host, err := netip.ParseAddr(ike.RemoteHost)
+
+	return err == nil && host == addr
+}
+
+// InstallTrap installs the trap, drop or bypass policy of the CHILD SA configuration
+// child, using the install command. ike optionally names the connection child belongs
+// to, if child is ambiguous.
+func (s *Session) InstallTrap(child, ike string) error {
+	return s.trapCommand("install", child, ike)
+}
+
+// UninstallTrap uninstalls the trap, drop or bypass policy of the CHILD SA configuration
+// child, using the uninstall command. ike optionally names the connection child belongs
+// to, if child is ambiguous.
+func (s *Session) UninstallTrap(child, ike string) error {
+	return s.trapCommand("uninstall", child, ike)
+}
+
+func (s *Session) trapCommand(cmd, child, ike string) error {
+	msg := NewMessage()
+
+	if err := msg.Set("child", child); err != nil {
+		return err
+	}
+
+	if ike != "" {
+		if err := msg.Set("ike", ike); err != nil {
+			return err
+		}
+	}
+
+	_, err := s.CommandRequest(cmd, msg)
+
+	return err
+}
+
+// ChildResult is the outcome of bringing up, or down, a CHILD SA of a connection.
+type ChildResult struct {
+	// Child is the name of the CHILD SA configuration.
+	Child string
+
+	// Err is the error that occurred, if any.
+	Err error
+}
+
+// UpConn initiates each of the CHILD SAs of the loaded connection name, in order, and
+// returns the result for each. The first CHILD SA also establishes the IKE SA. An error
+// is returned if the connection is not loaded, or if any CHILD SA failed.
+func (s *Session) UpConn(ctx context.Context, name string) ([]ChildResult, error) {
+	children, err := s.connChildren(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return eachChild(children, func(child string) error {
+		return s.Initiate(ctx, child, name)
+	})
+}
+
+// DownConn terminates each of the CHILD SAs of the loaded connection name, in order,
+// followed by its IKE SAs, and returns the result for each CHILD SA. CHILD SAs and IKE
+// SAs that are not established are skipped, rather than failed. An error is returned
+// if the connection is not loaded, if any CHILD SA failed to terminate, or if an IKE SA
+// of the connection failed to terminate.
+func (s *Session) DownConn(ctx context.Context, name string) ([]ChildResult, error) {
+	children, err := s.connChildren(name)
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := eachChild(children, func(child string) error {
+		res, err := s.Terminate(ctx, TerminateOptions{IKE: name, Child: child})
+		if noMatches(res, err) {
+			return nil
+		}
+
+		return err
+	})
+
+	res, ikeErr := s.Terminate(ctx, TerminateOptions{IKE: name})
+	if ikeErr != nil && !noMatches(res, ikeErr) && err == nil {
+		err = ikeErr
+	}
+
+	return results, err
+}
+
+// noMatches returns true if the terminate command failed only because no SAs matched,
+// e.g. because a CHILD SA was never installed, or the IKE SA is already gone.
+func noMatches(res TerminateResult, err error) bool {
+	return errors.Is(err, errCommandFailed) && res.Matches == 0
+}
+
+// connChildren returns the names of the CHILD SAs of the loaded connection name.
+func (s *Session) connChildren(name string) ([]string, error) {
+	conn, err := s.GetConn(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var children []string
+	for _, c := range conn.Children {
+		children = append(children, c.Name)
+	}
+
+	return children, nil
+}
+
+// eachChild calls fn for each of children, and returns the results.
+func eachChild(children []string, fn func(child string) error) ([]ChildResult, error) {
+	var (
+		results []ChildResult
+		failed  int
+	)
+
+	for _, child := range children {
+		err := fn(child)
+		if err != nil {
+			failed++
+		}
+
+		results = append(results, ChildResult{Child: child, Err: err})
+	}
+
+	if failed > 0 {
+		return results, fmt.Errorf("%v: %v of %v failed", errConnChildren, failed, len(results))
+	}
+
+	return results, nil
+}
+
+// EstablishError is returned by EstablishAndWait if a connection could not be
+// established.
+type EstablishError struct {
+	// Conn is the name of the connection, and Child the CHILD SA that failed to
+	// be established. Child is empty if the connection could not be loaded, or
+	// if it has no CHILD SAs and its IKE SA failed.
+	Conn  string
+	Child string
+
+	// Err is the error returned by the daemon.
+	Err error
+
+	// Log contains the control-log messages received while the SA was initiated,
+	// which usually explain the failure, e.g. "[IKE] received AUTHENTICATION_FAILED
+	// notify error".
+	Log []string
+}
+
+func (e *EstablishError) Error() string {
+	if e.Child == "" {
+		return fmt.Sprintf("vici: failed to establish %v: %v", e.Conn, e.Err)
+	}
+
+	return fmt.Sprintf("vici: failed to establish %v of %v: %v", e.Child, e.Conn, e.Err)
+}
+
+func (e *EstablishError) Unwrap() error {
+	return e.Err
+}
+
+// EstablishAndWait loads conn as the connection name, and initiates each of its CHILD
+// SAs in order, or only its IKE SA if it has none. It returns once the IKE and CHILD SAs
+// are established, or with an *EstablishError on the first failure. As with Initiate,
+// the daemon is told to give up once the deadline of ctx, if any, expires. opts are
+// passed to Initiate, and InitiateNoWait should not be used.
+func (s *Session) EstablishAndWait(ctx context.Context, name string, conn Connection, opts ...InitiateOption) error {
+	if err := s.LoadConn(name, conn); err != nil {
+		return &EstablishError{Conn: name, Err: err}
+	}
+
+	children := []string{""}
+	if len(conn.Children) > 0 {
+		children = children[:0]
+		for _, c := range conn.Children {
+			children = append(children, c.Name)
+		}
+	}
+
+	for _, child := range children {
+		var log []string
+
+		logOpt := func(c *initiateConfig) {
+			fn := c.log
+			c.log = func(m *Message) {
+				log = append(log, fmt.Sprintf("[%v] %v", stringField(m, "group"), stringField(m, "msg")))
+
+				if fn != nil {
+					fn(m)
+				}
+			}
+		}
+
+		// opts is limited to its length, so that the caller's array is not written to
+		if err := s.Initiate(ctx, child, name, append(opts[:len(opts):len(opts)], logOpt)...); err != nil {
+			return &EstablishError{Conn: name, Child: child, Err: err, Log: log}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,456 @@
+// Copyright (C) 2019 Nick Rosbrook
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package vici
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestInitiate(t *testing.T) {
+	client, srvr := net.Pipe()
+	defer client.Close()
+	defer srvr.Close()
+
+	s := &Session{ctr: &transport{conn: client}}
+
+	logMsg := NewMessage()
+	if err := logMsg.Set("msg", "establishing CHILD_SA net"); err != nil {
+		t.Fatalf("Unexpected error setting key: %v", err)
+	}
+
+	resp := NewMessage()
+	if err := resp.Set("success", "yes"); err != nil {
+		t.Fatalf("Unexpected error setting key: %v", err)
+	}
+
+	reqs := serveStreamedCommand(t, srvr, "control-log", []*Message{logMsg}, resp)
+
+	var logs []string
+
+	err := s.Initiate(context.Background(), "net", "gw", InitiateLog(func(m *Message) {
+		logs = append(logs, stringField(m, "msg"))
+	}))
+	if err != nil {
+		t.Fatalf("Unexpected error initiating SA: %v", err)
+	}
+
+	if len(logs) != 1 || logs[0] != "establishing CHILD_SA net" {
+		t.Errorf("Unexpected logs: %v", logs)
+	}
+
+	p := <-reqs
+	if p.name != "initiate" {
+		t.Errorf("Expected command initiate: received %v", p.name)
+	}
+
+	if child := stringField(p.msg, "child"); child != "net" {
+		t.Errorf("Unexpected child.\nExpected: %v\nReceived: %v", "net", child)
+	}
+
+	if timeout, ok := p.msg.GetString("timeout"); ok {
+		t.Errorf("Expected no timeout without a deadline: received %v", timeout)
+	}
+}
+
+func TestInitiateFailed(t *testing.T) {
+	client, srvr := net.Pipe()
+	defer client.Close()
+	defer srvr.Close()
+
+	s := &Session{ctr: &transport{conn: client}}
+
+	resp := NewMessage()
+	for _, kv := range [][2]string{{"success", "no"}, {"errmsg", "establishing CHILD_SA 'net' failed"}} {
+		if err := resp.Set(kv[0], kv[1]); err != nil {
+			t.Fatalf("Unexpected error setting key: %v", err)
+		}
+	}
+
+	reqs := serveStreamedCommand(t, srvr, "control-log", nil, resp)
+
+	if err := s.Initiate(context.Background(), "net", "", InitiateNoWait()); err == nil {
+		t.Errorf("Expected error when initiation failed")
+	}
+
+	p := <-reqs
+	if timeout := stringField(p.msg, "timeout"); timeout != "-1" {
+		t.Errorf("Unexpected timeout.\nExpected: %v\nReceived: %v", "-1", timeout)
+	}
+}
+
+func TestTerminate(t *testing.T) {
+	client, srvr := net.Pipe()
+	defer client.Close()
+	defer srvr.Close()
+
+	s := &Session{ctr: &transport{conn: client, version: &Version{Version: "5.9.14"}}}
+
+	resp := NewMessage()
+	for _, kv := range [][2]string{{"success", "yes"}, {"matches", "2"}, {"terminated", "2"}} {
+		if err := resp.Set(kv[0], kv[1]); err != nil {
+			t.Fatalf("Unexpected error setting key: %v", err)
+		}
+	}
+
+	reqs := serveStreamedCommand(t, srvr, "control-log", nil, resp)
+
+	res, err := s.Terminate(context.Background(), TerminateOptions{
+		IKE:     "gw",
+		Timeout: 2 * time.Second,
+		Force:   true,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error terminating SAs: %v", err)
+	}
+
+	expected := TerminateResult{Matches: 2, Terminated: 2}
+	if res != expected {
+		t.Errorf("Unexpected result.\nExpected: %+v\nReceived: %+v", expected, res)
+	}
+
+	p := <-reqs
+	if p.name != "terminate" {
+		t.Errorf("Expected command terminate: received %v", p.name)
+	}
+
+	expectedReq := map[string]interface{}{
+		"ike":     "gw",
+		"force":   "yes",
+		"timeout": "2000",
+	}
+
+	if !reflect.DeepEqual(p.msg.ToMap(), expectedReq) {
+		t.Errorf("Unexpected request.\nExpected: %v\nReceived: %v", expectedReq, p.msg.ToMap())
+	}
+}
+
+func TestInstallTrap(t *testing.T) {
+	client, srvr := net.Pipe()
+	defer client.Close()
+	defer srvr.Close()
+
+	s := &Session{ctr: &transport{conn: client}}
+
+	resp := NewMessage()
+	if err := resp.Set("success", "yes"); err != nil {
+		t.Fatalf("Unexpected error setting key: %v", err)
+	}
+
+	reqs := serveCommand(t, srvr, resp)
+
+	if err := s.InstallTrap("net", "gw"); err != nil {
+		t.Fatalf("Unexpected error installing trap: %v", err)
+	}
+
+	p := <-reqs
+	if p.name != "install" {
+		t.Errorf("Expected command install: received %v", p.name)
+	}
+
+	expected := map[string]interface{}{"child": "net", "ike": "gw"}
+
+	if !reflect.DeepEqual(p.msg.ToMap(), expected) {
+		t.Errorf("Unexpected request.\nExpected: %v\nReceived: %v", expected, p.msg.ToMap())
+	}
+}
+
+func TestUpConn(t *testing.T) {
+	client, srvr := net.Pipe()
+	defer client.Close()
+	defer srvr.Close()
+
+	s := &Session{ctr: &transport{conn: client}}
+
+	conn, err := NewMessageFromMap(map[string]interface{}{
+		"gw": map[string]interface{}{
+			"children": map[string]interface{}{
+				"net":  map[string]interface{}{"mode": "TUNNEL"},
+				"net6": map[string]interface{}{"mode": "TUNNEL"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error creating message: %v", err)
+	}
+
+	ok, err := NewMessageFromMap(map[string]interface{}{"success": "yes"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating message: %v", err)
+	}
+
+	failed, err := NewMessageFromMap(map[string]interface{}{"success": "no", "errmsg": "establishing CHILD_SA 'net6' failed"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating message: %v", err)
+	}
+
+	reqs := serveStreamedCommands(t, srvr, []streamedResponse{
+		{"list-conn", []*Message{conn}, NewMessage()},
+		{"control-log", nil, ok},
+		{"control-log", nil, failed},
+	})
+
+	results, err := s.UpConn(context.Background(), "gw")
+	if err == nil {
+		t.Errorf("Expected error when a CHILD SA failed")
+	}
+
+	if len(results) != 2 || results[0].Child != "net" || results[0].Err != nil ||
+		results[1].Child != "net6" || results[1].Err == nil {
+		t.Errorf("Unexpected results: %+v", results)
+	}
+
+	var initiated []string
+	for p := range reqs {
+		if p.name == "initiate" {
+			initiated = append(initiated, stringField(p.msg, "child"))
+		}
+	}
+
+	expected := []string{"net", "net6"}
+	if !reflect.DeepEqual(initiated, expected) {
+		t.Errorf("Unexpected initiated children.\nExpected: %v\nReceived: %v", expected, initiated)
+	}
+}
+
+func TestDownConnNotInstalled(t *testing.T) {
+	client, srvr := net.Pipe()
+	defer client.Close()
+	defer srvr.Close()
+
+	s := &Session{ctr: &transport{conn: client}}
+
+	conn, err := NewMessageFromMap(map[string]interface{}{
+		"gw": map[string]interface{}{
+			"children": map[string]interface{}{
+				"net":  map[string]interface{}{"mode": "TUNNEL"},
+				"net6": map[string]interface{}{"mode": "TUNNEL"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error creating message: %v", err)
+	}
+
+	ok, err := NewMessageFromMap(map[string]interface{}{"success": "yes", "matches": "1", "terminated": "1"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating message: %v", err)
+	}
+
+	noMatch, err := NewMessageFromMap(map[string]interface{}{"success": "no", "errmsg": "no matching SAs to terminate found", "matches": "0"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating message: %v", err)
+	}
+
+	reqs := serveStreamedCommands(t, srvr, []streamedResponse{
+		{"list-conn", []*Message{conn}, NewMessage()},
+		{"control-log", nil, ok},
+		{"control-log", nil, noMatch},
+		{"control-log", nil, ok},
+	})
+
+	results, err := s.DownConn(context.Background(), "gw")
+	if err != nil {
+		t.Fatalf("Unexpected error bringing down connection: %v", err)
+	}
+
+	if len(results) != 2 || results[0].Err != nil || results[1].Err != nil {
+		t.Errorf("Unexpected results: %+v", results)
+	}
+
+	var terminated []string
+	for p := range reqs {
+		if p.name == "terminate" {
+			terminated = append(terminated, stringField(p.msg, "child"))
+		}
+	}
+
+	expected := []string{"net", "net6", ""}
+	if !reflect.DeepEqual(terminated, expected) {
+		t.Errorf("Unexpected terminated children.\nExpected: %v\nReceived: %v", expected, terminated)
+	}
+}
+
+func TestDownConnFailed(t *testing.T) {
+	client, srvr := net.Pipe()
+	defer client.Close()
+	defer srvr.Close()
+
+	s := &Session{ctr: &transport{conn: client}}
+
+	conn, err := NewMessageFromMap(map[string]interface{}{
+		"gw": map[string]interface{}{
+			"children": map[string]interface{}{
+				"net": map[string]interface{}{"mode": "TUNNEL"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error creating message: %v", err)
+	}
+
+	failed, err := NewMessageFromMap(map[string]interface{}{"success": "no", "errmsg": "terminating CHILD_SA failed", "matches": "1", "terminated": "0"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating message: %v", err)
+	}
+
+	noMatch, err := NewMessageFromMap(map[string]interface{}{"success": "no", "errmsg": "no matching SAs to terminate found", "matches": "0"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating message: %v", err)
+	}
+
+	serveStreamedCommands(t, srvr, []streamedResponse{
+		{"list-conn", []*Message{conn}, NewMessage()},
+		{"control-log", nil, failed},
+		{"control-log", nil, noMatch},
+	})
+
+	results, err := s.DownConn(context.Background(), "gw")
+	if err == nil {
+		t.Errorf("Expected error when a CHILD SA failed to terminate")
+	}
+
+	if len(results) != 1 || results[0].Err == nil {
+		t.Errorf("Unexpected results: %+v", results)
+	}
+}
+
+func TestEstablishAndWait(t *testing.T) {
+	client, srvr := net.Pipe()
+	defer client.Close()
+	defer srvr.Close()
+
+	s := &Session{ctr: &transport{conn: client}}
+
+	ok, err := NewMessageFromMap(map[string]interface{}{"success": "yes"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating message: %v", err)
+	}
+
+	logMsg, err := NewMessageFromMap(map[string]interface{}{"group": "IKE", "msg": "received AUTHENTICATION_FAILED notify error"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating message: %v", err)
+	}
+
+	failed, err := NewMessageFromMap(map[string]interface{}{"success": "no", "errmsg": "establishing CHILD_SA 'net6' failed"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating message: %v", err)
+	}
+
+	reqs := serveStreamedCommands(t, srvr, []streamedResponse{
+		{"", nil, ok},
+		{"control-log", nil, ok},
+		{"control-log", []*Message{logMsg}, failed},
+	})
+
+	conn := Connection{
+		RemoteAddrs: []string{"192.0.2.1"},
+		Children:    []ChildSAConfig{{Name: "net"}, {Name: "net6"}},
+	}
+
+	var logged int
+
+	// Spare capacity must not be used for options added by EstablishAndWait
+	opts := make([]InitiateOption, 1, 2)
+	opts[0] = InitiateLog(func(*Message) {
+		logged++
+	})
+
+	err = s.EstablishAndWait(context.Background(), "gw", conn, opts...)
+
+	var e *EstablishError
+	if !errors.As(err, &e) {
+		t.Fatalf("Expected *EstablishError: received %v", err)
+	}
+
+	expected := []string{"[IKE] received AUTHENTICATION_FAILED notify error"}
+	if e.Conn != "gw" || e.Child != "net6" || !reflect.DeepEqual(e.Log, expected) {
+		t.Errorf("Unexpected error: %+v", e)
+	}
+
+	if logged != 1 {
+		t.Errorf("Expected log messages to be passed to InitiateLog: received %v", logged)
+	}
+
+	if opts[:2][1] != nil {
+		t.Errorf("Expected options not to be modified")
+	}
+
+	var names []string
+	for p := range reqs {
+		names = append(names, p.name)
+	}
+
+	expectedNames := []string{"load-conn", "initiate", "initiate"}
+	if !reflect.DeepEqual(names, expectedNames) {
+		t.Errorf("Unexpected commands.\nExpected: %v\nReceived: %v", expectedNames, names)
+	}
+}
+
+func TestTerminatePeer(t *testing.T) {
+	client, srvr := net.Pipe()
+	defer client.Close()
+	defer srvr.Close()
+
+	s := &Session{ctr: &transport{conn: client, version: &Version{Version: "5.9.14"}}}
+
+	sas, err := NewMessageFromMap(map[string]interface{}{
+		"gw1": map[string]interface{}{"uniqueid": "1", "remote-id": "peer@example.com", "remote-host": "192.0.2.1"},
+		"gw2": map[string]interface{}{"uniqueid": "2", "remote-id": "other@example.com", "remote-host": "2001:db8::1"},
+		"gw3": map[string]interface{}{"uniqueid": "3", "remote-id": "another@example.com", "remote-host": "192.0.2.3"},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error creating message: %v", err)
+	}
+
+	ok, err := NewMessageFromMap(map[string]interface{}{"success": "yes", "matches": "1", "terminated": "1"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating message: %v", err)
+	}
+
+	reqs := serveStreamedCommands(t, srvr, []streamedResponse{
+		{"list-sa", []*Message{sas}, NewMessage()},
+		{"control-log", nil, ok},
+	})
+
+	res, err := s.TerminatePeer(context.Background(), "2001:db8:0::1", TerminateOptions{Force: true})
+	if err != nil {
+		t.Fatalf("Unexpected error terminating peer: %v", err)
+	}
+
+	expected := TerminateResult{Matches: 1, Terminated: 1}
+	if res != expected {
+		t.Errorf("Unexpected result.\nExpected: %+v\nReceived: %+v", expected, res)
+	}
+
+	<-reqs
+
+	p := <-reqs
+	expectedReq := map[string]interface{}{"ike-id": "2", "force": "yes"}
+
+	if !reflect.DeepEqual(p.msg.ToMap(), expectedReq) {
+		t.Errorf("Unexpected request.\nExpected: %v\nReceived: %v", expectedReq, p.msg.ToMap())
+	}
+}
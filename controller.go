@@ -0,0 +1,196 @@
+// Copyright (C) 2019 Nick Rosbrook
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package vici
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ControllerStatus reports the outcome of a convergence of a Controller.
+type ControllerStatus struct {
+	// Time is when the convergence finished.
+	Time time.Time
+
+	// Plan are the actions that were executed, and Err is the error that stopped
+	// the convergence, if any.
+	Plan Plan
+	Err  error
+
+	// Reconnected is true if the session was re-established after an error, e.g.
+	// because the daemon was restarted.
+	Reconnected bool
+}
+
+// Controller continuously converges the daemon to a desired Config, using a Reconciler.
+// It converges whenever the desired Config is changed, periodically, and whenever one
+// of its trigger events is received by the session. Periodic convergence re-adds items
+// that were removed from the daemon, e.g. by swanctl. If the daemon restarts, the session
+// is re-established, and the complete Config is loaded again.
+type Controller struct {
+	s        *Session
+	r        *Reconciler
+	interval time.Duration
+
+	mux        sync.Mutex
+	desired    Config
+	hasDesired bool
+
+	trigger chan struct{}
+	events  map[string]bool
+
+	nmux sync.RWMutex
+	fns  []func(ControllerStatus)
+
+	// Removes the event middleware from the session
+	closeOnce sync.Once
+	remove    func()
+}
+
+// NewController returns a new Controller for s, which converges every interval, and
+// whenever one of events is received, e.g. ike-updown. If interval is not positive, the
+// Controller does not converge periodically. To receive events, the session must be
+// listening for them, e.g. with Session.Listen or Monitor.Run. The Controller installs
+// event middleware on s, but does not consume any events. The middleware is removed by
+// Close.
+func NewController(s *Session, interval time.Duration, events ...string) *Controller {
+	c := &Controller{
+		s:        s,
+		r:        NewReconciler(s),
+		interval: interval,
+		trigger:  make(chan struct{}, 1),
+		events:   make(map[string]bool),
+	}
+
+	for _, e := range events {
+		c.events[e] = true
+	}
+	c.remove = s.el.useRemovable(c.middleware)
+
+	return c
+}
+
+// Close removes the Controller's event middleware from the session. It should be
+// called once the Controller is no longer used, and Run has returned.
+func (c *Controller) Close() {
+	c.closeOnce.Do(c.remove)
+}
+
+// SetDesired sets the Config the controller converges to, and triggers a convergence.
+func (c *Controller) SetDesired(cfg Config) {
+	c.mux.Lock()
+	c.desired = cfg
+	c.hasDesired = true
+	c.mux.Unlock()
+
+	c.Trigger()
+}
+
+// Trigger causes the controller to converge as soon as possible.
+func (c *Controller) Trigger() {
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+		// A convergence is already pending
+	}
+}
+
+// Notify registers fn to be called with the status of each convergence. fn is called
+// from the goroutine running Run, and should not block.
+func (c *Controller) Notify(fn func(ControllerStatus)) {
+	c.nmux.Lock()
+	defer c.nmux.Unlock()
+
+	c.fns = append(c.fns, fn)
+}
+
+// Run converges the daemon until ctx is done, and then returns ctx.Err(). Nothing is
+// done until the desired Config is set with SetDesired.
+func (c *Controller) Run(ctx context.Context) error {
+	// A nil channel is never ready, so there is no periodic convergence without
+	// an interval
+	var tick <-chan time.Time
+	if c.interval > 0 {
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tick:
+		case <-c.trigger:
+		}
+
+		c.mux.Lock()
+		desired, ok := c.desired, c.hasDesired
+		c.mux.Unlock()
+
+		if !ok {
+			continue
+		}
+
+		c.notify(c.converge(desired))
+	}
+}
+
+func (c *Controller) converge(desired Config) ControllerStatus {
+	plan, err := c.r.Reconcile(desired)
+
+	status := ControllerStatus{Plan: plan, Err: err}
+
+	// If the daemon cannot be reached, it may have been restarted. In that case,
+	// it lost all configuration loaded over vici, so forget what was loaded.
+	if err != nil {
+		if _, perr := c.s.CommandRequest("version", nil); perr != nil {
+			if c.s.reconnect() == nil {
+				c.r.applied = make(map[string]string)
+				status.Reconnected = true
+
+				c.Trigger()
+			}
+		}
+	}
+	status.Time = time.Now()
+
+	return status
+}
+
+func (c *Controller) notify(status ControllerStatus) {
+	c.nmux.RLock()
+	defer c.nmux.RUnlock()
+
+	for _, fn := range c.fns {
+		fn(status)
+	}
+}
+
+func (c *Controller) middleware(e Event) (Event, bool) {
+	if c.events[e.Name] {
+		c.Trigger()
+	}
+
+	return e, true
+}
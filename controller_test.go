@@ -0,0 +1,205 @@
+// Copyright (C) 2019 Nick Rosbrook
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package vici
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestController(t *testing.T) {
+	client, srvr := net.Pipe()
+	defer client.Close()
+	defer srvr.Close()
+
+	s := &Session{ctr: &transport{conn: client}, el: &eventListener{}}
+	c := NewController(s, time.Hour, "ike-updown")
+
+	conns, err := NewMessageFromMap(map[string]interface{}{"conns": []string{}})
+	if err != nil {
+		t.Fatalf("Unexpected error creating message: %v", err)
+	}
+
+	ok, err := NewMessageFromMap(map[string]interface{}{"success": "yes"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating message: %v", err)
+	}
+
+	serveCommands(t, srvr, []*Message{conns, NewMessage(), NewMessage(), ok})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var statuses []ControllerStatus
+	c.Notify(func(status ControllerStatus) {
+		statuses = append(statuses, status)
+		cancel()
+	})
+
+	c.SetDesired(Config{Conns: map[string]interface{}{"gw": Connection{Version: 2}}})
+
+	if err := c.Run(ctx); err != context.Canceled {
+		t.Errorf("Unexpected error from Run: %v", err)
+	}
+
+	if len(statuses) != 1 {
+		t.Fatalf("Expected 1 status: received %v", len(statuses))
+	}
+
+	if s := statuses[0]; s.Err != nil || len(s.Plan) != 1 || s.Plan[0].String() != "load conn gw" {
+		t.Errorf("Unexpected status: %+v", s)
+	}
+
+	// Trigger events cause a convergence, and are passed through
+	if _, ok := c.middleware(Event{Name: "ike-updown"}); !ok {
+		t.Errorf("Expected trigger event to be delivered")
+	}
+
+	select {
+	case <-c.trigger:
+	default:
+		t.Errorf("Expected trigger event to trigger convergence")
+	}
+}
+
+func TestControllerReconnect(t *testing.T) {
+	first, firstSrvr := net.Pipe()
+	defer first.Close()
+	defer firstSrvr.Close()
+
+	second, secondSrvr := net.Pipe()
+	defer second.Close()
+	defer secondSrvr.Close()
+
+	s := &Session{
+		ctr: &transport{
+			conn: first,
+			dial: func() (net.Conn, error) {
+				return second, nil
+			},
+		},
+		el: &eventListener{},
+	}
+	c := NewController(s, time.Hour)
+
+	conns, err := NewMessageFromMap(map[string]interface{}{"conns": []string{}})
+	if err != nil {
+		t.Fatalf("Unexpected error creating message: %v", err)
+	}
+
+	ok, err := NewMessageFromMap(map[string]interface{}{"success": "yes"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating message: %v", err)
+	}
+
+	serveCommands(t, firstSrvr, []*Message{conns, NewMessage(), NewMessage(), ok})
+
+	// The restarted daemon has lost the configuration.
+	replayed := serveCommands(t, secondSrvr, []*Message{conns, NewMessage(), NewMessage(), ok})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var statuses []ControllerStatus
+	c.Notify(func(status ControllerStatus) {
+		statuses = append(statuses, status)
+
+		switch len(statuses) {
+		case 1:
+			// Simulate a daemon restart
+			firstSrvr.Close()
+			c.Trigger()
+		case 3:
+			cancel()
+		}
+	})
+
+	c.SetDesired(Config{Conns: map[string]interface{}{"gw": Connection{Version: 2}}})
+
+	if err := c.Run(ctx); err != context.Canceled {
+		t.Errorf("Unexpected error from Run: %v", err)
+	}
+
+	if len(statuses) != 3 {
+		t.Fatalf("Expected 3 statuses: received %+v", statuses)
+	}
+
+	if s := statuses[1]; s.Err == nil || !s.Reconnected {
+		t.Errorf("Expected failed convergence to reconnect: %+v", s)
+	}
+
+	if s := statuses[2]; s.Err != nil || len(s.Plan) != 1 || s.Plan[0].String() != "load conn gw" {
+		t.Errorf("Expected configuration to be loaded again: %+v", s)
+	}
+
+	var names []string
+	for p := range replayed {
+		names = append(names, p.name)
+	}
+
+	if len(names) != 4 || names[3] != "load-conn" {
+		t.Errorf("Unexpected commands after reconnecting: %v", names)
+	}
+}
+
+func TestControllerNoInterval(t *testing.T) {
+	s := &Session{el: &eventListener{}}
+	c := NewController(s, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := c.Run(ctx); err != context.Canceled {
+		t.Errorf("Unexpected error from Run: %v", err)
+	}
+}
+
+func TestControllerClose(t *testing.T) {
+	s := &Session{el: &eventListener{}}
+
+	other := func(e Event) (Event, bool) { return e, true }
+
+	s.UseEventMiddleware(other)
+	c := NewController(s, time.Hour, "ike-updown")
+
+	if len(s.el.mw) != 2 {
+		t.Fatalf("Expected controller middleware to be installed: received %v", len(s.el.mw))
+	}
+
+	c.Close()
+	c.Close()
+
+	if len(s.el.mw) != 1 {
+		t.Fatalf("Expected controller middleware to be removed: received %v", len(s.el.mw))
+	}
+
+	if _, ok := s.el.applyMiddleware(Event{Name: "ike-updown"}); !ok {
+		t.Errorf("Expected event to be delivered")
+	}
+
+	select {
+	case <-c.trigger:
+		t.Errorf("Unexpected convergence triggered after Close")
+	default:
+	}
+}
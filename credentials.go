@@ -0,0 +1,664 @@
+// Copyright (C) 2019 Nick Rosbrook
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package vici
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+var (
+	// Encountered a certificate that could not be parsed
+	errInvalidCertificate = errors.New("vici: invalid certificate")
+
+	// Found no certificate in data to be loaded
+	errNoCertificate = errors.New("vici: no certificate found")
+
+	// Encountered a private key type that cannot be loaded
+	errUnsupportedKey = errors.New("vici: unsupported private key type")
+
+	// Found no private key in data to be loaded
+	errNoPrivateKey = errors.New("vici: no private key found")
+
+	// Asked to generate a key of an unsupported size
+	errInvalidKeySize = errors.New("vici: invalid key size")
+)
+
+// CertFilter selects the certificates returned by Session.ListCerts. Empty fields match
+// any certificate.
+type CertFilter struct {
+	// Type is the certificate type, e.g. X509, X509_AC, X509_CRL, OCSP_RESPONSE
+	// or PUBKEY.
+	Type string `vici:"type,omitempty"`
+
+	// Flag is the X.509 certificate flag, e.g. NONE, CA, AA or OCSP.
+	Flag string `vici:"flag,omitempty"`
+
+	// Subject is the subject of the certificate.
+	Subject string `vici:"subject,omitempty"`
+}
+
+// Cert is a certificate loaded in the daemon, as reported by list-certs.
+type Cert struct {
+	Type          string `vici:"type"`
+	Flag          string `vici:"flag"`
+	HasPrivateKey bool   `vici:"has_privkey"`
+
+	// Data is the ASN.1 encoding of the certificate.
+	Data []byte `vici:"data"`
+
+	// Certificate is the parsed certificate, if Type is X509.
+	Certificate *x509.Certificate
+}
+
+// ListCerts returns the certificates selected by filter, using the list-certs command.
+// An error is returned if an X.509 certificate cannot be parsed.
+func (s *Session) ListCerts(filter CertFilter) ([]Cert, error) {
+	var certs []Cert
+
+	err := s.EachCert(context.Background(), filter, func(c Cert) error {
+		certs = append(certs, c)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return certs, nil
+}
+
+// EachCert calls fn with each of the certificates selected by filter, using the list-certs
+// command, as they are received from the daemon. If fn returns an error, it is not called
+// again, and that error is returned. The request is aborted once ctx is done.
+func (s *Session) EachCert(ctx context.Context, filter CertFilter, fn func(Cert) error) error {
+	msg, err := MarshalMessage(filter)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.StreamedCommandRequestFuncContext(ctx, "list-certs", "list-cert", msg, func(m *Message) error {
+		c, err := parseCert(m)
+		if err != nil {
+			return err
+		}
+
+		return fn(c)
+	})
+	if err != nil {
+		return err
+	}
+
+	return resp.Err()
+}
+
+func parseCert(m *Message) (Cert, error) {
+	var c Cert
+
+	if err := UnmarshalMessage(m, &c); err != nil {
+		return c, err
+	}
+
+	if c.Type != "X509" {
+		return c, nil
+	}
+
+	cert, err := x509.ParseCertificate(c.Data)
+	if err != nil {
+		return c, fmt.Errorf("%v: %v", errInvalidCertificate, err)
+	}
+	c.Certificate = cert
+
+	return c, nil
+}
+
+// LoadCert loads a certificate with the load-cert command. typ is the certificate type,
+// i.e. X509, X509_AC or X509_CRL, and flag is the X.509 certificate flag, i.e. NONE, CA,
+// AA or OCSP. data is the DER encoding of the certificate.
+func (s *Session) LoadCert(typ, flag string, data []byte) error {
+	msg, err := newLoadCertMessage(typ, flag, data)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.CommandRequest("load-cert", msg)
+
+	return err
+}
+
+// newLoadCertMessage returns the load-cert request for a certificate, as described by
+// LoadCert.
+func newLoadCertMessage(typ, flag string, data []byte) (*Message, error) {
+	msg := NewMessage()
+
+	for _, kv := range []struct {
+		k string
+		v interface{}
+	}{
+		{"type", typ},
+		{"flag", flag},
+		{"data", data},
+	} {
+		if err := msg.Set(kv.k, kv.v); err != nil {
+			return nil, err
+		}
+	}
+
+	return msg, nil
+}
+
+// LoadCertFromFile loads the certificates in the PEM or DER encoded file at path, as
+// described by LoadCertPEM.
+func (s *Session) LoadCertFromFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	return s.LoadCertPEM(data)
+}
+
+// LoadCertPEM loads each of the certificates and CRLs in data with the load-cert command.
+// The type of each is detected from its PEM block type and contents: CA certificates are
+// loaded with the CA flag, OCSP signer certificates with the OCSP flag, and other X.509
+// certificates with no flag. Since attribute authority certificates cannot be told apart
+// from others, they must be loaded with LoadCert and the AA flag. If data is not PEM
+// encoded, it is loaded as a single DER encoded certificate or CRL.
+func (s *Session) LoadCertPEM(data []byte) error {
+	certs, err := parseLoadCerts(data)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range certs {
+		if err := s.LoadCert(c.typ, c.flag, c.data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadCert is a certificate to be loaded with load-cert.
+type loadCert struct {
+	typ  string
+	flag string
+	data []byte
+}
+
+// parseLoadCerts returns the certificates in the PEM or DER encoded data, along with their
+// detected types and flags.
+func parseLoadCerts(data []byte) ([]loadCert, error) {
+	var certs []loadCert
+
+	rest := bytes.TrimSpace(data)
+	for len(rest) > 0 {
+		var block *pem.Block
+
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+
+		c, err := detectCert(block.Type, block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		if c != nil {
+			certs = append(certs, *c)
+		}
+	}
+
+	if certs != nil {
+		return certs, nil
+	}
+
+	// Not PEM encoded, so try DER.
+	for _, typ := range []string{"CERTIFICATE", "X509 CRL"} {
+		if c, err := detectCert(typ, data); err == nil && c != nil {
+			return []loadCert{*c}, nil
+		}
+	}
+
+	return nil, errNoCertificate
+}
+
+// detectCert returns the certificate in der, whose type is given by the PEM block type typ.
+// A nil certificate is returned if typ is not a certificate type, e.g. a private key.
+func detectCert(typ string, der []byte) (*loadCert, error) {
+	switch typ {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", errInvalidCertificate, err)
+		}
+
+		flag := "NONE"
+
+		switch {
+		case cert.IsCA:
+			flag = "CA"
+		case hasExtKeyUsage(cert, x509.ExtKeyUsageOCSPSigning):
+			flag = "OCSP"
+		}
+
+		return &loadCert{typ: "X509", flag: flag, data: der}, nil
+
+	case "X509 CRL":
+		if _, err := x509.ParseRevocationList(der); err != nil {
+			return nil, fmt.Errorf("%v: %v", errInvalidCertificate, err)
+		}
+
+		return &loadCert{typ: "X509_CRL", flag: "NONE", data: der}, nil
+
+	case "ATTRIBUTE CERTIFICATE":
+		return &loadCert{typ: "X509_AC", flag: "NONE", data: der}, nil
+	}
+
+	return nil, nil
+}
+
+func hasExtKeyUsage(cert *x509.Certificate, usage x509.ExtKeyUsage) bool {
+	for _, u := range cert.ExtKeyUsage {
+		if u == usage {
+			return true
+		}
+	}
+
+	return false
+}
+
+// LoadKey loads the private key key with the load-key command, and returns the key ID
+// reported by the daemon. key must be an *rsa.PrivateKey, *ecdsa.PrivateKey or
+// ed25519.PrivateKey.
+func (s *Session) LoadKey(key crypto.PrivateKey) (string, error) {
+	typ, der, err := marshalLoadKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	msg := NewMessage()
+	if err := msg.Set("type", typ); err != nil {
+		return "", err
+	}
+
+	if err := msg.Set("data", der); err != nil {
+		return "", err
+	}
+
+	resp, err := s.CommandRequest("load-key", msg)
+	if err != nil {
+		return "", err
+	}
+
+	return stringField(resp, "id"), nil
+}
+
+// LoadKeyFromPEM loads the first private key in the PEM encoded data, as described by
+// LoadKey. Keys are accepted in PKCS#1, SEC 1 or PKCS#8 form.
+func (s *Session) LoadKeyFromPEM(data []byte) (string, error) {
+	key, err := parsePEMPrivateKey(data)
+	if err != nil {
+		return "", err
+	}
+
+	return s.LoadKey(key)
+}
+
+// GenerateKey generates a new private key of type typ, i.e. rsa, ecdsa or ed25519, loads
+// it with LoadKey, and returns the key ID and the key. The key can be used as a signer,
+// e.g. to create a certificate signing request with x509.CreateCertificateRequest. bits
+// is the size of an RSA key, which defaults to 3072, or of the curve of an ECDSA key, i.e.
+// 256, 384 or 521, which defaults to 256. It is ignored for Ed25519 keys.
+func (s *Session) GenerateKey(typ string, bits int) (string, crypto.Signer, error) {
+	key, err := generateKey(typ, bits)
+	if err != nil {
+		return "", nil, err
+	}
+
+	id, err := s.LoadKey(key)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return id, key, nil
+}
+
+// generateKey generates a private key as described by GenerateKey.
+func generateKey(typ string, bits int) (crypto.Signer, error) {
+	switch typ {
+	case "rsa":
+		if bits == 0 {
+			bits = 3072
+		}
+
+		if bits < 2048 {
+			return nil, fmt.Errorf("%v: %v", errInvalidKeySize, bits)
+		}
+
+		return rsa.GenerateKey(rand.Reader, bits)
+
+	case "ecdsa":
+		var curve elliptic.Curve
+
+		switch bits {
+		case 0, 256:
+			curve = elliptic.P256()
+		case 384:
+			curve = elliptic.P384()
+		case 521:
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("%v: %v", errInvalidKeySize, bits)
+		}
+
+		return ecdsa.GenerateKey(curve, rand.Reader)
+
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+
+		return key, err
+	}
+
+	return nil, fmt.Errorf("%v: %v", errUnsupportedKey, typ)
+}
+
+// marshalLoadKey returns the load-key type and DER encoding of key.
+func marshalLoadKey(key crypto.PrivateKey) (string, []byte, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return "rsa", x509.MarshalPKCS1PrivateKey(k), nil
+
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return "", nil, fmt.Errorf("%v: %v", errUnsupportedKey, err)
+		}
+
+		return "ecdsa", der, nil
+
+	case ed25519.PrivateKey:
+		der, err := x509.MarshalPKCS8PrivateKey(k)
+		if err != nil {
+			return "", nil, fmt.Errorf("%v: %v", errUnsupportedKey, err)
+		}
+
+		return "ed25519", der, nil
+	}
+
+	return "", nil, fmt.Errorf("%v: %T", errUnsupportedKey, key)
+}
+
+// parsePEMPrivateKey returns the first private key in the PEM encoded data.
+func parsePEMPrivateKey(data []byte) (crypto.PrivateKey, error) {
+	rest := data
+	for {
+		var block *pem.Block
+
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return nil, errNoPrivateKey
+		}
+
+		var (
+			key crypto.PrivateKey
+			err error
+		)
+
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+		case "PRIVATE KEY":
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		default:
+			continue
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", errUnsupportedKey, err)
+		}
+
+		return key, nil
+	}
+}
+
+// GetKeys returns the IDs of the private keys loaded over vici, using the get-keys command.
+func (s *Session) GetKeys() ([]string, error) {
+	resp, err := s.CommandRequest("get-keys", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, _ := resp.GetList("keys")
+
+	return keys, nil
+}
+
+// UnloadKey unloads the private key with the given ID, as returned by LoadKey or GetKeys,
+// using the unload-key command.
+func (s *Session) UnloadKey(id string) error {
+	msg := NewMessage()
+	if err := msg.Set("id", id); err != nil {
+		return err
+	}
+
+	_, err := s.CommandRequest("unload-key", msg)
+
+	return err
+}
+
+// Token identifies a private key stored on a PKCS#11 token, to be loaded with LoadToken.
+type Token struct {
+	// Handle is the hex encoded CKA_ID of the private key on the token.
+	Handle string `vici:"handle"`
+
+	// Slot optionally restricts the key to the given slot, and Module to the
+	// given PKCS#11 module, as configured in strongswan.conf.
+	Slot   *uint32 `vici:"slot,omitempty"`
+	Module string  `vici:"module,omitempty"`
+
+	// PIN is the PIN used to access the key. If it is empty, the daemon's
+	// configured credentials are used.
+	PIN Secret `vici:"pin,omitempty"`
+}
+
+// LoadToken loads a private key located on a PKCS#11 token with the load-token command,
+// and returns the key ID reported by the daemon.
+func (s *Session) LoadToken(token Token) (string, error) {
+	msg, err := MarshalMessage(token)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := s.CommandRequest("load-token", msg)
+	if err != nil {
+		return "", err
+	}
+
+	return stringField(resp, "id"), nil
+}
+
+// Secret is the data of a shared secret. Its String and GoString methods do not reveal
+// the secret, so that it is not accidentally logged.
+type Secret []byte
+
+// String returns a placeholder for the secret.
+func (Secret) String() string {
+	return "<redacted>"
+}
+
+// GoString returns a placeholder for the secret.
+func (Secret) GoString() string {
+	return "vici.Secret(<redacted>)"
+}
+
+// MarshalVici implements MessageMarshaler.
+func (s Secret) MarshalVici() (interface{}, error) {
+	return []byte(s), nil
+}
+
+// SharedSecret is a shared secret, to be loaded with LoadShared.
+type SharedSecret struct {
+	// ID uniquely identifies the secret, so that it can be replaced or
+	// unloaded later. If it is empty, the secret cannot be unloaded.
+	ID string `vici:"id,omitempty"`
+
+	// Type is the type of the secret, i.e. IKE, EAP, XAUTH, NTLM or PPK.
+	Type string `vici:"type"`
+
+	Data Secret `vici:"data"`
+
+	// Owners are the identities the secret belongs to.
+	Owners []string `vici:"owners,omitempty"`
+}
+
+// LoadShared loads secret with the load-shared command. A secret previously loaded with
+// the same ID is replaced.
+func (s *Session) LoadShared(secret SharedSecret) error {
+	msg, err := MarshalMessage(secret)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.CommandRequest("load-shared", msg)
+
+	return err
+}
+
+// UnloadShared unloads the shared secret with the given ID, using the unload-shared
+// command.
+func (s *Session) UnloadShared(id string) error {
+	msg := NewMessage()
+	if err := msg.Set("id", id); err != nil {
+		return err
+	}
+
+	_, err := s.CommandRequest("unload-shared", msg)
+
+	return err
+}
+
+// GetShared returns the IDs of the shared secrets loaded over vici, using the get-shared
+// command.
+func (s *Session) GetShared() ([]string, error) {
+	resp, err := s.CommandRequest("get-shared", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, _ := resp.GetList("keys")
+
+	return keys, nil
+}
+
+// FlushCerts flushes the daemon's volatile certificate cache, e.g. of certificates
+// received from peers or fetched CRLs and OCSP responses, using the flush-certs command.
+// typ restricts the flush to certificates of the given type, e.g. X509_CRL or
+// OCSP_RESPONSE. If typ is empty, all cached certificates are flushed.
+func (s *Session) FlushCerts(typ string) error {
+	msg := NewMessage()
+
+	if typ != "" {
+		if err := msg.Set("type", typ); err != nil {
+			return err
+		}
+	}
+
+	_, err := s.CommandRequest("flush-certs", msg)
+
+	return err
+}
+
+// ClearCreds clears all certificates, private keys and shared secrets loaded over vici,
+// and flushes the daemon's certificate cache, using the clear-creds command.
+func (s *Session) ClearCreds() error {
+	_, err := s.CommandRequest("clear-creds", nil)
+
+	return err
+}
+
+// Authority is a certification authority loaded in the daemon, as reported by
+// list-authorities.
+type Authority struct {
+	// Name is the name of the authority.
+	Name string
+
+	// CACert is the subject of the authority's CA certificate.
+	CACert      string   `vici:"cacert"`
+	CRLURIs     []string `vici:"crl_uris"`
+	OCSPURIs    []string `vici:"ocsp_uris"`
+	CertURIBase string   `vici:"cert_uri_base"`
+}
+
+// ListAuthorities returns the certification authorities loaded in the daemon, using the
+// list-authorities command. If name is not empty, only the authority with that name is
+// returned.
+func (s *Session) ListAuthorities(name string) ([]Authority, error) {
+	msg := NewMessage()
+
+	if name != "" {
+		if err := msg.Set("name", name); err != nil {
+			return nil, err
+		}
+	}
+
+	var authorities []Authority
+
+	resp, err := s.StreamedCommandRequestFunc("list-authorities", "list-authority", msg, func(m *Message) error {
+		for _, name := range m.Keys() {
+			section, ok := m.GetSection(name)
+			if !ok {
+				continue
+			}
+
+			a := Authority{Name: name}
+			if err := UnmarshalMessage(section, &a); err != nil {
+				return err
+			}
+			authorities = append(authorities, a)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := resp.Err(); err != nil {
+		return nil, err
+	}
+
+	return authorities, nil
+}
@@ -0,0 +1,523 @@
+// Copyright (C) 2019 Nick Rosbrook
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package vici
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCertificateConfig holds the optional parameters of newTestCertificate.
+type testCertificateConfig struct {
+	parent    *x509.Certificate
+	parentKey ed25519.PrivateKey
+	lifetime  time.Duration
+}
+
+// testCertificateOption sets an optional parameter of newTestCertificate.
+type testCertificateOption func(*testCertificateConfig)
+
+// issuedBy issues the certificate by parent, rather than self-signing it.
+func issuedBy(parent *x509.Certificate, parentKey ed25519.PrivateKey) testCertificateOption {
+	return func(c *testCertificateConfig) {
+		c.parent = parent
+		c.parentKey = parentKey
+	}
+}
+
+// validFor sets the lifetime of the certificate, which is expired if lifetime is
+// negative. The default is one hour.
+func validFor(lifetime time.Duration) testCertificateOption {
+	return func(c *testCertificateConfig) {
+		c.lifetime = lifetime
+	}
+}
+
+// newTestCertificate returns a new certificate for cn, and its private key. It is
+// self-signed, unless issuedBy is given.
+func newTestCertificate(t *testing.T, cn string, ca bool, opts ...testCertificateOption) (*x509.Certificate, ed25519.PrivateKey) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Unexpected error generating key: %v", err)
+	}
+
+	c := testCertificateConfig{lifetime: time.Hour}
+	for _, opt := range opts {
+		opt(&c)
+	}
+
+	now := time.Now()
+	notBefore, notAfter := now, now.Add(c.lifetime)
+	if notAfter.Before(notBefore) {
+		notBefore = notAfter.Add(-time.Hour)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		IsCA:                  ca,
+		BasicConstraintsValid: ca,
+	}
+
+	if ca {
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	}
+
+	parent, parentKey := template, key
+	if c.parent != nil {
+		parent, parentKey = c.parent, c.parentKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatalf("Unexpected error creating certificate: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing certificate: %v", err)
+	}
+
+	return cert, key
+}
+
+func TestListCerts(t *testing.T) {
+	client, srvr := net.Pipe()
+	defer client.Close()
+	defer srvr.Close()
+
+	s := &Session{ctr: &transport{conn: client}}
+
+	cert, _ := newTestCertificate(t, "moon.strongswan.org", false)
+
+	event := NewMessage()
+	for _, kv := range []struct {
+		k string
+		v interface{}
+	}{
+		{"type", "X509"},
+		{"flag", "NONE"},
+		{"has_privkey", "yes"},
+		{"data", cert.Raw},
+	} {
+		if err := event.Set(kv.k, kv.v); err != nil {
+			t.Fatalf("Unexpected error setting key: %v", err)
+		}
+	}
+
+	reqs := serveStreamedCommand(t, srvr, "list-cert", []*Message{event}, NewMessage())
+
+	certs, err := s.ListCerts(CertFilter{Type: "X509"})
+	if err != nil {
+		t.Fatalf("Unexpected error listing certificates: %v", err)
+	}
+
+	if len(certs) != 1 {
+		t.Fatalf("Expected 1 certificate: received %v", len(certs))
+	}
+
+	if c := certs[0]; c.Type != "X509" || c.Flag != "NONE" || !c.HasPrivateKey {
+		t.Errorf("Unexpected certificate: %+v", c)
+	}
+
+	if c := certs[0].Certificate; c == nil || !c.Equal(cert) {
+		t.Errorf("Expected parsed certificate to equal listed certificate")
+	}
+
+	p := <-reqs
+	expectedReq := map[string]interface{}{"type": "X509"}
+
+	if !reflect.DeepEqual(p.msg.ToMap(), expectedReq) {
+		t.Errorf("Unexpected request.\nExpected: %v\nReceived: %v", expectedReq, p.msg.ToMap())
+	}
+}
+
+func TestParseLoadCerts(t *testing.T) {
+	ca, caKey := newTestCertificate(t, "strongSwan CA", true)
+	cert, _ := newTestCertificate(t, "moon.strongswan.org", false)
+
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{Number: big.NewInt(1)}, ca, caKey)
+	if err != nil {
+		t.Fatalf("Unexpected error creating CRL: %v", err)
+	}
+
+	var data []byte
+	for _, b := range []*pem.Block{
+		{Type: "CERTIFICATE", Bytes: ca.Raw},
+		{Type: "CERTIFICATE", Bytes: cert.Raw},
+		{Type: "PRIVATE KEY", Bytes: []byte{0}},
+		{Type: "X509 CRL", Bytes: crl},
+	} {
+		data = append(data, pem.EncodeToMemory(b)...)
+	}
+
+	certs, err := parseLoadCerts(data)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing certificates: %v", err)
+	}
+
+	expected := []loadCert{
+		{typ: "X509", flag: "CA", data: ca.Raw},
+		{typ: "X509", flag: "NONE", data: cert.Raw},
+		{typ: "X509_CRL", flag: "NONE", data: crl},
+	}
+
+	if !reflect.DeepEqual(certs, expected) {
+		t.Errorf("Unexpected certificates.\nExpected: %+v\nReceived: %+v", expected, certs)
+	}
+
+	certs, err = parseLoadCerts(cert.Raw)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing DER certificate: %v", err)
+	}
+
+	if len(certs) != 1 || certs[0].typ != "X509" {
+		t.Errorf("Unexpected DER certificates: %+v", certs)
+	}
+
+	if _, err := parseLoadCerts([]byte("not a certificate")); err == nil {
+		t.Errorf("Expected error parsing invalid data")
+	}
+}
+
+func TestLoadKeyFromPEM(t *testing.T) {
+	client, srvr := net.Pipe()
+	defer client.Close()
+	defer srvr.Close()
+
+	s := &Session{ctr: &transport{conn: client}}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unexpected error generating key: %v", err)
+	}
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling key: %v", err)
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte{0}})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})...)
+
+	resp := NewMessage()
+	for _, kv := range [][2]string{{"success", "yes"}, {"id", "4a:b1"}} {
+		if err := resp.Set(kv[0], kv[1]); err != nil {
+			t.Fatalf("Unexpected error setting key: %v", err)
+		}
+	}
+
+	reqs := serveCommand(t, srvr, resp)
+
+	id, err := s.LoadKeyFromPEM(data)
+	if err != nil {
+		t.Fatalf("Unexpected error loading key: %v", err)
+	}
+
+	if id != "4a:b1" {
+		t.Errorf("Unexpected key ID.\nExpected: %v\nReceived: %v", "4a:b1", id)
+	}
+
+	p := <-reqs
+	if typ := stringField(p.msg, "type"); typ != "ecdsa" {
+		t.Errorf("Unexpected key type.\nExpected: %v\nReceived: %v", "ecdsa", typ)
+	}
+
+	if b, _ := p.msg.GetBytes("data"); !bytes.Equal(b, der) {
+		t.Errorf("Expected key data to be DER encoded key")
+	}
+
+	if _, _, err := marshalLoadKey("not a key"); err == nil {
+		t.Errorf("Expected error marshaling unsupported key")
+	}
+}
+
+func TestGenerateKey(t *testing.T) {
+	client, srvr := net.Pipe()
+	defer client.Close()
+	defer srvr.Close()
+
+	s := &Session{ctr: &transport{conn: client}}
+
+	resp := NewMessage()
+	for _, kv := range [][2]string{{"success", "yes"}, {"id", "4a:b1"}} {
+		if err := resp.Set(kv[0], kv[1]); err != nil {
+			t.Fatalf("Unexpected error setting key: %v", err)
+		}
+	}
+
+	reqs := serveCommand(t, srvr, resp)
+
+	id, signer, err := s.GenerateKey("ecdsa", 384)
+	if err != nil {
+		t.Fatalf("Unexpected error generating key: %v", err)
+	}
+
+	if id != "4a:b1" {
+		t.Errorf("Unexpected key ID.\nExpected: %v\nReceived: %v", "4a:b1", id)
+	}
+
+	key, ok := signer.(*ecdsa.PrivateKey)
+	if !ok || key.Curve != elliptic.P384() {
+		t.Fatalf("Unexpected key: %T", signer)
+	}
+
+	p := <-reqs
+	if typ := stringField(p.msg, "type"); typ != "ecdsa" {
+		t.Errorf("Unexpected key type.\nExpected: %v\nReceived: %v", "ecdsa", typ)
+	}
+
+	b, _ := p.msg.GetBytes("data")
+
+	loaded, err := x509.ParseECPrivateKey(b)
+	if err != nil || !loaded.Equal(key) {
+		t.Errorf("Expected loaded key to be the generated key: %v", err)
+	}
+
+	csr := &x509.CertificateRequest{Subject: pkix.Name{CommonName: "moon.strongswan.org"}}
+	if _, err := x509.CreateCertificateRequest(rand.Reader, csr, signer); err != nil {
+		t.Errorf("Unexpected error creating CSR: %v", err)
+	}
+
+	for _, tt := range []struct {
+		typ  string
+		bits int
+	}{
+		{"rsa", 1024},
+		{"ecdsa", 128},
+		{"dsa", 0},
+	} {
+		if _, err := generateKey(tt.typ, tt.bits); err == nil {
+			t.Errorf("Expected error generating %v key of %v bits", tt.typ, tt.bits)
+		}
+	}
+
+	if key, err := generateKey("ed25519", 0); err != nil {
+		t.Errorf("Unexpected error generating ed25519 key: %v", err)
+	} else if _, ok := key.(ed25519.PrivateKey); !ok {
+		t.Errorf("Unexpected key: %T", key)
+	}
+}
+
+func TestGetKeys(t *testing.T) {
+	client, srvr := net.Pipe()
+	defer client.Close()
+	defer srvr.Close()
+
+	s := &Session{ctr: &transport{conn: client}}
+
+	expected := []string{"4a:b1", "9c:02"}
+
+	resp := NewMessage()
+	if err := resp.Set("keys", expected); err != nil {
+		t.Fatalf("Unexpected error setting key: %v", err)
+	}
+
+	reqs := serveCommand(t, srvr, resp)
+
+	keys, err := s.GetKeys()
+	if err != nil {
+		t.Fatalf("Unexpected error getting keys: %v", err)
+	}
+
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Unexpected keys.\nExpected: %v\nReceived: %v", expected, keys)
+	}
+
+	if p := <-reqs; p.name != "get-keys" {
+		t.Errorf("Expected command get-keys: received %v", p.name)
+	}
+}
+
+func TestLoadToken(t *testing.T) {
+	client, srvr := net.Pipe()
+	defer client.Close()
+	defer srvr.Close()
+
+	s := &Session{ctr: &transport{conn: client}}
+
+	resp := NewMessage()
+	for _, kv := range [][2]string{{"success", "yes"}, {"id", "4a:b1"}} {
+		if err := resp.Set(kv[0], kv[1]); err != nil {
+			t.Fatalf("Unexpected error setting key: %v", err)
+		}
+	}
+
+	reqs := serveCommand(t, srvr, resp)
+
+	slot := uint32(0)
+
+	token := Token{Handle: "4ab1", Slot: &slot, PIN: Secret("1234")}
+
+	id, err := s.LoadToken(token)
+	if err != nil {
+		t.Fatalf("Unexpected error loading token: %v", err)
+	}
+
+	if id != "4a:b1" {
+		t.Errorf("Unexpected key ID.\nExpected: %v\nReceived: %v", "4a:b1", id)
+	}
+
+	p := <-reqs
+	expected := map[string]interface{}{"handle": "4ab1", "slot": "0", "pin": "1234"}
+
+	if !reflect.DeepEqual(p.msg.ToMap(), expected) {
+		t.Errorf("Unexpected request.\nExpected: %v\nReceived: %v", expected, p.msg.ToMap())
+	}
+
+	for _, format := range []string{"%v", "%+v", "%#v", "%s"} {
+		if s := fmt.Sprintf(format, token); strings.Contains(s, "1234") {
+			t.Errorf("PIN revealed by %v: %v", format, s)
+		}
+	}
+}
+
+func TestLoadShared(t *testing.T) {
+	client, srvr := net.Pipe()
+	defer client.Close()
+	defer srvr.Close()
+
+	s := &Session{ctr: &transport{conn: client}}
+
+	resp := NewMessage()
+	if err := resp.Set("success", "yes"); err != nil {
+		t.Fatalf("Unexpected error setting key: %v", err)
+	}
+
+	reqs := serveCommand(t, srvr, resp)
+
+	secret := SharedSecret{
+		ID:     "ike-moon",
+		Type:   "IKE",
+		Data:   Secret("0sv+NkxY9LLZvwj4qCC2o/gGrWDF2d21jL"),
+		Owners: []string{"moon.strongswan.org"},
+	}
+
+	if err := s.LoadShared(secret); err != nil {
+		t.Fatalf("Unexpected error loading shared secret: %v", err)
+	}
+
+	p := <-reqs
+	expected := map[string]interface{}{
+		"id":     "ike-moon",
+		"type":   "IKE",
+		"data":   "0sv+NkxY9LLZvwj4qCC2o/gGrWDF2d21jL",
+		"owners": []string{"moon.strongswan.org"},
+	}
+
+	if !reflect.DeepEqual(p.msg.ToMap(), expected) {
+		t.Errorf("Unexpected request.\nExpected: %v\nReceived: %v", expected, p.msg.ToMap())
+	}
+
+	for _, format := range []string{"%v", "%+v", "%#v", "%s"} {
+		if s := fmt.Sprintf(format, secret); strings.Contains(s, "0sv+") {
+			t.Errorf("Secret revealed by %v: %v", format, s)
+		}
+	}
+}
+
+func TestFlushCerts(t *testing.T) {
+	client, srvr := net.Pipe()
+	defer client.Close()
+	defer srvr.Close()
+
+	s := &Session{ctr: &transport{conn: client}}
+
+	resp := NewMessage()
+	if err := resp.Set("success", "yes"); err != nil {
+		t.Fatalf("Unexpected error setting key: %v", err)
+	}
+
+	reqs := serveCommand(t, srvr, resp)
+
+	if err := s.FlushCerts("X509_CRL"); err != nil {
+		t.Fatalf("Unexpected error flushing certificates: %v", err)
+	}
+
+	p := <-reqs
+	if p.name != "flush-certs" {
+		t.Errorf("Expected command flush-certs: received %v", p.name)
+	}
+
+	if typ := stringField(p.msg, "type"); typ != "X509_CRL" {
+		t.Errorf("Unexpected type.\nExpected: %v\nReceived: %v", "X509_CRL", typ)
+	}
+}
+
+func TestListAuthorities(t *testing.T) {
+	client, srvr := net.Pipe()
+	defer client.Close()
+	defer srvr.Close()
+
+	s := &Session{ctr: &transport{conn: client}}
+
+	authority := NewMessage()
+	for _, kv := range []struct {
+		k string
+		v interface{}
+	}{
+		{"cacert", "C=CH, O=strongSwan Project, CN=strongSwan Root CA"},
+		{"crl_uris", []string{"http://crl.strongswan.org/strongswan.crl"}},
+	} {
+		if err := authority.Set(kv.k, kv.v); err != nil {
+			t.Fatalf("Unexpected error setting key: %v", err)
+		}
+	}
+
+	event := NewMessage()
+	if err := event.Set("strongswan", authority); err != nil {
+		t.Fatalf("Unexpected error setting key: %v", err)
+	}
+
+	serveStreamedCommand(t, srvr, "list-authority", []*Message{event}, NewMessage())
+
+	authorities, err := s.ListAuthorities("")
+	if err != nil {
+		t.Fatalf("Unexpected error listing authorities: %v", err)
+	}
+
+	expected := []Authority{
+		{
+			Name:    "strongswan",
+			CACert:  "C=CH, O=strongSwan Project, CN=strongSwan Root CA",
+			CRLURIs: []string{"http://crl.strongswan.org/strongswan.crl"},
+		},
+	}
+
+	if !reflect.DeepEqual(authorities, expected) {
+		t.Errorf("Unexpected authorities.\nExpected: %+v\nReceived: %+v", expected, authorities)
+	}
+}
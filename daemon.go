@@ -0,0 +1,399 @@
+// Copyright (C) 2019 Nick Rosbrook
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package vici
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Algorithm is an algorithm implementation loaded in the daemon.
+type Algorithm struct {
+	// Name is the name of the algorithm, e.g. AES_CBC or CURVE_25519.
+	Name string
+
+	// Plugin is the name of the plugin providing the implementation.
+	Plugin string
+}
+
+// Algorithms are the algorithms loaded in the daemon, keyed by algorithm type, e.g.
+// encryption, integrity, aead, hasher, prf, xof, kdf, drbg, ke, rng or nonce-gen.
+type Algorithms map[string][]Algorithm
+
+// Has returns true if an implementation of the algorithm name, of the given type, is
+// loaded.
+func (a Algorithms) Has(typ, name string) bool {
+	for _, alg := range a[typ] {
+		if alg.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetAlgorithms returns the algorithms loaded in the daemon, using the get-algorithms
+// command.
+func (s *Session) GetAlgorithms() (Algorithms, error) {
+	resp, err := s.CommandRequest("get-algorithms", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseAlgorithms(resp), nil
+}
+
+func parseAlgorithms(m *Message) Algorithms {
+	algs := make(Algorithms)
+
+	for _, typ := range m.Keys() {
+		section, ok := m.GetSection(typ)
+		if !ok {
+			continue
+		}
+
+		for _, name := range section.Keys() {
+			algs[typ] = append(algs[typ], Algorithm{
+				Name:   name,
+				Plugin: stringField(section, name),
+			})
+		}
+	}
+
+	return algs
+}
+
+// DaemonStats are statistics of the daemon, as reported by the stats command.
+type DaemonStats struct {
+	Uptime    StatsUptime  `vici:"uptime"`
+	Workers   StatsWorkers `vici:"workers"`
+	Queues    StatsQueues  `vici:"queues"`
+	Scheduled uint64       `vici:"scheduled"`
+	IKESAs    StatsIKESAs  `vici:"ikesas"`
+	Plugins   []string     `vici:"plugins"`
+
+	// Mem and Mallinfo are only reported on platforms that support them,
+	// and are nil otherwise.
+	Mem      *StatsMem      `vici:"mem"`
+	Mallinfo *StatsMallinfo `vici:"mallinfo"`
+}
+
+// StatsUptime is the uptime of the daemon, as formatted by the daemon.
+type StatsUptime struct {
+	Running string `vici:"running"`
+	Since   string `vici:"since"`
+}
+
+// StatsWorkers are the worker thread counts of the daemon.
+type StatsWorkers struct {
+	Total uint64 `vici:"total"`
+	Idle  uint64 `vici:"idle"`
+
+	// Active are the active workers, by job priority.
+	Active StatsQueues `vici:"active"`
+}
+
+// StatsQueues are counts by job priority.
+type StatsQueues struct {
+	Critical uint64 `vici:"critical"`
+	High     uint64 `vici:"high"`
+	Medium   uint64 `vici:"medium"`
+	Low      uint64 `vici:"low"`
+}
+
+// StatsIKESAs are the IKE SA counts of the daemon.
+type StatsIKESAs struct {
+	Total    uint64 `vici:"total"`
+	HalfOpen uint64 `vici:"half-open"`
+}
+
+// StatsMem is the memory usage of the daemon, as tracked by the leak-detective.
+type StatsMem struct {
+	Total  uint64 `vici:"total"`
+	Allocs uint64 `vici:"allocs"`
+}
+
+// StatsMallinfo is the memory usage of the daemon, as reported by mallinfo().
+type StatsMallinfo struct {
+	Sbrk uint64 `vici:"sbrk"`
+	Mmap uint64 `vici:"mmap"`
+	Used uint64 `vici:"used"`
+	Free uint64 `vici:"free"`
+}
+
+// DaemonStats returns statistics of the daemon, using the stats command.
+func (s *Session) DaemonStats() (DaemonStats, error) {
+	var stats DaemonStats
+
+	resp, err := s.CommandRequest("stats", nil)
+	if err != nil {
+		return stats, err
+	}
+
+	err = UnmarshalMessage(resp, &stats)
+
+	return stats, err
+}
+
+// Counters are the IKE event counters of a connection, or of the daemon, keyed by
+// counter name, e.g. ike-rekey-init or ike-init-out.
+type Counters map[string]uint64
+
+// GetCounters returns IKE event counters, using the get-counters command. If all is
+// true, the counters of all connections, and the global counters, are returned. Otherwise,
+// the counters of the connection name are returned, or the global counters if name is
+// empty. The returned counters are keyed by connection name, and the global counters by
+// an empty name. The counters plugin requires strongSwan 5.6.1 or later, and a
+// *VersionError is returned for older daemons.
+func (s *Session) GetCounters(name string, all bool) (map[string]Counters, error) {
+	if err := s.requireFeature("get-counters", minVersionCounters); err != nil {
+		return nil, err
+	}
+
+	msg, err := countersMessage(name, all)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.CommandRequest("get-counters", msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseCounters(resp)
+}
+
+// ResetCounters resets IKE event counters, using the reset-counters command. name and
+// all select the counters as for GetCounters.
+func (s *Session) ResetCounters(name string, all bool) error {
+	if err := s.requireFeature("reset-counters", minVersionCounters); err != nil {
+		return err
+	}
+
+	msg, err := countersMessage(name, all)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.CommandRequest("reset-counters", msg)
+
+	return err
+}
+
+func countersMessage(name string, all bool) (*Message, error) {
+	msg := NewMessage()
+
+	if name != "" {
+		if err := msg.Set("name", name); err != nil {
+			return nil, err
+		}
+	}
+
+	if all {
+		if err := msg.Set("all", "yes"); err != nil {
+			return nil, err
+		}
+	}
+
+	return msg, nil
+}
+
+func parseCounters(m *Message) (map[string]Counters, error) {
+	counters := make(map[string]Counters)
+
+	section, ok := m.GetSection("counters")
+	if !ok {
+		return counters, nil
+	}
+
+	for _, name := range section.Keys() {
+		conn, ok := section.GetSection(name)
+		if !ok {
+			continue
+		}
+
+		c := make(Counters)
+
+		for _, k := range conn.Keys() {
+			v, err := strconv.ParseUint(stringField(conn, k), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%v: %v: %v", errUnmarshal, k, err)
+			}
+			c[k] = v
+		}
+		counters[name] = c
+	}
+
+	return counters, nil
+}
+
+// Version is the version of the daemon and the system it runs on, as reported by the
+// version command.
+type Version struct {
+	Daemon  string `vici:"daemon"`
+	Version string `vici:"version"`
+	Sysname string `vici:"sysname"`
+	Release string `vici:"release"`
+	Machine string `vici:"machine"`
+}
+
+// AtLeast returns true if the daemon version is at least min, e.g. 5.9.6. Suffixes of
+// version components, e.g. in 6.0.0rc1, are ignored. AtLeast returns false if either
+// version cannot be parsed.
+func (v Version) AtLeast(min string) bool {
+	have, ok := parseVersion(v.Version)
+	if !ok {
+		return false
+	}
+
+	want, ok := parseVersion(min)
+	if !ok {
+		return false
+	}
+
+	for i := range want {
+		var n int
+		if i < len(have) {
+			n = have[i]
+		}
+
+		if n != want[i] {
+			return n > want[i]
+		}
+	}
+
+	return true
+}
+
+// parseVersion returns the numeric components of the dotted version s.
+func parseVersion(s string) ([]int, bool) {
+	var nums []int
+
+	for _, c := range strings.Split(s, ".") {
+		end := strings.IndexFunc(c, func(r rune) bool { return r < '0' || r > '9' })
+		if end < 0 {
+			end = len(c)
+		}
+
+		n, err := strconv.Atoi(c[:end])
+		if err != nil {
+			return nil, false
+		}
+		nums = append(nums, n)
+	}
+
+	return nums, true
+}
+
+// Minimum daemon versions of commands, and command options, that are checked before
+// they are used.
+const (
+	// The force option of the terminate command
+	minVersionTerminateForce = "5.5.2"
+
+	// The get-counters and reset-counters commands of the counters plugin
+	minVersionCounters = "5.6.1"
+)
+
+// VersionError is returned by RequireVersion if the daemon is older than required, and
+// by commands that use a feature the daemon does not support.
+type VersionError struct {
+	// Feature is the command, or option, that is not supported. It is empty
+	// for errors returned by RequireVersion.
+	Feature string
+
+	// Required is the minimum version required, and Actual the daemon's version.
+	Required string
+	Actual   string
+}
+
+func (e *VersionError) Error() string {
+	if e.Feature != "" {
+		return fmt.Sprintf("vici: %v requires daemon version %v, but daemon version is %v", e.Feature, e.Required, e.Actual)
+	}
+
+	return fmt.Sprintf("vici: daemon version %v is older than required version %v", e.Actual, e.Required)
+}
+
+// Version returns the version of the daemon, using the version command.
+func (s *Session) Version() (Version, error) {
+	var v Version
+
+	resp, err := s.CommandRequest("version", nil)
+	if err != nil {
+		return v, err
+	}
+
+	err = UnmarshalMessage(resp, &v)
+
+	return v, err
+}
+
+// RequireVersion returns a *VersionError if the daemon version is older than min, so that
+// callers can refuse, or adapt, commands that are not supported by older releases.
+func (s *Session) RequireVersion(min string) error {
+	v, err := s.Version()
+	if err != nil {
+		return err
+	}
+
+	if !v.AtLeast(min) {
+		return &VersionError{Required: min, Actual: v.Version}
+	}
+
+	return nil
+}
+
+// requireFeature returns a *VersionError if the daemon version is older than min, which
+// is required by feature. Unlike RequireVersion, the version is only queried once per
+// connection to the daemon.
+func (s *Session) requireFeature(feature, min string) error {
+	s.mux.Lock()
+	v := s.ctr.version
+	s.mux.Unlock()
+
+	if v == nil {
+		version, err := s.Version()
+		if err != nil {
+			return err
+		}
+		v = &version
+
+		s.mux.Lock()
+		s.ctr.version = v
+		s.mux.Unlock()
+	}
+
+	if !v.AtLeast(min) {
+		return &VersionError{Feature: feature, Required: min, Actual: v.Version}
+	}
+
+	return nil
+}
+
+// ReloadSettings reloads strongswan.conf, and the configuration of plugins that
+// support it, using the reload-settings command.
+func (s *Session) ReloadSettings() error {
+	_, err := s.CommandRequest("reload-settings", nil)
+
+	return err
+}
@@ -0,0 +1,238 @@
+// Copyright (C) 2019 Nick Rosbrook
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package vici
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParseAlgorithms(t *testing.T) {
+	m := NewMessage()
+
+	for _, s := range []struct {
+		typ   string
+		algs  []string
+		plugs []string
+	}{
+		{"encryption", []string{"AES_CBC", "3DES_CBC"}, []string{"openssl", "openssl"}},
+		{"ke", []string{"CURVE_25519"}, []string{"openssl"}},
+	} {
+		section := NewMessage()
+		for i := range s.algs {
+			if err := section.Set(s.algs[i], s.plugs[i]); err != nil {
+				t.Fatalf("Unexpected error setting key: %v", err)
+			}
+		}
+
+		if err := m.Set(s.typ, section); err != nil {
+			t.Fatalf("Unexpected error setting key: %v", err)
+		}
+	}
+
+	algs := parseAlgorithms(m)
+
+	expected := Algorithms{
+		"encryption": {{Name: "AES_CBC", Plugin: "openssl"}, {Name: "3DES_CBC", Plugin: "openssl"}},
+		"ke":         {{Name: "CURVE_25519", Plugin: "openssl"}},
+	}
+
+	if !reflect.DeepEqual(algs, expected) {
+		t.Errorf("Unexpected algorithms.\nExpected: %v\nReceived: %v", expected, algs)
+	}
+
+	if !algs.Has("ke", "CURVE_25519") || algs.Has("ke", "CURVE_448") {
+		t.Errorf("Unexpected result of Has")
+	}
+}
+
+func TestDaemonStats(t *testing.T) {
+	client, srvr := net.Pipe()
+	defer client.Close()
+	defer srvr.Close()
+
+	s := &Session{ctr: &transport{conn: client}}
+
+	resp, err := NewMessageFromMap(map[string]interface{}{
+		"uptime":    map[string]interface{}{"running": "2 hours", "since": "Oct 16 08:00:00 2026"},
+		"workers":   map[string]interface{}{"total": "16", "idle": "11", "active": map[string]interface{}{"critical": "4", "high": "0", "medium": "1", "low": "0"}},
+		"queues":    map[string]interface{}{"critical": "0", "high": "0", "medium": "0", "low": "0"},
+		"scheduled": "5",
+		"ikesas":    map[string]interface{}{"total": "12", "half-open": "1"},
+		"plugins":   []string{"charon", "openssl", "vici"},
+		"mallinfo":  map[string]interface{}{"sbrk": "2490368", "mmap": "0", "used": "326960", "free": "2163408"},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error creating message: %v", err)
+	}
+
+	serveCommand(t, srvr, resp)
+
+	stats, err := s.DaemonStats()
+	if err != nil {
+		t.Fatalf("Unexpected error getting stats: %v", err)
+	}
+
+	expected := DaemonStats{
+		Uptime:    StatsUptime{Running: "2 hours", Since: "Oct 16 08:00:00 2026"},
+		Workers:   StatsWorkers{Total: 16, Idle: 11, Active: StatsQueues{Critical: 4, Medium: 1}},
+		Scheduled: 5,
+		IKESAs:    StatsIKESAs{Total: 12, HalfOpen: 1},
+		Plugins:   []string{"charon", "openssl", "vici"},
+		Mallinfo:  &StatsMallinfo{Sbrk: 2490368, Used: 326960, Free: 2163408},
+	}
+
+	if !reflect.DeepEqual(stats, expected) {
+		t.Errorf("Unexpected stats.\nExpected: %+v\nReceived: %+v", expected, stats)
+	}
+}
+
+func TestGetCounters(t *testing.T) {
+	client, srvr := net.Pipe()
+	defer client.Close()
+	defer srvr.Close()
+
+	s := &Session{ctr: &transport{conn: client, version: &Version{Version: "5.9.14"}}}
+
+	resp, err := NewMessageFromMap(map[string]interface{}{
+		"counters": map[string]interface{}{
+			"gw": map[string]interface{}{"ike-rekey-init": "3", "ike-init-out": "1"},
+		},
+		"success": "yes",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error creating message: %v", err)
+	}
+
+	reqs := serveCommand(t, srvr, resp)
+
+	counters, err := s.GetCounters("gw", false)
+	if err != nil {
+		t.Fatalf("Unexpected error getting counters: %v", err)
+	}
+
+	expected := map[string]Counters{
+		"gw": {"ike-rekey-init": 3, "ike-init-out": 1},
+	}
+
+	if !reflect.DeepEqual(counters, expected) {
+		t.Errorf("Unexpected counters.\nExpected: %v\nReceived: %v", expected, counters)
+	}
+
+	p := <-reqs
+	expectedReq := map[string]interface{}{"name": "gw"}
+
+	if !reflect.DeepEqual(p.msg.ToMap(), expectedReq) {
+		t.Errorf("Unexpected request.\nExpected: %v\nReceived: %v", expectedReq, p.msg.ToMap())
+	}
+}
+
+func TestRequireFeature(t *testing.T) {
+	client, srvr := net.Pipe()
+	defer client.Close()
+	defer srvr.Close()
+
+	s := &Session{ctr: &transport{conn: client}}
+
+	version, err := NewMessageFromMap(map[string]interface{}{"daemon": "charon", "version": "5.5.0"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating message: %v", err)
+	}
+
+	// The version is only queried once, so no other command is served
+	reqs := serveCommands(t, srvr, []*Message{version})
+
+	for _, fn := range []func() error{
+		func() error {
+			_, err := s.GetCounters("", true)
+			return err
+		},
+		func() error {
+			_, err := s.Terminate(context.Background(), TerminateOptions{IKE: "gw", Force: true})
+			return err
+		},
+	} {
+		err := fn()
+
+		ve, ok := err.(*VersionError)
+		if !ok {
+			t.Fatalf("Expected *VersionError: received %v", err)
+		}
+
+		if ve.Feature == "" || ve.Actual != "5.5.0" {
+			t.Errorf("Unexpected version error: %+v", ve)
+		}
+	}
+
+	if p := <-reqs; p.name != "version" {
+		t.Errorf("Unexpected command.\nExpected: %v\nReceived: %v", "version", p.name)
+	}
+}
+
+func TestVersionAtLeast(t *testing.T) {
+	tests := []struct {
+		version  string
+		min      string
+		expected bool
+	}{
+		{"5.9.6", "5.9.6", true},
+		{"5.9.14", "5.9.6", true},
+		{"6.0.0rc1", "5.9.6", true},
+		{"5.9.5", "5.9.6", false},
+		{"5.9", "5.9.1", false},
+		{"5.10", "5.9.14", true},
+		{"unknown", "5.9.6", false},
+	}
+
+	for _, tt := range tests {
+		if got := (Version{Version: tt.version}).AtLeast(tt.min); got != tt.expected {
+			t.Errorf("Unexpected result of %v.AtLeast(%v)\nExpected: %v\nReceived: %v", tt.version, tt.min, tt.expected, got)
+		}
+	}
+}
+
+func TestReloadSettingsFailed(t *testing.T) {
+	client, srvr := net.Pipe()
+	defer client.Close()
+	defer srvr.Close()
+
+	s := &Session{ctr: &transport{conn: client}}
+
+	resp, err := NewMessageFromMap(map[string]interface{}{
+		"success": "no",
+		"errmsg":  "reloading 'strongswan.conf' failed",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error creating message: %v", err)
+	}
+
+	reqs := serveCommand(t, srvr, resp)
+
+	if err := s.ReloadSettings(); err == nil {
+		t.Errorf("Expected error when reload failed")
+	}
+
+	if p := <-reqs; p.name != "reload-settings" {
+		t.Errorf("Expected command reload-settings: received %v", p.name)
+	}
+}
@@ -23,19 +23,100 @@ package vici
 import (
 	"errors"
 	"fmt"
+	"strconv"
+	"sync"
+	"time"
 )
 
 var (
 	// Event listener channel was closed
 	errChannelClosed = errors.New("vici: event listener channel closed")
+
+	// An injected event was dropped by middleware
+	errEventDropped = errors.New("vici: event dropped by middleware")
 )
 
+// Event is an event received from the daemon.
+type Event struct {
+	// Name is the event type, e.g. "ike-updown".
+	Name string
+
+	// Message is the event message.
+	Message *Message
+}
+
+// EventMiddleware is called with each event received by the event listener, before the
+// event is delivered. It returns the event to pass on, which may be modified, and a bool
+// indicating if the event should be delivered at all. Middleware can be used for concerns
+// like redaction, enrichment, or sampling of events.
+type EventMiddleware func(Event) (Event, bool)
+
+// LogLevelFilter returns event middleware that drops log and control-log events based on
+// their logging group and level. Like charon's logger configuration, levels maps group
+// names (e.g. "ike" or "knl") to the highest level that is delivered for that group, and
+// the "default" key applies to groups not otherwise listed. Entries of unlisted groups are
+// always delivered if no default is given. Other event types are not affected.
+func LogLevelFilter(levels map[string]int) EventMiddleware {
+	// Copy levels so that the filter is not affected by later changes
+	l := make(map[string]int, len(levels))
+	for k, v := range levels {
+		l[k] = v
+	}
+
+	return func(e Event) (Event, bool) {
+		if e.Name != "log" && e.Name != "control-log" {
+			return e, true
+		}
+
+		if e.Message == nil {
+			return e, true
+		}
+
+		group := stringField(e.Message, "group")
+
+		max, ok := l[group]
+		if !ok {
+			max, ok = l["default"]
+		}
+
+		if !ok {
+			return e, true
+		}
+
+		level, err := strconv.Atoi(stringField(e.Message, "level"))
+		if err != nil {
+			return e, true
+		}
+
+		return e, level <= max
+	}
+}
+
+// EventStats holds statistics about the events of a single type received by a session.
+type EventStats struct {
+	// Number of events received
+	Count uint64
+
+	// Time the last event was received
+	LastSeen time.Time
+}
+
 type eventError struct{ error }
 
 type eventListener struct {
 	*transport
 
-	mc chan *Message
+	// Event channel
+	cmux sync.Mutex
+	mc   *eventChannel
+
+	// Middleware applied to events, in order
+	mwmux sync.RWMutex
+	mw    []*installedMiddleware
+
+	// Statistics by event name
+	smux  sync.Mutex
+	stats map[string]EventStats
 }
 
 func newEventListener(t *transport) *eventListener {
@@ -44,16 +125,200 @@ func newEventListener(t *transport) *eventListener {
 	}
 }
 
-func (el *eventListener) nextEvent() (*Message, error) {
-	m := <-el.mc
-	if m == nil {
-		return nil, errChannelClosed
+// eventChannel is a channel of events delivered to NextEvent, and the state needed to
+// close it safely while events are still being injected.
+type eventChannel struct {
+	c chan Event
+
+	// done is closed once the channel is to be closed. The channel itself is only
+	// closed once no injected event is being sent on it.
+	done    chan struct{}
+	senders int
+	closed  bool
+}
+
+// channel returns the event channel. If create is true, a new channel is created
+// if the current one has been closed. Otherwise, a channel is only created if there
+// is none yet, so that a closed channel is still observed by readers.
+func (el *eventListener) channel(create bool) *eventChannel {
+	el.cmux.Lock()
+	defer el.cmux.Unlock()
+
+	return el.channelLocked(create)
+}
+
+func (el *eventListener) channelLocked(create bool) *eventChannel {
+	if el.mc == nil || (create && el.mc.closed) {
+		// Add small buffer to allow for event processing
+		el.mc = &eventChannel{
+			c:    make(chan Event, 10),
+			done: make(chan struct{}),
+		}
+	}
+
+	return el.mc
+}
+
+func (el *eventListener) closeChannel() {
+	el.cmux.Lock()
+	defer el.cmux.Unlock()
+
+	if ec := el.mc; ec != nil && !ec.closed {
+		ec.closed = true
+		close(ec.done)
+
+		if ec.senders == 0 {
+			close(ec.c)
+		}
 	}
+}
+
+// deliver sends e on the event channel, unless it is closed first, in which case
+// errChannelClosed is returned. A new channel is created if the current one has
+// already been closed.
+func (el *eventListener) deliver(e Event) error {
+	el.cmux.Lock()
+	ec := el.channelLocked(true)
+	ec.senders++
+	el.cmux.Unlock()
 
-	return m, nil
+	defer func() {
+		el.cmux.Lock()
+		defer el.cmux.Unlock()
+
+		ec.senders--
+		if ec.senders == 0 && ec.closed {
+			close(ec.c)
+		}
+	}()
+
+	select {
+	case ec.c <- e:
+		return nil
+	case <-ec.done:
+		return errChannelClosed
+	}
 }
 
-func (el *eventListener) safeListen(events []string) (err error) {
+func (el *eventListener) nextEvent() (Event, error) {
+	e, ok := <-el.channel(false).c
+	if !ok {
+		return Event{}, errChannelClosed
+	}
+
+	return e, nil
+}
+
+// record updates the statistics for the named event type.
+func (el *eventListener) record(name string) {
+	el.smux.Lock()
+	defer el.smux.Unlock()
+
+	if el.stats == nil {
+		el.stats = make(map[string]EventStats)
+	}
+
+	st := el.stats[name]
+	st.Count++
+	st.LastSeen = time.Now()
+
+	el.stats[name] = st
+}
+
+// eventStats returns a snapshot of the event statistics. If reset is true, the
+// statistics are cleared.
+func (el *eventListener) eventStats(reset bool) map[string]EventStats {
+	el.smux.Lock()
+	defer el.smux.Unlock()
+
+	stats := make(map[string]EventStats, len(el.stats))
+	for k, v := range el.stats {
+		stats[k] = v
+	}
+
+	if reset {
+		el.stats = nil
+	}
+
+	return stats
+}
+
+// installedMiddleware is middleware installed on an eventListener. Since functions
+// cannot be compared, middleware is removed by the address of its entry.
+type installedMiddleware struct {
+	fn EventMiddleware
+}
+
+func (el *eventListener) use(mw ...EventMiddleware) {
+	for _, fn := range mw {
+		el.useRemovable(fn)
+	}
+}
+
+// useRemovable installs mw, and returns a function that removes it again.
+func (el *eventListener) useRemovable(mw EventMiddleware) func() {
+	el.mwmux.Lock()
+	defer el.mwmux.Unlock()
+
+	entry := &installedMiddleware{fn: mw}
+	el.mw = append(el.mw, entry)
+
+	return func() {
+		el.mwmux.Lock()
+		defer el.mwmux.Unlock()
+
+		for i, e := range el.mw {
+			if e == entry {
+				el.mw = append(el.mw[:i:i], el.mw[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// applyMiddleware runs e through the installed middleware, and returns the resulting
+// event and whether or not it should be delivered.
+func (el *eventListener) applyMiddleware(e Event) (Event, bool) {
+	el.mwmux.RLock()
+	defer el.mwmux.RUnlock()
+
+	for _, mw := range el.mw {
+		var ok bool
+
+		e, ok = mw.fn(e)
+		if !ok {
+			return e, false
+		}
+	}
+
+	return e, true
+}
+
+func (el *eventListener) safeListen(events []string) error {
+	c := el.channel(true).c
+	defer el.closeChannel()
+
+	return el.safeListenFunc(events, func(e Event) {
+		c <- e
+	})
+}
+
+// inject delivers e to the event channel as if it had been received from the
+// daemon, including applying middleware and recording statistics.
+func (el *eventListener) inject(e Event) error {
+	el.record(e.Name)
+
+	e, ok := el.applyMiddleware(e)
+	if !ok {
+		return errEventDropped
+	}
+
+	return el.deliver(e)
+}
+
+// safeListenFunc registers the given events, and calls fn for each event received
+// until an error occurs.
+func (el *eventListener) safeListenFunc(events []string, fn func(Event)) (err error) {
 	err = el.registerEvents(events)
 	if err != nil {
 		return err
@@ -69,24 +334,25 @@ func (el *eventListener) safeListen(events []string) (err error) {
 		}
 	}()
 
-	el.listen()
+	el.listen(fn)
 
 	return nil
 }
 
-func (el *eventListener) listen() {
-	// Add small buffer to allow for event processing
-	el.mc = make(chan *Message, 10)
-	defer close(el.mc)
-
+func (el *eventListener) listen(fn func(Event)) {
 	for {
 		p, err := el.recv()
 		if err != nil {
 			panic(eventError{err})
 		}
 
-		if p.ptype == pktEvent {
-			el.mc <- p.msg
+		if p.ptype != pktEvent {
+			continue
+		}
+		el.record(p.name)
+
+		if e, ok := el.applyMiddleware(Event{Name: p.name, Message: p.msg}); ok {
+			fn(e)
 		}
 	}
 }
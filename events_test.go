@@ -0,0 +1,202 @@
+// Copyright (C) 2019 Nick Rosbrook
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package vici
+
+import (
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestEventListenerMiddleware(t *testing.T) {
+	el := newEventListener(nil)
+
+	el.use(
+		func(e Event) (Event, bool) {
+			return e, e.Name != "drop"
+		},
+		func(e Event) (Event, bool) {
+			e.Name = "renamed-" + e.Name
+
+			return e, true
+		},
+	)
+
+	e, ok := el.applyMiddleware(Event{Name: "ike-updown"})
+	if !ok {
+		t.Errorf("Expected event to be delivered")
+	}
+
+	if e.Name != "renamed-ike-updown" {
+		t.Errorf("Expected event to be modified by middleware: received %v", e.Name)
+	}
+
+	if _, ok := el.applyMiddleware(Event{Name: "drop"}); ok {
+		t.Errorf("Expected event to be dropped by middleware")
+	}
+}
+
+func TestEventListenerStats(t *testing.T) {
+	el := newEventListener(nil)
+
+	el.record("child-updown")
+	el.record("child-updown")
+	el.record("ike-updown")
+
+	stats := el.eventStats(true)
+	if stats["child-updown"].Count != 2 || stats["ike-updown"].Count != 1 {
+		t.Errorf("Unexpected event counts: %+v", stats)
+	}
+
+	if stats["child-updown"].LastSeen.IsZero() {
+		t.Errorf("Expected last seen time to be set")
+	}
+
+	if stats := el.eventStats(false); len(stats) != 0 {
+		t.Errorf("Expected stats to be reset: %+v", stats)
+	}
+}
+
+func TestEventListenerInject(t *testing.T) {
+	el := newEventListener(nil)
+
+	el.use(func(e Event) (Event, bool) {
+		return e, e.Name != "drop"
+	})
+
+	err := el.inject(Event{Name: "ike-updown", Message: NewMessage()})
+	if err != nil {
+		t.Errorf("Unexpected error injecting event: %v", err)
+	}
+
+	if err := el.inject(Event{Name: "drop"}); err != errEventDropped {
+		t.Errorf("Expected injected event to be dropped: received %v", err)
+	}
+
+	e, err := el.nextEvent()
+	if err != nil {
+		t.Errorf("Unexpected error receiving injected event: %v", err)
+	}
+
+	if e.Name != "ike-updown" {
+		t.Errorf("Received unexpected event: %v", e.Name)
+	}
+
+	el.closeChannel()
+
+	if _, err := el.nextEvent(); err != errChannelClosed {
+		t.Errorf("Expected error after channel was closed: received %v", err)
+	}
+}
+
+func TestLogLevelFilter(t *testing.T) {
+	filter := LogLevelFilter(map[string]int{"ike": 2, "default": 0})
+
+	tests := []struct {
+		name    string
+		group   string
+		level   string
+		deliver bool
+	}{
+		{"log", "ike", "2", true},
+		{"log", "ike", "3", false},
+		{"control-log", "knl", "0", true},
+		{"control-log", "knl", "1", false},
+		{"ike-updown", "knl", "4", true},
+	}
+
+	for _, tt := range tests {
+		m := &Message{
+			keys: []string{"group", "level"},
+			data: map[string]interface{}{
+				"group": tt.group,
+				"level": tt.level,
+			},
+		}
+
+		if _, ok := filter(Event{Name: tt.name, Message: m}); ok != tt.deliver {
+			t.Errorf("Unexpected filter result for %v %v level %v: expected %v", tt.name, tt.group, tt.level, tt.deliver)
+		}
+	}
+}
+
+func TestEventListenerInjectWhileClosing(t *testing.T) {
+	client, srvr := net.Pipe()
+	defer client.Close()
+
+	el := newEventListener(&transport{conn: client})
+
+	// Confirm the event registration, then drop the connection so that
+	// listening stops.
+	go func() {
+		tr := &transport{conn: srvr}
+
+		if _, err := tr.recv(); err != nil {
+			t.Errorf("Unexpected error receiving event registration: %v", err)
+		}
+
+		if err := tr.send(newPacket(pktEventConfirm, "", nil)); err != nil {
+			t.Errorf("Unexpected error confirming event registration: %v", err)
+		}
+
+		srvr.Close()
+	}()
+
+	listening := make(chan error)
+	go func() {
+		listening <- el.safeListen([]string{"ike-updown"})
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 20; j++ {
+				err := el.inject(Event{Name: "ike-updown", Message: NewMessage()})
+				if err != nil && err != errChannelClosed {
+					t.Errorf("Unexpected error injecting event: %v", err)
+				}
+			}
+		}()
+	}
+
+	if err := <-listening; err == nil {
+		t.Errorf("Expected error once the connection was closed")
+	}
+
+	// Drain the events injected after listening stopped, which go to a new channel.
+	injected := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(injected)
+	}()
+
+	for {
+		select {
+		case <-injected:
+			return
+		case <-el.channel(false).c:
+		}
+	}
+}
@@ -22,11 +22,28 @@ package vici
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding"
 	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net"
+	"net/netip"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
 )
 
 const (
@@ -49,6 +66,41 @@ const (
 	msgListEnd
 )
 
+// defaultTagKey identifies the struct tags used for marshaling and unmarshaling.
+const defaultTagKey = "vici"
+
+const (
+	// Maximum length of a key, which is prefixed by a single byte
+	maxKeyLength = 0xff
+
+	// Maximum length of a value or list item, which are prefixed by two bytes
+	maxValueLength = 0xffff
+)
+
+// durationType is handled separately from other int64 types when marshaling.
+var durationType = reflect.TypeOf(time.Duration(0))
+
+var (
+	marshalerType   = reflect.TypeOf((*MessageMarshaler)(nil)).Elem()
+	unmarshalerType = reflect.TypeOf((*MessageUnmarshaler)(nil)).Elem()
+
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// Address types are marshaled in their textual form.
+var (
+	ipType       = reflect.TypeOf(net.IP{})
+	ipNetType    = reflect.TypeOf(net.IPNet{})
+	ipNetPtrType = reflect.TypeOf(&net.IPNet{})
+	addrType     = reflect.TypeOf(netip.Addr{})
+	prefixType   = reflect.TypeOf(netip.Prefix{})
+)
+
+// SkipSection can be returned by a WalkFunc to skip the elements of the section
+// being visited. It is not returned as an error by Walk.
+var SkipSection = errors.New("vici: skip this section")
+
 var (
 	// Generic encoding/decoding and marshaling/unmarshaling errors
 	errEncoding  = errors.New("vici: error encoding message")
@@ -59,6 +111,28 @@ var (
 	// Encountered unsupported type when encoding a message
 	errUnsupportedType = errors.New("vici: unsupported message element type")
 
+	// Keys and values are length-prefixed by one and two bytes, respectively
+	errKeyTooLong   = fmt.Errorf("vici: key exceeds maximum length of %v bytes", maxKeyLength)
+	errValueTooLong = fmt.Errorf("vici: value exceeds maximum length of %v bytes", maxValueLength)
+
+	// A value could not be converted to the requested type
+	errConvertValue = errors.New("vici: cannot convert message value")
+
+	// Tried to append to an element that is not a list
+	errNotList = errors.New("vici: message element is not a list")
+
+	// A key that was expected to exist in a message was not found
+	errKeyNotFound = errors.New("vici: key not found in message")
+
+	// Encountered an unknown merge policy
+	errUnknownMergePolicy = errors.New("vici: unknown merge policy")
+
+	// Encountered a path that does not address a message element
+	errInvalidPath = errors.New("vici: invalid message path")
+
+	// Encountered a duration that does not fit in a time.Duration
+	errDurationOverflow = errors.New("vici: duration out of range")
+
 	// Used in CheckError - the 'success' field was set to "no"
 	errCommandFailed = errors.New("vici: command failed")
 
@@ -73,13 +147,146 @@ var (
 
 	// Marshaling errors
 	errMarshalUnsupportedType = fmt.Errorf("%v: encountered unsupported type", errMarshal)
+	errMarshalInvalid         = fmt.Errorf("%v: validation failed", errMarshal)
 
 	// Unmarshaling errors
 	errUnmarshalBadType      = fmt.Errorf("%v: type must be non-nil pointer", errUnmarshal)
 	errUnmarshalTypeMismatch = fmt.Errorf("%v: incompatible types", errUnmarshal)
 	errUnmarshalNonMessage   = fmt.Errorf("%v: encountered non-message type", errUnmarshal)
+	errUnmarshalMissingField = fmt.Errorf("%v: missing required field", errUnmarshal)
+)
+
+// MergePolicy determines how conflicting elements are handled by Message.Merge.
+type MergePolicy uint8
+
+const (
+	// MergeOverwrite replaces existing elements with those being merged.
+	MergeOverwrite MergePolicy = iota
+
+	// MergeKeepExisting keeps existing elements, ignoring those being merged.
+	MergeKeepExisting
+
+	// MergeAppendLists appends the items of lists being merged to existing lists.
+	// Other conflicting elements are overwritten.
+	MergeAppendLists
 )
 
+// WalkFunc is called by Message.Walk for each message element. path is the list of keys
+// leading to the element, including its own key, and value is the element itself: a
+// string, []string, or *Message.
+type WalkFunc func(path []string, value interface{}) error
+
+// MessageMarshaler is implemented by types that marshal themselves into a message
+// element. MarshalVici must return a string, []string, *Message or RawMessage.
+type MessageMarshaler interface {
+	MarshalVici() (interface{}, error)
+}
+
+// MessageUnmarshaler is implemented by types that unmarshal themselves from a message
+// element. The value passed to UnmarshalVici is a string, []string or *Message.
+type MessageUnmarshaler interface {
+	UnmarshalVici(value interface{}) error
+}
+
+// DecodeLimits restricts the messages accepted when decoding data received from the daemon.
+// A zero value for any limit means that it is not enforced.
+type DecodeLimits struct {
+	// Maximum nesting depth of sections
+	MaxDepth int
+
+	// Maximum number of elements, i.e. key-value pairs, lists, list items and sections
+	MaxElements int
+
+	// Maximum size of an encoded message in bytes
+	MaxSize int
+}
+
+// DecodeLimitError is returned when a message being decoded exceeds one of the
+// configured DecodeLimits.
+type DecodeLimitError struct {
+	// Limit is the name of the limit that was exceeded, i.e. "depth", "elements" or "size".
+	Limit string
+
+	// Max is the configured value of the limit.
+	Max int
+}
+
+func (e *DecodeLimitError) Error() string {
+	return fmt.Sprintf("%v: exceeded %v limit of %v", errDecoding, e.Limit, e.Max)
+}
+
+// decodeOptions control how messages received from the daemon are decoded.
+type decodeOptions struct {
+	limits DecodeLimits
+
+	// If set, keys and values reference the decoded buffer rather than copying it
+	zeroCopy bool
+
+	// If set, nested sections are decoded when first accessed
+	lazy bool
+}
+
+// encodeOptions control how messages are encoded.
+type encodeOptions struct {
+	// Encode the elements of each section ordered by key
+	canonical bool
+}
+
+// decodeState tracks the progress of decoding a message, in order to enforce
+// decode limits.
+type decodeState struct {
+	decodeOptions
+
+	depth    int
+	elements int
+
+	// Set while validating a lazy section, in which case nothing is decoded
+	discard bool
+}
+
+// str returns b as a string. Unless zero-copy decoding is enabled, b is copied.
+// Otherwise, the returned string shares memory with b, so b must not be modified
+// afterwards.
+func (st *decodeState) str(b []byte) string {
+	if st.discard {
+		return ""
+	}
+
+	if !st.zeroCopy || len(b) == 0 {
+		return string(b)
+	}
+
+	return unsafeString(b)
+}
+
+func (st *decodeState) addElement() error {
+	st.elements++
+
+	if st.limits.MaxElements > 0 && st.elements > st.limits.MaxElements {
+		return &DecodeLimitError{Limit: "elements", Max: st.limits.MaxElements}
+	}
+
+	return nil
+}
+
+// enter is called when a section is started, and leave when it is ended.
+func (st *decodeState) enter() error {
+	if err := st.addElement(); err != nil {
+		return err
+	}
+	st.depth++
+
+	if st.limits.MaxDepth > 0 && st.depth > st.limits.MaxDepth {
+		return &DecodeLimitError{Limit: "depth", Max: st.limits.MaxDepth}
+	}
+
+	return nil
+}
+
+func (st *decodeState) leave() {
+	st.depth--
+}
+
 // MessageStream is used to feed continuous data during a command request, and simply
 // contains a slice of *Message.
 type MessageStream struct {
@@ -92,16 +299,67 @@ func (ms *MessageStream) Messages() []*Message {
 	return ms.messages
 }
 
+// RawMessage is a pre-encoded vici message, i.e. the encoded elements of a section
+// as returned by Message.MarshalBinary. A RawMessage can be set as a message element,
+// in which case it is encoded as a section, and its bytes are spliced into the encoded
+// message verbatim. This allows elements to be forwarded, or captured fragments to be
+// embedded, without decoding them first. Once the section is accessed, e.g. with Get or
+// GetSection, it is decoded and replaced by the decoded section, which is then encoded
+// like any other.
+type RawMessage []byte
+
+// message returns the decoded r. The RawMessage is validated when it is added to a
+// Message, so decoding errors are ignored.
+func (r RawMessage) message() *Message {
+	m := NewMessage()
+
+	// nolint
+	m.decode(r)
+
+	return m
+}
+
 // Message represents a vici message.
 //
 // A Message ensures that elements are encoded in the order they are
 // added to the message, through the usage of Set. Valid message elements
 // are key-value pairs, lists, and sections which correspond to the Go types
-// string, []string, and *Message respectively.
+// string, []string, and *Message respectively. Sections may also be given
+// as a RawMessage.
 type Message struct {
 	keys []string
 
 	data map[string]interface{}
+
+	// Set if the message is a section whose decoding was deferred
+	lazy *lazySection
+}
+
+// get returns the element key of m, or nil if it does not exist. A section given as a
+// RawMessage is decoded on first access, and replaced by the decoded section, so that
+// changes made through any accessor are seen by all others.
+func (m *Message) get(key string) interface{} {
+	m.load()
+
+	v := m.data[key]
+	if raw, ok := v.(RawMessage); ok {
+		section := raw.message()
+		m.data[key] = section
+
+		return section
+	}
+
+	return v
+}
+
+// lazySection holds the encoded elements of a section that has not been
+// decoded yet.
+type lazySection struct {
+	once sync.Once
+
+	// Encoded elements, including the section end
+	data []byte
+	opts decodeOptions
 }
 
 // NewMessage returns an empty Message.
@@ -112,13 +370,169 @@ func NewMessage() *Message {
 	}
 }
 
+// NewMessageFromMap returns a Message built from m. Values of m may be strings, lists
+// (given as []string, or []interface{} containing only strings), *Message, or nested
+// map[string]interface{} which are converted into sections. This makes it possible to
+// build messages from e.g. decoded JSON or YAML. Since maps are unordered, elements are
+// added to the Message in order of their keys. An error is returned if an unsupported
+// value type is encountered.
+func NewMessageFromMap(m map[string]interface{}) (*Message, error) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	msg := NewMessage()
+
+	for _, k := range keys {
+		var value interface{}
+
+		switch v := m[k].(type) {
+		case map[string]interface{}:
+			section, err := NewMessageFromMap(v)
+			if err != nil {
+				return nil, err
+			}
+			value = section
+
+		case []interface{}:
+			list := make([]string, 0, len(v))
+			for _, item := range v {
+				s, ok := item.(string)
+				if !ok {
+					return nil, fmt.Errorf("%v: list item of %v is %T", errUnsupportedType, k, item)
+				}
+				list = append(list, s)
+			}
+			value = list
+
+		default:
+			value = v
+		}
+
+		if err := msg.addItem(k, value); err != nil {
+			return nil, fmt.Errorf("%v: %v", err, k)
+		}
+	}
+
+	return msg, nil
+}
+
 // MarshalMessage returns a Message marshaled from v. Only exported fields
 // with a `vici` tag explicitly set are marshaled. An error is returned
 // if v is not a struct (or a pointer to one), or an unsupported Message
 // element type is encountered.
+//
+// Empty fields are not marshaled, unless the "keepempty" option is given in the
+// field's tag, e.g. `vici:"remote_addrs,keepempty"`. This is needed to explicitly
+// clear an option in the daemon. The "omitempty" option, e.g.
+// `vici:"rekey_time,omitempty"`, states the default explicitly, and takes
+// precedence if both options are given. The "default" option, e.g.
+// `vici:"version,default=2"`, gives a value to marshal in place of an empty
+// field. Since options are separated by commas, the value cannot contain one.
+//
+// The fields of embedded structs without a `vici` tag, and of struct fields with
+// the "inline" option, e.g. `vici:",inline"`, are marshaled into the enclosing
+// message rather than a nested section. "flatten" is accepted as a synonym for
+// "inline". UnmarshalMessage handles them likewise.
+//
+// A map with string keys is marshaled as a section, with an element for each
+// entry of the map, ordered by key. This is useful for sections whose keys are
+// chosen by the user, e.g. the children of a connection:
+//
+//	Children map[string]ChildSA `vici:"children"`
+//
+// Values of the map are marshaled like fields, so a map[string]string results
+// in key-value pairs, and a map of structs results in nested sections.
+//
+// Bool fields are marshaled as "yes" or "no", following strongSwan's convention.
+// Since false is empty, the "keepempty" option is needed to send "no". Integer
+// and floating-point fields are marshaled in decimal form. time.Duration fields
+// are marshaled in strongSwan's duration syntax, e.g. "30m" or "4h", and must be
+// a whole number of seconds. net.IP, net.IPNet, netip.Addr and netip.Prefix fields,
+// and slices of them, are marshaled in their textual form, e.g. "10.0.0.0/24".
+//
+// *x509.Certificate fields, and *rsa.PrivateKey, *ecdsa.PrivateKey and
+// ed25519.PrivateKey fields (including crypto.PrivateKey fields holding one),
+// are marshaled in DER form, as expected by load-cert and load-key. Private keys
+// are encoded as PKCS #8. The "pem" option, e.g. `vici:"data,pem"`, marshals them
+// in PEM form instead. []byte fields are marshaled as is.
+//
+// Fields whose type implements MessageMarshaler are marshaled by calling its
+// MarshalVici method. This takes precedence over all of the above. Otherwise,
+// fields whose type implements encoding.TextMarshaler, and slices of them, are
+// marshaled using MarshalText, unless they are handled by one of the above.
+//
+// Pointers to types other than structs, e.g. *string, *int or *bool, marshal
+// the value they point to, and are omitted if nil. This allows a zero value to
+// be sent, while still omitting fields that are not set. With the "keepempty"
+// option, a nil pointer is marshaled as an empty value.
+//
+// A slice of structs is marshaled as a section, with a subsection for each
+// element. The subsections are numbered from 1, unless the "key" option names a
+// key of the struct, e.g. `vici:"children,key=name"`, whose value is used as
+// the name of each subsection instead. UnmarshalMessage handles them likewise.
+//
+// A map with string keys and the "prefix" option, e.g. `vici:"local,prefix"`, is
+// marshaled into the enclosing message, with each entry keyed by the field's key
+// followed by the entry's key. This supports groups of sections such as the
+// authentication rounds of a connection, e.g. local-1 and local-2:
+//
+//	LocalAuth map[string]LocalAuth `vici:"local,prefix"`
+//
+// An entry with an empty key is marshaled as the field's key itself, e.g. local. The
+// prefix option on any other type is an error.
+//
+// If v, or any struct within it, has a Validate() error method, it is called
+// before the struct is marshaled, and any error it returns is returned by
+// MarshalMessage. This allows bad configurations to be caught before they are
+// sent to the daemon.
 func MarshalMessage(v interface{}) (*Message, error) {
+	return MarshalOptions{}.Marshal(v)
+}
+
+// MarshalInto marshals v, as described by MarshalMessage, into the existing message m.
+// Elements of v whose keys already exist in m overwrite them, without changing the order
+// of m, and other elements are appended. This allows typed fragments to be layered with
+// each other, and with elements added by Set. If an error is returned, m is unchanged.
+func (m *Message) MarshalInto(v interface{}) error {
+	msg, err := MarshalMessage(v)
+	if err != nil {
+		return err
+	}
+
+	return m.Merge(msg, MergeOverwrite)
+}
+
+// MarshalOptions configures how Go values are marshaled into messages. The zero
+// value marshals like MarshalMessage.
+type MarshalOptions struct {
+	// DeriveKeys marshals exported fields without a vici tag, using the field
+	// name converted to lower_snake_case as the key, e.g. RekeyTime as rekey_time
+	// and LocalTS as local_ts. A field can still be skipped with `vici:"-"`.
+	DeriveKeys bool
+
+	// TagKey is the struct tag key used instead of "vici", e.g. "json" to reuse
+	// existing tags. The tag is parsed like a vici tag, and unknown options, such
+	// as json's "string", are ignored.
+	TagKey string
+}
+
+// tagKey returns the struct tag key used by o.
+func (o MarshalOptions) tagKey() string {
+	if o.TagKey == "" {
+		return defaultTagKey
+	}
+
+	return o.TagKey
+}
+
+// Marshal returns a Message marshaled from v, as described by MarshalMessage,
+// according to the options o.
+func (o MarshalOptions) Marshal(v interface{}) (*Message, error) {
 	m := NewMessage()
-	if err := m.marshal(v); err != nil {
+	if err := m.marshal(v, o); err != nil {
 		return nil, err
 	}
 
@@ -127,626 +541,2409 @@ func MarshalMessage(v interface{}) (*Message, error) {
 
 // UnmarshalMessage unmarshals m to v. Fields of v are ignored unless
 // explicitly tagged and exported. The underlying value of v should be
-// a pointer to a struct.
+// a pointer to a struct, or to a map with string keys. Unmarshaling into
+// a map[string]interface{} gives a generic view of m, like Message.ToMap,
+// in which sections are nested map[string]interface{} values. Fields of
+// type interface{} are unmarshaled likewise. Pointer fields are only allocated
+// if their key is present, so e.g. a *bool field remains nil if it is not set.
+//
+// If a field has the "required" option, e.g. `vici:"local_ts,required"`, an
+// error is returned if m does not contain its key.
+//
+// A section can be unmarshaled into a map with string keys, which is useful
+// when its keys are not known in advance, e.g. the child SAs of list-sas:
+//
+//	ChildSAs map[string]ChildSA `vici:"child-sas"`
+//
+// A map with the "prefix" option, as described by MarshalMessage, collects each key
+// of m that begins with the field's key, keyed by the remainder of the key, e.g. -1
+// for local-1. Since keys such as local_addrs share the prefix, only keys whose values
+// are sections are collected if the map's values are structs or maps, and only other
+// keys otherwise. The map is left nil if no keys match.
+//
+// Nil maps and pointers are allocated as needed. Bool fields are unmarshaled
+// from "yes", "no", "true", "false", "1" or "0", and numeric fields from their
+// decimal form. An error is returned if a number does not fit in its field.
+// time.Duration fields are unmarshaled from a number of seconds, optionally
+// with a duration suffix. Address fields are parsed from their textual form,
+// and an error is returned if an address is malformed. *x509.Certificate fields
+// are parsed from DER or PEM. Fields whose type, or a pointer to it, implements
+// MessageUnmarshaler are unmarshaled by calling its UnmarshalVici method.
+// Similarly, encoding.TextUnmarshaler is used for key-value pairs and lists.
 func UnmarshalMessage(m *Message, v interface{}) error {
-	return m.unmarshal(v)
+	return UnmarshalOptions{}.Unmarshal(m, v)
 }
 
-// Set sets key to value. An error is returned if value's underlying
-// type is not supported as a Message element type.
-//
-// If the key already exists the value is overwritten, but the ordering
-// of the message is not changed.
-func (m *Message) Set(key string, value interface{}) error {
-	return m.addItem(key, value)
+// UnmarshalSection unmarshals the section of m identified by path to v, as described by
+// UnmarshalMessage. See Message.GetPath for the format of path. This allows only the part
+// of a large response that is needed, e.g. a single child SA of list-sas, to be unmarshaled.
+// An error is returned if path does not identify a section.
+func UnmarshalSection(m *Message, path string, v interface{}) error {
+	section, ok := m.GetPath(path).(*Message)
+	if !ok {
+		return fmt.Errorf("%v: %v is not a section", errInvalidPath, path)
+	}
+
+	return UnmarshalMessage(section, v)
 }
 
-// Get returns the message field identified by key, if it exists. If the
-// field does not exist, nil is returned.
-func (m *Message) Get(key string) interface{} {
-	v, ok := m.data[key]
-	if !ok {
-		return nil
+// UnmarshalMessageTo unmarshals m to a new value of type T, which should be a struct,
+// or a map with string keys, as described by UnmarshalMessage.
+func UnmarshalMessageTo[T any](m *Message) (T, error) {
+	var v T
+	if err := UnmarshalMessage(m, &v); err != nil {
+		var zero T
+		return zero, err
 	}
 
-	return v
+	return v, nil
 }
 
-// Keys returns the list of valid message keys.
-func (m *Message) Keys() []string {
-	return m.keys
+// UnmarshalOptions configures how messages are unmarshaled into Go values. The
+// zero value unmarshals like UnmarshalMessage.
+type UnmarshalOptions struct {
+	// FoldKeys matches message keys to fields case-insensitively, and treats '-'
+	// and '_' as equivalent, e.g. "local-ts" and "LOCAL_TS" both match a field
+	// tagged `vici:"local_ts"`. An exact match is preferred, if there is one.
+	// Different versions and plugins of charon are not always consistent in
+	// their key naming.
+	FoldKeys bool
+
+	// TagKey is the struct tag key used instead of "vici", like MarshalOptions.TagKey.
+	TagKey string
 }
 
-// Err examines a command response Message, and determines if it was successful.
-// If it was, or if the message does not contain a 'success' field, nil is returned. Otherwise,
-// an error is returned using the 'errmsg' field.
-func (m *Message) Err() error {
-	if success, ok := m.data["success"]; ok {
-		if success != "yes" {
-			return fmt.Errorf("%v: %v", errCommandFailed, m.data["errmsg"])
-		}
+// tagKey returns the struct tag key used by o.
+func (o UnmarshalOptions) tagKey() string {
+	if o.TagKey == "" {
+		return defaultTagKey
 	}
 
-	return nil
+	return o.TagKey
 }
 
-func (m *Message) addItem(key string, value interface{}) error {
-	rv := reflect.ValueOf(value)
+// Unmarshal unmarshals m to v, as described by UnmarshalMessage, according to
+// the options o.
+func (o UnmarshalOptions) Unmarshal(m *Message, v interface{}) error {
+	return m.unmarshal(v, o)
+}
 
-	// Check if the key is already set in the message
-	_, exists := m.data[key]
+// MarshalBinary implements encoding.BinaryMarshaler. The returned bytes are the vici
+// encoding of m, as sent to the daemon.
+func (m *Message) MarshalBinary() ([]byte, error) {
+	return m.encode()
+}
 
-	switch rv.Kind() {
+// MarshalCanonical returns the vici encoding of m in canonical form, in which the elements
+// of each section, including those of raw sections, are ordered by key. Messages with the
+// same elements therefore have the same canonical encoding, regardless of the order in
+// which the elements were added. m itself is not modified.
+func (m *Message) MarshalCanonical() ([]byte, error) {
+	return m.encodeWithOptions(encodeOptions{canonical: true})
+}
 
-	case reflect.String:
-		m.data[key] = value.(string)
+// UnmarshalBinary implements encoding.BinaryUnmarshaler. It decodes data, which must
+// be a vici encoded message, into m. Any existing elements of m are discarded.
+func (m *Message) UnmarshalBinary(data []byte) error {
+	msg := NewMessage()
+	if err := msg.decode(data); err != nil {
+		return err
+	}
+	*m = *msg
 
-	case reflect.Slice, reflect.Array:
-		list, ok := value.([]string)
-		if !ok {
-			return errUnsupportedType
-		}
-		m.data[key] = list
+	return nil
+}
 
-	case reflect.Ptr:
-		msg, ok := value.(*Message)
-		if !ok {
-			return errUnsupportedType
-		}
-		m.data[key] = msg
+// Set sets key to value. An error is returned if value's underlying
+// type is not supported as a Message element type. In addition to the
+// element types described by Message, a []byte may be given as the
+// value of a key-value pair.
+//
+// If the key already exists the value is overwritten, but the ordering
+// of the message is not changed.
+func (m *Message) Set(key string, value interface{}) error {
+	m.load()
 
-	default:
-		return errUnsupportedType
-	}
+	return m.addItem(key, value)
+}
 
-	// Only append to keys if this is a new key.
+// Append appends items to the list identified by key. If key does not exist, a new
+// list is created. An error is returned if key exists but is not a list.
+func (m *Message) Append(key string, items ...string) error {
+	m.load()
+
+	v, exists := m.data[key]
 	if !exists {
-		m.keys = append(m.keys, key)
+		return m.addItem(key, append([]string{}, items...))
 	}
 
-	return nil
-}
+	list, ok := v.([]string)
+	if !ok {
+		return fmt.Errorf("%v: %v", errNotList, key)
+	}
 
-type messageElement struct {
-	k string
-	v interface{}
+	// Do not modify the existing list, since it may be shared
+	appended := make([]string, 0, len(list)+len(items))
+	appended = append(appended, list...)
+	appended = append(appended, items...)
+
+	return m.addItem(key, appended)
 }
 
-func (m *Message) elements() chan messageElement {
-	c := make(chan messageElement)
-	go m.orderedIterate(c)
+// SetBefore behaves like Set, but key is positioned immediately before mark in the
+// message ordering. If key already exists it is moved. An error is returned if mark
+// does not exist.
+func (m *Message) SetBefore(mark, key string, value interface{}) error {
+	return m.setAt(mark, 0, key, value)
+}
 
-	return c
+// SetAfter behaves like Set, but key is positioned immediately after mark in the
+// message ordering. If key already exists it is moved. An error is returned if mark
+// does not exist.
+func (m *Message) SetAfter(mark, key string, value interface{}) error {
+	return m.setAt(mark, 1, key, value)
 }
 
-func (m *Message) orderedIterate(c chan messageElement) {
-	defer close(c)
+// setAt sets key to value, and positions it at the index of mark plus offset.
+func (m *Message) setAt(mark string, offset int, key string, value interface{}) error {
+	m.load()
+
+	if _, ok := m.data[mark]; !ok || mark == key {
+		return fmt.Errorf("%v: %v", errKeyNotFound, mark)
+	}
+
+	if err := m.addItem(key, value); err != nil {
+		return err
+	}
 
+	// Remove key from its current position, and insert it relative to mark
+	keys := make([]string, 0, len(m.keys))
 	for _, k := range m.keys {
-		c <- messageElement{k, m.data[k]}
+		if k != key {
+			keys = append(keys, k)
+		}
 	}
-}
 
-func (m *Message) encode() ([]byte, error) {
-	buf := bytes.NewBuffer([]byte{})
+	i := 0
+	for i < len(keys) && keys[i] != mark {
+		i++
+	}
+	i += offset
 
-	for e := range m.elements() {
-		k := e.k
-		v := e.v
+	keys = append(keys, "")
+	copy(keys[i+1:], keys[i:])
+	keys[i] = key
 
-		rv := reflect.ValueOf(v)
+	m.keys = keys
 
-		var (
-			data []byte
-			err  error
-		)
+	return nil
+}
 
-		switch rv.Kind() {
+// Has returns true if key is set in the message. Unlike checking the result of Get, this
+// distinguishes a key that is set to an empty value from one that is not set at all.
+func (m *Message) Has(key string) bool {
+	m.load()
 
-		case reflect.String:
-			uv := v.(string)
+	_, ok := m.data[key]
 
-			data, err = m.encodeKeyValue(k, uv)
-			if err != nil {
-				return []byte{}, err
-			}
+	return ok
+}
 
-		case reflect.Slice, reflect.Array:
-			uv := v.([]string)
+// Get returns the message field identified by key, if it exists. If the
+// field does not exist, nil is returned.
+func (m *Message) Get(key string) interface{} {
+	return m.get(key)
+}
 
-			data, err = m.encodeList(k, uv)
-			if err != nil {
-				return []byte{}, err
-			}
+// GetString returns the value of key if it exists and is a string. The returned bool
+// is false if key does not exist, or is not a key-value pair.
+func (m *Message) GetString(key string) (string, bool) {
+	m.load()
 
-		case reflect.Ptr:
-			uv, ok := v.(*Message)
-			if !ok {
-				return []byte{}, errUnsupportedType
-			}
+	v, ok := m.data[key].(string)
 
-			data, err = m.encodeSection(k, uv)
-			if err != nil {
-				return []byte{}, err
-			}
+	return v, ok
+}
 
-		default:
-			return []byte{}, errUnsupportedType
-		}
+// GetList returns the value of key if it exists and is a list. The returned bool is
+// false if key does not exist, or is not a list.
+func (m *Message) GetList(key string) ([]string, bool) {
+	m.load()
 
-		_, err = buf.Write(data)
-		if err != nil {
-			return []byte{}, fmt.Errorf("%v: %v", errEncoding, err)
-		}
-	}
+	v, ok := m.data[key].([]string)
 
-	return buf.Bytes(), nil
+	return v, ok
 }
 
-func (m *Message) decode(data []byte) error {
-	buf := bytes.NewBuffer(data)
+// GetBytes returns the value of key if it exists and is a key-value pair. Since vici values
+// may contain arbitrary binary data, e.g. DER encoded certificates, this is an alternative
+// to GetString for binary values. The returned slice is a copy of the value.
+func (m *Message) GetBytes(key string) ([]byte, bool) {
+	v, ok := m.GetString(key)
+	if !ok {
+		return nil, false
+	}
 
-	b, err := buf.ReadByte()
-	if err != nil && err != io.EOF {
-		return fmt.Errorf("%v: %v", errDecoding, err)
+	return []byte(v), true
+}
+
+// GetStringDefault returns the value of key if it exists and is a string. Otherwise, def
+// is returned.
+func (m *Message) GetStringDefault(key, def string) string {
+	if v, ok := m.GetString(key); ok {
+		return v
 	}
 
-	for buf.Len() > 0 {
-		// Determine the next message element
-		switch b {
+	return def
+}
 
-		case msgKeyValue:
-			n, err := m.decodeKeyValue(buf.Bytes())
-			if err != nil {
-				return err
-			}
-			buf.Next(n)
+// GetListDefault returns the value of key if it exists and is a list. Otherwise, def
+// is returned.
+func (m *Message) GetListDefault(key string, def []string) []string {
+	if v, ok := m.GetList(key); ok {
+		return v
+	}
 
-		case msgListStart:
-			n, err := m.decodeList(buf.Bytes())
-			if err != nil {
-				return err
-			}
-			buf.Next(n)
+	return def
+}
 
-		case msgSectionStart:
-			n, err := m.decodeSection(buf.Bytes())
-			if err != nil {
-				return err
-			}
-			buf.Next(n)
-		}
+// GetBool returns the value of key as a bool. vici uses "yes" and "no" for boolean
+// values, but "true", "false", "1" and "0" are also accepted. An error is returned if
+// key is not set, or its value is not a valid boolean.
+func (m *Message) GetBool(key string) (bool, error) {
+	v, err := m.getValue(key)
+	if err != nil {
+		return false, err
+	}
 
-		b, err = buf.ReadByte()
-		if err != nil && err != io.EOF {
-			return fmt.Errorf("%v: %v", errDecoding, err)
-		}
+	b, ok := parseBool(v)
+	if !ok {
+		return false, fmt.Errorf("%v: %v=%q is not a bool", errConvertValue, key, v)
 	}
 
-	return nil
+	return b, nil
 }
 
-// encodeKeyValue will return a byte slice of an encoded key-value pair.
-//
-// The size of the byte slice is the length of the key and value, plus four bytes:
-// one byte for message element type, one byte for key length, and two bytes for value
-// length.
-func (m *Message) encodeKeyValue(key, value string) ([]byte, error) {
-	// Initialize buffer to indictate the message element type
-	// is a key-value pair
-	buf := bytes.NewBuffer([]byte{msgKeyValue})
-
-	// Write the key length and key
-	err := buf.WriteByte(uint8(len(key)))
+// GetInt returns the value of key, a decimal string, as an int. An error is returned if
+// key is not set, or its value is not a valid int.
+func (m *Message) GetInt(key string) (int, error) {
+	v, err := m.getValue(key)
 	if err != nil {
-		return []byte{}, fmt.Errorf("%v: %v", errEncoding, err)
+		return 0, err
 	}
 
-	_, err = buf.WriteString(key)
+	i, err := strconv.Atoi(v)
 	if err != nil {
-		return []byte{}, fmt.Errorf("%v: %v", errEncoding, err)
+		return 0, fmt.Errorf("%v: %v", errConvertValue, err)
 	}
 
-	// Write the value's length to the buffer as two bytes
-	vl := make([]byte, 2)
-	binary.BigEndian.PutUint16(vl, uint16(len(value)))
+	return i, nil
+}
 
-	_, err = buf.Write(vl)
+// GetUint64 returns the value of key, a decimal string, as a uint64. This is useful for
+// e.g. byte and packet counters. An error is returned if key is not set, or its value is
+// not a valid uint64.
+func (m *Message) GetUint64(key string) (uint64, error) {
+	v, err := m.getValue(key)
 	if err != nil {
-		return []byte{}, fmt.Errorf("%v: %v", errEncoding, err)
+		return 0, err
 	}
 
-	// Write the value to the buffer
-	_, err = buf.WriteString(value)
+	u, err := strconv.ParseUint(v, 10, 64)
 	if err != nil {
-		return []byte{}, fmt.Errorf("%v: %v", errEncoding, err)
+		return 0, fmt.Errorf("%v: %v", errConvertValue, err)
 	}
 
-	return buf.Bytes(), nil
+	return u, nil
 }
 
-// encodeList will return a byte slice of an encoded list.
-//
-// The size of the byte slice is the length of the key and total length of
-// the list (sum of length of the items in the list), plus three bytes for each
-// list item: one for message element type, and two for item length. Another three
-// bytes are used to indicate list start and list stop, and the length of the key.
-func (m *Message) encodeList(key string, list []string) ([]byte, error) {
-	// Initialize buffer to indictate the message element type
-	// is the start of a list
-	buf := bytes.NewBuffer([]byte{msgListStart})
-
-	// Write the key length and key
-	err := buf.WriteByte(uint8(len(key)))
+// GetDuration returns the value of key, a number of seconds as used by e.g. "rekey-time"
+// or "established", as a time.Duration. The number may have one of strongSwan's duration
+// suffixes: s, m, h or d. An error is returned if key is not set, or its value is not a
+// valid duration.
+func (m *Message) GetDuration(key string) (time.Duration, error) {
+	v, err := m.getValue(key)
 	if err != nil {
-		return []byte{}, fmt.Errorf("%v: %v", errEncoding, err)
+		return 0, err
 	}
 
-	_, err = buf.WriteString(key)
+	d, err := parseDuration(v)
 	if err != nil {
-		return []byte{}, fmt.Errorf("%v: %v", errEncoding, err)
+		return 0, fmt.Errorf("%v: %v", errConvertValue, err)
 	}
 
-	for _, item := range list {
-		// Indicate that this is a list item
-		err = buf.WriteByte(msgListItem)
-		if err != nil {
-			return []byte{}, fmt.Errorf("%v: %v", errEncoding, err)
-		}
+	return d, nil
+}
 
-		// Write the item's length to the buffer as two bytes
-		il := make([]byte, 2)
-		binary.BigEndian.PutUint16(il, uint16(len(item)))
+// durationUnits are the suffixes understood by strongSwan for durations, largest first.
+var durationUnits = []struct {
+	suffix string
+	unit   time.Duration
+}{
+	{"d", 24 * time.Hour},
+	{"h", time.Hour},
+	{"m", time.Minute},
+	{"s", time.Second},
+}
 
-		_, err = buf.Write(il)
-		if err != nil {
-			return []byte{}, fmt.Errorf("%v: %v", errEncoding, err)
-		}
+// parseDuration parses a number of seconds, optionally followed by one of strongSwan's
+// duration suffixes.
+func parseDuration(s string) (time.Duration, error) {
+	orig := s
+	unit := time.Second
 
-		// Write the item to the buffer
-		_, err = buf.WriteString(item)
-		if err != nil {
-			return []byte{}, fmt.Errorf("%v: %v", errEncoding, err)
+	for _, u := range durationUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSuffix(s, u.suffix)
+			unit = u.unit
+
+			break
 		}
 	}
 
-	// Indicate the end of the list
-	err = buf.WriteByte(msgListEnd)
+	n, err := strconv.ParseInt(s, 10, 64)
 	if err != nil {
-		return []byte{}, fmt.Errorf("%v: %v", errEncoding, err)
+		return 0, err
 	}
 
-	return buf.Bytes(), nil
+	if n > math.MaxInt64/int64(unit) || n < math.MinInt64/int64(unit) {
+		return 0, fmt.Errorf("%v: %v", errDurationOverflow, orig)
+	}
+
+	return time.Duration(n) * unit, nil
 }
 
-// encodeSection will return a byte slice of an encoded section
-func (m *Message) encodeSection(key string, section *Message) ([]byte, error) {
-	// Initialize buffer to indictate the message element type
-	// is the start of a section
-	buf := bytes.NewBuffer([]byte{msgSectionStart})
+// Credential types are marshaled in their DER or PEM encoding, as expected by
+// e.g. load-cert and load-key.
+var (
+	certificateType = reflect.TypeOf(&x509.Certificate{})
+	rsaKeyType      = reflect.TypeOf(&rsa.PrivateKey{})
+	ecdsaKeyType    = reflect.TypeOf(&ecdsa.PrivateKey{})
+	ed25519KeyType  = reflect.TypeOf(ed25519.PrivateKey{})
+)
 
-	// Write the key length and key
-	err := buf.WriteByte(uint8(len(key)))
-	if err != nil {
-		return []byte{}, fmt.Errorf("%v: %v", errEncoding, err)
+// isCredentialType returns true if t is a certificate or private key type supported
+// by MarshalMessage.
+func isCredentialType(t reflect.Type) bool {
+	switch t {
+	case certificateType, rsaKeyType, ecdsaKeyType, ed25519KeyType:
+		return true
 	}
 
-	_, err = buf.WriteString(key)
-	if err != nil {
-		return []byte{}, fmt.Errorf("%v: %v", errEncoding, err)
+	return false
+}
+
+// formatCredential returns the DER encoding of the certificate or private key rv,
+// or its PEM encoding if pem is true. Private keys are encoded in PKCS #8 form.
+func formatCredential(rv reflect.Value, pemEncode bool) (string, error) {
+	if rv.Kind() == reflect.Ptr && rv.IsNil() {
+		return "", fmt.Errorf("%v: nil %v", errMarshal, rv.Type())
 	}
 
-	// Encode the sections elements
-	for e := range section.elements() {
-		k := e.k
-		v := e.v
+	var block *pem.Block
 
-		rv := reflect.ValueOf(v)
+	if cert, ok := rv.Interface().(*x509.Certificate); ok {
+		block = &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}
+	} else {
+		der, err := x509.MarshalPKCS8PrivateKey(rv.Interface())
+		if err != nil {
+			return "", fmt.Errorf("%v: %v", errMarshal, err)
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	}
 
-		var data []byte
+	if pemEncode {
+		return string(pem.EncodeToMemory(block)), nil
+	}
 
-		switch rv.Kind() {
+	return string(block.Bytes), nil
+}
 
-		case reflect.String:
-			uv := v.(string)
+// parseCertificate parses a DER or PEM encoded certificate.
+func parseCertificate(s string) (*x509.Certificate, error) {
+	der := []byte(s)
 
-			data, err = m.encodeKeyValue(k, uv)
-			if err != nil {
-				return []byte{}, err
-			}
+	if block, _ := pem.Decode(der); block != nil {
+		der = block.Bytes
+	}
 
-		case reflect.Slice, reflect.Array:
-			uv := v.([]string)
+	return x509.ParseCertificate(der)
+}
 
-			data, err = m.encodeList(k, uv)
-			if err != nil {
-				return []byte{}, err
-			}
+// isAddressType returns true if t is one of the IP address or prefix types supported
+// by MarshalMessage.
+func isAddressType(t reflect.Type) bool {
+	switch t {
+	case ipType, ipNetType, ipNetPtrType, addrType, prefixType:
+		return true
+	}
 
-		case reflect.Ptr:
-			uv, ok := v.(*Message)
-			if !ok {
-				return []byte{}, errUnsupportedType
-			}
+	return false
+}
 
-			data, err = m.encodeSection(k, uv)
-			if err != nil {
-				return []byte{}, err
-			}
+// formatAddress returns the textual form of the address or prefix rv.
+func formatAddress(rv reflect.Value) (string, error) {
+	switch v := rv.Interface().(type) {
+	case net.IP:
+		if len(v) != net.IPv4len && len(v) != net.IPv6len {
+			return "", fmt.Errorf("%v: invalid IP address %v", errMarshal, v)
+		}
 
-		default:
-			return []byte{}, errUnsupportedType
+		return v.String(), nil
+
+	case net.IPNet:
+		return v.String(), nil
+
+	case *net.IPNet:
+		return v.String(), nil
+
+	case netip.Addr:
+		if !v.IsValid() {
+			return "", fmt.Errorf("%v: invalid IP address", errMarshal)
 		}
 
-		_, err = buf.Write(data)
-		if err != nil {
-			return []byte{}, fmt.Errorf("%v: %v", errEncoding, err)
+		return v.String(), nil
+
+	case netip.Prefix:
+		if !v.IsValid() {
+			return "", fmt.Errorf("%v: invalid IP prefix", errMarshal)
 		}
 
+		return v.String(), nil
+	}
+
+	return "", fmt.Errorf("%v: %v", errMarshalUnsupportedType, rv.Type())
+}
+
+// parseAddress parses s into field, which must be one of the address types.
+func parseAddress(field reflect.Value, s string) error {
+	var (
+		v   interface{}
+		err error
+	)
+
+	switch field.Type() {
+	case ipType:
+		ip := net.ParseIP(s)
+		if ip == nil {
+			err = fmt.Errorf("invalid IP address %q", s)
+		}
+		v = ip
+
+	case ipNetType, ipNetPtrType:
+		var n *net.IPNet
+		_, n, err = net.ParseCIDR(s)
+		v = n
+		if err == nil && field.Type() == ipNetType {
+			v = *n
+		}
+
+	case addrType:
+		v, err = netip.ParseAddr(s)
+
+	case prefixType:
+		v, err = netip.ParsePrefix(s)
 	}
 
-	// Indicate the end of the section
-	err = buf.WriteByte(msgSectionEnd)
 	if err != nil {
-		return []byte{}, fmt.Errorf("%v: %v", errEncoding, err)
+		return fmt.Errorf("%v: %v", errUnmarshal, err)
 	}
+	field.Set(reflect.ValueOf(v))
 
-	return buf.Bytes(), nil
+	return nil
 }
 
-// decodeKeyValue will decode a key-value pair and write it to the message's
-// data, and returns the number of bytes decoded.
-func (m *Message) decodeKeyValue(data []byte) (int, error) {
-	buf := bytes.NewBuffer(data)
-
-	// Read the key from the buffer
-	n, err := buf.ReadByte()
-	if err != nil {
-		return -1, fmt.Errorf("%v: %v", errDecoding, err)
+// formatDuration formats d using the largest of strongSwan's duration suffixes that
+// represents it exactly. strongSwan durations have a resolution of one second.
+func formatDuration(d time.Duration) (string, error) {
+	if d%time.Second != 0 {
+		return "", fmt.Errorf("duration %v is not a whole number of seconds", d)
 	}
 
-	keyLen := int(n)
-	key := string(buf.Next(keyLen))
-	if len(key) != keyLen {
-		return -1, errBadKey
+	for _, u := range durationUnits {
+		if d%u.unit == 0 {
+			return strconv.FormatInt(int64(d/u.unit), 10) + u.suffix, nil
+		}
 	}
 
-	// Read the value's length
-	v := buf.Next(2)
-	if len(v) != 2 {
-		return -1, errEndOfBuffer
+	return "", nil
+}
 
-	}
+// getValue returns the value of key, which must be a key-value pair.
+func (m *Message) getValue(key string) (string, error) {
+	m.load()
 
-	// Read the value from the buffer
-	valueLen := int(binary.BigEndian.Uint16(v))
-	value := string(buf.Next(valueLen))
-	if len(value) != valueLen {
-		return -1, errBadValue
+	v, ok := m.data[key]
+	if !ok {
+		return "", fmt.Errorf("%v: %v", errKeyNotFound, key)
 	}
 
-	err = m.addItem(key, value)
-	if err != nil {
-		return -1, fmt.Errorf("%v: %v", errDecoding, err)
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("%v: %v is not a key-value pair", errConvertValue, key)
 	}
 
-	// Return the length of the key and value, plus the three bytes for their
-	// lengths
-	return keyLen + valueLen + 3, nil
+	return s, nil
 }
 
-// decodeList will decode a list and write it to the message's data, and return
-// the number of bytes decoded.
-func (m *Message) decodeList(data []byte) (int, error) {
-	var list []string
-
-	buf := bytes.NewBuffer(data)
+// parseBool parses the boolean representations used by vici.
+func parseBool(s string) (bool, bool) {
+	switch strings.ToLower(s) {
+	case "yes", "true", "1":
+		return true, true
 
-	// Read the key from the buffer
-	n, err := buf.ReadByte()
-	if err != nil {
-		return -1, fmt.Errorf("%v: %v", errDecoding, err)
+	case "no", "false", "0":
+		return false, true
 	}
 
-	keyLen := int(n)
-	key := string(buf.Next(keyLen))
-	if len(key) != keyLen {
-		return -1, errBadKey
-	}
+	return false, false
+}
 
-	b, err := buf.ReadByte()
-	if err != nil {
-		return -1, fmt.Errorf("%v: %v", errDecoding, err)
-	}
+// GetSection returns the value of key if it exists and is a section. The returned bool
+// is false if key does not exist, or is not a section. A RawMessage is returned decoded.
+func (m *Message) GetSection(key string) (*Message, bool) {
+	v, ok := m.get(key).(*Message)
 
-	// Keep track of bytes decoded
-	count := keyLen + 2
+	return v, ok
+}
 
-	// Read the list from the buffer
-	for b != msgListEnd {
-		// Ensure this is the beginning of a list item
-		if b != msgListItem {
-			return -1, errExpectedBeginning
-		}
+// GetPath returns the message element identified by path, a dot-separated list of keys
+// that traverses nested sections, e.g. "children.net-net.remote-ts". If any element along
+// the path does not exist, or is not a section, nil is returned. Keys that contain a dot
+// cannot be addressed by GetPath. Sections given as a RawMessage are traversed, and
+// returned, decoded.
+func (m *Message) GetPath(path string) interface{} {
+	keys := strings.Split(path, ".")
 
-		// Read the value's length
-		v := buf.Next(2)
-		if len(v) != 2 {
-			return -1, errEndOfBuffer
+	section := m
+	for _, k := range keys[:len(keys)-1] {
+		var ok bool
 
+		section, ok = section.GetSection(k)
+		if !ok {
+			return nil
 		}
+	}
 
-		// Read the value from the buffer
-		valueLen := int(binary.BigEndian.Uint16(v))
-		value := string(buf.Next(valueLen))
-		if len(value) != valueLen {
-			return -1, errBadValue
-		}
+	return section.Get(keys[len(keys)-1])
+}
 
-		list = append(list, value)
+// SetPath sets the message element identified by path to value. See GetPath for the
+// format of path. Sections along the path are created if they do not exist. An error is
+// returned if an element along the path exists but is not a section, or if value's
+// underlying type is not supported as a Message element type. If an error is returned,
+// m is unchanged.
+func (m *Message) SetPath(path string, value interface{}) error {
+	keys := strings.Split(path, ".")
+	last := len(keys) - 1
+
+	// Find the deepest section along the path that already exists
+	section := m
+	i := 0
+	for ; i < last; i++ {
+		section.load()
+
+		if _, exists := section.data[keys[i]]; !exists {
+			break
+		}
 
-		b, err = buf.ReadByte()
-		if err != nil {
-			return -1, fmt.Errorf("%v: %v", errDecoding, err)
+		next, ok := section.get(keys[i]).(*Message)
+		if !ok {
+			return fmt.Errorf("%v: %v is not a section", errInvalidPath, keys[i])
 		}
+		section = next
+	}
+	section.load()
 
-		count += valueLen + 3
+	if i == last {
+		return section.addItem(keys[last], value)
 	}
 
-	err = m.addItem(key, list)
-	if err != nil {
-		return -1, fmt.Errorf("%v: %v", errDecoding, err)
+	// The missing sections are built separately, and only added once value has been
+	// set, so that nothing is added if value is invalid.
+	next := NewMessage()
+	if err := next.addItem(keys[last], value); err != nil {
+		return err
 	}
 
-	return count, nil
+	for j := last - 1; j > i; j-- {
+		parent := NewMessage()
+		if err := parent.addItem(keys[j], next); err != nil {
+			return err
+		}
+		next = parent
+	}
+
+	return section.addItem(keys[i], next)
 }
 
-// decodeSection will decode a section into a message's data, and return the number
-// of bytes decoded.
-func (m *Message) decodeSection(data []byte) (int, error) {
-	section := NewMessage()
+// Keys returns the list of valid message keys.
+func (m *Message) Keys() []string {
+	m.load()
 
-	buf := bytes.NewBuffer(data)
+	return m.keys
+}
 
-	// Read the key from the buffer
-	n, err := buf.ReadByte()
-	if err != nil {
-		return -1, fmt.Errorf("%v: %v", errDecoding, err)
-	}
+// SortKeys orders the elements of m by key, recursing into sections. Since keys are unique
+// within a section, the resulting order is deterministic. Raw sections are decoded and
+// replaced by their sorted equivalent.
+func (m *Message) SortKeys() {
+	m.load()
 
-	keyLen := int(n)
-	key := string(buf.Next(keyLen))
-	if len(key) != keyLen {
-		return -1, errBadKey
-	}
+	sort.Strings(m.keys)
 
-	b, err := buf.ReadByte()
-	if err != nil {
-		return -1, fmt.Errorf("%v: %v", errDecoding, err)
+	for _, k := range m.keys {
+		switch v := m.data[k].(type) {
+		case RawMessage:
+			section := v.message()
+			section.SortKeys()
+			m.data[k] = section
+
+		case *Message:
+			v.SortKeys()
+		}
 	}
+}
 
-	// Keep track of bytes decoded
-	count := keyLen + 2
+// EncodedLen returns the length in bytes of m when encoded, without encoding it. Since
+// the daemon limits the size of packets it accepts (512KB by default), this can be used to
+// validate large messages, or split work across multiple requests, beforehand.
+func (m *Message) EncodedLen() int {
+	m.load()
 
-	for b != msgSectionEnd {
-		// Determine the next message element
-		switch b {
+	n := 0
 
-		case msgKeyValue:
-			n, err := section.decodeKeyValue(buf.Bytes())
-			if err != nil {
-				return -1, err
-			}
-			// Skip those decoded bytes
-			buf.Next(n)
+	for _, k := range m.keys {
+		// Element type, key length and key
+		n += 2 + len(k)
 
-			count += n
+		switch v := m.data[k].(type) {
+		case string:
+			n += 2 + len(v)
 
-		case msgListStart:
-			n, err := section.decodeList(buf.Bytes())
-			if err != nil {
-				return -1, err
+		case []string:
+			for _, item := range v {
+				// Item type, length and item
+				n += 3 + len(item)
 			}
-			// Skip those decoded bytes
-			buf.Next(n)
+			// List end
+			n++
 
-			count += n
+		case *Message:
+			// Section elements and section end
+			n += v.EncodedLen() + 1
 
-		case msgSectionStart:
-			n, err := section.decodeSection(buf.Bytes())
-			if err != nil {
-				return -1, err
-			}
-			// Skip those decoded bytes
-			buf.Next(n)
+		case RawMessage:
+			n += len(v) + 1
+		}
+	}
 
-			count += n
+	return n
+}
 
-		default:
-			return -1, errExpectedBeginning
-		}
+// NumElements returns the number of elements in m, including the elements of nested
+// sections. Each key-value pair, list, list item, and section counts as one element,
+// as with DecodeLimits.
+func (m *Message) NumElements() int {
+	m.load()
 
-		b, err = buf.ReadByte()
-		if err != nil {
-			return -1, fmt.Errorf("%v: %v", errDecoding, err)
-		}
+	n := len(m.keys)
 
-		count++
-	}
+	for _, v := range m.data {
+		switch v := v.(type) {
+		case []string:
+			n += len(v)
 
-	err = m.addItem(key, section)
-	if err != nil {
-		return -1, err
+		case *Message:
+			n += v.NumElements()
+
+		case RawMessage:
+			n += v.message().NumElements()
+		}
 	}
 
-	return count, nil
+	return n
 }
 
-// messageTag is used for parsing struct tags in marshaling Messages
-type messageTag struct {
-	name string
+// Clone returns a deep copy of m. Nested sections and lists are copied, so the
+// returned Message does not share any data with m.
+func (m *Message) Clone() *Message {
+	m.load()
 
-	skip bool
-}
+	c := &Message{
+		keys: make([]string, len(m.keys)),
+		data: make(map[string]interface{}, len(m.data)),
+	}
+	copy(c.keys, m.keys)
 
-func newMessageTag(tag reflect.StructTag) messageTag {
-	t := tag.Get("vici")
-	if t == "-" || t == "" {
-		return messageTag{skip: true}
+	for k, v := range m.data {
+		c.data[k] = cloneElement(v)
 	}
 
-	return messageTag{name: t}
+	return c
+}
+
+// Merge recursively merges other into m. Elements of other that do not exist in m are
+// appended to m, and sections that exist in both are merged. Other conflicting elements
+// are resolved according to policy. Elements are copied from other, so m does not share
+// any data with other after the merge.
+func (m *Message) Merge(other *Message, policy MergePolicy) error {
+	m.load()
+	other.load()
+
+	if policy > MergeAppendLists {
+		return fmt.Errorf("%v: %v", errUnknownMergePolicy, policy)
+	}
+
+	for _, k := range other.keys {
+		ov := other.get(k)
+
+		if _, exists := m.data[k]; !exists {
+			if err := m.addItem(k, cloneElement(ov)); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		v := m.get(k)
+
+		// Merge sections that exist in both
+		section, ok := v.(*Message)
+		osection, ook := ov.(*Message)
+		if ok && ook {
+			if err := section.Merge(osection, policy); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		switch policy {
+		case MergeKeepExisting:
+			continue
+
+		case MergeAppendLists:
+			list, ok := v.([]string)
+			olist, ook := ov.([]string)
+			if ok && ook {
+				merged := make([]string, 0, len(list)+len(olist))
+				merged = append(merged, list...)
+				merged = append(merged, olist...)
+				m.data[k] = merged
+
+				continue
+			}
+		}
+
+		if err := m.addItem(k, cloneElement(ov)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// cloneElement returns a deep copy of a message element value.
+func cloneElement(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []string:
+		list := make([]string, len(v))
+		copy(list, v)
+
+		return list
+
+	case *Message:
+		return v.Clone()
+
+	case RawMessage:
+		return append(RawMessage{}, v...)
+
+	default:
+		return v
+	}
+}
+
+// ToMap returns the contents of m as a map. Key-value pairs are given as string, lists as
+// []string, and sections are expanded as nested map[string]interface{}. The returned map
+// does not share any data with m. Note that the ordering of m is not preserved.
+func (m *Message) ToMap() map[string]interface{} {
+	m.load()
+
+	mm := make(map[string]interface{}, len(m.data))
+
+	for _, k := range m.keys {
+		v := m.get(k)
+		if section, ok := v.(*Message); ok {
+			mm[k] = section.ToMap()
+
+			continue
+		}
+
+		mm[k] = cloneElement(v)
+	}
+
+	return mm
+}
+
+// Hash returns a hex-encoded SHA-256 digest of m. The digest is computed over a canonical
+// form of m, in which the elements of each section are ordered by key, so two messages
+// with the same elements have the same hash regardless of the order they were added in.
+// This can be used to cheaply detect differences between e.g. desired and loaded connection
+// configurations.
+func (m *Message) Hash() string {
+	h := sha256.New()
+	m.writeCanonical(h)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writeCanonical writes the canonical form of m to w. Each element is written as its
+// element type, followed by its length-prefixed key and value(s), with the elements of
+// each section ordered by key.
+func (m *Message) writeCanonical(w io.Writer) {
+	m.load()
+
+	keys := make([]string, len(m.keys))
+	copy(keys, m.keys)
+	sort.Strings(keys)
+
+	writeString := func(s string) {
+		l := make([]byte, 4)
+		binary.BigEndian.PutUint32(l, uint32(len(s)))
+
+		// nolint
+		w.Write(l)
+		// nolint
+		io.WriteString(w, s)
+	}
+
+	for _, k := range keys {
+		// Raw messages are canonicalized like any other section
+		switch v := m.get(k).(type) {
+		case string:
+			// nolint
+			w.Write([]byte{msgKeyValue})
+			writeString(k)
+			writeString(v)
+
+		case []string:
+			// nolint
+			w.Write([]byte{msgListStart})
+			writeString(k)
+			for _, item := range v {
+				// nolint
+				w.Write([]byte{msgListItem})
+				writeString(item)
+			}
+			// nolint
+			w.Write([]byte{msgListEnd})
+
+		case *Message:
+			// nolint
+			w.Write([]byte{msgSectionStart})
+			writeString(k)
+			v.writeCanonical(w)
+			// nolint
+			w.Write([]byte{msgSectionEnd})
+		}
+	}
+}
+
+// Walk performs a depth-first traversal of m, calling fn for each element in order. A
+// section is visited before its elements. If fn returns SkipSection when visiting a section,
+// the elements of that section are skipped. If fn returns any other error, the traversal
+// stops and that error is returned. Sections given as a RawMessage are visited decoded.
+func (m *Message) Walk(fn WalkFunc) error {
+	err := m.walk(nil, fn)
+	if err == SkipSection {
+		return nil
+	}
+
+	return err
+}
+
+func (m *Message) walk(parent []string, fn WalkFunc) error {
+	m.load()
+
+	for _, k := range m.keys {
+		path := make([]string, len(parent)+1)
+		copy(path, parent)
+		path[len(parent)] = k
+
+		v := m.get(k)
+
+		err := fn(path, v)
+		if err != nil && err != SkipSection {
+			return err
+		}
+
+		section, ok := v.(*Message)
+		if !ok || err == SkipSection {
+			continue
+		}
+
+		if err := section.walk(path, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// String returns a human-readable representation of m, with nested sections and
+// lists rendered in an indented form similar to swanctl's.
+func (m *Message) String() string {
+	return m.Dump()
+}
+
+// Dump behaves like String, but the values of any keys given in redact are replaced with
+// "<redacted>", at any level of nesting. This is useful for logging messages that contain
+// e.g. "secret" or "data" fields.
+func (m *Message) Dump(redact ...string) string {
+	r := make(map[string]bool, len(redact))
+	for _, k := range redact {
+		r[k] = true
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+	m.dump(buf, 0, r)
+
+	return buf.String()
+}
+
+func (m *Message) dump(buf *bytes.Buffer, depth int, redact map[string]bool) {
+	m.load()
+
+	indent := strings.Repeat("  ", depth)
+
+	for _, k := range m.keys {
+		if redact[k] {
+			fmt.Fprintf(buf, "%s%s = <redacted>\n", indent, k)
+
+			continue
+		}
+
+		switch v := m.get(k).(type) {
+		case string:
+			fmt.Fprintf(buf, "%s%s = %s\n", indent, k, v)
+
+		case []string:
+			fmt.Fprintf(buf, "%s%s = [\n", indent, k)
+			for _, item := range v {
+				fmt.Fprintf(buf, "%s  %s\n", indent, item)
+			}
+			fmt.Fprintf(buf, "%s]\n", indent)
+
+		case *Message:
+			fmt.Fprintf(buf, "%s%s {\n", indent, k)
+			v.dump(buf, depth+1, redact)
+			fmt.Fprintf(buf, "%s}\n", indent)
+		}
+	}
+}
+
+// Err examines a command response Message, and determines if it was successful.
+// If it was, or if the message does not contain a 'success' field, nil is returned. Otherwise,
+// an error is returned using the 'errmsg' field.
+func (m *Message) Err() error {
+	m.load()
+
+	if success, ok := m.data["success"]; ok {
+		if success != "yes" {
+			return fmt.Errorf("%w: %v", errCommandFailed, m.data["errmsg"])
+		}
+	}
+
+	return nil
+}
+
+// delete removes key from m, if it exists.
+func (m *Message) delete(key string) {
+	m.load()
+
+	if _, ok := m.data[key]; !ok {
+		return
+	}
+	delete(m.data, key)
+
+	for i, k := range m.keys {
+		if k == key {
+			m.keys = append(m.keys[:i], m.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+func (m *Message) addItem(key string, value interface{}) error {
+	rv := reflect.ValueOf(value)
+
+	if len(key) > maxKeyLength {
+		return fmt.Errorf("%v: %v has length %v", errKeyTooLong, key[:16]+"...", len(key))
+	}
+
+	// Check if the key is already set in the message
+	_, exists := m.data[key]
+
+	switch rv.Kind() {
+
+	case reflect.String:
+		v := value.(string)
+		if len(v) > maxValueLength {
+			return fmt.Errorf("%v: value of %v has length %v", errValueTooLong, key, len(v))
+		}
+		m.data[key] = v
+
+	case reflect.Slice, reflect.Array:
+		if raw, ok := value.(RawMessage); ok {
+			if err := NewMessage().decode(raw); err != nil {
+				return fmt.Errorf("%v: invalid raw message for %v", err, key)
+			}
+			m.data[key] = raw
+
+			break
+		}
+
+		// Binary values are stored as strings, which may hold arbitrary bytes
+		if b, ok := value.([]byte); ok {
+			if len(b) > maxValueLength {
+				return fmt.Errorf("%v: value of %v has length %v", errValueTooLong, key, len(b))
+			}
+			m.data[key] = string(b)
+
+			break
+		}
+
+		list, ok := value.([]string)
+		if !ok {
+			return errUnsupportedType
+		}
+
+		for i, item := range list {
+			if len(item) > maxValueLength {
+				return fmt.Errorf("%v: item %v of %v has length %v", errValueTooLong, i, key, len(item))
+			}
+		}
+		m.data[key] = list
+
+	case reflect.Ptr:
+		msg, ok := value.(*Message)
+		if !ok {
+			return errUnsupportedType
+		}
+		m.data[key] = msg
+
+	default:
+		return errUnsupportedType
+	}
+
+	// Only append to keys if this is a new key.
+	if !exists {
+		m.keys = append(m.keys, key)
+	}
+
+	return nil
+}
+
+func (m *Message) encode() ([]byte, error) {
+	return m.encodeWithOptions(encodeOptions{})
+}
+
+func (m *Message) encodeWithOptions(opts encodeOptions) ([]byte, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	if err := m.encodeElementsWithOptions(buf, opts); err != nil {
+		return []byte{}, err
+	}
+
+	// The buffer is returned to the pool, so copy out the result
+	b := make([]byte, buf.Len())
+	copy(b, buf.Bytes())
+
+	return b, nil
+}
+
+// encodeElements writes the encoded elements of m to buf, in order.
+func (m *Message) encodeElements(buf *bytes.Buffer) error {
+	return m.encodeElementsWithOptions(buf, encodeOptions{})
+}
+
+// encodeElementsWithOptions behaves like encodeElements, but the elements are encoded
+// with the given options.
+func (m *Message) encodeElementsWithOptions(buf *bytes.Buffer, opts encodeOptions) error {
+	m.load()
+
+	keys := m.keys
+	if opts.canonical {
+		keys = make([]string, len(m.keys))
+		copy(keys, m.keys)
+		sort.Strings(keys)
+	}
+
+	for _, k := range keys {
+		v := m.data[k]
+
+		rv := reflect.ValueOf(v)
+
+		var err error
+
+		switch rv.Kind() {
+
+		case reflect.String:
+			err = m.encodeKeyValue(buf, k, v.(string))
+
+		case reflect.Slice, reflect.Array:
+			if raw, ok := v.(RawMessage); ok {
+				// Raw sections must be decoded to be put in canonical form
+				if opts.canonical {
+					err = m.encodeSection(buf, k, raw.message(), opts)
+
+					break
+				}
+
+				err = m.encodeRawSection(buf, k, raw)
+
+				break
+			}
+
+			err = m.encodeList(buf, k, v.([]string))
+
+		case reflect.Ptr:
+			uv, ok := v.(*Message)
+			if !ok {
+				return errUnsupportedType
+			}
+
+			err = m.encodeSection(buf, k, uv, opts)
+
+		default:
+			return errUnsupportedType
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *Message) decode(data []byte) error {
+	return m.decodeWithOptions(data, decodeOptions{})
+}
+
+// decodeWithOptions decodes data into m, returning a *DecodeLimitError if data
+// exceeds any of the configured limits.
+func (m *Message) decodeWithOptions(data []byte, opts decodeOptions) error {
+	if opts.limits.MaxSize > 0 && len(data) > opts.limits.MaxSize {
+		return &DecodeLimitError{Limit: "size", Max: opts.limits.MaxSize}
+	}
+
+	st := &decodeState{decodeOptions: opts}
+
+	buf := bytes.NewBuffer(data)
+
+	b, err := buf.ReadByte()
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("%v: %v", errDecoding, err)
+	}
+
+	for buf.Len() > 0 {
+		// Determine the next message element
+		switch b {
+
+		case msgKeyValue:
+			n, err := m.decodeKeyValue(buf.Bytes(), st)
+			if err != nil {
+				return err
+			}
+			buf.Next(n)
+
+		case msgListStart:
+			n, err := m.decodeList(buf.Bytes(), st)
+			if err != nil {
+				return err
+			}
+			buf.Next(n)
+
+		case msgSectionStart:
+			n, err := m.decodeSection(buf.Bytes(), st)
+			if err != nil {
+				return err
+			}
+			buf.Next(n)
+		}
+
+		b, err = buf.ReadByte()
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("%v: %v", errDecoding, err)
+		}
+	}
+
+	return nil
+}
+
+// encodeKeyValue will write an encoded key-value pair to buf.
+//
+// The size of the encoded pair is the length of the key and value, plus four bytes:
+// one byte for message element type, one byte for key length, and two bytes for value
+// length.
+func (m *Message) encodeKeyValue(buf *bytes.Buffer, key, value string) error {
+	// Indictate the message element type is a key-value pair
+	err := buf.WriteByte(msgKeyValue)
+	if err != nil {
+		return fmt.Errorf("%v: %v", errEncoding, err)
+	}
+
+	// Write the key length and key
+	err = writeKey(buf, key)
+	if err != nil {
+		return err
+	}
+
+	// Write the value's length and value
+	return writeValue(buf, value)
+}
+
+// encodeList will write an encoded list to buf.
+//
+// The size of the encoded list is the length of the key and total length of
+// the list (sum of length of the items in the list), plus three bytes for each
+// list item: one for message element type, and two for item length. Another three
+// bytes are used to indicate list start and list stop, and the length of the key.
+func (m *Message) encodeList(buf *bytes.Buffer, key string, list []string) error {
+	// Indictate the message element type is the start of a list
+	err := buf.WriteByte(msgListStart)
+	if err != nil {
+		return fmt.Errorf("%v: %v", errEncoding, err)
+	}
+
+	// Write the key length and key
+	err = writeKey(buf, key)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range list {
+		// Indicate that this is a list item
+		err = buf.WriteByte(msgListItem)
+		if err != nil {
+			return fmt.Errorf("%v: %v", errEncoding, err)
+		}
+
+		// Write the item's length and the item
+		err = writeValue(buf, item)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Indicate the end of the list
+	err = buf.WriteByte(msgListEnd)
+	if err != nil {
+		return fmt.Errorf("%v: %v", errEncoding, err)
+	}
+
+	return nil
+}
+
+// encodeSection will write an encoded section to buf.
+func (m *Message) encodeSection(buf *bytes.Buffer, key string, section *Message, opts encodeOptions) error {
+	// Indictate the message element type is the start of a section
+	err := buf.WriteByte(msgSectionStart)
+	if err != nil {
+		return fmt.Errorf("%v: %v", errEncoding, err)
+	}
+
+	// Write the key length and key
+	err = writeKey(buf, key)
+	if err != nil {
+		return err
+	}
+
+	// Encode the sections elements
+	err = section.encodeElementsWithOptions(buf, opts)
+	if err != nil {
+		return err
+	}
+
+	// Indicate the end of the section
+	err = buf.WriteByte(msgSectionEnd)
+	if err != nil {
+		return fmt.Errorf("%v: %v", errEncoding, err)
+	}
+
+	return nil
+}
+
+// encodeRawSection will write a section to buf, with the pre-encoded elements of raw.
+func (m *Message) encodeRawSection(buf *bytes.Buffer, key string, raw RawMessage) error {
+	err := buf.WriteByte(msgSectionStart)
+	if err != nil {
+		return fmt.Errorf("%v: %v", errEncoding, err)
+	}
+
+	err = writeKey(buf, key)
+	if err != nil {
+		return err
+	}
+
+	_, err = buf.Write(raw)
+	if err != nil {
+		return fmt.Errorf("%v: %v", errEncoding, err)
+	}
+
+	err = buf.WriteByte(msgSectionEnd)
+	if err != nil {
+		return fmt.Errorf("%v: %v", errEncoding, err)
+	}
+
+	return nil
+}
+
+// writeKey writes key to buf, preceded by its length as one byte.
+func writeKey(buf *bytes.Buffer, key string) error {
+	err := buf.WriteByte(uint8(len(key)))
+	if err != nil {
+		return fmt.Errorf("%v: %v", errEncoding, err)
+	}
+
+	_, err = buf.WriteString(key)
+	if err != nil {
+		return fmt.Errorf("%v: %v", errEncoding, err)
+	}
+
+	return nil
+}
+
+// writeValue writes value to buf, preceded by its length as two bytes.
+func writeValue(buf *bytes.Buffer, value string) error {
+	var vl [2]byte
+	binary.BigEndian.PutUint16(vl[:], uint16(len(value)))
+
+	_, err := buf.Write(vl[:])
+	if err != nil {
+		return fmt.Errorf("%v: %v", errEncoding, err)
+	}
+
+	_, err = buf.WriteString(value)
+	if err != nil {
+		return fmt.Errorf("%v: %v", errEncoding, err)
+	}
+
+	return nil
+}
+
+// decodeKeyValue will decode a key-value pair and write it to the message's
+// data, and returns the number of bytes decoded.
+func (m *Message) decodeKeyValue(data []byte, st *decodeState) (int, error) {
+	if err := st.addElement(); err != nil {
+		return -1, err
+	}
+
+	buf := bytes.NewBuffer(data)
+
+	// Read the key from the buffer
+	n, err := buf.ReadByte()
+	if err != nil {
+		return -1, fmt.Errorf("%v: %v", errDecoding, err)
+	}
+
+	keyLen := int(n)
+	key := buf.Next(keyLen)
+	if len(key) != keyLen {
+		return -1, errBadKey
+	}
+
+	// Read the value's length
+	v := buf.Next(2)
+	if len(v) != 2 {
+		return -1, errEndOfBuffer
+
+	}
+
+	// Read the value from the buffer
+	valueLen := int(binary.BigEndian.Uint16(v))
+	value := buf.Next(valueLen)
+	if len(value) != valueLen {
+		return -1, errBadValue
+	}
+
+	if !st.discard {
+		err = m.addItem(st.str(key), st.str(value))
+		if err != nil {
+			return -1, fmt.Errorf("%v: %v", errDecoding, err)
+		}
+	}
+
+	// Return the length of the key and value, plus the three bytes for their
+	// lengths
+	return keyLen + valueLen + 3, nil
+}
+
+// decodeList will decode a list and write it to the message's data, and return
+// the number of bytes decoded.
+func (m *Message) decodeList(data []byte, st *decodeState) (int, error) {
+	if err := st.addElement(); err != nil {
+		return -1, err
+	}
+
+	var list []string
+
+	buf := bytes.NewBuffer(data)
+
+	// Read the key from the buffer
+	n, err := buf.ReadByte()
+	if err != nil {
+		return -1, fmt.Errorf("%v: %v", errDecoding, err)
+	}
+
+	keyLen := int(n)
+	key := buf.Next(keyLen)
+	if len(key) != keyLen {
+		return -1, errBadKey
+	}
+
+	b, err := buf.ReadByte()
+	if err != nil {
+		return -1, fmt.Errorf("%v: %v", errDecoding, err)
+	}
+
+	// Keep track of bytes decoded
+	count := keyLen + 2
+
+	// Read the list from the buffer
+	for b != msgListEnd {
+		// Ensure this is the beginning of a list item
+		if b != msgListItem {
+			return -1, errExpectedBeginning
+		}
+
+		if err := st.addElement(); err != nil {
+			return -1, err
+		}
+
+		// Read the value's length
+		v := buf.Next(2)
+		if len(v) != 2 {
+			return -1, errEndOfBuffer
+
+		}
+
+		// Read the value from the buffer
+		valueLen := int(binary.BigEndian.Uint16(v))
+		value := buf.Next(valueLen)
+		if len(value) != valueLen {
+			return -1, errBadValue
+		}
+
+		if !st.discard {
+			list = append(list, st.str(value))
+		}
+
+		b, err = buf.ReadByte()
+		if err != nil {
+			return -1, fmt.Errorf("%v: %v", errDecoding, err)
+		}
+
+		count += valueLen + 3
+	}
+
+	if !st.discard {
+		err = m.addItem(st.str(key), list)
+		if err != nil {
+			return -1, fmt.Errorf("%v: %v", errDecoding, err)
+		}
+	}
+
+	return count, nil
+}
+
+// decodeSection will decode a section into a message's data, and return the number
+// of bytes decoded.
+func (m *Message) decodeSection(data []byte, st *decodeState) (int, error) {
+	if err := st.enter(); err != nil {
+		return -1, err
+	}
+	defer st.leave()
+
+	buf := bytes.NewBuffer(data)
+
+	// Read the key from the buffer
+	n, err := buf.ReadByte()
+	if err != nil {
+		return -1, fmt.Errorf("%v: %v", errDecoding, err)
+	}
+
+	keyLen := int(n)
+	key := buf.Next(keyLen)
+	if len(key) != keyLen {
+		return -1, errBadKey
+	}
+
+	if st.discard {
+		n, err := m.decodeSectionElements(buf.Bytes(), st)
+		if err != nil {
+			return -1, err
+		}
+
+		return keyLen + 1 + n, nil
+	}
+
+	var (
+		section *Message
+		count   int
+	)
+
+	if st.lazy {
+		// Validate the section without decoding it, so that errors are still
+		// returned now rather than when the section is accessed
+		st.discard = true
+		count, err = m.decodeSectionElements(buf.Bytes(), st)
+		st.discard = false
+
+		if err != nil {
+			return -1, err
+		}
+
+		elements := buf.Bytes()[:count]
+		if !st.zeroCopy {
+			// The received buffer may be re-used, so keep a copy
+			elements = append([]byte{}, elements...)
+		}
+
+		// Limits were already enforced for the whole section
+		opts := st.decodeOptions
+		opts.limits = DecodeLimits{}
+
+		section = NewMessage()
+		section.lazy = &lazySection{data: elements, opts: opts}
+	} else {
+		section = NewMessage()
+
+		count, err = section.decodeSectionElements(buf.Bytes(), st)
+		if err != nil {
+			return -1, err
+		}
+	}
+
+	err = m.addItem(st.str(key), section)
+	if err != nil {
+		return -1, err
+	}
+
+	// Include the key and its length
+	return keyLen + 1 + count, nil
+}
+
+// decodeSectionElements will decode the elements of a section, up to and including
+// the section end, into a message's data and return the number of bytes decoded.
+func (m *Message) decodeSectionElements(data []byte, st *decodeState) (int, error) {
+	buf := bytes.NewBuffer(data)
+
+	b, err := buf.ReadByte()
+	if err != nil {
+		return -1, fmt.Errorf("%v: %v", errDecoding, err)
+	}
+
+	// Keep track of bytes decoded
+	count := 1
+
+	for b != msgSectionEnd {
+		var n int
+
+		// Determine the next message element
+		switch b {
+
+		case msgKeyValue:
+			n, err = m.decodeKeyValue(buf.Bytes(), st)
+
+		case msgListStart:
+			n, err = m.decodeList(buf.Bytes(), st)
+
+		case msgSectionStart:
+			n, err = m.decodeSection(buf.Bytes(), st)
+
+		default:
+			return -1, errExpectedBeginning
+		}
+
+		if err != nil {
+			return -1, err
+		}
+
+		// Skip those decoded bytes
+		buf.Next(n)
+		count += n
+
+		b, err = buf.ReadByte()
+		if err != nil {
+			return -1, fmt.Errorf("%v: %v", errDecoding, err)
+		}
+
+		count++
+	}
+
+	return count, nil
+}
+
+// load decodes the elements of a lazy section, if they have not been decoded yet.
+func (m *Message) load() {
+	if m.lazy == nil {
+		return
+	}
+
+	m.lazy.once.Do(func() {
+		st := &decodeState{decodeOptions: m.lazy.opts}
+
+		// The section was already validated when it was deferred
+		// nolint
+		m.decodeSectionElements(m.lazy.data, st)
+		m.lazy.data = nil
+	})
+}
+
+// messageTag is used for parsing struct tags in marshaling Messages
+type messageTag struct {
+	name string
+
+	skip bool
+
+	// Marshal the field even if it is empty
+	keepEmpty bool
+
+	// Do not marshal the field if it is empty
+	omitEmpty bool
+
+	// The fields of the struct are part of the enclosing message
+	inline bool
+
+	// Marshal a certificate or key as PEM, rather than DER
+	pem bool
+
+	// The field must be present when unmarshaling
+	required bool
+
+	// Value to marshal if the field is empty
+	def        string
+	hasDefault bool
+
+	// For slices of structs, the key whose value names each subsection
+	sectionKey string
+
+	// The entries of a map are part of the enclosing message, keyed by name
+	// followed by the entry's key
+	prefix bool
+}
+
+// newMessageTag parses the struct tag of field identified by key, normally "vici". The
+// tag consists of the message key, optionally followed by comma-separated options.
+// Untagged embedded structs are inlined.
+func newMessageTag(field reflect.StructField, key string) messageTag {
+	t, ok := field.Tag.Lookup(key)
+	if !ok && field.Anonymous {
+		ft := field.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+
+		return messageTag{inline: true, skip: ft.Kind() != reflect.Struct}
+	}
+
+	opts := strings.Split(t, ",")
+	if opts[0] == "-" {
+		return messageTag{skip: true}
+	}
+
+	mt := messageTag{name: opts[0]}
+
+	for _, opt := range opts[1:] {
+		switch opt {
+		case "keepempty":
+			mt.keepEmpty = true
+		case "omitempty":
+			mt.omitEmpty = true
+		case "inline", "flatten":
+			mt.inline = true
+		case "pem":
+			mt.pem = true
+		case "required":
+			mt.required = true
+		case "prefix":
+			mt.prefix = true
+		default:
+			if v, ok := strings.CutPrefix(opt, "default="); ok {
+				mt.def = v
+				mt.hasDefault = true
+			}
+
+			if v, ok := strings.CutPrefix(opt, "key="); ok {
+				mt.sectionKey = v
+			}
+		}
+	}
+
+	if mt.name == "" && !mt.inline {
+		mt.skip = true
+	}
+
+	return mt
+}
+
+// structField describes a field of a struct type for marshaling and unmarshaling.
+type structField struct {
+	index int
+	tag   messageTag
+
+	// Key derived from the field name, if the field is exported and untagged
+	derived string
+}
+
+// structFieldCache maps struct types and tag keys to their []structField, so that
+// struct tags are only parsed once per type.
+var structFieldCache sync.Map
+
+type structFieldCacheKey struct {
+	t      reflect.Type
+	tagKey string
+}
+
+// cachedStructFields returns the fields of the struct type t, whose tags are
+// identified by tagKey.
+func cachedStructFields(t reflect.Type, tagKey string) []structField {
+	ck := structFieldCacheKey{t, tagKey}
+
+	if f, ok := structFieldCache.Load(ck); ok {
+		return f.([]structField)
+	}
+
+	fields := make([]structField, t.NumField())
+	for i := range fields {
+		rf := t.Field(i)
+
+		fields[i] = structField{index: i, tag: newMessageTag(rf, tagKey)}
+
+		if _, tagged := rf.Tag.Lookup(tagKey); !tagged && rf.IsExported() && !rf.Anonymous {
+			fields[i].derived = deriveKey(rf.Name)
+		}
+	}
+
+	f, _ := structFieldCache.LoadOrStore(ck, fields)
+
+	return f.([]structField)
+}
+
+// deriveKey converts the field name to lower_snake_case. A run of capitals is
+// treated as an acronym, so e.g. DPDDelay becomes dpd_delay.
+func deriveKey(name string) string {
+	var b strings.Builder
+
+	r := []rune(name)
+	for i, c := range r {
+		if unicode.IsUpper(c) {
+			if i > 0 && (!unicode.IsUpper(r[i-1]) || (i+1 < len(r) && unicode.IsLower(r[i+1]))) {
+				b.WriteByte('_')
+			}
+			c = unicode.ToLower(c)
+		}
+		b.WriteRune(c)
+	}
+
+	return b.String()
+}
+
+func emptyMessageElement(rv reflect.Value) bool {
+	switch rv.Kind() {
+
+	case reflect.Slice, reflect.Map:
+		return rv.IsNil()
+
+	case reflect.Struct:
+		z := true
+		for i := 0; i < rv.NumField(); i++ {
+			z = z && emptyMessageElement(rv.Field(i))
+		}
+		return z
+	}
+
+	// Fields of e.g. netip.Addr are unexported, so they cannot be compared
+	// through Interface
+	return rv.IsZero()
+}
+
+func (m *Message) marshal(v interface{}, opts MarshalOptions) error {
+	return m.marshalValue(reflect.ValueOf(v), opts)
+}
+
+// validator is implemented by types that validate themselves before being marshaled.
+type validator interface {
+	Validate() error
+}
+
+var validatorType = reflect.TypeOf((*validator)(nil)).Elem()
+
+// validateValue calls the Validate method of the struct rv, if it, or a pointer to it,
+// has one.
+func validateValue(rv reflect.Value) error {
+	if !rv.CanInterface() || !reflect.PointerTo(rv.Type()).Implements(validatorType) {
+		return nil
+	}
+
+	ptr := reflect.New(rv.Type())
+	if rv.CanAddr() {
+		ptr = rv.Addr()
+	} else {
+		ptr.Elem().Set(rv)
+	}
+
+	if v, ok := ptr.Interface().(validator); ok {
+		return v.Validate()
+	}
+
+	return nil
+}
+
+func (m *Message) marshalValue(rv reflect.Value, opts MarshalOptions) error {
+	// rv must either be a struct or a pointer to one
+	if rv.Kind() == reflect.Ptr {
+		rv = reflect.Indirect(rv)
+	}
+
+	if rv.Kind() != reflect.Struct {
+		return fmt.Errorf("%v: %v", errMarshalUnsupportedType, rv.Kind())
+	}
+
+	if err := validateValue(rv); err != nil {
+		return fmt.Errorf("%v: %v", errMarshalInvalid, err)
+	}
+
+	for _, sf := range cachedStructFields(rv.Type(), opts.tagKey()) {
+		mt := sf.tag
+		if opts.DeriveKeys && sf.derived != "" {
+			mt = messageTag{name: sf.derived}
+		}
+
+		if mt.skip {
+			continue
+		}
+
+		rfv := rv.Field(sf.index)
+
+		// The exported fields of an inlined struct are marshaled into m, even
+		// if the struct itself is unexported
+		if mt.inline {
+			if rfv.Kind() == reflect.Ptr && rfv.IsNil() {
+				continue
+			}
+
+			if err := m.marshalValue(rfv, opts); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if !rfv.CanInterface() {
+			continue
+		}
+
+		if mt.prefix {
+			if err := m.marshalPrefixed(mt.name, rfv, opts); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if emptyMessageElement(rfv) {
+			if mt.hasDefault {
+				if err := m.addItem(mt.name, mt.def); err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			if mt.omitEmpty || !mt.keepEmpty {
+				continue
+			}
+		}
+
+		// Certificates and keys are marshaled as DER, unless PEM is requested
+		if mt.pem {
+			cv := rfv
+			if cv.Kind() == reflect.Interface && !cv.IsNil() {
+				cv = cv.Elem()
+			}
+
+			if !isCredentialType(cv.Type()) {
+				return fmt.Errorf("%v: pem option on %v", errMarshalUnsupportedType, cv.Type())
+			}
+
+			s, err := formatCredential(cv, true)
+			if err != nil {
+				return err
+			}
+
+			if err := m.addItem(mt.name, s); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if isStructSlice(rfv.Type()) {
+			msg, err := marshalStructSlice(rfv, mt.sectionKey, opts)
+			if err != nil {
+				return err
+			}
+
+			if err := m.addItem(mt.name, msg); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		// Add the message element
+		err := m.marshalField(mt.name, rfv, opts)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *Message) marshalField(name string, rv reflect.Value, opts MarshalOptions) error {
+	if mv, ok := messageMarshaler(rv); ok {
+		v, err := mv.MarshalVici()
+		if err != nil {
+			return fmt.Errorf("%v: %v", errMarshal, err)
+		}
+
+		return m.addItem(name, v)
+	}
+
+	if rv.Type() == durationType {
+		s, err := formatDuration(time.Duration(rv.Int()))
+		if err != nil {
+			return fmt.Errorf("%v: %v", errMarshal, err)
+		}
+
+		return m.addItem(name, s)
+	}
+
+	if isAddressType(rv.Type()) {
+		s, err := formatAddress(rv)
+		if err != nil {
+			return err
+		}
+
+		return m.addItem(name, s)
+	}
+
+	if isCredentialType(rv.Type()) {
+		s, err := formatCredential(rv, false)
+		if err != nil {
+			return err
+		}
+
+		return m.addItem(name, s)
+	}
+
+	if tm, ok := textMarshaler(rv); ok {
+		s, err := tm.MarshalText()
+		if err != nil {
+			return fmt.Errorf("%v: %v", errMarshal, err)
+		}
+
+		return m.addItem(name, string(s))
+	}
+
+	// Lists of values implementing encoding.TextMarshaler
+	if k := rv.Kind(); (k == reflect.Slice || k == reflect.Array) && rv.Type().Elem().Implements(textMarshalerType) {
+		list := make([]string, rv.Len())
+		for i := range list {
+			tm, ok := textMarshaler(rv.Index(i))
+			if !ok {
+				return fmt.Errorf("%v: nil %v", errMarshal, rv.Type().Elem())
+			}
+
+			s, err := tm.MarshalText()
+			if err != nil {
+				return fmt.Errorf("%v: %v", errMarshal, err)
+			}
+			list[i] = string(s)
+		}
+
+		return m.addItem(name, list)
+	}
+
+	// Lists of addresses, e.g. local_addrs or remote_ts
+	if k := rv.Kind(); (k == reflect.Slice || k == reflect.Array) && isAddressType(rv.Type().Elem()) {
+		list := make([]string, rv.Len())
+		for i := range list {
+			s, err := formatAddress(rv.Index(i))
+			if err != nil {
+				return err
+			}
+			list[i] = s
+		}
+
+		return m.addItem(name, list)
+	}
+
+	if isStructSlice(rv.Type()) {
+		msg, err := marshalStructSlice(rv, "", opts)
+		if err != nil {
+			return err
+		}
+
+		return m.addItem(name, msg)
+	}
+
+	switch rv.Kind() {
+
+	case reflect.String, reflect.Slice, reflect.Array:
+		return m.addItem(name, rv.Interface())
+
+	case reflect.Bool:
+		if rv.Bool() {
+			return m.addItem(name, "yes")
+		}
+
+		return m.addItem(name, "no")
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return m.addItem(name, strconv.FormatInt(rv.Int(), 10))
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return m.addItem(name, strconv.FormatUint(rv.Uint(), 10))
+
+	case reflect.Float32, reflect.Float64:
+		return m.addItem(name, strconv.FormatFloat(rv.Float(), 'f', -1, rv.Type().Bits()))
+
+	case reflect.Ptr:
+		// Pointers to anything but structs marshal the value they point to,
+		// so that e.g. a *bool can distinguish false from not set
+		if rv.Type().Elem().Kind() != reflect.Struct {
+			// A nil pointer is only marshaled with the "keepempty" option,
+			// as an empty value, since its zero value would set the option
+			if rv.IsNil() {
+				return m.addItem(name, "")
+			}
+
+			return m.marshalField(name, rv.Elem(), opts)
+		}
+
+		// An empty field is only marshaled if explicitly requested, in
+		// which case a nil pointer is an empty section
+		if rv.IsNil() {
+			return m.addItem(name, NewMessage())
+		}
+
+		if _, ok := rv.Interface().(*Message); ok {
+			return m.addItem(name, rv.Interface())
+		}
+
+		msg := NewMessage()
+		if err := msg.marshalValue(rv, opts); err != nil {
+			return err
+		}
+
+		return m.addItem(name, msg)
+
+	case reflect.Struct:
+		msg := NewMessage()
+		if err := msg.marshalValue(rv, opts); err != nil {
+			return err
+		}
+
+		return m.addItem(name, msg)
+
+	case reflect.Map:
+		msg, err := marshalMap(rv, opts)
+		if err != nil {
+			return err
+		}
+
+		return m.addItem(name, msg)
+
+	case reflect.Interface:
+		// Marshal the dynamic value, e.g. of a crypto.PrivateKey
+		if rv.IsNil() {
+			return fmt.Errorf("%v: nil %v", errMarshalUnsupportedType, rv.Type())
+		}
+
+		return m.marshalField(name, rv.Elem(), opts)
+
+	default:
+		return fmt.Errorf("%v: %v", errMarshalUnsupportedType, rv.Kind())
+	}
+}
+
+// isStructSlice returns true if t is a slice of structs, or of pointers to structs, that
+// are marshaled as sections.
+func isStructSlice(t reflect.Type) bool {
+	if t.Kind() != reflect.Slice {
+		return false
+	}
+
+	elem := t.Elem()
+	if elem.Kind() == reflect.Ptr {
+		elem = elem.Elem()
+	}
+
+	if elem.Kind() != reflect.Struct || isAddressType(elem) {
+		return false
+	}
+
+	// Types that marshal themselves are not sections
+	for _, it := range []reflect.Type{marshalerType, textMarshalerType} {
+		if reflect.PointerTo(elem).Implements(it) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// marshalStructSlice returns a section with a subsection for each element of the slice
+// of structs rv. The subsections are numbered from 1, unless sectionKey is given, in which
+// case each is named by the value of that key in the marshaled element. That key is then
+// removed from the subsection.
+func marshalStructSlice(rv reflect.Value, sectionKey string, opts MarshalOptions) (*Message, error) {
+	msg := NewMessage()
+
+	for i := 0; i < rv.Len(); i++ {
+		section := NewMessage()
+		if err := section.marshalValue(rv.Index(i), opts); err != nil {
+			return nil, err
+		}
+
+		key := strconv.Itoa(i + 1)
+
+		if sectionKey != "" {
+			name, ok := section.GetString(sectionKey)
+			if !ok || name == "" {
+				return nil, fmt.Errorf("%v: element %v has no %v", errMarshal, i, sectionKey)
+			}
+			section.delete(sectionKey)
+			key = name
+		}
+
+		if msg.Has(key) {
+			return nil, fmt.Errorf("%v: duplicate section %v", errMarshal, key)
+		}
+
+		if err := msg.addItem(key, section); err != nil {
+			return nil, err
+		}
+	}
+
+	return msg, nil
+}
+
+// messageMarshaler returns rv as a MessageMarshaler, if it, or a pointer to it,
+// implements the interface. A nil pointer is not considered a MessageMarshaler.
+func messageMarshaler(rv reflect.Value) (MessageMarshaler, bool) {
+	if rv.Kind() == reflect.Ptr && rv.IsNil() {
+		return nil, false
+	}
+
+	if rv.Type().Implements(marshalerType) {
+		return rv.Interface().(MessageMarshaler), true
+	}
+
+	if rv.CanAddr() && rv.Addr().Type().Implements(marshalerType) {
+		return rv.Addr().Interface().(MessageMarshaler), true
+	}
+
+	return nil, false
+}
+
+// textMarshaler returns rv as an encoding.TextMarshaler, if it, or a pointer to it,
+// implements the interface. A nil pointer is not considered a TextMarshaler.
+func textMarshaler(rv reflect.Value) (encoding.TextMarshaler, bool) {
+	if rv.Kind() == reflect.Ptr && rv.IsNil() {
+		return nil, false
+	}
+
+	if rv.Type().Implements(textMarshalerType) {
+		return rv.Interface().(encoding.TextMarshaler), true
+	}
+
+	if rv.CanAddr() && rv.Addr().Type().Implements(textMarshalerType) {
+		return rv.Addr().Interface().(encoding.TextMarshaler), true
+	}
+
+	return nil, false
+}
+
+// textUnmarshaler returns field as an encoding.TextUnmarshaler, if it, or a pointer
+// to it, implements the interface. A nil pointer field is allocated.
+func textUnmarshaler(field reflect.Value) (encoding.TextUnmarshaler, bool) {
+	if field.Kind() == reflect.Ptr && field.Type().Implements(textUnmarshalerType) {
+		if field.IsNil() {
+			field.Set(reflect.New(field.Type().Elem()))
+		}
+
+		return field.Interface().(encoding.TextUnmarshaler), true
+	}
+
+	if field.CanAddr() && field.Addr().Type().Implements(textUnmarshalerType) {
+		return field.Addr().Interface().(encoding.TextUnmarshaler), true
+	}
+
+	return nil, false
 }
 
-func emptyMessageElement(rv reflect.Value) bool {
-	switch rv.Kind() {
+// marshalMap returns a section with an element for each entry of the map rv,
+// ordered by key so that the result is deterministic. Each value is marshaled
+// like a struct field, so e.g. struct values become nested sections.
+func marshalMap(rv reflect.Value, opts MarshalOptions) (*Message, error) {
+	if rv.Type().Key().Kind() != reflect.String {
+		return nil, fmt.Errorf("%v: map key %v", errMarshalUnsupportedType, rv.Type().Key().Kind())
+	}
 
-	case reflect.Slice:
-		return rv.IsNil()
+	keys := rv.MapKeys()
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].String() < keys[j].String()
+	})
 
-	case reflect.Struct:
-		z := true
-		for i := 0; i < rv.NumField(); i++ {
-			z = z && emptyMessageElement(rv.Field(i))
+	msg := NewMessage()
+	for _, k := range keys {
+		if err := msg.marshalField(k.String(), rv.MapIndex(k), opts); err != nil {
+			return nil, err
 		}
-		return z
 	}
 
-	return rv.Interface() == reflect.Zero(rv.Type()).Interface()
+	return msg, nil
+}
+
+// marshalPrefixed marshals the entries of the map rv into m, each keyed by prefix followed
+// by the entry's key.
+func (m *Message) marshalPrefixed(prefix string, rv reflect.Value, opts MarshalOptions) error {
+	if rv.Kind() != reflect.Map {
+		return fmt.Errorf("%v: prefix option on %v", errMarshalUnsupportedType, rv.Type())
+	}
+
+	msg, err := marshalMap(rv, opts)
+	if err != nil {
+		return err
+	}
+
+	for _, k := range msg.keys {
+		if err := m.addItem(prefix+k, msg.data[k]); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-func (m *Message) marshal(v interface{}) error {
+func (m *Message) unmarshal(v interface{}, opts UnmarshalOptions) error {
+	m.load()
+
 	rv := reflect.ValueOf(v)
 
-	// v must either be a struct or a pointer to one
-	if rv.Kind() == reflect.Ptr {
-		rv = reflect.Indirect(rv)
+	if rv.Kind() != reflect.Ptr {
+		return errUnmarshalBadType
+	}
+
+	if rv.IsNil() {
+		return errUnmarshalBadType
+	}
+
+	// Allow unmarshaling into e.g. a map[string]interface{}
+	if rv.Elem().Kind() == reflect.Map {
+		return m.unmarshalMap(rv.Elem(), opts)
 	}
 
+	return m.unmarshalValue(rv.Elem(), opts)
+}
+
+func (m *Message) unmarshalValue(rv reflect.Value, opts UnmarshalOptions) error {
 	if rv.Kind() != reflect.Struct {
-		return fmt.Errorf("%v: %v", errMarshalUnsupportedType, rv.Kind())
+		return errUnmarshalBadType
 	}
 
-	rt := rv.Type()
-	for i := 0; i < rt.NumField(); i++ {
-		rf := rt.Field(i)
+	for _, sf := range cachedStructFields(rv.Type(), opts.tagKey()) {
+		tag := sf.tag
+		if tag.skip {
+			continue
+		}
+
+		rfv := rv.Field(sf.index)
+
+		// Inlined structs are unmarshaled from m itself. A nil pointer is
+		// allocated if possible.
+		if tag.inline {
+			if rfv.Kind() == reflect.Ptr {
+				if rfv.IsNil() {
+					if !rfv.CanSet() {
+						continue
+					}
+					rfv.Set(reflect.New(rfv.Type().Elem()))
+				}
+				rfv = rfv.Elem()
+			}
+
+			if err := m.unmarshalValue(rfv, opts); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if tag.prefix {
+			if !rfv.CanInterface() {
+				continue
+			}
+
+			if err := m.unmarshalPrefixed(tag.name, rfv, opts); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		value, ok := m.data[tag.name]
+		if ok {
+			value = m.get(tag.name)
+		}
+		if !ok && opts.FoldKeys {
+			value, ok = m.lookupFold(tag.name)
+		}
+
+		if !ok {
+			if tag.required {
+				return fmt.Errorf("%v: %v", errUnmarshalMissingField, tag.name)
+			}
 
-		mt := newMessageTag(rf.Tag)
-		if mt.skip {
 			continue
 		}
 
-		rfv := rv.Field(i)
 		if !rfv.CanInterface() {
 			continue
 		}
 
-		if emptyMessageElement(rfv) {
+		if isStructSlice(rfv.Type()) {
+			msg, ok := value.(*Message)
+			if !ok {
+				return fmt.Errorf("%v: %v", errUnmarshalNonMessage, reflect.TypeOf(value))
+			}
+
+			if err := msg.unmarshalStructSlice(rfv, tag.sectionKey, opts); err != nil {
+				return err
+			}
+
 			continue
 		}
 
-		// Add the message element
-		err := m.marshalField(mt.name, rfv)
+		err := m.unmarshalField(rfv, reflect.ValueOf(value), opts)
 		if err != nil {
 			return err
 		}
@@ -755,73 +2952,107 @@ func (m *Message) marshal(v interface{}) error {
 	return nil
 }
 
-func (m *Message) marshalField(name string, rv reflect.Value) error {
-	switch rv.Kind() {
+func (m *Message) unmarshalField(field reflect.Value, rv reflect.Value, opts UnmarshalOptions) error {
+	if field.Kind() == reflect.Ptr && field.Type().Implements(unmarshalerType) {
+		if field.IsNil() {
+			field.Set(reflect.New(field.Type().Elem()))
+		}
 
-	case reflect.String, reflect.Slice, reflect.Array:
-		return m.addItem(name, rv.Interface())
+		return field.Interface().(MessageUnmarshaler).UnmarshalVici(rv.Interface())
+	}
 
-	case reflect.Ptr:
-		if _, ok := rv.Interface().(*Message); ok {
-			return m.addItem(name, rv.Interface())
+	if field.CanAddr() && field.Addr().Type().Implements(unmarshalerType) {
+		return field.Addr().Interface().(MessageUnmarshaler).UnmarshalVici(rv.Interface())
+	}
+
+	if field.Type() == durationType {
+		s, ok := rv.Interface().(string)
+		if !ok {
+			return fmt.Errorf("%v: %v and %v", errUnmarshalTypeMismatch, field.Type(), rv.Type())
 		}
 
-		msg := NewMessage()
-		if err := msg.marshal(rv.Interface()); err != nil {
-			return err
+		d, err := parseDuration(s)
+		if err != nil {
+			return fmt.Errorf("%v: %v", errUnmarshalTypeMismatch, err)
 		}
+		field.SetInt(int64(d))
 
-		return m.addItem(name, msg)
+		return nil
+	}
 
-	case reflect.Struct:
-		msg := NewMessage()
-		if err := msg.marshal(rv.Interface()); err != nil {
-			return err
+	if isAddressType(field.Type()) {
+		s, ok := rv.Interface().(string)
+		if !ok {
+			return fmt.Errorf("%v: %v and %v", errUnmarshalTypeMismatch, field.Type(), rv.Type())
 		}
 
-		return m.addItem(name, msg)
-
-	default:
-		return fmt.Errorf("%v: %v", errMarshalUnsupportedType, rv.Kind())
+		return parseAddress(field, s)
 	}
-}
 
-func (m *Message) unmarshal(v interface{}) error {
-	rv := reflect.ValueOf(v)
+	if field.Type() == certificateType {
+		s, ok := rv.Interface().(string)
+		if !ok {
+			return fmt.Errorf("%v: %v and %v", errUnmarshalTypeMismatch, field.Type(), rv.Type())
+		}
 
-	if rv.Kind() != reflect.Ptr {
-		return errUnmarshalBadType
-	}
+		cert, err := parseCertificate(s)
+		if err != nil {
+			return fmt.Errorf("%v: %v", errUnmarshal, err)
+		}
+		field.Set(reflect.ValueOf(cert))
 
-	if rv.IsNil() {
-		return errUnmarshalBadType
+		return nil
 	}
 
-	rt := reflect.Indirect(rv).Type()
-	for i := 0; i < rt.NumField(); i++ {
-		rf := rt.Field(i)
-		tag := newMessageTag(rf.Tag)
-
-		value, ok := m.data[tag.name]
+	if field.Kind() == reflect.Slice && isAddressType(field.Type().Elem()) {
+		list, ok := rv.Interface().([]string)
 		if !ok {
-			continue
+			return fmt.Errorf("%v: %v and %v", errUnmarshalTypeMismatch, field.Type(), rv.Type())
 		}
 
-		rfv := rv.Elem().Field(i)
-		if !rfv.CanInterface() {
-			continue
+		addrs := reflect.MakeSlice(field.Type(), len(list), len(list))
+		for i, s := range list {
+			if err := parseAddress(addrs.Index(i), s); err != nil {
+				return err
+			}
 		}
+		field.Set(addrs)
 
-		err := m.unmarshalField(rfv, reflect.ValueOf(value))
-		if err != nil {
-			return err
+		return nil
+	}
+
+	if tu, ok := textUnmarshaler(field); ok {
+		s, ok := rv.Interface().(string)
+		if !ok {
+			return fmt.Errorf("%v: %v and %v", errUnmarshalTypeMismatch, field.Type(), rv.Type())
 		}
+
+		if err := tu.UnmarshalText([]byte(s)); err != nil {
+			return fmt.Errorf("%v: %v", errUnmarshal, err)
+		}
+
+		return nil
 	}
 
-	return nil
-}
+	// Lists of values implementing encoding.TextUnmarshaler
+	if field.Kind() == reflect.Slice && reflect.PointerTo(field.Type().Elem()).Implements(textUnmarshalerType) {
+		list, ok := rv.Interface().([]string)
+		if !ok {
+			return fmt.Errorf("%v: %v and %v", errUnmarshalTypeMismatch, field.Type(), rv.Type())
+		}
+
+		items := reflect.MakeSlice(field.Type(), len(list), len(list))
+		for i, s := range list {
+			tu, _ := textUnmarshaler(items.Index(i))
+			if err := tu.UnmarshalText([]byte(s)); err != nil {
+				return fmt.Errorf("%v: %v", errUnmarshal, err)
+			}
+		}
+		field.Set(items)
+
+		return nil
+	}
 
-func (m *Message) unmarshalField(field reflect.Value, rv reflect.Value) error {
 	switch field.Kind() {
 
 	case reflect.String:
@@ -830,7 +3061,76 @@ func (m *Message) unmarshalField(field reflect.Value, rv reflect.Value) error {
 		}
 		field.Set(rv)
 
+	case reflect.Bool:
+		s, ok := rv.Interface().(string)
+		if !ok {
+			return fmt.Errorf("%v: bool and %v", errUnmarshalTypeMismatch, rv.Type())
+		}
+
+		b, ok := parseBool(s)
+		if !ok {
+			return fmt.Errorf("%v: %q is not a boolean", errUnmarshalTypeMismatch, s)
+		}
+		field.SetBool(b)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		s, ok := rv.Interface().(string)
+		if !ok {
+			return fmt.Errorf("%v: %v and %v", errUnmarshalTypeMismatch, field.Type(), rv.Type())
+		}
+
+		// ParseInt checks that the value fits in the field
+		n, err := strconv.ParseInt(s, 10, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%v: %v", errUnmarshalTypeMismatch, err)
+		}
+		field.SetInt(n)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		s, ok := rv.Interface().(string)
+		if !ok {
+			return fmt.Errorf("%v: %v and %v", errUnmarshalTypeMismatch, field.Type(), rv.Type())
+		}
+
+		n, err := strconv.ParseUint(s, 10, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%v: %v", errUnmarshalTypeMismatch, err)
+		}
+		field.SetUint(n)
+
+	case reflect.Float32, reflect.Float64:
+		s, ok := rv.Interface().(string)
+		if !ok {
+			return fmt.Errorf("%v: %v and %v", errUnmarshalTypeMismatch, field.Type(), rv.Type())
+		}
+
+		f, err := strconv.ParseFloat(s, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%v: %v", errUnmarshalTypeMismatch, err)
+		}
+		field.SetFloat(f)
+
 	case reflect.Slice:
+		if isStructSlice(field.Type()) {
+			msg, ok := rv.Interface().(*Message)
+			if !ok {
+				return fmt.Errorf("%v: %v", errUnmarshalNonMessage, rv.Type())
+			}
+
+			return msg.unmarshalStructSlice(field, "", opts)
+		}
+
+		// Binary values are decoded as strings
+		if _, ok := field.Interface().([]byte); ok {
+			v, ok := rv.Interface().(string)
+			if !ok {
+				return fmt.Errorf("%v: []byte and %v", errUnmarshalTypeMismatch, rv.Type())
+			}
+			field.SetBytes([]byte(v))
+
+			return nil
+		}
+
 		if _, ok := rv.Interface().([]string); !ok {
 			return fmt.Errorf("%v: []string and %v", errUnmarshalTypeMismatch, rv.Type())
 		}
@@ -843,12 +3143,49 @@ func (m *Message) unmarshalField(field reflect.Value, rv reflect.Value) error {
 			return nil
 		}
 
+		// Pointers to anything but structs are set to point to the value
+		if field.Type().Elem().Kind() != reflect.Struct {
+			elem := reflect.New(field.Type().Elem())
+			if err := m.unmarshalField(elem.Elem(), rv, opts); err != nil {
+				return err
+			}
+			field.Set(elem)
+
+			return nil
+		}
+
+		msg, ok := rv.Interface().(*Message)
+		if !ok {
+			return fmt.Errorf("%v: %v", errUnmarshalNonMessage, rv.Type())
+		}
+
+		if field.IsNil() {
+			field.Set(reflect.New(field.Type().Elem()))
+		}
+
+		return msg.unmarshal(field.Interface(), opts)
+
+	case reflect.Map:
 		msg, ok := rv.Interface().(*Message)
 		if !ok {
 			return fmt.Errorf("%v: %v", errUnmarshalNonMessage, rv.Type())
 		}
 
-		return msg.unmarshal(field.Interface())
+		return msg.unmarshalMap(field, opts)
+
+	case reflect.Interface:
+		if field.NumMethod() > 0 {
+			return fmt.Errorf("%v: %v and %v", errUnmarshalTypeMismatch, field.Type(), rv.Type())
+		}
+
+		// Sections are given as nested maps, like Message.ToMap
+		v := rv.Interface()
+		if msg, ok := v.(*Message); ok {
+			field.Set(reflect.ValueOf(msg.ToMap()))
+
+			return nil
+		}
+		field.Set(reflect.ValueOf(cloneElement(v)))
 
 	case reflect.Struct:
 		msg, ok := rv.Interface().(*Message)
@@ -857,7 +3194,7 @@ func (m *Message) unmarshalField(field reflect.Value, rv reflect.Value) error {
 		}
 
 		fp := reflect.New(field.Type())
-		if err := msg.unmarshal(fp.Interface()); err != nil {
+		if err := msg.unmarshal(fp.Interface(), opts); err != nil {
 			return err
 		}
 
@@ -866,3 +3203,120 @@ func (m *Message) unmarshalField(field reflect.Value, rv reflect.Value) error {
 
 	return nil
 }
+
+// unmarshalPrefixed sets the map field to an entry for each key of m that begins with
+// prefix, keyed by the remainder of the key. Keys whose values are sections are only
+// included if the map's values are structs or maps, and other keys only if not.
+func (m *Message) unmarshalPrefixed(prefix string, field reflect.Value, opts UnmarshalOptions) error {
+	if field.Kind() != reflect.Map {
+		return fmt.Errorf("%v: prefix option on %v", errUnmarshalTypeMismatch, field.Type())
+	}
+
+	et := field.Type().Elem()
+	if et.Kind() == reflect.Ptr {
+		et = et.Elem()
+	}
+	sections := et.Kind() == reflect.Struct || et.Kind() == reflect.Map
+
+	entries := NewMessage()
+	for _, k := range m.Keys() {
+		suffix, ok := strings.CutPrefix(k, prefix)
+		if !ok {
+			continue
+		}
+
+		if _, isSection := m.get(k).(*Message); isSection != sections {
+			continue
+		}
+
+		if err := entries.addItem(suffix, m.data[k]); err != nil {
+			return err
+		}
+	}
+
+	if len(entries.keys) == 0 {
+		return nil
+	}
+
+	return entries.unmarshalMap(field, opts)
+}
+
+// unmarshalMap adds an entry to the map field for each element of m, keyed by
+// the element's key. The map is allocated if it is nil.
+func (m *Message) unmarshalMap(field reflect.Value, opts UnmarshalOptions) error {
+	ft := field.Type()
+	if ft.Key().Kind() != reflect.String {
+		return fmt.Errorf("%v: map key %v", errUnmarshalTypeMismatch, ft.Key().Kind())
+	}
+
+	if field.IsNil() {
+		field.Set(reflect.MakeMap(ft))
+	}
+
+	for _, k := range m.Keys() {
+		elem := reflect.New(ft.Elem()).Elem()
+		if err := m.unmarshalField(elem, reflect.ValueOf(m.get(k)), opts); err != nil {
+			return err
+		}
+
+		field.SetMapIndex(reflect.ValueOf(k).Convert(ft.Key()), elem)
+	}
+
+	return nil
+}
+
+// lookupFold returns the value of the first key of m that matches key when both are
+// folded, i.e. compared case-insensitively with '-' and '_' treated as equivalent.
+func (m *Message) lookupFold(key string) (interface{}, bool) {
+	key = foldKey(key)
+
+	for _, k := range m.keys {
+		if foldKey(k) == key {
+			return m.get(k), true
+		}
+	}
+
+	return nil, false
+}
+
+// foldKey returns the folded form of key.
+func foldKey(key string) string {
+	return strings.ReplaceAll(strings.ToLower(key), "-", "_")
+}
+
+// unmarshalStructSlice sets the slice of structs field to an element for each subsection
+// of m, in order. If sectionKey is given, the name of each subsection is unmarshaled as the
+// value of that key.
+func (m *Message) unmarshalStructSlice(field reflect.Value, sectionKey string, opts UnmarshalOptions) error {
+	keys := m.Keys()
+	elems := reflect.MakeSlice(field.Type(), len(keys), len(keys))
+
+	for i, k := range keys {
+		v := m.get(k)
+
+		section, ok := v.(*Message)
+		if !ok {
+			return fmt.Errorf("%v: %v", errUnmarshalNonMessage, reflect.TypeOf(v))
+		}
+
+		if sectionKey != "" {
+			section = section.Clone()
+			if err := section.Set(sectionKey, k); err != nil {
+				return err
+			}
+		}
+
+		elem := elems.Index(i)
+		if elem.Kind() == reflect.Ptr {
+			elem.Set(reflect.New(elem.Type().Elem()))
+			elem = elem.Elem()
+		}
+
+		if err := section.unmarshalValue(elem, opts); err != nil {
+			return err
+		}
+	}
+	field.Set(elems)
+
+	return nil
+}
@@ -0,0 +1,60 @@
+// Copyright (C) 2019 Nick Rosbrook
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build go1.23
+
+package vici
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMessageAll(t *testing.T) {
+	var keys []string
+
+	for k, v := range goldMessage.All() {
+		keys = append(keys, k)
+
+		if !reflect.DeepEqual(v, goldMessage.Get(k)) {
+			t.Errorf("Unexpected value for %v: %v", k, v)
+		}
+	}
+
+	if !reflect.DeepEqual(keys, goldMessage.Keys()) {
+		t.Errorf("Expected iteration in key order %v: received %v", goldMessage.Keys(), keys)
+	}
+
+	for k := range goldMessage.All() {
+		if k != "key1" {
+			t.Errorf("Expected iteration to stop after break: received %v", k)
+		}
+
+		break
+	}
+}
+
+func TestMessageAllRawMessage(t *testing.T) {
+	for k, v := range rawGoldMessage(t).All() {
+		if _, ok := v.(RawMessage); ok {
+			t.Errorf("Unexpected RawMessage yielded for %v", k)
+		}
+	}
+}
@@ -22,8 +22,21 @@ package vici
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/netip"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 var (
@@ -238,3 +251,2258 @@ func TestMessageSet(t *testing.T) {
 		t.Errorf("Expected unique message keys: found %v instances of 'key1'", len(indices))
 	}
 }
+
+func TestMessageTypedGetters(t *testing.T) {
+	if v, ok := goldMessage.GetString("key1"); !ok || v != "value1" {
+		t.Errorf("Expected 'key1' to be string 'value1': received %v, %v", v, ok)
+	}
+
+	if _, ok := goldMessage.GetString("section1"); ok {
+		t.Errorf("Expected GetString to fail for section")
+	}
+
+	section, ok := goldMessage.GetSection("section1")
+	if !ok {
+		t.Fatalf("Expected 'section1' to be a section")
+	}
+
+	if v, ok := section.GetList("list1"); !ok || !reflect.DeepEqual(v, []string{"item1", "item2"}) {
+		t.Errorf("Expected 'list1' to be a list: received %v, %v", v, ok)
+	}
+
+	if _, ok := section.GetList("invalid"); ok {
+		t.Errorf("Expected GetList to fail for non-existent key")
+	}
+
+	if _, ok := goldMessage.GetSection("key1"); ok {
+		t.Errorf("Expected GetSection to fail for key-value pair")
+	}
+}
+
+func TestMessageGetDefault(t *testing.T) {
+	if v := goldMessage.GetStringDefault("key1", "default"); v != "value1" {
+		t.Errorf("Expected 'key1' to be 'value1': received %v", v)
+	}
+
+	if v := goldMessage.GetStringDefault("rekey-time", "0"); v != "0" {
+		t.Errorf("Expected default for non-existent key: received %v", v)
+	}
+
+	if v := goldMessage.GetListDefault("key1", []string{"default"}); !reflect.DeepEqual(v, []string{"default"}) {
+		t.Errorf("Expected default for non-list element: received %v", v)
+	}
+}
+
+func TestMessageCoercingGetters(t *testing.T) {
+	m := &Message{
+		keys: []string{"up", "port", "bytes-in", "rekey-time", "bad"},
+		data: map[string]interface{}{
+			"up":         "yes",
+			"port":       "4500",
+			"bytes-in":   "18446744073709551615",
+			"rekey-time": "3600",
+			"bad":        "nope",
+		},
+	}
+
+	if v, err := m.GetBool("up"); err != nil || !v {
+		t.Errorf("Expected 'up' to be true: received %v, %v", v, err)
+	}
+
+	if v, err := m.GetInt("port"); err != nil || v != 4500 {
+		t.Errorf("Expected 'port' to be 4500: received %v, %v", v, err)
+	}
+
+	if v, err := m.GetUint64("bytes-in"); err != nil || v != 18446744073709551615 {
+		t.Errorf("Expected 'bytes-in' to be max uint64: received %v, %v", v, err)
+	}
+
+	if v, err := m.GetDuration("rekey-time"); err != nil || v != time.Hour {
+		t.Errorf("Expected 'rekey-time' to be 1h: received %v, %v", v, err)
+	}
+
+	if _, err := m.GetBool("bad"); err == nil {
+		t.Errorf("Expected error for malformed bool")
+	}
+
+	if _, err := m.GetInt("bad"); err == nil {
+		t.Errorf("Expected error for malformed int")
+	}
+
+	if _, err := m.GetDuration("invalid"); err == nil {
+		t.Errorf("Expected error for non-existent key")
+	}
+}
+
+func TestParseDurationOverflow(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected time.Duration
+		ok       bool
+	}{
+		{"9223372036", 9223372036 * time.Second, true},
+		{"9223372037", 0, false},
+		{"2562047h", 2562047 * time.Hour, true},
+		{"2562048h", 0, false},
+		{"106751d", 106751 * 24 * time.Hour, true},
+		{"106752d", 0, false},
+		{"-106752d", 0, false},
+	}
+
+	for _, tt := range tests {
+		d, err := parseDuration(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("Unexpected result parsing %v: %v", tt.in, err)
+			continue
+		}
+
+		if d != tt.expected {
+			t.Errorf("Unexpected duration parsing %v.\nExpected: %v\nReceived: %v", tt.in, tt.expected, d)
+		}
+	}
+}
+
+func TestMessagePath(t *testing.T) {
+	if v := goldMessage.GetPath("section1.sub-section.key2"); v != "value2" {
+		t.Errorf("Expected 'section1.sub-section.key2' to be 'value2': received %v", v)
+	}
+
+	if v := goldMessage.GetPath("key1.invalid"); v != nil {
+		t.Errorf("Expected nil for path through non-section: received %v", v)
+	}
+
+	m := NewMessage()
+
+	err := m.SetPath("children.net.remote-ts", []string{"10.0.0.0/8"})
+	if err != nil {
+		t.Errorf("Unexpected error setting path: %v", err)
+	}
+
+	if v, ok := m.GetPath("children.net.remote-ts").([]string); !ok || len(v) != 1 {
+		t.Errorf("Expected list at path: received %v", v)
+	}
+
+	err = m.SetPath("children.net.remote-ts.invalid", "value")
+	if err == nil {
+		t.Errorf("Expected error setting path through non-section")
+	}
+}
+
+func TestMessageSetPathUnchangedOnError(t *testing.T) {
+	m := NewMessage()
+	if err := m.SetPath("children.net.mode", "tunnel"); err != nil {
+		t.Fatalf("Unexpected error setting path: %v", err)
+	}
+	expected := m.ToMap()
+
+	for _, path := range []string{
+		"children.host.local-ts",
+		"children.net.esp.proposals",
+		"pools.pool." + strings.Repeat("k", maxKeyLength+1) + ".addrs",
+	} {
+		if err := m.SetPath(path, struct{}{}); err == nil {
+			t.Errorf("Expected error setting unsupported value at %v", path)
+		}
+
+		if !reflect.DeepEqual(m.ToMap(), expected) {
+			t.Errorf("Unexpected message after failing to set %v.\nExpected: %v\nReceived: %v", path, expected, m.ToMap())
+		}
+	}
+}
+
+func TestMessageClone(t *testing.T) {
+	c := goldMessage.Clone()
+
+	if !reflect.DeepEqual(c, goldMessage) {
+		t.Errorf("Cloned message does not equal gold message.\nExpected: %v\nReceived: %v", goldMessage, c)
+	}
+
+	// Modifying the clone must not affect the original
+	err := c.SetPath("section1.sub-section.key2", "modified")
+	if err != nil {
+		t.Errorf("Unexpected error setting path: %v", err)
+	}
+	c.GetPath("section1.list1").([]string)[0] = "modified"
+
+	if v := goldMessage.GetPath("section1.sub-section.key2"); v != "value2" {
+		t.Errorf("Expected original section to be unchanged: received %v", v)
+	}
+
+	if v := goldMessage.GetPath("section1.list1").([]string)[0]; v != "item1" {
+		t.Errorf("Expected original list to be unchanged: received %v", v)
+	}
+}
+
+func TestMessageMerge(t *testing.T) {
+	newBase := func() *Message {
+		return &Message{
+			keys: []string{"version", "local_addrs", "children"},
+			data: map[string]interface{}{
+				"version":     "2",
+				"local_addrs": []string{"10.0.0.1"},
+				"children": &Message{
+					keys: []string{"esp_proposals"},
+					data: map[string]interface{}{
+						"esp_proposals": []string{"aes128-sha256"},
+					},
+				},
+			},
+		}
+	}
+
+	overrides := &Message{
+		keys: []string{"version", "local_addrs", "children", "remote_addrs"},
+		data: map[string]interface{}{
+			"version":     "1",
+			"local_addrs": []string{"10.0.0.2"},
+			"children": &Message{
+				keys: []string{"esp_proposals", "mode"},
+				data: map[string]interface{}{
+					"esp_proposals": []string{"aes256-sha256"},
+					"mode":          "tunnel",
+				},
+			},
+			"remote_addrs": []string{"192.168.0.1"},
+		},
+	}
+
+	tests := []struct {
+		policy  MergePolicy
+		version string
+		addrs   []string
+	}{
+		{MergeOverwrite, "1", []string{"10.0.0.2"}},
+		{MergeKeepExisting, "2", []string{"10.0.0.1"}},
+		{MergeAppendLists, "1", []string{"10.0.0.1", "10.0.0.2"}},
+	}
+
+	for _, tt := range tests {
+		m := newBase()
+
+		if err := m.Merge(overrides, tt.policy); err != nil {
+			t.Errorf("Unexpected error merging with policy %v: %v", tt.policy, err)
+		}
+
+		if v := m.Get("version"); v != tt.version {
+			t.Errorf("Policy %v: expected version %v: received %v", tt.policy, tt.version, v)
+		}
+
+		if v := m.Get("local_addrs"); !reflect.DeepEqual(v, tt.addrs) {
+			t.Errorf("Policy %v: expected local_addrs %v: received %v", tt.policy, tt.addrs, v)
+		}
+
+		if v := m.GetPath("children.mode"); v != "tunnel" {
+			t.Errorf("Policy %v: expected sections to be merged: received %v", tt.policy, v)
+		}
+
+		expected := []string{"version", "local_addrs", "children", "remote_addrs"}
+		if !reflect.DeepEqual(m.Keys(), expected) {
+			t.Errorf("Policy %v: expected keys %v: received %v", tt.policy, expected, m.Keys())
+		}
+	}
+
+	if err := NewMessage().Merge(overrides, MergePolicy(42)); err == nil {
+		t.Errorf("Expected error merging with unknown policy")
+	}
+}
+
+func TestMessageDump(t *testing.T) {
+	expected := `key1 = value1
+section1 {
+  sub-section {
+    key2 = value2
+  }
+  list1 = [
+    item1
+    item2
+  ]
+}
+`
+	if s := goldMessage.String(); s != expected {
+		t.Errorf("Unexpected message string.\nExpected:\n%v\nReceived:\n%v", expected, s)
+	}
+
+	expected = `key1 = value1
+section1 {
+  sub-section = <redacted>
+  list1 = <redacted>
+}
+`
+	if s := goldMessage.Dump("sub-section", "list1"); s != expected {
+		t.Errorf("Unexpected redacted message dump.\nExpected:\n%v\nReceived:\n%v", expected, s)
+	}
+}
+
+func TestMessageBinaryRoundTrip(t *testing.T) {
+	b, err := goldMessage.MarshalBinary()
+	if err != nil {
+		t.Errorf("Unexpected error marshaling binary: %v", err)
+	}
+
+	if !bytes.Equal(b, goldMessageBytes) {
+		t.Errorf("Marshaled bytes do not equal gold bytes.\nExpected: %v\nReceived: %v", goldMessageBytes, b)
+	}
+
+	m := &Message{}
+	if err := m.UnmarshalBinary(b); err != nil {
+		t.Errorf("Unexpected error unmarshaling binary: %v", err)
+	}
+
+	if !reflect.DeepEqual(m.data, goldMessage.data) {
+		t.Errorf("Unmarshaled message does not equal gold message.\nExpected: %v\nReceived: %v", goldMessage, m)
+	}
+}
+
+func TestMessageWalk(t *testing.T) {
+	var paths []string
+
+	err := goldMessage.Walk(func(path []string, value interface{}) error {
+		paths = append(paths, strings.Join(path, "."))
+
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Unexpected error walking message: %v", err)
+	}
+
+	expected := []string{"key1", "section1", "section1.sub-section", "section1.sub-section.key2", "section1.list1"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Unexpected walk order.\nExpected: %v\nReceived: %v", expected, paths)
+	}
+
+	paths = nil
+
+	err = goldMessage.Walk(func(path []string, value interface{}) error {
+		paths = append(paths, strings.Join(path, "."))
+		if _, ok := value.(*Message); ok && len(path) > 1 {
+			return SkipSection
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Unexpected error walking message: %v", err)
+	}
+
+	expected = []string{"key1", "section1", "section1.sub-section", "section1.list1"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Unexpected walk order with skipped section.\nExpected: %v\nReceived: %v", expected, paths)
+	}
+}
+
+func TestNewMessageFromMap(t *testing.T) {
+	m, err := NewMessageFromMap(map[string]interface{}{
+		"section1": map[string]interface{}{
+			"sub-section": map[string]interface{}{
+				"key2": "value2",
+			},
+			"list1": []interface{}{"item1", "item2"},
+		},
+		"key1": "value1",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error building message from map: %v", err)
+	}
+
+	if v := m.GetPath("section1.sub-section.key2"); v != "value2" {
+		t.Errorf("Expected 'section1.sub-section.key2' to be 'value2': received %v", v)
+	}
+
+	if v := m.GetPath("section1.list1"); !reflect.DeepEqual(v, []string{"item1", "item2"}) {
+		t.Errorf("Expected 'section1.list1' to be a list: received %v", v)
+	}
+
+	expected := []string{"key1", "section1"}
+	if !reflect.DeepEqual(m.Keys(), expected) {
+		t.Errorf("Expected sorted keys %v: received %v", expected, m.Keys())
+	}
+
+	expected = []string{"list1", "sub-section"}
+	if section, _ := m.GetSection("section1"); !reflect.DeepEqual(section.Keys(), expected) {
+		t.Errorf("Expected sorted section keys %v: received %v", expected, section.Keys())
+	}
+
+	_, err = NewMessageFromMap(map[string]interface{}{"list": []interface{}{"item", 1}})
+	if err == nil {
+		t.Errorf("Expected error for unsupported list item type")
+	}
+
+	_, err = NewMessageFromMap(map[string]interface{}{"key": 1})
+	if err == nil {
+		t.Errorf("Expected error for unsupported value type")
+	}
+}
+
+func TestMessageToMap(t *testing.T) {
+	expected := map[string]interface{}{
+		"key1": "value1",
+		"section1": map[string]interface{}{
+			"sub-section": map[string]interface{}{
+				"key2": "value2",
+			},
+			"list1": []string{"item1", "item2"},
+		},
+	}
+
+	if m := goldMessage.ToMap(); !reflect.DeepEqual(m, expected) {
+		t.Errorf("Unexpected map from gold message.\nExpected: %v\nReceived: %v", expected, m)
+	}
+}
+
+func TestMessageHash(t *testing.T) {
+	a := NewMessage()
+	b := NewMessage()
+
+	for _, m := range []*Message{a, b} {
+		if err := m.SetPath("section.list", []string{"item1", "item2"}); err != nil {
+			t.Fatalf("Unexpected error setting path: %v", err)
+		}
+	}
+
+	// Add the same elements in a different order
+	if err := a.Set("key1", "value1"); err != nil {
+		t.Fatalf("Unexpected error setting key: %v", err)
+	}
+	if err := a.SetPath("section.key2", "value2"); err != nil {
+		t.Fatalf("Unexpected error setting path: %v", err)
+	}
+	if err := b.SetPath("section.key2", "value2"); err != nil {
+		t.Fatalf("Unexpected error setting path: %v", err)
+	}
+	if err := b.Set("key1", "value1"); err != nil {
+		t.Fatalf("Unexpected error setting key: %v", err)
+	}
+
+	if a.Hash() != b.Hash() {
+		t.Errorf("Expected equal hashes for messages with the same elements")
+	}
+
+	if err := b.SetPath("section.key2", "changed"); err != nil {
+		t.Fatalf("Unexpected error setting path: %v", err)
+	}
+
+	if a.Hash() == b.Hash() {
+		t.Errorf("Expected different hashes for messages with different elements")
+	}
+}
+
+func TestMessageSortKeys(t *testing.T) {
+	a := NewMessage()
+	b := NewMessage()
+
+	// Add the same elements in a different order
+	for _, kv := range [][2]string{{"key2", "value2"}, {"section.b", "b"}, {"section.a", "a"}, {"key1", "value1"}} {
+		if err := a.SetPath(kv[0], kv[1]); err != nil {
+			t.Fatalf("Unexpected error setting path: %v", err)
+		}
+	}
+	for _, kv := range [][2]string{{"section.a", "a"}, {"key1", "value1"}, {"section.b", "b"}, {"key2", "value2"}} {
+		if err := b.SetPath(kv[0], kv[1]); err != nil {
+			t.Fatalf("Unexpected error setting path: %v", err)
+		}
+	}
+
+	ca, err := a.MarshalCanonical()
+	if err != nil {
+		t.Fatalf("Unexpected error encoding canonical message: %v", err)
+	}
+	cb, err := b.MarshalCanonical()
+	if err != nil {
+		t.Fatalf("Unexpected error encoding canonical message: %v", err)
+	}
+
+	if !bytes.Equal(ca, cb) {
+		t.Errorf("Expected equal canonical encodings.\nExpected: %v\nReceived: %v", ca, cb)
+	}
+
+	// The messages themselves should not be modified
+	if keys := a.Keys(); !reflect.DeepEqual(keys, []string{"key2", "section", "key1"}) {
+		t.Errorf("Unexpected keys after canonical encoding: %v", keys)
+	}
+
+	a.SortKeys()
+
+	expected := []string{"key1", "key2", "section"}
+	if keys := a.Keys(); !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Unexpected keys after sorting.\nExpected: %v\nReceived: %v", expected, keys)
+	}
+
+	section, _ := a.GetSection("section")
+	if keys := section.Keys(); !reflect.DeepEqual(keys, []string{"a", "b"}) {
+		t.Errorf("Expected nested section keys to be sorted: %v", keys)
+	}
+
+	b2, err := a.encode()
+	if err != nil {
+		t.Fatalf("Unexpected error encoding message: %v", err)
+	}
+
+	if !bytes.Equal(b2, ca) {
+		t.Errorf("Expected sorted message to encode in canonical form.\nExpected: %v\nReceived: %v", ca, b2)
+	}
+}
+
+func TestMessageSetBeforeAfter(t *testing.T) {
+	m := NewMessage()
+
+	for _, k := range []string{"a", "b", "c"} {
+		if err := m.Set(k, k); err != nil {
+			t.Fatalf("Unexpected error setting key: %v", err)
+		}
+	}
+
+	if err := m.SetBefore("b", "x", "x"); err != nil {
+		t.Errorf("Unexpected error in SetBefore: %v", err)
+	}
+
+	if err := m.SetAfter("c", "y", "y"); err != nil {
+		t.Errorf("Unexpected error in SetAfter: %v", err)
+	}
+
+	// Move an existing key
+	if err := m.SetBefore("a", "c", "moved"); err != nil {
+		t.Errorf("Unexpected error in SetBefore: %v", err)
+	}
+
+	expected := []string{"c", "a", "x", "b", "y"}
+	if !reflect.DeepEqual(m.Keys(), expected) {
+		t.Errorf("Unexpected key order.\nExpected: %v\nReceived: %v", expected, m.Keys())
+	}
+
+	if v := m.Get("c"); v != "moved" {
+		t.Errorf("Expected value of moved key to be updated: received %v", v)
+	}
+
+	if err := m.SetAfter("invalid", "z", "z"); err == nil {
+		t.Errorf("Expected error for non-existent mark")
+	}
+}
+
+func TestMessageSetLengthValidation(t *testing.T) {
+	m := NewMessage()
+
+	long := strings.Repeat("x", maxValueLength+1)
+
+	if err := m.Set(strings.Repeat("k", maxKeyLength+1), "value"); err == nil {
+		t.Errorf("Expected error setting key longer than %v bytes", maxKeyLength)
+	}
+
+	if err := m.Set("key", long); err == nil {
+		t.Errorf("Expected error setting value longer than %v bytes", maxValueLength)
+	}
+
+	if err := m.Set("list", []string{"item", long}); err == nil {
+		t.Errorf("Expected error setting list item longer than %v bytes", maxValueLength)
+	}
+
+	if err := m.Set(strings.Repeat("k", maxKeyLength), long[1:]); err != nil {
+		t.Errorf("Unexpected error setting key and value of maximum length: %v", err)
+	}
+
+	if len(m.Keys()) != 1 {
+		t.Errorf("Expected only valid elements to be set: received %v", m.Keys())
+	}
+}
+
+func TestMessageDecodeLimits(t *testing.T) {
+	tests := []struct {
+		limits DecodeLimits
+		limit  string
+	}{
+		{DecodeLimits{MaxDepth: 1}, "depth"},
+		{DecodeLimits{MaxElements: 6}, "elements"},
+		{DecodeLimits{MaxSize: len(goldMessageBytes) - 1}, "size"},
+	}
+
+	for _, tt := range tests {
+		err := NewMessage().decodeWithOptions(goldMessageBytes, decodeOptions{limits: tt.limits})
+
+		dle, ok := err.(*DecodeLimitError)
+		if !ok {
+			t.Errorf("Expected *DecodeLimitError for limits %+v: received %v", tt.limits, err)
+
+			continue
+		}
+
+		if dle.Limit != tt.limit {
+			t.Errorf("Expected %v limit to be exceeded: received %v", tt.limit, dle.Limit)
+		}
+	}
+
+	// The gold message has a depth of 2, and 7 elements: key1, section1, sub-section,
+	// key2, list1, item1 and item2. The limits are exact, so the message is rejected
+	// if any of them is lowered, as checked above.
+	limits := DecodeLimits{MaxDepth: 2, MaxElements: 7, MaxSize: len(goldMessageBytes)}
+	if err := NewMessage().decodeWithOptions(goldMessageBytes, decodeOptions{limits: limits}); err != nil {
+		t.Errorf("Unexpected error decoding within limits: %v", err)
+	}
+}
+
+func TestMessageDecodeLazy(t *testing.T) {
+	for _, zeroCopy := range []bool{false, true} {
+		m := NewMessage()
+
+		err := m.decodeWithOptions(goldMessageBytes, decodeOptions{lazy: true, zeroCopy: zeroCopy})
+		if err != nil {
+			t.Errorf("Error decoding test bytes: %v", err)
+		}
+
+		section := m.data["section1"].(*Message)
+		if section.lazy == nil || len(section.keys) != 0 {
+			t.Errorf("Expected section to be decoded lazily")
+		}
+
+		if !reflect.DeepEqual(m.ToMap(), goldMessage.ToMap()) {
+			t.Errorf("Decoded message does not equal gold message.\nExpected: %v\nReceived: %v", goldMessage, m)
+		}
+	}
+
+	// Malformed sections must still be detected up front
+	bad := goldMessageBytes[:len(goldMessageBytes)-1]
+	if err := NewMessage().decodeWithOptions(bad, decodeOptions{lazy: true}); err == nil {
+		t.Errorf("Expected error decoding malformed section lazily")
+	}
+}
+
+func TestMessageEncodedLen(t *testing.T) {
+	if n := goldMessage.EncodedLen(); n != len(goldMessageBytes) {
+		t.Errorf("Expected encoded length %v: received %v", len(goldMessageBytes), n)
+	}
+
+	// key1, section1, sub-section, key2, list1, item1 and item2
+	if n := goldMessage.NumElements(); n != 7 {
+		t.Errorf("Expected 7 elements: received %v", n)
+	}
+}
+
+func TestMarshalMessageKeepEmpty(t *testing.T) {
+	type keepEmpty struct {
+		Key     string       `vici:"key,keepempty"`
+		List    []string     `vici:"list,keepempty"`
+		Section *testSection `vici:"section,keepempty"`
+		Omitted string       `vici:"omitted"`
+	}
+
+	m, err := MarshalMessage(keepEmpty{})
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling: %v", err)
+	}
+
+	expected := []string{"key", "list", "section"}
+	if !reflect.DeepEqual(m.Keys(), expected) {
+		t.Errorf("Expected empty fields %v to be marshaled: received %v", expected, m.Keys())
+	}
+
+	if !m.Has("key") || m.Get("key") != "" {
+		t.Errorf("Expected 'key' to be set to empty string: received %v", m.Get("key"))
+	}
+
+	if m.Has("omitted") {
+		t.Errorf("Expected empty field without keepempty to be omitted")
+	}
+
+	if _, err := m.encode(); err != nil {
+		t.Errorf("Unexpected error encoding message with empty elements: %v", err)
+	}
+}
+
+func TestMarshalMessageOmitEmpty(t *testing.T) {
+	type omitEmpty struct {
+		RekeyTime string   `vici:"rekey_time,omitempty"`
+		Proposals []string `vici:"proposals,omitempty"`
+		Both      string   `vici:"both,keepempty,omitempty"`
+		Version   string   `vici:"version,omitempty"`
+	}
+
+	m, err := MarshalMessage(omitEmpty{Version: "2"})
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling: %v", err)
+	}
+
+	expected := []string{"version"}
+	if !reflect.DeepEqual(m.Keys(), expected) {
+		t.Errorf("Expected only non-empty fields to be marshaled.\nExpected: %v\nReceived: %v", expected, m.Keys())
+	}
+}
+
+func TestMarshalMessageInline(t *testing.T) {
+	type ikeOptions struct {
+		Version   string   `vici:"version"`
+		Proposals []string `vici:"proposals"`
+	}
+
+	type authOptions struct {
+		Auth string `vici:"auth"`
+	}
+
+	type conn struct {
+		ikeOptions
+		Local      authOptions  `vici:",inline"`
+		LocalAddrs []string     `vici:"local_addrs"`
+		Remote     *authOptions `vici:"remote"`
+	}
+
+	in := conn{
+		ikeOptions: ikeOptions{Version: "2", Proposals: []string{"aes128-sha256"}},
+		Local:      authOptions{Auth: "psk"},
+		LocalAddrs: []string{"192.168.0.1"},
+		Remote:     &authOptions{Auth: "pubkey"},
+	}
+
+	m, err := MarshalMessage(in)
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling: %v", err)
+	}
+
+	expected := []string{"version", "proposals", "auth", "local_addrs", "remote"}
+	if !reflect.DeepEqual(m.Keys(), expected) {
+		t.Errorf("Unexpected keys for inlined fields.\nExpected: %v\nReceived: %v", expected, m.Keys())
+	}
+
+	out := conn{Remote: &authOptions{}}
+	if err := UnmarshalMessage(m, &out); err != nil {
+		t.Fatalf("Unexpected error unmarshaling: %v", err)
+	}
+
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("Unexpected unmarshaled value.\nExpected: %+v\nReceived: %+v", in, out)
+	}
+
+	type flattened struct {
+		Local authOptions `vici:"local,flatten"`
+	}
+
+	m, err = MarshalMessage(flattened{Local: authOptions{Auth: "psk"}})
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling: %v", err)
+	}
+
+	if !reflect.DeepEqual(m.Keys(), []string{"auth"}) {
+		t.Errorf("Expected flattened fields in parent section: received %v", m.Keys())
+	}
+
+	type bad struct {
+		Key string `vici:",inline"`
+	}
+
+	if _, err := MarshalMessage(bad{Key: "value"}); err == nil {
+		t.Errorf("Expected error inlining non-struct field")
+	}
+}
+
+func TestMarshalMessageMap(t *testing.T) {
+	type pool struct {
+		Addrs      string            `vici:"addrs"`
+		Attributes map[string]string `vici:"attributes"`
+		Empty      map[string]string `vici:"empty"`
+	}
+
+	m, err := MarshalMessage(pool{
+		Addrs: "10.0.0.0/24",
+		Attributes: map[string]string{
+			"dns":  "10.0.0.1",
+			"nbns": "10.0.0.2",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling: %v", err)
+	}
+
+	if m.Has("empty") {
+		t.Errorf("Expected nil map to be omitted")
+	}
+
+	attrs, ok := m.GetSection("attributes")
+	if !ok {
+		t.Fatalf("Expected map to be marshaled as a section")
+	}
+
+	expected := []string{"dns", "nbns"}
+	if !reflect.DeepEqual(attrs.Keys(), expected) {
+		t.Errorf("Unexpected section keys.\nExpected: %v\nReceived: %v", expected, attrs.Keys())
+	}
+
+	if v, _ := attrs.GetString("nbns"); v != "10.0.0.2" {
+		t.Errorf("Expected 'nbns' to be 10.0.0.2: received %v", v)
+	}
+
+	type badKey struct {
+		Map map[int]string `vici:"map"`
+	}
+
+	if _, err := MarshalMessage(badKey{Map: map[int]string{1: "one"}}); err == nil {
+		t.Errorf("Expected error marshaling map with non-string keys")
+	}
+}
+
+func TestMarshalMessageMapOfStructs(t *testing.T) {
+	type child struct {
+		LocalTS []string `vici:"local_ts"`
+		Mode    string   `vici:"mode"`
+	}
+
+	type conn struct {
+		Version  string           `vici:"version"`
+		Children map[string]child `vici:"children"`
+	}
+
+	m, err := MarshalMessage(conn{
+		Version: "2",
+		Children: map[string]child{
+			"net-2": {LocalTS: []string{"10.2.0.0/16"}, Mode: "tunnel"},
+			"net-1": {LocalTS: []string{"10.1.0.0/16"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling: %v", err)
+	}
+
+	children, ok := m.GetSection("children")
+	if !ok {
+		t.Fatalf("Expected map to be marshaled as a section")
+	}
+
+	expected := []string{"net-1", "net-2"}
+	if !reflect.DeepEqual(children.Keys(), expected) {
+		t.Errorf("Unexpected section keys.\nExpected: %v\nReceived: %v", expected, children.Keys())
+	}
+
+	if v := m.GetPath("children.net-2.mode"); v != "tunnel" {
+		t.Errorf("Expected children.net-2.mode to be tunnel: received %v", v)
+	}
+
+	if m.GetPath("children.net-1.mode") != nil {
+		t.Errorf("Expected empty field of map value to be omitted")
+	}
+
+	if v := m.GetPath("children.net-1.local_ts"); !reflect.DeepEqual(v, []string{"10.1.0.0/16"}) {
+		t.Errorf("Expected children.net-1.local_ts to be [10.1.0.0/16]: received %v", v)
+	}
+}
+
+func TestUnmarshalMessageMap(t *testing.T) {
+	type childSA struct {
+		Name  string `vici:"name"`
+		State string `vici:"state"`
+	}
+
+	type ikeSA struct {
+		State    string              `vici:"state"`
+		ChildSAs map[string]*childSA `vici:"child-sas"`
+		Attrs    map[string]string   `vici:"attrs"`
+	}
+
+	m := NewMessage()
+	for path, value := range map[string]string{
+		"state":                 "ESTABLISHED",
+		"child-sas.net-1.name":  "net-1",
+		"child-sas.net-1.state": "INSTALLED",
+		"child-sas.net-2.name":  "net-2",
+		"attrs.dns":             "10.0.0.1",
+	} {
+		if err := m.SetPath(path, value); err != nil {
+			t.Fatalf("Unexpected error setting path: %v", err)
+		}
+	}
+
+	sa := ikeSA{}
+	if err := UnmarshalMessage(m, &sa); err != nil {
+		t.Fatalf("Unexpected error unmarshaling: %v", err)
+	}
+
+	expected := ikeSA{
+		State: "ESTABLISHED",
+		ChildSAs: map[string]*childSA{
+			"net-1": {Name: "net-1", State: "INSTALLED"},
+			"net-2": {Name: "net-2"},
+		},
+		Attrs: map[string]string{"dns": "10.0.0.1"},
+	}
+
+	if !reflect.DeepEqual(sa, expected) {
+		t.Errorf("Unexpected unmarshaled value.\nExpected: %+v\nReceived: %+v", expected, sa)
+	}
+
+	bad := struct {
+		Attrs map[string]string `vici:"child-sas"`
+	}{}
+
+	if err := UnmarshalMessage(m, &bad); err == nil {
+		t.Errorf("Expected error unmarshaling sections into map[string]string")
+	}
+}
+
+func TestMarshalMessageBool(t *testing.T) {
+	type options struct {
+		Mobike     bool `vici:"mobike,keepempty"`
+		Aggressive bool `vici:"aggressive"`
+		Pull       bool `vici:"pull"`
+	}
+
+	m, err := MarshalMessage(options{Pull: true})
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling: %v", err)
+	}
+
+	expected := []string{"mobike", "pull"}
+	if !reflect.DeepEqual(m.Keys(), expected) {
+		t.Errorf("Unexpected keys.\nExpected: %v\nReceived: %v", expected, m.Keys())
+	}
+
+	if v, _ := m.GetString("mobike"); v != "no" {
+		t.Errorf("Expected false to be marshaled as no: received %v", v)
+	}
+
+	if v, _ := m.GetString("pull"); v != "yes" {
+		t.Errorf("Expected true to be marshaled as yes: received %v", v)
+	}
+
+	for _, s := range []string{"yes", "true", "1"} {
+		if err := m.Set("aggressive", s); err != nil {
+			t.Fatalf("Unexpected error setting key: %v", err)
+		}
+
+		opts := options{}
+		if err := UnmarshalMessage(m, &opts); err != nil {
+			t.Fatalf("Unexpected error unmarshaling: %v", err)
+		}
+
+		if !opts.Aggressive || !opts.Pull || opts.Mobike {
+			t.Errorf("Unexpected unmarshaled value for aggressive = %v: %+v", s, opts)
+		}
+	}
+
+	if err := m.Set("aggressive", "maybe"); err != nil {
+		t.Fatalf("Unexpected error setting key: %v", err)
+	}
+
+	if err := UnmarshalMessage(m, &options{}); err == nil {
+		t.Errorf("Expected error unmarshaling invalid boolean")
+	}
+}
+
+func TestMarshalMessageNumeric(t *testing.T) {
+	type options struct {
+		Port        uint16  `vici:"port"`
+		Keyingtries int     `vici:"keyingtries"`
+		Offset      int8    `vici:"offset"`
+		Bytes       uint64  `vici:"life_bytes"`
+		Ratio       float64 `vici:"ratio"`
+	}
+
+	in := options{Port: 4500, Keyingtries: -1, Bytes: 1 << 40, Ratio: 0.5}
+
+	m, err := MarshalMessage(in)
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling: %v", err)
+	}
+
+	for k, v := range map[string]string{"port": "4500", "keyingtries": "-1", "life_bytes": "1099511627776", "ratio": "0.5"} {
+		if s, _ := m.GetString(k); s != v {
+			t.Errorf("Expected %v to be marshaled as %v: received %v", k, v, s)
+		}
+	}
+
+	if m.Has("offset") {
+		t.Errorf("Expected zero number to be omitted")
+	}
+
+	out := options{}
+	if err := UnmarshalMessage(m, &out); err != nil {
+		t.Fatalf("Unexpected error unmarshaling: %v", err)
+	}
+
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("Unexpected unmarshaled value.\nExpected: %+v\nReceived: %+v", in, out)
+	}
+
+	for k, v := range map[string]string{"port": "65536", "offset": "-129", "life_bytes": "-1", "keyingtries": "many"} {
+		bad := NewMessage()
+		if err := bad.Set(k, v); err != nil {
+			t.Fatalf("Unexpected error setting key: %v", err)
+		}
+
+		if err := UnmarshalMessage(bad, &options{}); err == nil {
+			t.Errorf("Expected error unmarshaling %v = %v", k, v)
+		}
+	}
+}
+
+func TestMarshalMessageDuration(t *testing.T) {
+	type lifetimes struct {
+		RekeyTime time.Duration `vici:"rekey_time"`
+		DPDDelay  time.Duration `vici:"dpd_delay"`
+		LifeTime  time.Duration `vici:"life_time"`
+		Over      time.Duration `vici:"over_time"`
+	}
+
+	in := lifetimes{
+		RekeyTime: 4 * time.Hour,
+		DPDDelay:  30 * time.Second,
+		LifeTime:  90 * time.Minute,
+		Over:      48 * time.Hour,
+	}
+
+	m, err := MarshalMessage(in)
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling: %v", err)
+	}
+
+	for k, v := range map[string]string{"rekey_time": "4h", "dpd_delay": "30s", "life_time": "90m", "over_time": "2d"} {
+		if s, _ := m.GetString(k); s != v {
+			t.Errorf("Expected %v to be marshaled as %v: received %v", k, v, s)
+		}
+	}
+
+	out := lifetimes{}
+	if err := UnmarshalMessage(m, &out); err != nil {
+		t.Fatalf("Unexpected error unmarshaling: %v", err)
+	}
+
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("Unexpected unmarshaled value.\nExpected: %+v\nReceived: %+v", in, out)
+	}
+
+	// Responses contain plain numbers of seconds
+	if err := m.Set("rekey_time", "3600"); err != nil {
+		t.Fatalf("Unexpected error setting key: %v", err)
+	}
+
+	if err := UnmarshalMessage(m, &out); err != nil {
+		t.Fatalf("Unexpected error unmarshaling: %v", err)
+	}
+
+	if out.RekeyTime != time.Hour {
+		t.Errorf("Expected rekey_time to be 1h: received %v", out.RekeyTime)
+	}
+
+	if _, err := MarshalMessage(lifetimes{DPDDelay: 1500 * time.Millisecond}); err == nil {
+		t.Errorf("Expected error marshaling fractional seconds")
+	}
+}
+
+func TestMarshalMessageAddresses(t *testing.T) {
+	type conn struct {
+		LocalAddrs []net.IP       `vici:"local_addrs"`
+		RemoteAddr netip.Addr     `vici:"remote_addr"`
+		LocalTS    []netip.Prefix `vici:"local_ts"`
+		RemoteTS   *net.IPNet     `vici:"remote_ts"`
+		Subnet     net.IPNet      `vici:"subnet"`
+		VIP        net.IP         `vici:"vip"`
+		Pools      []*net.IPNet   `vici:"pools"`
+		Unset      netip.Prefix   `vici:"unset"`
+	}
+
+	_, remote, _ := net.ParseCIDR("10.2.0.0/16")
+	_, pool, _ := net.ParseCIDR("fd00::/64")
+
+	in := conn{
+		LocalAddrs: []net.IP{net.ParseIP("192.168.0.1"), net.ParseIP("2001:db8::1")},
+		RemoteAddr: netip.MustParseAddr("203.0.113.5"),
+		LocalTS:    []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")},
+		RemoteTS:   remote,
+		Subnet:     *remote,
+		VIP:        net.ParseIP("10.3.0.1"),
+		Pools:      []*net.IPNet{pool},
+	}
+
+	m, err := MarshalMessage(in)
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling: %v", err)
+	}
+
+	expected := map[string]interface{}{
+		"local_addrs": []string{"192.168.0.1", "2001:db8::1"},
+		"remote_addr": "203.0.113.5",
+		"local_ts":    []string{"10.1.0.0/16"},
+		"remote_ts":   "10.2.0.0/16",
+		"subnet":      "10.2.0.0/16",
+		"vip":         "10.3.0.1",
+		"pools":       []string{"fd00::/64"},
+	}
+
+	if mm := m.ToMap(); !reflect.DeepEqual(mm, expected) {
+		t.Errorf("Unexpected marshaled message.\nExpected: %v\nReceived: %v", expected, mm)
+	}
+
+	out := conn{}
+	if err := UnmarshalMessage(m, &out); err != nil {
+		t.Fatalf("Unexpected error unmarshaling: %v", err)
+	}
+
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("Unexpected unmarshaled value.\nExpected: %+v\nReceived: %+v", in, out)
+	}
+
+	if err := m.Set("remote_addr", "203.0.113.256"); err != nil {
+		t.Fatalf("Unexpected error setting key: %v", err)
+	}
+
+	if err := UnmarshalMessage(m, &conn{}); err == nil {
+		t.Errorf("Expected error unmarshaling malformed address")
+	}
+}
+
+func TestMarshalMessageCredentials(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Unexpected error generating key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "moon.strongswan.org"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatalf("Unexpected error creating certificate: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing certificate: %v", err)
+	}
+
+	type loadCert struct {
+		Type string            `vici:"type"`
+		Data *x509.Certificate `vici:"data"`
+		PEM  *x509.Certificate `vici:"pem,pem"`
+	}
+
+	m, err := MarshalMessage(loadCert{Type: "x509", Data: cert, PEM: cert})
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling: %v", err)
+	}
+
+	if v, _ := m.GetBytes("data"); !bytes.Equal(v, der) {
+		t.Errorf("Expected certificate to be marshaled as DER")
+	}
+
+	if v, _ := m.GetString("pem"); !strings.HasPrefix(v, "-----BEGIN CERTIFICATE-----") {
+		t.Errorf("Expected certificate to be marshaled as PEM: received %v", v)
+	}
+
+	out := loadCert{}
+	if err := UnmarshalMessage(m, &out); err != nil {
+		t.Fatalf("Unexpected error unmarshaling: %v", err)
+	}
+
+	if !out.Data.Equal(cert) || !out.PEM.Equal(cert) {
+		t.Errorf("Expected certificates to be unmarshaled from DER and PEM")
+	}
+
+	type loadKey struct {
+		Type string            `vici:"type"`
+		Data crypto.PrivateKey `vici:"data,pem"`
+	}
+
+	m, err = MarshalMessage(loadKey{Type: "any", Data: key})
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling: %v", err)
+	}
+
+	v, _ := m.GetBytes("data")
+	block, _ := pem.Decode(v)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		t.Fatalf("Expected key to be marshaled as a PEM encoded PKCS #8 key: received %s", v)
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing marshaled key: %v", err)
+	}
+
+	if !key.Equal(parsed) {
+		t.Errorf("Expected marshaled key to match original key")
+	}
+}
+
+// testMode is a MessageMarshaler and MessageUnmarshaler.
+type testMode int
+
+const (
+	testModeTunnel testMode = iota + 1
+	testModeTransport
+)
+
+func (t testMode) MarshalVici() (interface{}, error) {
+	switch t {
+	case testModeTunnel:
+		return "tunnel", nil
+	case testModeTransport:
+		return "transport", nil
+	}
+
+	return nil, errors.New("unknown mode")
+}
+
+func (t *testMode) UnmarshalVici(value interface{}) error {
+	switch value {
+	case "tunnel":
+		*t = testModeTunnel
+	case "transport":
+		*t = testModeTransport
+	default:
+		return errors.New("unknown mode")
+	}
+
+	return nil
+}
+
+func TestMarshalMessageMarshaler(t *testing.T) {
+	type child struct {
+		Mode     testMode            `vici:"mode"`
+		ModePtr  *testMode           `vici:"mode_ptr"`
+		Children map[string]testMode `vici:"children"`
+	}
+
+	transport := testModeTransport
+	in := child{
+		Mode:     testModeTunnel,
+		ModePtr:  &transport,
+		Children: map[string]testMode{"net": testModeTransport},
+	}
+
+	m, err := MarshalMessage(in)
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling: %v", err)
+	}
+
+	if v, _ := m.GetString("mode"); v != "tunnel" {
+		t.Errorf("Expected mode to be marshaled as tunnel: received %v", v)
+	}
+
+	if v := m.GetPath("children.net"); v != "transport" {
+		t.Errorf("Expected children.net to be marshaled as transport: received %v", v)
+	}
+
+	out := child{}
+	if err := UnmarshalMessage(m, &out); err != nil {
+		t.Fatalf("Unexpected error unmarshaling: %v", err)
+	}
+
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("Unexpected unmarshaled value.\nExpected: %+v\nReceived: %+v", in, out)
+	}
+
+	if _, err := MarshalMessage(child{Mode: 3}); err == nil {
+		t.Errorf("Expected error from MarshalVici to be returned")
+	}
+}
+
+// testProtocol implements encoding.TextMarshaler and encoding.TextUnmarshaler.
+type testProtocol struct {
+	name string
+}
+
+func (p testProtocol) MarshalText() ([]byte, error) {
+	if p.name == "" {
+		return nil, errors.New("empty protocol")
+	}
+
+	return []byte(p.name), nil
+}
+
+func (p *testProtocol) UnmarshalText(text []byte) error {
+	p.name = strings.ToLower(string(text))
+
+	return nil
+}
+
+func TestMarshalMessageTextMarshaler(t *testing.T) {
+	type options struct {
+		Protocol  testProtocol   `vici:"protocol"`
+		Protocols []testProtocol `vici:"protocols"`
+		Expires   time.Time      `vici:"expires"`
+		Optional  *testProtocol  `vici:"optional"`
+	}
+
+	in := options{
+		Protocol:  testProtocol{"esp"},
+		Protocols: []testProtocol{{"ah"}, {"esp"}},
+		Expires:   time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC),
+		Optional:  &testProtocol{"ah"},
+	}
+
+	m, err := MarshalMessage(in)
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling: %v", err)
+	}
+
+	expected := map[string]interface{}{
+		"protocol":  "esp",
+		"protocols": []string{"ah", "esp"},
+		"expires":   "2020-01-01T00:00:00Z",
+		"optional":  "ah",
+	}
+
+	if mm := m.ToMap(); !reflect.DeepEqual(mm, expected) {
+		t.Errorf("Unexpected marshaled message.\nExpected: %v\nReceived: %v", expected, mm)
+	}
+
+	out := options{}
+	if err := UnmarshalMessage(m, &out); err != nil {
+		t.Fatalf("Unexpected error unmarshaling: %v", err)
+	}
+
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("Unexpected unmarshaled value.\nExpected: %+v\nReceived: %+v", in, out)
+	}
+
+	if _, err := MarshalMessage(options{Protocols: []testProtocol{{}}}); err == nil {
+		t.Errorf("Expected error from MarshalText to be returned")
+	}
+}
+
+func TestUnmarshalMessageGenericMap(t *testing.T) {
+	mm := map[string]interface{}{}
+	if err := UnmarshalMessage(goldMessage, &mm); err != nil {
+		t.Fatalf("Unexpected error unmarshaling: %v", err)
+	}
+
+	if expected := goldMessage.ToMap(); !reflect.DeepEqual(mm, expected) {
+		t.Errorf("Unexpected unmarshaled map.\nExpected: %v\nReceived: %v", expected, mm)
+	}
+
+	var generic struct {
+		Key     interface{}            `vici:"key1"`
+		Section map[string]interface{} `vici:"section1"`
+	}
+	if err := UnmarshalMessage(goldMessage, &generic); err != nil {
+		t.Fatalf("Unexpected error unmarshaling: %v", err)
+	}
+
+	if generic.Key != "value1" {
+		t.Errorf("Expected interface{} field to be value1: received %v", generic.Key)
+	}
+
+	expected := map[string]interface{}{
+		"sub-section": map[string]interface{}{"key2": "value2"},
+		"list1":       []string{"item1", "item2"},
+	}
+	if !reflect.DeepEqual(generic.Section, expected) {
+		t.Errorf("Unexpected nested map.\nExpected: %v\nReceived: %v", expected, generic.Section)
+	}
+
+	if err := UnmarshalMessage(goldMessage, &map[int]string{}); err == nil {
+		t.Errorf("Expected error unmarshaling into map with non-string keys")
+	}
+}
+
+func TestUnmarshalMessageRequired(t *testing.T) {
+	type child struct {
+		Name    string   `vici:"name,required"`
+		LocalTS []string `vici:"local-ts,required"`
+		Mode    string   `vici:"mode"`
+	}
+
+	m := NewMessage()
+	if err := m.Set("name", "net-1"); err != nil {
+		t.Fatalf("Unexpected error setting key: %v", err)
+	}
+
+	err := UnmarshalMessage(m, &child{})
+	if err == nil {
+		t.Fatalf("Expected error unmarshaling message missing required field")
+	}
+
+	if !strings.Contains(err.Error(), "local-ts") {
+		t.Errorf("Expected error to name the missing field: received %v", err)
+	}
+
+	if err := m.Set("local-ts", []string{"10.1.0.0/16"}); err != nil {
+		t.Fatalf("Unexpected error setting key: %v", err)
+	}
+
+	if err := UnmarshalMessage(m, &child{}); err != nil {
+		t.Errorf("Unexpected error unmarshaling message with required fields: %v", err)
+	}
+}
+
+func TestMarshalMessageDefault(t *testing.T) {
+	type conn struct {
+		Version     int           `vici:"version,default=2"`
+		Mobike      bool          `vici:"mobike,default=no"`
+		RekeyTime   time.Duration `vici:"rekey_time,default=4h"`
+		RemoteAddrs []string      `vici:"remote_addrs,default=%any"`
+		Encap       string        `vici:"encap"`
+	}
+
+	m, err := MarshalMessage(conn{RekeyTime: time.Hour})
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling: %v", err)
+	}
+
+	expected := map[string]interface{}{
+		"version":      "2",
+		"mobike":       "no",
+		"rekey_time":   "1h",
+		"remote_addrs": "%any",
+	}
+
+	if mm := m.ToMap(); !reflect.DeepEqual(mm, expected) {
+		t.Errorf("Unexpected marshaled message.\nExpected: %v\nReceived: %v", expected, mm)
+	}
+
+	if !reflect.DeepEqual(m.Keys(), []string{"version", "mobike", "rekey_time", "remote_addrs"}) {
+		t.Errorf("Expected defaults to be marshaled in field order: received %v", m.Keys())
+	}
+}
+
+func TestMarshalOptionsDeriveKeys(t *testing.T) {
+	type child struct {
+		LocalTS  []string
+		Mode     string `vici:"mode"`
+		internal string
+	}
+
+	type conn struct {
+		Version    string
+		RekeyTime  time.Duration
+		DPDDelay   time.Duration
+		IKEVersion string `vici:"-"`
+		Children   map[string]child
+	}
+
+	in := conn{
+		Version:    "2",
+		RekeyTime:  time.Hour,
+		DPDDelay:   30 * time.Second,
+		IKEVersion: "skipped",
+		Children:   map[string]child{"net": {LocalTS: []string{"10.1.0.0/16"}, Mode: "tunnel", internal: "x"}},
+	}
+
+	m, err := MarshalOptions{DeriveKeys: true}.Marshal(in)
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling: %v", err)
+	}
+
+	expected := map[string]interface{}{
+		"version":    "2",
+		"rekey_time": "1h",
+		"dpd_delay":  "30s",
+		"children": map[string]interface{}{
+			"net": map[string]interface{}{
+				"local_ts": []string{"10.1.0.0/16"},
+				"mode":     "tunnel",
+			},
+		},
+	}
+
+	if mm := m.ToMap(); !reflect.DeepEqual(mm, expected) {
+		t.Errorf("Unexpected marshaled message.\nExpected: %v\nReceived: %v", expected, mm)
+	}
+
+	// Untagged fields are not marshaled by default
+	m, err = MarshalMessage(in)
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling: %v", err)
+	}
+
+	if len(m.Keys()) != 0 {
+		t.Errorf("Expected untagged fields to be skipped by default: received %v", m.Keys())
+	}
+}
+
+func TestUnmarshalOptionsFoldKeys(t *testing.T) {
+	type child struct {
+		LocalTS  []string `vici:"local_ts,required"`
+		State    string   `vici:"state"`
+		ReqID    string   `vici:"reqid"`
+		RekeyIn  string   `vici:"rekey-time"`
+		Protocol string   `vici:"protocol"`
+	}
+
+	m := NewMessage()
+	for k, v := range map[string]interface{}{
+		"local-ts":   []string{"10.1.0.0/16"},
+		"STATE":      "INSTALLED",
+		"reqid":      "1",
+		"Rekey_Time": "3600",
+	} {
+		if err := m.Set(k, v); err != nil {
+			t.Fatalf("Unexpected error setting key: %v", err)
+		}
+	}
+
+	if err := UnmarshalMessage(m, &child{}); err == nil {
+		t.Errorf("Expected keys not to be folded by default")
+	}
+
+	out := child{}
+	if err := (UnmarshalOptions{FoldKeys: true}).Unmarshal(m, &out); err != nil {
+		t.Fatalf("Unexpected error unmarshaling: %v", err)
+	}
+
+	expected := child{
+		LocalTS: []string{"10.1.0.0/16"},
+		State:   "INSTALLED",
+		ReqID:   "1",
+		RekeyIn: "3600",
+	}
+
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("Unexpected unmarshaled value.\nExpected: %+v\nReceived: %+v", expected, out)
+	}
+}
+
+func TestUnmarshalMessageTo(t *testing.T) {
+	tm, err := UnmarshalMessageTo[testMessage](goldMarshaled)
+	if err != nil {
+		t.Fatalf("Unexpected error unmarshaling: %v", err)
+	}
+
+	if !reflect.DeepEqual(tm, goldUnmarshaled) {
+		t.Errorf("Unexpected unmarshaled value.\nExpected: %+v\nReceived: %+v", goldUnmarshaled, tm)
+	}
+
+	mm, err := UnmarshalMessageTo[map[string]interface{}](goldMessage)
+	if err != nil {
+		t.Fatalf("Unexpected error unmarshaling: %v", err)
+	}
+
+	if expected := goldMessage.ToMap(); !reflect.DeepEqual(mm, expected) {
+		t.Errorf("Unexpected unmarshaled map.\nExpected: %v\nReceived: %v", expected, mm)
+	}
+
+	if _, err := UnmarshalMessageTo[string](goldMessage); err == nil {
+		t.Errorf("Expected error unmarshaling into non-struct type")
+	}
+}
+
+func TestMarshalMessagePrimitivePointers(t *testing.T) {
+	type options struct {
+		Mobike      *bool   `vici:"mobike"`
+		Keyingtries *int    `vici:"keyingtries"`
+		Encap       *bool   `vici:"encap"`
+		Pools       *string `vici:"pools"`
+		Unset       *string `vici:"unset"`
+	}
+
+	mobike, keyingtries, encap, pools := false, 0, true, ""
+	in := options{
+		Mobike:      &mobike,
+		Keyingtries: &keyingtries,
+		Encap:       &encap,
+		Pools:       &pools,
+	}
+
+	m, err := MarshalMessage(in)
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling: %v", err)
+	}
+
+	expected := map[string]interface{}{
+		"mobike":      "no",
+		"keyingtries": "0",
+		"encap":       "yes",
+		"pools":       "",
+	}
+
+	if mm := m.ToMap(); !reflect.DeepEqual(mm, expected) {
+		t.Errorf("Unexpected marshaled message.\nExpected: %v\nReceived: %v", expected, mm)
+	}
+
+	out := options{}
+	if err := UnmarshalMessage(m, &out); err != nil {
+		t.Fatalf("Unexpected error unmarshaling: %v", err)
+	}
+
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("Unexpected unmarshaled value.\nExpected: %+v\nReceived: %+v", in, out)
+	}
+
+	if out.Unset != nil {
+		t.Errorf("Expected pointer to remain nil for absent key: received %v", *out.Unset)
+	}
+}
+
+func TestMarshalMessageNilPointerKeepEmpty(t *testing.T) {
+	type options struct {
+		Mobike      *bool `vici:"mobike,keepempty"`
+		Keyingtries *int  `vici:"keyingtries,keepempty"`
+	}
+
+	m, err := MarshalMessage(options{})
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling: %v", err)
+	}
+
+	expected := map[string]interface{}{
+		"mobike":      "",
+		"keyingtries": "",
+	}
+
+	if mm := m.ToMap(); !reflect.DeepEqual(mm, expected) {
+		t.Errorf("Unexpected marshaled message.\nExpected: %v\nReceived: %v", expected, mm)
+	}
+}
+
+func TestMarshalMessageStructSlice(t *testing.T) {
+	type child struct {
+		Name    string   `vici:"name"`
+		LocalTS []string `vici:"local_ts"`
+	}
+
+	type auth struct {
+		Auth string `vici:"auth"`
+	}
+
+	type conn struct {
+		Children []child `vici:"children,key=name"`
+		Rounds   []*auth `vici:"rounds"`
+	}
+
+	in := conn{
+		Children: []child{
+			{Name: "net-2", LocalTS: []string{"10.2.0.0/16"}},
+			{Name: "net-1", LocalTS: []string{"10.1.0.0/16"}},
+		},
+		Rounds: []*auth{{Auth: "pubkey"}, {Auth: "eap"}},
+	}
+
+	m, err := MarshalMessage(in)
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling: %v", err)
+	}
+
+	expected := map[string]interface{}{
+		"children": map[string]interface{}{
+			"net-2": map[string]interface{}{"local_ts": []string{"10.2.0.0/16"}},
+			"net-1": map[string]interface{}{"local_ts": []string{"10.1.0.0/16"}},
+		},
+		"rounds": map[string]interface{}{
+			"1": map[string]interface{}{"auth": "pubkey"},
+			"2": map[string]interface{}{"auth": "eap"},
+		},
+	}
+
+	if mm := m.ToMap(); !reflect.DeepEqual(mm, expected) {
+		t.Errorf("Unexpected marshaled message.\nExpected: %v\nReceived: %v", expected, mm)
+	}
+
+	children, _ := m.GetSection("children")
+	if !reflect.DeepEqual(children.Keys(), []string{"net-2", "net-1"}) {
+		t.Errorf("Expected subsections in slice order: received %v", children.Keys())
+	}
+
+	out := conn{}
+	if err := UnmarshalMessage(m, &out); err != nil {
+		t.Fatalf("Unexpected error unmarshaling: %v", err)
+	}
+
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("Unexpected unmarshaled value.\nExpected: %+v\nReceived: %+v", in, out)
+	}
+
+	dup := conn{Children: []child{{Name: "net"}, {Name: "net"}}}
+	if _, err := MarshalMessage(dup); err == nil {
+		t.Errorf("Expected error marshaling duplicate subsection names")
+	}
+}
+
+func TestMarshalOptionsTagKey(t *testing.T) {
+	type conn struct {
+		Version   string   `json:"version"`
+		Proposals []string `json:"proposals,omitempty"`
+		Internal  string   `json:"-"`
+		Other     string   `vici:"other"`
+	}
+
+	in := conn{Version: "2", Proposals: []string{"aes128-sha256"}, Internal: "x", Other: "y"}
+
+	m, err := MarshalOptions{TagKey: "json"}.Marshal(in)
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling: %v", err)
+	}
+
+	expected := []string{"version", "proposals"}
+	if !reflect.DeepEqual(m.Keys(), expected) {
+		t.Errorf("Unexpected keys.\nExpected: %v\nReceived: %v", expected, m.Keys())
+	}
+
+	out := conn{}
+	if err := (UnmarshalOptions{TagKey: "json"}).Unmarshal(m, &out); err != nil {
+		t.Fatalf("Unexpected error unmarshaling: %v", err)
+	}
+
+	if out.Version != "2" || !reflect.DeepEqual(out.Proposals, in.Proposals) {
+		t.Errorf("Unexpected unmarshaled value: %+v", out)
+	}
+
+	// The default tag key is unaffected
+	m, err = MarshalMessage(in)
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling: %v", err)
+	}
+
+	if !reflect.DeepEqual(m.Keys(), []string{"other"}) {
+		t.Errorf("Expected only vici tags to be used by default: received %v", m.Keys())
+	}
+}
+
+type testValidatedChild struct {
+	Mode string `vici:"mode"`
+}
+
+func (c testValidatedChild) Validate() error {
+	if c.Mode != "tunnel" && c.Mode != "transport" {
+		return fmt.Errorf("invalid mode %q", c.Mode)
+	}
+
+	return nil
+}
+
+type testValidatedConn struct {
+	Version  string                        `vici:"version"`
+	Children map[string]testValidatedChild `vici:"children"`
+}
+
+func (c *testValidatedConn) Validate() error {
+	if c.Version != "1" && c.Version != "2" {
+		return fmt.Errorf("invalid version %q", c.Version)
+	}
+
+	return nil
+}
+
+func TestMarshalMessageValidate(t *testing.T) {
+	valid := testValidatedConn{
+		Version:  "2",
+		Children: map[string]testValidatedChild{"net": {Mode: "tunnel"}},
+	}
+
+	if _, err := MarshalMessage(valid); err != nil {
+		t.Errorf("Unexpected error marshaling valid struct: %v", err)
+	}
+
+	invalid := valid
+	invalid.Version = "3"
+
+	if _, err := MarshalMessage(&invalid); err == nil {
+		t.Errorf("Expected validation error for invalid struct")
+	}
+
+	nested := valid
+	nested.Children = map[string]testValidatedChild{"net": {Mode: "tunel"}}
+
+	_, err := MarshalMessage(nested)
+	if err == nil {
+		t.Fatalf("Expected validation error for invalid nested struct")
+	}
+
+	if !strings.Contains(err.Error(), "tunel") {
+		t.Errorf("Expected error to contain validation failure: received %v", err)
+	}
+}
+
+func TestMessageMarshalInto(t *testing.T) {
+	type ike struct {
+		Version   string   `vici:"version"`
+		Proposals []string `vici:"proposals"`
+	}
+
+	type addrs struct {
+		LocalAddrs []string `vici:"local_addrs"`
+	}
+
+	m := NewMessage()
+	if err := m.Set("version", "1"); err != nil {
+		t.Fatalf("Unexpected error setting key: %v", err)
+	}
+	if err := m.Set("pools", []string{"pool-1"}); err != nil {
+		t.Fatalf("Unexpected error setting key: %v", err)
+	}
+
+	if err := m.MarshalInto(ike{Version: "2", Proposals: []string{"aes128-sha256"}}); err != nil {
+		t.Fatalf("Unexpected error marshaling into message: %v", err)
+	}
+
+	if err := m.MarshalInto(&addrs{LocalAddrs: []string{"192.168.0.1"}}); err != nil {
+		t.Fatalf("Unexpected error marshaling into message: %v", err)
+	}
+
+	expected := []string{"version", "pools", "proposals", "local_addrs"}
+	if !reflect.DeepEqual(m.Keys(), expected) {
+		t.Errorf("Unexpected keys.\nExpected: %v\nReceived: %v", expected, m.Keys())
+	}
+
+	if v, _ := m.GetString("version"); v != "2" {
+		t.Errorf("Expected version to be overwritten: received %v", v)
+	}
+
+	if err := m.MarshalInto("not a struct"); err == nil {
+		t.Errorf("Expected error marshaling non-struct into message")
+	}
+}
+
+func TestUnmarshalSection(t *testing.T) {
+	m := NewMessage()
+	for path, value := range map[string]interface{}{
+		"gw-gw.state":                    "ESTABLISHED",
+		"gw-gw.child-sas.net-1.name":     "net-1",
+		"gw-gw.child-sas.net-1.local-ts": []string{"10.1.0.0/16"},
+		"gw-gw.child-sas.net-2.name":     "net-2",
+	} {
+		if err := m.SetPath(path, value); err != nil {
+			t.Fatalf("Unexpected error setting path: %v", err)
+		}
+	}
+
+	type childSA struct {
+		Name    string   `vici:"name"`
+		LocalTS []string `vici:"local-ts"`
+	}
+
+	child := childSA{}
+	if err := UnmarshalSection(m, "gw-gw.child-sas.net-1", &child); err != nil {
+		t.Fatalf("Unexpected error unmarshaling section: %v", err)
+	}
+
+	expected := childSA{Name: "net-1", LocalTS: []string{"10.1.0.0/16"}}
+	if !reflect.DeepEqual(child, expected) {
+		t.Errorf("Unexpected unmarshaled value.\nExpected: %+v\nReceived: %+v", expected, child)
+	}
+
+	for _, path := range []string{"gw-gw.state", "gw-gw.child-sas.net-3", "other"} {
+		if err := UnmarshalSection(m, path, &childSA{}); err == nil {
+			t.Errorf("Expected error unmarshaling %v", path)
+		}
+	}
+}
+
+func TestMessageAppend(t *testing.T) {
+	m := NewMessage()
+
+	if err := m.Append("proposals", "aes128-sha256"); err != nil {
+		t.Errorf("Unexpected error appending to new list: %v", err)
+	}
+
+	if err := m.Append("proposals", "aes256-sha256", "aes256gcm16"); err != nil {
+		t.Errorf("Unexpected error appending to existing list: %v", err)
+	}
+
+	expected := []string{"aes128-sha256", "aes256-sha256", "aes256gcm16"}
+	if v := m.Get("proposals"); !reflect.DeepEqual(v, expected) {
+		t.Errorf("Expected list %v: received %v", expected, v)
+	}
+
+	if err := m.Set("key", "value"); err != nil {
+		t.Fatalf("Unexpected error setting key: %v", err)
+	}
+
+	if err := m.Append("key", "item"); err == nil {
+		t.Errorf("Expected error appending to non-list element")
+	}
+}
+
+func TestMessageRawMessage(t *testing.T) {
+	section, _ := goldMessage.GetSection("section1")
+
+	raw, err := section.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling section: %v", err)
+	}
+
+	m := NewMessage()
+	if err := m.Set("key1", "value1"); err != nil {
+		t.Fatalf("Unexpected error setting key: %v", err)
+	}
+
+	if err := m.Set("section1", RawMessage(raw)); err != nil {
+		t.Fatalf("Unexpected error setting raw message: %v", err)
+	}
+
+	b, err := m.encode()
+	if err != nil {
+		t.Errorf("Unexpected error encoding message: %v", err)
+	}
+
+	if !bytes.Equal(b, goldMessageBytes) {
+		t.Errorf("Encoded message does not equal gold bytes.\nExpected: %v\nReceived: %v", goldMessageBytes, b)
+	}
+
+	if n := m.EncodedLen(); n != len(goldMessageBytes) {
+		t.Errorf("Expected encoded length %v: received %v", len(goldMessageBytes), n)
+	}
+
+	if m.Hash() != goldMessage.Hash() {
+		t.Errorf("Expected raw message to hash like the equivalent section")
+	}
+
+	if err := m.Set("invalid", RawMessage{msgKeyValue, 4}); err == nil {
+		t.Errorf("Expected error setting malformed raw message")
+	}
+}
+
+// rawGoldMessage returns goldMessage, with section1 given as a RawMessage.
+func rawGoldMessage(t *testing.T) *Message {
+	section, _ := goldMessage.GetSection("section1")
+
+	raw, err := section.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling section: %v", err)
+	}
+
+	m := NewMessage()
+	if err := m.Set("key1", "value1"); err != nil {
+		t.Fatalf("Unexpected error setting key: %v", err)
+	}
+
+	if err := m.Set("section1", RawMessage(raw)); err != nil {
+		t.Fatalf("Unexpected error setting raw message: %v", err)
+	}
+
+	return m
+}
+
+func TestMessageRawMessageGet(t *testing.T) {
+	m := rawGoldMessage(t)
+
+	section, ok := m.GetSection("section1")
+	if !ok {
+		t.Fatalf("Expected raw message to be returned as a section")
+	}
+
+	if list, _ := section.GetList("list1"); !reflect.DeepEqual(list, []string{"item1", "item2"}) {
+		t.Errorf("Unexpected list in raw section.\nExpected: %v\nReceived: %v", []string{"item1", "item2"}, list)
+	}
+
+	if v := m.GetPath("section1.sub-section.key2"); v != "value2" {
+		t.Errorf("Unexpected value at path in raw section.\nExpected: %v\nReceived: %v", "value2", v)
+	}
+
+	if _, ok := m.GetPath("section1").(*Message); !ok {
+		t.Errorf("Expected raw message at path to be returned as a section: received %T", m.GetPath("section1"))
+	}
+}
+
+func TestMessageRawMessageModify(t *testing.T) {
+	m := rawGoldMessage(t)
+
+	if _, ok := m.Get("section1").(*Message); !ok {
+		t.Errorf("Expected raw message to be returned as a section: received %T", m.Get("section1"))
+	}
+
+	section, _ := m.GetSection("section1")
+	if err := section.Set("key3", "value3"); err != nil {
+		t.Fatalf("Unexpected error setting key: %v", err)
+	}
+
+	if v := m.GetPath("section1.key3"); v != "value3" {
+		t.Errorf("Unexpected value set in raw section.\nExpected: %v\nReceived: %v", "value3", v)
+	}
+
+	m = rawGoldMessage(t)
+	if err := m.SetPath("section1.sub-section.key4", "value4"); err != nil {
+		t.Fatalf("Unexpected error setting path in raw section: %v", err)
+	}
+
+	if v := m.GetPath("section1.sub-section.key4"); v != "value4" {
+		t.Errorf("Unexpected value set at path in raw section.\nExpected: %v\nReceived: %v", "value4", v)
+	}
+
+	other, err := NewMessageFromMap(map[string]interface{}{
+		"section1": map[string]interface{}{"key5": "value5"},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error creating message: %v", err)
+	}
+
+	m = rawGoldMessage(t)
+	if err := m.Merge(other, MergeOverwrite); err != nil {
+		t.Fatalf("Unexpected error merging message: %v", err)
+	}
+
+	if v := m.GetPath("section1.key5"); v != "value5" {
+		t.Errorf("Unexpected value merged into raw section.\nExpected: %v\nReceived: %v", "value5", v)
+	}
+
+	if v := m.GetPath("section1.sub-section.key2"); v != "value2" {
+		t.Errorf("Unexpected value after merging into raw section.\nExpected: %v\nReceived: %v", "value2", v)
+	}
+}
+
+func TestMessageRawMessageWalk(t *testing.T) {
+	paths := func(m *Message) []string {
+		var paths []string
+
+		err := m.Walk(func(path []string, value interface{}) error {
+			if _, ok := value.(RawMessage); ok {
+				t.Errorf("Unexpected RawMessage visited at %v", path)
+			}
+			paths = append(paths, strings.Join(path, "."))
+
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error walking message: %v", err)
+		}
+
+		return paths
+	}
+
+	expected := paths(goldMessage)
+	if received := paths(rawGoldMessage(t)); !reflect.DeepEqual(received, expected) {
+		t.Errorf("Unexpected paths walked.\nExpected: %v\nReceived: %v", expected, received)
+	}
+}
+
+func TestMessageRawMessageUnmarshal(t *testing.T) {
+	m := rawGoldMessage(t)
+
+	type subSection struct {
+		Key2 string `vici:"key2"`
+	}
+
+	var v struct {
+		Key1     string `vici:"key1"`
+		Section1 struct {
+			SubSection subSection `vici:"sub-section"`
+			List1      []string   `vici:"list1"`
+		} `vici:"section1"`
+		Map map[string]interface{} `vici:"section1"`
+	}
+
+	if err := UnmarshalMessage(m, &v); err != nil {
+		t.Fatalf("Unexpected error unmarshaling raw message: %v", err)
+	}
+
+	if v.Section1.SubSection.Key2 != "value2" || !reflect.DeepEqual(v.Section1.List1, []string{"item1", "item2"}) {
+		t.Errorf("Unexpected struct unmarshaled from raw section: %+v", v.Section1)
+	}
+
+	section, _ := goldMessage.GetSection("section1")
+	if !reflect.DeepEqual(v.Map, section.ToMap()) {
+		t.Errorf("Unexpected map unmarshaled from raw section.\nExpected: %v\nReceived: %v", section.ToMap(), v.Map)
+	}
+
+	var sub subSection
+	if err := UnmarshalSection(m, "section1.sub-section", &sub); err != nil {
+		t.Fatalf("Unexpected error unmarshaling section of raw message: %v", err)
+	}
+
+	if sub.Key2 != "value2" {
+		t.Errorf("Unexpected section unmarshaled from raw message.\nExpected: %v\nReceived: %v", "value2", sub.Key2)
+	}
+}
+
+func TestMessageBytes(t *testing.T) {
+	der := []byte{0x30, 0x82, 0x00, 0xff, 0x0a}
+
+	m := NewMessage()
+	if err := m.Set("data", der); err != nil {
+		t.Fatalf("Unexpected error setting []byte value: %v", err)
+	}
+
+	if v, ok := m.GetBytes("data"); !ok || !bytes.Equal(v, der) {
+		t.Errorf("Expected 'data' to be %v: received %v", der, v)
+	}
+
+	type cert struct {
+		Type string `vici:"type"`
+		Data []byte `vici:"data"`
+	}
+
+	m, err := MarshalMessage(cert{Type: "x509", Data: der})
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling: %v", err)
+	}
+
+	b, err := m.encode()
+	if err != nil {
+		t.Fatalf("Unexpected error encoding: %v", err)
+	}
+
+	decoded := NewMessage()
+	if err := decoded.decode(b); err != nil {
+		t.Fatalf("Unexpected error decoding: %v", err)
+	}
+
+	c := cert{}
+	if err := UnmarshalMessage(decoded, &c); err != nil {
+		t.Fatalf("Unexpected error unmarshaling: %v", err)
+	}
+
+	if !bytes.Equal(c.Data, der) {
+		t.Errorf("Expected binary data to round trip: received %v", c.Data)
+	}
+}
+
+func BenchmarkMessageEncode(b *testing.B) {
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := goldMessage.encode(); err != nil {
+			b.Fatalf("Error encoding test message: %v", err)
+		}
+	}
+}
+
+func BenchmarkMessageDecode(b *testing.B) {
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if err := NewMessage().decode(goldMessageBytes); err != nil {
+			b.Fatalf("Error decoding test bytes: %v", err)
+		}
+	}
+}
+
+func BenchmarkMarshalMessage(b *testing.B) {
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := MarshalMessage(goldUnmarshaled); err != nil {
+			b.Fatalf("Unexpected error marshaling: %v", err)
+		}
+	}
+}
+
+func BenchmarkUnmarshalMessage(b *testing.B) {
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		tm := &testMessage{}
+		if err := UnmarshalMessage(goldMarshaled, tm); err != nil {
+			b.Fatalf("Unexpected error unmarshaling: %v", err)
+		}
+	}
+}
+
+func BenchmarkPacketBytes(b *testing.B) {
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := goldNamedPacket.bytes(); err != nil {
+			b.Fatalf("Error getting packet bytes: %v", err)
+		}
+	}
+}
+
+func TestMessageDecodeZeroCopy(t *testing.T) {
+	data := make([]byte, len(goldMessageBytes))
+	copy(data, goldMessageBytes)
+
+	m := NewMessage()
+	if err := m.decodeWithOptions(data, decodeOptions{zeroCopy: true}); err != nil {
+		t.Errorf("Error decoding test bytes: %v", err)
+	}
+
+	if !reflect.DeepEqual(m.data, goldMessage.data) {
+		t.Errorf("Decoded message does not equal gold message.\nExpected: %v\nReceived: %v", goldMessage.data, m.data)
+	}
+}
+
+func BenchmarkMessageDecodeZeroCopy(b *testing.B) {
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if err := NewMessage().decodeWithOptions(goldMessageBytes, decodeOptions{zeroCopy: true}); err != nil {
+			b.Fatalf("Error decoding test bytes: %v", err)
+		}
+	}
+}
+
+func TestMarshalMessagePrefix(t *testing.T) {
+	type auth struct {
+		Auth string `vici:"auth"`
+	}
+
+	type conn struct {
+		LocalAddrs []string          `vici:"local_addrs"`
+		LocalAuth  map[string]auth   `vici:"local,prefix"`
+		RemoteAuth map[string]*auth  `vici:"remote,prefix"`
+		IDs        map[string]string `vici:"id,prefix"`
+	}
+
+	c := conn{
+		LocalAddrs: []string{"192.0.2.1"},
+		LocalAuth:  map[string]auth{"-2": {Auth: "eap"}, "-1": {Auth: "pubkey"}},
+		RemoteAuth: map[string]*auth{"": {Auth: "pubkey"}},
+		IDs:        map[string]string{"-moon": "moon.strongswan.org"},
+	}
+
+	m, err := MarshalMessage(c)
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling: %v", err)
+	}
+
+	expectedKeys := []string{"local_addrs", "local-1", "local-2", "remote", "id-moon"}
+	if !reflect.DeepEqual(m.Keys(), expectedKeys) {
+		t.Errorf("Unexpected keys.\nExpected: %v\nReceived: %v", expectedKeys, m.Keys())
+	}
+
+	var u conn
+	if err := UnmarshalMessage(m, &u); err != nil {
+		t.Fatalf("Unexpected error unmarshaling: %v", err)
+	}
+
+	if !reflect.DeepEqual(u, c) {
+		t.Errorf("Unexpected unmarshaled value.\nExpected: %+v\nReceived: %+v", c, u)
+	}
+}
+
+func TestUnmarshalMessagePrefix(t *testing.T) {
+	type auth struct {
+		Auth string `vici:"auth"`
+	}
+
+	m := NewMessage()
+	for path, value := range map[string]interface{}{
+		"local_addrs":  []string{"192.0.2.1"},
+		"local-1.auth": "pubkey",
+		"local_port":   "4500",
+	} {
+		if err := m.SetPath(path, value); err != nil {
+			t.Fatalf("Unexpected error setting path: %v", err)
+		}
+	}
+
+	var v struct {
+		Auth    map[string]auth        `vici:"local,prefix"`
+		Options map[string]interface{} `vici:"local,prefix"`
+		Remote  map[string]auth        `vici:"remote,prefix"`
+	}
+
+	if err := UnmarshalMessage(m, &v); err != nil {
+		t.Fatalf("Unexpected error unmarshaling: %v", err)
+	}
+
+	expectedAuth := map[string]auth{"-1": {Auth: "pubkey"}}
+	if !reflect.DeepEqual(v.Auth, expectedAuth) {
+		t.Errorf("Unexpected sections collected by prefix.\nExpected: %v\nReceived: %v", expectedAuth, v.Auth)
+	}
+
+	expectedOptions := map[string]interface{}{"_addrs": []string{"192.0.2.1"}, "_port": "4500"}
+	if !reflect.DeepEqual(v.Options, expectedOptions) {
+		t.Errorf("Unexpected values collected by prefix.\nExpected: %v\nReceived: %v", expectedOptions, v.Options)
+	}
+
+	if v.Remote != nil {
+		t.Errorf("Expected map to remain nil without matching keys: received %v", v.Remote)
+	}
+}
+
+func TestMarshalMessagePrefixInvalid(t *testing.T) {
+	type invalid struct {
+		Local string `vici:"local,prefix"`
+	}
+
+	if _, err := MarshalMessage(invalid{Local: "pubkey"}); err == nil {
+		t.Errorf("Expected error marshaling prefix option on string field")
+	}
+
+	m := NewMessage()
+	if err := m.Set("local", "pubkey"); err != nil {
+		t.Fatalf("Unexpected error setting key: %v", err)
+	}
+
+	var v invalid
+	if err := UnmarshalMessage(m, &v); err == nil {
+		t.Errorf("Expected error unmarshaling prefix option into string field")
+	}
+}
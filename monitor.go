@@ -0,0 +1,534 @@
+// Copyright (C) 2019 Nick Rosbrook
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package vici
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Event types used by the Monitor to track SA state.
+var monitorEvents = []string{"ike-updown", "child-updown", "ike-rekey", "child-rekey"}
+
+// IKESA is a Monitor's view of an IKE SA.
+type IKESA struct {
+	Name       string
+	UniqueID   string
+	State      string
+	LocalHost  string
+	RemoteHost string
+	LocalID    string
+	RemoteID   string
+
+	// Established is the time since the IKE SA was established, as of when it
+	// was reported by the daemon, and EstablishedAt is the time it was established.
+	Established   time.Duration
+	EstablishedAt time.Time
+
+	// RekeyTime and ReauthTime are the times until the IKE SA is rekeyed or
+	// reauthenticated, as of when it was reported by the daemon, and RekeyAt
+	// and ReauthAt are the times it will be. They are zero if not scheduled.
+	RekeyTime  time.Duration
+	RekeyAt    time.Time
+	ReauthTime time.Duration
+	ReauthAt   time.Time
+
+	// CHILD SAs of this IKE SA, keyed by unique ID
+	Children map[string]ChildSA
+}
+
+// ChildSA is a Monitor's view of a CHILD SA.
+type ChildSA struct {
+	Name     string
+	UniqueID string
+	ReqID    string
+	State    string
+
+	// Installed is the time since the CHILD SA was installed, as of when it was
+	// reported by the daemon, and InstalledAt is the time it was installed.
+	Installed   time.Duration
+	InstalledAt time.Time
+
+	// RekeyTime and LifeTime are the times until the CHILD SA is rekeyed or
+	// expires, as of when it was reported by the daemon, and RekeyAt and ExpiresAt
+	// are the times it will be. They are zero if not scheduled.
+	RekeyTime time.Duration
+	RekeyAt   time.Time
+	LifeTime  time.Duration
+	ExpiresAt time.Time
+
+	// Traffic selectors negotiated for the CHILD SA
+	LocalTS  []TrafficSelector
+	RemoteTS []TrafficSelector
+}
+
+// SAChange describes a state transition observed by a Monitor.
+type SAChange struct {
+	// Event is the name of the event that caused the change.
+	Event string
+
+	// IKE is the IKE SA affected by the change. For CHILD SA changes,
+	// this is the parent IKE SA.
+	IKE IKESA
+
+	// Child is the CHILD SA affected by the change, or nil if the
+	// change only affected the IKE SA.
+	Child *ChildSA
+
+	// Up indicates if the SA was established (or rekeyed), or deleted.
+	Up bool
+
+	// Replaces is the unique ID of the SA replaced by a rekey, and is
+	// empty for other changes.
+	Replaces string
+}
+
+// Monitor maintains an in-memory model of IKE and CHILD SA state, by tracking the
+// ike-updown, child-updown, ike-rekey and child-rekey events of a Session. Use Run
+// to start monitoring, and Notify to be informed of state changes.
+type Monitor struct {
+	s *Session
+
+	mux  sync.RWMutex
+	ikes map[string]*IKESA
+
+	// Set while Run is active
+	running     bool
+	passthrough map[string]bool
+
+	nmux sync.RWMutex
+	fns  []func(SAChange)
+}
+
+// NewMonitor returns a new Monitor for the SAs of s. The Monitor installs event
+// middleware on s, so a Session should not be used by more than one Monitor.
+func NewMonitor(s *Session) *Monitor {
+	m := &Monitor{
+		s:    s,
+		ikes: make(map[string]*IKESA),
+	}
+	s.UseEventMiddleware(m.middleware)
+
+	return m
+}
+
+// Run registers the session for the events needed by the monitor, in addition to the
+// events given. Events needed by the monitor are consumed by it, unless they are also
+// given in events. Otherwise, events are delivered through the session as usual. Like
+// Session.Listen, Run does not return unless the event channel is closed.
+func (m *Monitor) Run(events ...string) error {
+	passthrough := make(map[string]bool)
+	for _, e := range events {
+		passthrough[e] = true
+	}
+
+	all := append([]string{}, events...)
+	for _, e := range monitorEvents {
+		if !passthrough[e] {
+			all = append(all, e)
+		}
+	}
+
+	m.mux.Lock()
+	m.running = true
+	m.passthrough = passthrough
+	m.mux.Unlock()
+
+	defer func() {
+		m.mux.Lock()
+		m.running = false
+		m.passthrough = nil
+		m.mux.Unlock()
+	}()
+
+	return m.s.Listen(all)
+}
+
+// Sync populates the monitor with the SAs currently known by the daemon, using the
+// list-sas command. Notifications are not sent for SAs added by Sync.
+func (m *Monitor) Sync() error {
+	ikes := make(map[string]*IKESA)
+
+	_, err := m.s.StreamedCommandRequestFunc("list-sas", "list-sa", nil, func(msg *Message) error {
+		for _, ike := range parseIKESAs(msg) {
+			ikes[ike.UniqueID] = ike
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	m.mux.Lock()
+	m.ikes = ikes
+	m.mux.Unlock()
+
+	return nil
+}
+
+// Notify registers fn to be called with each SA state change observed by the monitor.
+// fn is called from the session's event listener, so it should not block.
+func (m *Monitor) Notify(fn func(SAChange)) {
+	m.nmux.Lock()
+	defer m.nmux.Unlock()
+
+	m.fns = append(m.fns, fn)
+}
+
+// IKESAs returns all IKE SAs currently known by the monitor.
+func (m *Monitor) IKESAs() []IKESA {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+
+	ikes := make([]IKESA, 0, len(m.ikes))
+	for _, ike := range m.ikes {
+		ikes = append(ikes, ike.copy())
+	}
+
+	return ikes
+}
+
+// IKESA returns the IKE SA identified by uniqueID, if it is known by the monitor.
+func (m *Monitor) IKESA(uniqueID string) (IKESA, bool) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+
+	ike, ok := m.ikes[uniqueID]
+	if !ok {
+		return IKESA{}, false
+	}
+
+	return ike.copy(), true
+}
+
+// ChildSA returns the CHILD SA identified by uniqueID, and its parent IKE SA, if it
+// is known by the monitor.
+func (m *Monitor) ChildSA(uniqueID string) (ChildSA, IKESA, bool) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+
+	for _, ike := range m.ikes {
+		if child, ok := ike.Children[uniqueID]; ok {
+			return child, ike.copy(), true
+		}
+	}
+
+	return ChildSA{}, IKESA{}, false
+}
+
+func (m *Monitor) middleware(e Event) (Event, bool) {
+	var changes []SAChange
+
+	switch e.Name {
+	case "ike-updown":
+		changes = m.handleIKEUpdown(e)
+	case "child-updown":
+		changes = m.handleChildUpdown(e)
+	case "ike-rekey":
+		changes = m.handleIKERekey(e)
+	case "child-rekey":
+		changes = m.handleChildRekey(e)
+	default:
+		return e, true
+	}
+
+	m.notify(changes)
+
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+
+	return e, !m.running || m.passthrough[e.Name]
+}
+
+func (m *Monitor) notify(changes []SAChange) {
+	m.nmux.RLock()
+	defer m.nmux.RUnlock()
+
+	for _, c := range changes {
+		for _, fn := range m.fns {
+			fn(c)
+		}
+	}
+}
+
+func (m *Monitor) handleIKEUpdown(e Event) []SAChange {
+	up := e.Message.Get("up") == "yes"
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	var changes []SAChange
+
+	for _, ike := range parseIKESAs(e.Message) {
+		if up {
+			m.ikes[ike.UniqueID] = ike
+		} else {
+			delete(m.ikes, ike.UniqueID)
+		}
+
+		changes = append(changes, SAChange{Event: e.Name, IKE: ike.copy(), Up: up})
+	}
+
+	return changes
+}
+
+func (m *Monitor) handleChildUpdown(e Event) []SAChange {
+	up := e.Message.Get("up") == "yes"
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	var changes []SAChange
+
+	for _, ike := range parseIKESAs(e.Message) {
+		// A CHILD SA going down does not add its IKE SA to the model if it is not
+		// known, e.g. because the IKE SA is going down as well. The change is still
+		// reported.
+		unknown := ike.copy()
+
+		known := &unknown
+		if up {
+			known = m.lookupOrAdd(ike)
+		} else if k, ok := m.ikes[ike.UniqueID]; ok {
+			known = k
+		}
+
+		for id, child := range ike.Children {
+			if up {
+				known.Children[id] = child
+			} else {
+				delete(known.Children, id)
+			}
+
+			child := child
+			changes = append(changes, SAChange{Event: e.Name, IKE: known.copy(), Child: &child, Up: up})
+		}
+	}
+
+	return changes
+}
+
+func (m *Monitor) handleIKERekey(e Event) []SAChange {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	var changes []SAChange
+
+	for _, name := range e.Message.Keys() {
+		sa, ok := e.Message.GetSection(name)
+		if !ok {
+			continue
+		}
+
+		old, oldOK := sa.GetSection("old")
+		nw, newOK := sa.GetSection("new")
+		if !oldOK || !newOK {
+			continue
+		}
+
+		o := parseIKESA(name, old)
+		n := parseIKESA(name, nw)
+
+		// CHILD SAs are migrated to the new IKE SA
+		if known, ok := m.ikes[o.UniqueID]; ok && len(n.Children) == 0 {
+			n.Children = known.copy().Children
+		}
+
+		delete(m.ikes, o.UniqueID)
+		m.ikes[n.UniqueID] = n
+
+		changes = append(changes, SAChange{Event: e.Name, IKE: n.copy(), Up: true, Replaces: o.UniqueID})
+	}
+
+	return changes
+}
+
+func (m *Monitor) handleChildRekey(e Event) []SAChange {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	var changes []SAChange
+
+	for _, name := range e.Message.Keys() {
+		sa, ok := e.Message.GetSection(name)
+		if !ok {
+			continue
+		}
+
+		ike := parseIKESA(name, sa)
+		known := m.lookupOrAdd(ike)
+
+		children, ok := sa.GetSection("child-sas")
+		if !ok {
+			continue
+		}
+
+		for _, ck := range children.Keys() {
+			child, ok := children.GetSection(ck)
+			if !ok {
+				continue
+			}
+
+			old, oldOK := child.GetSection("old")
+			nw, newOK := child.GetSection("new")
+			if !oldOK || !newOK {
+				continue
+			}
+
+			o := parseChildSA(old)
+			n := parseChildSA(nw)
+
+			delete(known.Children, o.UniqueID)
+			known.Children[n.UniqueID] = n
+
+			changes = append(changes, SAChange{Event: e.Name, IKE: known.copy(), Child: &n, Up: true, Replaces: o.UniqueID})
+		}
+	}
+
+	return changes
+}
+
+// lookupOrAdd returns the known IKE SA with the same unique ID as ike, or adds ike
+// to the model. It must be called with the monitor lock held.
+func (m *Monitor) lookupOrAdd(ike *IKESA) *IKESA {
+	if known, ok := m.ikes[ike.UniqueID]; ok {
+		return known
+	}
+
+	known := ike.copy()
+	known.Children = make(map[string]ChildSA)
+	m.ikes[known.UniqueID] = &known
+
+	return &known
+}
+
+func (ike *IKESA) copy() IKESA {
+	c := *ike
+
+	c.Children = make(map[string]ChildSA, len(ike.Children))
+	for k, v := range ike.Children {
+		c.Children[k] = v
+	}
+
+	return c
+}
+
+// parseIKESAs parses the IKE SAs in m, which is keyed by IKE SA name as in list-sas,
+// ike-updown and child-updown messages.
+func parseIKESAs(m *Message) []*IKESA {
+	var ikes []*IKESA
+
+	for _, name := range m.Keys() {
+		sa, ok := m.GetSection(name)
+		if !ok {
+			continue
+		}
+
+		ikes = append(ikes, parseIKESA(name, sa))
+	}
+
+	return ikes
+}
+
+func parseIKESA(name string, m *Message) *IKESA {
+	now := time.Now()
+
+	ike := &IKESA{
+		Name:       name,
+		UniqueID:   stringField(m, "uniqueid"),
+		State:      stringField(m, "state"),
+		LocalHost:  stringField(m, "local-host"),
+		RemoteHost: stringField(m, "remote-host"),
+		LocalID:    stringField(m, "local-id"),
+		RemoteID:   stringField(m, "remote-id"),
+		Children:   make(map[string]ChildSA),
+	}
+
+	ike.Established, ike.EstablishedAt = timeField(m, "established", now, true)
+	ike.RekeyTime, ike.RekeyAt = timeField(m, "rekey-time", now, false)
+	ike.ReauthTime, ike.ReauthAt = timeField(m, "reauth-time", now, false)
+
+	children, ok := m.GetSection("child-sas")
+	if !ok {
+		return ike
+	}
+
+	for _, k := range children.Keys() {
+		child, ok := children.GetSection(k)
+		if !ok {
+			continue
+		}
+
+		c := parseChildSAAt(child, now)
+		ike.Children[c.UniqueID] = c
+	}
+
+	return ike
+}
+
+func parseChildSA(m *Message) ChildSA {
+	return parseChildSAAt(m, time.Now())
+}
+
+// parseChildSAAt parses the CHILD SA in m, with relative times taken relative to now.
+func parseChildSAAt(m *Message, now time.Time) ChildSA {
+	c := ChildSA{
+		Name:     stringField(m, "name"),
+		UniqueID: stringField(m, "uniqueid"),
+		ReqID:    stringField(m, "reqid"),
+		State:    stringField(m, "state"),
+		LocalTS:  validTrafficSelectors(m, "local-ts"),
+		RemoteTS: validTrafficSelectors(m, "remote-ts"),
+	}
+
+	c.Installed, c.InstalledAt = timeField(m, "install-time", now, true)
+	c.RekeyTime, c.RekeyAt = timeField(m, "rekey-time", now, false)
+	c.LifeTime, c.ExpiresAt = timeField(m, "life-time", now, false)
+
+	return c
+}
+
+// stringField returns the string value of key in m, or an empty string if it
+// is not set or not a string.
+func stringField(m *Message, key string) string {
+	v, _ := m.GetString(key)
+
+	return v
+}
+
+// timeField returns the duration of key in m, which is a number of seconds, and the
+// time that is that duration before now if ago is true, or after now otherwise. Both
+// are zero if key is not set or not a number.
+func timeField(m *Message, key string, now time.Time, ago bool) (time.Duration, time.Time) {
+	v, err := strconv.ParseUint(stringField(m, key), 10, 32)
+	if err != nil {
+		return 0, time.Time{}
+	}
+
+	d := time.Duration(v) * time.Second
+	if ago {
+		return d, now.Add(-d)
+	}
+
+	return d, now.Add(d)
+}
@@ -0,0 +1,239 @@
+// Copyright (C) 2019 Nick Rosbrook
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package vici
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestSAMessage(keys []string, data map[string]interface{}) *Message {
+	return &Message{keys: keys, data: data}
+}
+
+func TestMonitorUpdown(t *testing.T) {
+	m := &Monitor{ikes: make(map[string]*IKESA)}
+
+	var changes []SAChange
+	m.Notify(func(c SAChange) {
+		changes = append(changes, c)
+	})
+
+	child := newTestSAMessage(
+		[]string{"name", "uniqueid", "state"},
+		map[string]interface{}{"name": "net", "uniqueid": "7", "state": "INSTALLED"},
+	)
+	ike := newTestSAMessage(
+		[]string{"uniqueid", "state", "child-sas"},
+		map[string]interface{}{
+			"uniqueid": "3",
+			"state":    "ESTABLISHED",
+			"child-sas": newTestSAMessage(
+				[]string{"net-7"},
+				map[string]interface{}{"net-7": child},
+			),
+		},
+	)
+	up := newTestSAMessage(
+		[]string{"up", "gw"},
+		map[string]interface{}{"up": "yes", "gw": ike},
+	)
+
+	if _, ok := m.middleware(Event{Name: "child-updown", Message: up}); !ok {
+		t.Errorf("Expected event to be delivered while monitor is not running")
+	}
+
+	c, sa, ok := m.ChildSA("7")
+	if !ok {
+		t.Fatalf("Expected CHILD SA to be known after child-updown")
+	}
+
+	if c.Name != "net" || sa.Name != "gw" {
+		t.Errorf("Unexpected SAs: %+v, %+v", c, sa)
+	}
+
+	down := newTestSAMessage([]string{"gw"}, map[string]interface{}{"gw": ike})
+	m.middleware(Event{Name: "ike-updown", Message: down})
+
+	if _, ok := m.IKESA("3"); ok {
+		t.Errorf("Expected IKE SA to be removed after ike-updown")
+	}
+
+	if len(changes) != 2 {
+		t.Fatalf("Expected 2 changes: received %v", len(changes))
+	}
+
+	if !changes[0].Up || changes[0].Child == nil || changes[1].Up {
+		t.Errorf("Unexpected changes: %+v", changes)
+	}
+}
+
+func TestParseIKESATimes(t *testing.T) {
+	child := newTestSAMessage(
+		[]string{"name", "uniqueid", "install-time", "rekey-time", "life-time"},
+		map[string]interface{}{"name": "net", "uniqueid": "7", "install-time": "30", "rekey-time": "3000", "life-time": "3300"},
+	)
+	children := newTestSAMessage([]string{"net-7"}, map[string]interface{}{"net-7": child})
+	sa := newTestSAMessage(
+		[]string{"uniqueid", "established", "rekey-time", "child-sas"},
+		map[string]interface{}{"uniqueid": "3", "established": "60", "rekey-time": "bogus", "child-sas": children},
+	)
+
+	before := time.Now()
+	ike := parseIKESA("gw", sa)
+	after := time.Now()
+
+	within := func(name string, received time.Time, offset time.Duration) {
+		if received.Before(before.Add(offset)) || received.After(after.Add(offset)) {
+			t.Errorf("Unexpected %v.\nExpected: %v\nReceived: %v", name, before.Add(offset), received)
+		}
+	}
+
+	if ike.Established != time.Minute {
+		t.Errorf("Unexpected established.\nExpected: %v\nReceived: %v", time.Minute, ike.Established)
+	}
+	within("established time", ike.EstablishedAt, -time.Minute)
+
+	if ike.RekeyTime != 0 || !ike.RekeyAt.IsZero() || ike.ReauthTime != 0 || !ike.ReauthAt.IsZero() {
+		t.Errorf("Unexpected rekey or reauth time: %+v", ike)
+	}
+
+	c, ok := ike.Children["7"]
+	if !ok {
+		t.Fatalf("Expected CHILD SA 7: %+v", ike.Children)
+	}
+
+	if c.Installed != 30*time.Second || c.RekeyTime != 50*time.Minute || c.LifeTime != 55*time.Minute {
+		t.Errorf("Unexpected CHILD SA durations: %+v", c)
+	}
+	within("install time", c.InstalledAt, -30*time.Second)
+	within("rekey time", c.RekeyAt, 50*time.Minute)
+	within("expiry time", c.ExpiresAt, 55*time.Minute)
+}
+
+func TestMonitorChildDownUnknownIKESA(t *testing.T) {
+	m := &Monitor{ikes: make(map[string]*IKESA)}
+
+	var changes []SAChange
+	m.Notify(func(c SAChange) {
+		changes = append(changes, c)
+	})
+
+	child := newTestSAMessage(
+		[]string{"name", "uniqueid", "state"},
+		map[string]interface{}{"name": "net", "uniqueid": "7", "state": "DELETING"},
+	)
+	ike := newTestSAMessage(
+		[]string{"uniqueid", "state", "child-sas"},
+		map[string]interface{}{
+			"uniqueid":  "3",
+			"state":     "DELETING",
+			"child-sas": newTestSAMessage([]string{"net-7"}, map[string]interface{}{"net-7": child}),
+		},
+	)
+	down := newTestSAMessage([]string{"gw"}, map[string]interface{}{"gw": ike})
+
+	m.middleware(Event{Name: "child-updown", Message: down})
+
+	if _, ok := m.IKESA("3"); ok {
+		t.Errorf("Expected unknown IKE SA not to be added by a CHILD SA going down")
+	}
+
+	if len(changes) != 1 || changes[0].Up || changes[0].Child == nil || changes[0].Child.UniqueID != "7" {
+		t.Errorf("Unexpected changes: %+v", changes)
+	}
+}
+
+func TestMonitorChildRekey(t *testing.T) {
+	m := &Monitor{ikes: make(map[string]*IKESA)}
+
+	var changes []SAChange
+	m.Notify(func(c SAChange) {
+		changes = append(changes, c)
+	})
+
+	newChild := func(id string) *Message {
+		return newTestSAMessage(
+			[]string{"name", "uniqueid", "state"},
+			map[string]interface{}{"name": "net", "uniqueid": id, "state": "INSTALLED"},
+		)
+	}
+
+	up := newTestSAMessage(
+		[]string{"up", "gw"},
+		map[string]interface{}{
+			"up": "yes",
+			"gw": newTestSAMessage(
+				[]string{"uniqueid", "state", "child-sas"},
+				map[string]interface{}{
+					"uniqueid":  "3",
+					"state":     "ESTABLISHED",
+					"child-sas": newTestSAMessage([]string{"net-7"}, map[string]interface{}{"net-7": newChild("7")}),
+				},
+			),
+		},
+	)
+	m.middleware(Event{Name: "child-updown", Message: up})
+
+	rekey := newTestSAMessage(
+		[]string{"gw"},
+		map[string]interface{}{
+			"gw": newTestSAMessage(
+				[]string{"uniqueid", "state", "child-sas"},
+				map[string]interface{}{
+					"uniqueid": "3",
+					"state":    "ESTABLISHED",
+					"child-sas": newTestSAMessage(
+						[]string{"net-7"},
+						map[string]interface{}{
+							"net-7": newTestSAMessage(
+								[]string{"old", "new"},
+								map[string]interface{}{"old": newChild("7"), "new": newChild("8")},
+							),
+						},
+					),
+				},
+			),
+		},
+	)
+	m.middleware(Event{Name: "child-rekey", Message: rekey})
+
+	if _, _, ok := m.ChildSA("7"); ok {
+		t.Errorf("Expected rekeyed CHILD SA to be removed")
+	}
+
+	c, sa, ok := m.ChildSA("8")
+	if !ok {
+		t.Fatalf("Expected new CHILD SA to be known after child-rekey")
+	}
+
+	if c.Name != "net" || sa.UniqueID != "3" || len(sa.Children) != 1 {
+		t.Errorf("Unexpected SAs after child-rekey: %+v, %+v", c, sa)
+	}
+
+	if len(changes) != 2 {
+		t.Fatalf("Expected 2 changes: received %v", len(changes))
+	}
+
+	if last := changes[1]; last.Event != "child-rekey" || last.Replaces != "7" || last.Child == nil || last.Child.UniqueID != "8" {
+		t.Errorf("Unexpected rekey change: %+v", last)
+	}
+}
@@ -97,39 +97,63 @@ func (p *packet) isNamed() bool {
 
 // bytes formats the packet and returns it as a byte slice
 func (p *packet) bytes() ([]byte, error) {
-	// Create a new buffer with the first byte indicating the packet type
-	buf := bytes.NewBuffer([]byte{p.ptype})
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	if err := p.writeTo(buf); err != nil {
+		return []byte{}, err
+	}
+
+	// The buffer is returned to the pool, so copy out the result
+	b := make([]byte, buf.Len())
+	copy(b, buf.Bytes())
+
+	return b, nil
+}
+
+// writeTo formats the packet and writes it to buf
+func (p *packet) writeTo(buf *bytes.Buffer) error {
+	return p.writeToWithOptions(buf, encodeOptions{})
+}
+
+// writeToWithOptions behaves like writeTo, but the message is encoded with the given options
+func (p *packet) writeToWithOptions(buf *bytes.Buffer, opts encodeOptions) error {
+	// The first byte indicates the packet type
+	err := buf.WriteByte(p.ptype)
+	if err != nil {
+		return fmt.Errorf("%v: %v", errPacketWrite, err)
+	}
 
 	// Write the name, preceded by its length
 	if p.isNamed() {
 		err := buf.WriteByte(uint8(len(p.name)))
 		if err != nil {
-			return []byte{}, fmt.Errorf("%v: %v", errPacketWrite, err)
+			return fmt.Errorf("%v: %v", errPacketWrite, err)
 		}
 
 		_, err = buf.WriteString(p.name)
 		if err != nil {
-			return []byte{}, fmt.Errorf("%v: %v", errPacketWrite, err)
+			return fmt.Errorf("%v: %v", errPacketWrite, err)
 		}
 	}
 
 	if p.msg != nil {
-		b, err := p.msg.encode()
-		if err != nil {
-			return []byte{}, err
-		}
-
-		_, err = buf.Write(b)
+		err := p.msg.encodeElementsWithOptions(buf, opts)
 		if err != nil {
-			return []byte{}, fmt.Errorf("%v: %v", errPacketWrite, err)
+			return err
 		}
 	}
 
-	return buf.Bytes(), nil
+	return nil
 }
 
 // parse will parse the given bytes and populate its fields with that data
 func (p *packet) parse(data []byte) error {
+	return p.parseWithOptions(data, decodeOptions{})
+}
+
+// parseWithOptions behaves like parse, but the message is decoded with the given options
+func (p *packet) parseWithOptions(data []byte, opts decodeOptions) error {
 	buf := bytes.NewBuffer(data)
 
 	// Read the packet type
@@ -156,7 +180,7 @@ func (p *packet) parse(data []byte) error {
 
 	// Decode the message field
 	m := NewMessage()
-	err = m.decode(buf.Bytes())
+	err = m.decodeWithOptions(buf.Bytes(), opts)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,396 @@
+// Copyright (C) 2019 Nick Rosbrook
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package vici
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+var (
+	// Encountered a traffic selector that could not be parsed
+	errInvalidTrafficSelector = errors.New("vici: invalid traffic selector")
+)
+
+// Protocol numbers of the protocol names reported by the daemon
+var protocolNumbers = map[string]uint8{
+	"icmp":      1,
+	"igmp":      2,
+	"tcp":       6,
+	"udp":       17,
+	"ipv6":      41,
+	"gre":       47,
+	"esp":       50,
+	"ah":        51,
+	"ipv6-icmp": 58,
+	"sctp":      132,
+	"udplite":   136,
+}
+
+// TrafficSelector is a traffic selector, as reported in the local-ts and remote-ts
+// lists of the daemon, e.g. 10.0.1.0/24, 10.0.1.10..10.0.1.20 or 10.0.1.0/24[tcp/80].
+type TrafficSelector struct {
+	// Start and End are the first and last address of the traffic selector.
+	Start netip.Addr
+	End   netip.Addr
+
+	// Prefix is the address range of the traffic selector, if it is a subnet.
+	// It is the zero value for ranges that are not a subnet.
+	Prefix netip.Prefix
+
+	// Protocol and Port are the protocol and port restrictions of the traffic
+	// selector, as reported by the daemon, e.g. tcp and 80, or udp and
+	// 1024-65535. They are empty if any protocol or port is selected.
+	Protocol string
+	Port     string
+
+	// ProtocolNumber is the IP protocol number of Protocol, or 0 for any.
+	ProtocolNumber uint8
+
+	// FromPort and ToPort are the port range of Port. For ICMP, they contain
+	// the message type and code. If any port is selected, they are 0 and 65535,
+	// and for opaque ports, they are 65535 and 0.
+	FromPort uint16
+	ToPort   uint16
+}
+
+// String returns the traffic selector in the format used by the daemon.
+func (ts TrafficSelector) String() string {
+	var s string
+
+	if ts.Prefix.IsValid() {
+		s = ts.Prefix.String()
+	} else {
+		s = ts.Start.String() + ".." + ts.End.String()
+	}
+
+	switch {
+	case ts.Port != "":
+		s += "[" + ts.Protocol + "/" + ts.Port + "]"
+	case ts.Protocol != "":
+		s += "[" + ts.Protocol + "]"
+	}
+
+	return s
+}
+
+// Contains returns true if the address range of the traffic selector contains addr.
+func (ts TrafficSelector) Contains(addr netip.Addr) bool {
+	return addr.BitLen() == ts.Start.BitLen() && ts.Start.Compare(addr) <= 0 && addr.Compare(ts.End) <= 0
+}
+
+// ParseTrafficSelector parses a traffic selector in the format used by the daemon. The
+// address range is either a subnet, or a range of addresses separated by "..". It is
+// optionally followed by a protocol, and port, restriction in brackets. Protocols and
+// ports may be given by name or number, and ports as a range separated by "-".
+func ParseTrafficSelector(s string) (TrafficSelector, error) {
+	ts := TrafficSelector{ToPort: 65535}
+
+	invalid := func() (TrafficSelector, error) {
+		return TrafficSelector{}, fmt.Errorf("%v: %v", errInvalidTrafficSelector, s)
+	}
+
+	addrs, restriction, found := strings.Cut(s, "[")
+	if found {
+		r, ok := strings.CutSuffix(restriction, "]")
+		if !ok {
+			return invalid()
+		}
+
+		ts.Protocol, ts.Port, _ = strings.Cut(r, "/")
+
+		if err := ts.parseRestriction(); err != nil {
+			return invalid()
+		}
+	}
+
+	if from, to, ok := strings.Cut(addrs, ".."); ok {
+		start, err := netip.ParseAddr(from)
+		if err != nil {
+			return invalid()
+		}
+
+		end, err := netip.ParseAddr(to)
+		if err != nil || start.BitLen() != end.BitLen() || end.Less(start) {
+			return invalid()
+		}
+
+		ts.Start, ts.End = start, end
+		ts.Prefix = rangePrefix(start, end)
+
+		return ts, nil
+	}
+
+	prefix, err := netip.ParsePrefix(addrs)
+	if err != nil {
+		return invalid()
+	}
+
+	ts.Prefix = prefix.Masked()
+	ts.Start, ts.End = ts.Prefix.Addr(), lastAddr(ts.Prefix)
+
+	return ts, nil
+}
+
+// parseRestriction sets the protocol number and port range from Protocol and Port.
+func (ts *TrafficSelector) parseRestriction() error {
+	if ts.Protocol != "" {
+		n, ok := protocolNumbers[ts.Protocol]
+		if !ok {
+			v, err := strconv.ParseUint(ts.Protocol, 10, 8)
+			if err != nil {
+				return err
+			}
+			n = uint8(v)
+		}
+		ts.ProtocolNumber = n
+	}
+
+	switch ts.Port {
+	case "":
+		return nil
+	case "OPAQUE":
+		ts.FromPort, ts.ToPort = 65535, 0
+		return nil
+	}
+
+	from, to, isRange := strings.Cut(ts.Port, "-")
+	if !isRange {
+		to = from
+	}
+
+	var err error
+
+	if ts.FromPort, err = ts.parsePort(from); err != nil {
+		return err
+	}
+
+	if ts.ToPort, err = ts.parsePort(to); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// parsePort parses a port given by number, or by service name. The daemon reports ports
+// by number, so net.LookupPort, which may consult the system's services database, is
+// only used for ports that are not numeric.
+func (ts *TrafficSelector) parsePort(s string) (uint16, error) {
+	if s != "" && strings.Trim(s, "0123456789") == "" {
+		v, err := strconv.ParseUint(s, 10, 16)
+		if err != nil {
+			return 0, err
+		}
+
+		return uint16(v), nil
+	}
+
+	network := "tcp"
+	if ts.Protocol == "udp" {
+		network = "udp"
+	}
+
+	port, err := net.LookupPort(network, s)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint16(port), nil
+}
+
+// lastAddr returns the last address of prefix.
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	b := prefix.Addr().AsSlice()
+
+	for i := prefix.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+
+	addr, _ := netip.AddrFromSlice(b)
+
+	return addr
+}
+
+// rangePrefix returns the prefix covering exactly start to end, or the zero value if
+// there is none.
+func rangePrefix(start, end netip.Addr) netip.Prefix {
+	for bits := 0; bits <= start.BitLen(); bits++ {
+		prefix, err := start.Prefix(bits)
+		if err != nil || prefix.Addr() != start {
+			continue
+		}
+
+		if lastAddr(prefix) == end {
+			return prefix
+		}
+	}
+
+	return netip.Prefix{}
+}
+
+// parseTrafficSelectors parses each of the traffic selectors in the list key of m.
+func parseTrafficSelectors(m *Message, key string) ([]TrafficSelector, error) {
+	var selectors []TrafficSelector
+
+	list, _ := m.GetList(key)
+	for _, s := range list {
+		ts, err := ParseTrafficSelector(s)
+		if err != nil {
+			return nil, err
+		}
+		selectors = append(selectors, ts)
+	}
+
+	return selectors, nil
+}
+
+// validTrafficSelectors is like parseTrafficSelectors, but skips the traffic selectors
+// that cannot be parsed, rather than failing.
+func validTrafficSelectors(m *Message, key string) []TrafficSelector {
+	var selectors []TrafficSelector
+
+	list, _ := m.GetList(key)
+	for _, s := range list {
+		if ts, err := ParseTrafficSelector(s); err == nil {
+			selectors = append(selectors, ts)
+		}
+	}
+
+	return selectors
+}
+
+// PolicyFilter selects the policies returned by Session.ListPolicies. If none of Drop,
+// Pass and Trap are set, policies of all types are returned.
+type PolicyFilter struct {
+	Drop bool `vici:"drop,omitempty"`
+	Pass bool `vici:"pass,omitempty"`
+	Trap bool `vici:"trap,omitempty"`
+
+	// Child and IKE restrict the policies to those of the named CHILD SA
+	// and connection configurations.
+	Child string `vici:"child,omitempty"`
+	IKE   string `vici:"ike,omitempty"`
+}
+
+// Policy is a trap, drop or bypass policy installed in the daemon, as reported by
+// list-policies.
+type Policy struct {
+	// Name identifies the policy, e.g. gw/net for a trap policy, or net for
+	// a drop or bypass policy.
+	Name string
+
+	Child    string
+	IKE      string
+	Mode     string
+	Label    string
+	LocalTS  []TrafficSelector
+	RemoteTS []TrafficSelector
+}
+
+// ListPolicies returns the policies selected by filter, using the list-policies command.
+func (s *Session) ListPolicies(filter PolicyFilter) ([]Policy, error) {
+	var policies []Policy
+
+	err := s.EachPolicy(context.Background(), filter, func(p Policy) error {
+		policies = append(policies, p)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return policies, nil
+}
+
+// EachPolicy calls fn with each of the policies selected by filter, using the
+// list-policies command, as they are received from the daemon. If fn returns an error, it
+// is not called again, and that error is returned. The request is aborted once ctx is done.
+func (s *Session) EachPolicy(ctx context.Context, filter PolicyFilter, fn func(Policy) error) error {
+	if !filter.Drop && !filter.Pass && !filter.Trap {
+		filter.Drop, filter.Pass, filter.Trap = true, true, true
+	}
+
+	msg, err := MarshalMessage(filter)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.StreamedCommandRequestFuncContext(ctx, "list-policies", "list-policy", msg, func(m *Message) error {
+		policies, err := parsePolicies(m)
+		if err != nil {
+			return err
+		}
+
+		for _, p := range policies {
+			if err := fn(p); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return resp.Err()
+}
+
+// parsePolicies parses the policies in m, which is keyed by policy name as in
+// list-policy messages.
+func parsePolicies(m *Message) ([]Policy, error) {
+	var policies []Policy
+
+	for _, name := range m.Keys() {
+		section, ok := m.GetSection(name)
+		if !ok {
+			continue
+		}
+
+		p := Policy{
+			Name:  name,
+			Child: stringField(section, "child"),
+			IKE:   stringField(section, "ike"),
+			Mode:  stringField(section, "mode"),
+			Label: stringField(section, "label"),
+		}
+
+		var err error
+
+		if p.LocalTS, err = parseTrafficSelectors(section, "local-ts"); err != nil {
+			return nil, err
+		}
+
+		if p.RemoteTS, err = parseTrafficSelectors(section, "remote-ts"); err != nil {
+			return nil, err
+		}
+
+		policies = append(policies, p)
+	}
+
+	return policies, nil
+}
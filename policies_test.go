@@ -0,0 +1,235 @@
+// Copyright (C) 2019 Nick Rosbrook
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package vici
+
+import (
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func mustParseTrafficSelector(t *testing.T, s string) TrafficSelector {
+	t.Helper()
+
+	ts, err := ParseTrafficSelector(s)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing %v: %v", s, err)
+	}
+
+	return ts
+}
+
+func TestParseTrafficSelector(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected TrafficSelector
+	}{
+		{
+			in: "10.0.1.0/24",
+			expected: TrafficSelector{
+				Start:  netip.MustParseAddr("10.0.1.0"),
+				End:    netip.MustParseAddr("10.0.1.255"),
+				Prefix: netip.MustParsePrefix("10.0.1.0/24"),
+				ToPort: 65535,
+			},
+		},
+		{
+			in: "10.0.1.0/24[tcp/80]",
+			expected: TrafficSelector{
+				Start:          netip.MustParseAddr("10.0.1.0"),
+				End:            netip.MustParseAddr("10.0.1.255"),
+				Prefix:         netip.MustParsePrefix("10.0.1.0/24"),
+				Protocol:       "tcp",
+				Port:           "80",
+				ProtocolNumber: 6,
+				FromPort:       80,
+				ToPort:         80,
+			},
+		},
+		{
+			in: "fec1::/16[udp]",
+			expected: TrafficSelector{
+				Start:          netip.MustParseAddr("fec1::"),
+				End:            netip.MustParseAddr("fec1:ffff:ffff:ffff:ffff:ffff:ffff:ffff"),
+				Prefix:         netip.MustParsePrefix("fec1::/16"),
+				Protocol:       "udp",
+				ProtocolNumber: 17,
+				ToPort:         65535,
+			},
+		},
+		{
+			in: "10.0.1.10..10.0.1.20[udp/1024-65535]",
+			expected: TrafficSelector{
+				Start:          netip.MustParseAddr("10.0.1.10"),
+				End:            netip.MustParseAddr("10.0.1.20"),
+				Protocol:       "udp",
+				Port:           "1024-65535",
+				ProtocolNumber: 17,
+				FromPort:       1024,
+				ToPort:         65535,
+			},
+		},
+		{
+			in: "192.168.0.1/32[47/OPAQUE]",
+			expected: TrafficSelector{
+				Start:          netip.MustParseAddr("192.168.0.1"),
+				End:            netip.MustParseAddr("192.168.0.1"),
+				Prefix:         netip.MustParsePrefix("192.168.0.1/32"),
+				Protocol:       "47",
+				Port:           "OPAQUE",
+				ProtocolNumber: 47,
+				FromPort:       65535,
+				ToPort:         0,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		ts, err := ParseTrafficSelector(tt.in)
+		if err != nil {
+			t.Errorf("Unexpected error parsing %v: %v", tt.in, err)
+			continue
+		}
+
+		if ts != tt.expected {
+			t.Errorf("Unexpected traffic selector.\nExpected: %+v\nReceived: %+v", tt.expected, ts)
+		}
+
+		if ts.String() != tt.in {
+			t.Errorf("Unexpected string.\nExpected: %v\nReceived: %v", tt.in, ts.String())
+		}
+	}
+
+	for _, in := range []string{
+		"10.0.1.0",
+		"10.0.1.0/24[tcp/80",
+		"dynamic",
+		"10.0.1.20..10.0.1.10",
+		"10.0.1.0..fec1::",
+		"10.0.1.0/24[bogus]",
+		"10.0.1.0/24[tcp/70000]",
+		"10.0.1.0/24[tcp/1-99999]",
+	} {
+		if _, err := ParseTrafficSelector(in); err == nil {
+			t.Errorf("Expected error parsing %v", in)
+		}
+	}
+}
+
+func TestTrafficSelectorRange(t *testing.T) {
+	ts := mustParseTrafficSelector(t, "10.0.1.0..10.0.1.255")
+
+	if expected := netip.MustParsePrefix("10.0.1.0/24"); ts.Prefix != expected {
+		t.Errorf("Unexpected prefix.\nExpected: %v\nReceived: %v", expected, ts.Prefix)
+	}
+
+	for addr, expected := range map[string]bool{
+		"10.0.1.0":   true,
+		"10.0.1.128": true,
+		"10.0.2.0":   false,
+		"::1":        false,
+	} {
+		if ts.Contains(netip.MustParseAddr(addr)) != expected {
+			t.Errorf("Unexpected result of Contains(%v).\nExpected: %v\nReceived: %v", addr, expected, !expected)
+		}
+	}
+}
+
+func TestParseChildSATrafficSelectors(t *testing.T) {
+	m := NewMessage()
+	if err := m.Set("local-ts", []string{"10.0.1.0/24", "dynamic"}); err != nil {
+		t.Fatalf("Unexpected error setting key: %v", err)
+	}
+
+	if err := m.Set("remote-ts", []string{"10.0.2.0/24[tcp/https]"}); err != nil {
+		t.Fatalf("Unexpected error setting key: %v", err)
+	}
+
+	c := parseChildSA(m)
+
+	expected := []TrafficSelector{mustParseTrafficSelector(t, "10.0.1.0/24")}
+	if !reflect.DeepEqual(c.LocalTS, expected) {
+		t.Errorf("Unexpected local traffic selectors.\nExpected: %+v\nReceived: %+v", expected, c.LocalTS)
+	}
+
+	if len(c.RemoteTS) != 1 || c.RemoteTS[0].FromPort != 443 {
+		t.Errorf("Unexpected remote traffic selectors: %+v", c.RemoteTS)
+	}
+}
+
+func TestListPolicies(t *testing.T) {
+	client, srvr := net.Pipe()
+	defer client.Close()
+	defer srvr.Close()
+
+	s := &Session{ctr: &transport{conn: client}}
+
+	policy := NewMessage()
+	for _, kv := range []struct {
+		k string
+		v interface{}
+	}{
+		{"child", "net"},
+		{"ike", "gw"},
+		{"mode", "TUNNEL"},
+		{"local-ts", []string{"10.0.1.0/24"}},
+		{"remote-ts", []string{"10.0.2.0/24[tcp/443]"}},
+	} {
+		if err := policy.Set(kv.k, kv.v); err != nil {
+			t.Fatalf("Unexpected error setting key: %v", err)
+		}
+	}
+
+	event := NewMessage()
+	if err := event.Set("gw/net", policy); err != nil {
+		t.Fatalf("Unexpected error setting key: %v", err)
+	}
+
+	reqs := serveStreamedCommand(t, srvr, "list-policy", []*Message{event}, NewMessage())
+
+	policies, err := s.ListPolicies(PolicyFilter{IKE: "gw"})
+	if err != nil {
+		t.Fatalf("Unexpected error listing policies: %v", err)
+	}
+
+	expected := []Policy{
+		{
+			Name:     "gw/net",
+			Child:    "net",
+			IKE:      "gw",
+			Mode:     "TUNNEL",
+			LocalTS:  []TrafficSelector{mustParseTrafficSelector(t, "10.0.1.0/24")},
+			RemoteTS: []TrafficSelector{mustParseTrafficSelector(t, "10.0.2.0/24[tcp/443]")},
+		},
+	}
+
+	if !reflect.DeepEqual(policies, expected) {
+		t.Errorf("Unexpected policies.\nExpected: %+v\nReceived: %+v", expected, policies)
+	}
+
+	p := <-reqs
+	expectedReq := map[string]interface{}{"drop": "yes", "pass": "yes", "trap": "yes", "ike": "gw"}
+
+	if !reflect.DeepEqual(p.msg.ToMap(), expectedReq) {
+		t.Errorf("Unexpected request.\nExpected: %v\nReceived: %v", expectedReq, p.msg.ToMap())
+	}
+}
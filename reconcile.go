@@ -0,0 +1,273 @@
+// Copyright (C) 2019 Nick Rosbrook
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package vici
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+var (
+	// A secret to be reconciled has no ID
+	errReconcileSecretID = errors.New("vici: secret to reconcile has no ID")
+)
+
+// Action is a single step of a reconciliation Plan.
+type Action struct {
+	// Op is the operation, i.e. load or unload.
+	Op string
+
+	// Kind is the kind of item, i.e. cert, secret, pool or conn, and Name
+	// identifies the item, e.g. by connection name or secret ID.
+	Kind string
+	Name string
+
+	cmd         string
+	msg         *Message
+	fingerprint string
+}
+
+// String returns a description of the action, e.g. load conn gw.
+func (a Action) String() string {
+	return fmt.Sprintf("%v %v %v", a.Op, a.Kind, a.Name)
+}
+
+// Plan is a sequence of actions that converge the daemon to a desired Config.
+type Plan []Action
+
+// Reconciler converges the configuration loaded in the daemon to a desired Config,
+// issuing as few load and unload commands as possible. Connections, pools and secrets
+// that are loaded, but not desired, are unloaded. Desired items are loaded if they are
+// missing, or if they changed since the Reconciler last loaded them. Certificates are
+// loaded once, as they cannot be listed or unloaded individually.
+//
+// A Reconciler assumes it is the only client managing the daemon's configuration, e.g.
+// connections loaded by swanctl will be unloaded if they are not desired.
+type Reconciler struct {
+	s *Session
+
+	// Fingerprints of the items last loaded, by kind and name
+	applied map[string]string
+}
+
+// NewReconciler returns a new Reconciler for the session s.
+func NewReconciler(s *Session) *Reconciler {
+	return &Reconciler{
+		s:       s,
+		applied: make(map[string]string),
+	}
+}
+
+// Plan returns the actions needed to converge the daemon to desired, without executing
+// them. The daemon's current state is fetched with get-conns, get-pools and get-shared.
+func (r *Reconciler) Plan(desired Config) (Plan, error) {
+	conns, err := r.currentConns()
+	if err != nil {
+		return nil, err
+	}
+
+	pools, err := r.currentPools()
+	if err != nil {
+		return nil, err
+	}
+
+	secrets, err := r.s.GetShared()
+	if err != nil {
+		return nil, err
+	}
+
+	var plan Plan
+
+	for _, data := range desired.Certs {
+		certs, err := parseLoadCerts(data)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range certs {
+			fp := fmt.Sprintf("%x", sha256.Sum256(c.data))
+			if _, ok := r.applied["cert/"+fp]; ok {
+				continue
+			}
+
+			msg, err := newLoadCertMessage(c.typ, c.flag, c.data)
+			if err != nil {
+				return nil, err
+			}
+
+			plan = append(plan, Action{Op: "load", Kind: "cert", Name: fp[:16], cmd: "load-cert", msg: msg, fingerprint: fp})
+		}
+	}
+
+	var secretIDs []string
+
+	for _, secret := range desired.Secrets {
+		if secret.ID == "" {
+			return nil, errReconcileSecretID
+		}
+		secretIDs = append(secretIDs, secret.ID)
+
+		msg, err := MarshalMessage(secret)
+		if err != nil {
+			return nil, err
+		}
+
+		plan, err = r.planLoad(plan, "secret", secret.ID, "load-shared", msg, contains(secrets, secret.ID))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, name := range sortedKeys(desired.Pools) {
+		msg, err := marshalNamed(name, desired.Pools[name])
+		if err != nil {
+			return nil, err
+		}
+
+		plan, err = r.planLoad(plan, "pool", name, "load-pool", msg, contains(pools, name))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, name := range sortedKeys(desired.Conns) {
+		msg, err := marshalNamed(name, desired.Conns[name])
+		if err != nil {
+			return nil, err
+		}
+
+		plan, err = r.planLoad(plan, "conn", name, "load-conn", msg, contains(conns, name))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	plan = planUnload(plan, "conn", "unload-conn", "name", conns, sortedKeys(desired.Conns))
+	plan = planUnload(plan, "pool", "unload-pool", "name", pools, sortedKeys(desired.Pools))
+	plan = planUnload(plan, "secret", "unload-shared", "id", secrets, secretIDs)
+
+	return plan, nil
+}
+
+// Reconcile converges the daemon to desired, and returns the actions that were executed.
+// If an action fails, the actions executed so far are returned along with the error, and
+// the remaining actions are left for the next call.
+func (r *Reconciler) Reconcile(desired Config) (Plan, error) {
+	plan, err := r.Plan(desired)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.Execute(plan)
+}
+
+// Execute executes the actions of plan, as returned by Plan, in order, and returns the
+// actions that were executed. It stops at the first action that fails.
+func (r *Reconciler) Execute(plan Plan) (Plan, error) {
+	var executed Plan
+
+	for _, a := range plan {
+		if _, err := r.s.CommandRequest(a.cmd, a.msg); err != nil {
+			return executed, fmt.Errorf("%v: %v", a, err)
+		}
+
+		key := a.Kind + "/" + a.Name
+		if a.Kind == "cert" {
+			key = "cert/" + a.fingerprint
+		}
+
+		if a.Op == "load" {
+			r.applied[key] = a.fingerprint
+		} else {
+			delete(r.applied, key)
+		}
+
+		executed = append(executed, a)
+	}
+
+	return executed, nil
+}
+
+// planLoad appends an action to load msg to plan, unless the item is loaded, and
+// unchanged since the Reconciler last loaded it.
+func (r *Reconciler) planLoad(plan Plan, kind, name, cmd string, msg *Message, loaded bool) (Plan, error) {
+	data, err := msg.MarshalCanonical()
+	if err != nil {
+		return nil, err
+	}
+
+	fp := fmt.Sprintf("%x", sha256.Sum256(data))
+	if loaded && r.applied[kind+"/"+name] == fp {
+		return plan, nil
+	}
+
+	return append(plan, Action{Op: "load", Kind: kind, Name: name, cmd: cmd, msg: msg, fingerprint: fp}), nil
+}
+
+// planUnload appends an action to plan for each of the current items that is not desired.
+func planUnload(plan Plan, kind, cmd, key string, current, desired []string) Plan {
+	for _, name := range current {
+		if contains(desired, name) {
+			continue
+		}
+
+		msg := NewMessage()
+		// nolint
+		msg.Set(key, name)
+
+		plan = append(plan, Action{Op: "unload", Kind: kind, Name: name, cmd: cmd, msg: msg})
+	}
+
+	return plan
+}
+
+// currentConns returns the names of the connections loaded in the daemon.
+func (r *Reconciler) currentConns() ([]string, error) {
+	resp, err := r.s.CommandRequest("get-conns", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	conns, _ := resp.GetList("conns")
+
+	return conns, nil
+}
+
+// currentPools returns the names of the pools loaded in the daemon.
+func (r *Reconciler) currentPools() ([]string, error) {
+	resp, err := r.s.CommandRequest("get-pools", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Keys(), nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,99 @@
+// Copyright (C) 2019 Nick Rosbrook
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package vici
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestReconcile(t *testing.T) {
+	client, srvr := net.Pipe()
+	defer client.Close()
+	defer srvr.Close()
+
+	s := &Session{ctr: &transport{conn: client}}
+	r := NewReconciler(s)
+
+	newMessage := func(m map[string]interface{}) *Message {
+		msg, err := NewMessageFromMap(m)
+		if err != nil {
+			t.Fatalf("Unexpected error creating message: %v", err)
+		}
+
+		return msg
+	}
+
+	ok := newMessage(map[string]interface{}{"success": "yes"})
+	desired := Config{
+		Conns: map[string]interface{}{
+			"gw": Connection{Version: 2},
+			"rw": Connection{Version: 2, Pools: []string{"rw"}},
+		},
+	}
+
+	// The daemon has gw and old loaded, e.g. from swanctl.conf, and no pools
+	// or secrets.
+	state := []*Message{
+		newMessage(map[string]interface{}{"conns": []string{"gw", "old"}}),
+		NewMessage(),
+		newMessage(map[string]interface{}{"keys": []string{}}),
+	}
+
+	serveCommands(t, srvr, append(state, ok, ok, ok))
+
+	plan, err := r.Reconcile(desired)
+	if err != nil {
+		t.Fatalf("Unexpected error reconciling: %v", err)
+	}
+
+	expected := []string{"load conn gw", "load conn rw", "unload conn old"}
+	if got := planStrings(plan); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Unexpected plan.\nExpected: %v\nReceived: %v", expected, got)
+	}
+
+	// Now that the Reconciler has loaded them, unchanged connections are not
+	// loaded again, and only the changed one is.
+	desired.Conns["rw"] = Connection{Version: 2, Pools: []string{"rw", "rw6"}}
+
+	state[0] = newMessage(map[string]interface{}{"conns": []string{"gw", "rw"}})
+	serveCommands(t, srvr, append(state, ok))
+
+	plan, err = r.Reconcile(desired)
+	if err != nil {
+		t.Fatalf("Unexpected error reconciling: %v", err)
+	}
+
+	expected = []string{"load conn rw"}
+	if got := planStrings(plan); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Unexpected plan.\nExpected: %v\nReceived: %v", expected, got)
+	}
+}
+
+func planStrings(plan Plan) []string {
+	var s []string
+	for _, a := range plan {
+		s = append(s, a.String())
+	}
+
+	return s
+}
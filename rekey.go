@@ -0,0 +1,205 @@
+// Copyright (C) 2019 Nick Rosbrook
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package vici
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// Received an event that is not a rekey event
+	errNotRekeyEvent = errors.New("vici: not a rekey event")
+
+	// ListenRekeys was given no functions to call
+	errNoRekeyFuncs = errors.New("vici: no rekey functions given")
+)
+
+// IKERekey describes an IKE SA rekeying, as reported by an ike-rekey event.
+type IKERekey struct {
+	// Name of the IKE SA
+	Name string
+
+	Old IKERekeySA
+	New IKERekeySA
+}
+
+// IKERekeySA identifies one side of an IKE SA rekeying.
+type IKERekeySA struct {
+	UniqueID     string
+	InitiatorSPI string
+	ResponderSPI string
+}
+
+// ChildRekey describes a CHILD SA rekeying, as reported by a child-rekey event.
+type ChildRekey struct {
+	// Name and unique ID of the parent IKE SA
+	IKEName     string
+	IKEUniqueID string
+
+	// Name of the CHILD SA
+	Name string
+
+	Old ChildRekeySA
+	New ChildRekeySA
+}
+
+// ChildRekeySA identifies one side of a CHILD SA rekeying.
+type ChildRekeySA struct {
+	UniqueID string
+	SPIIn    string
+	SPIOut   string
+}
+
+// ListenRekeys registers the session for rekey events, and calls ike and child for each
+// IKE SA and CHILD SA rekeying received. Either function may be nil, in which case the
+// corresponding event is not registered, but an error is returned if both are nil. Like
+// Listen, ListenRekeys does not return unless an error occurs, and should not be called
+// while Listen is active.
+func (s *Session) ListenRekeys(ike func(IKERekey), child func(ChildRekey)) error {
+	var events []string
+
+	if ike != nil {
+		events = append(events, "ike-rekey")
+	}
+
+	if child != nil {
+		events = append(events, "child-rekey")
+	}
+
+	if len(events) == 0 {
+		return errNoRekeyFuncs
+	}
+
+	return s.el.safeListenFunc(events, func(e Event) {
+		switch e.Name {
+		case "ike-rekey":
+			rekeys, err := ParseIKERekeyEvent(e)
+			if err != nil {
+				return
+			}
+
+			for _, r := range rekeys {
+				ike(r)
+			}
+
+		case "child-rekey":
+			rekeys, err := ParseChildRekeyEvent(e)
+			if err != nil {
+				return
+			}
+
+			for _, r := range rekeys {
+				child(r)
+			}
+		}
+	})
+}
+
+// ParseIKERekeyEvent returns the IKE SA rekeyings described by an ike-rekey event.
+func ParseIKERekeyEvent(e Event) ([]IKERekey, error) {
+	if e.Name != "ike-rekey" {
+		return nil, fmt.Errorf("%v: %v", errNotRekeyEvent, e.Name)
+	}
+
+	var rekeys []IKERekey
+
+	for _, name := range e.Message.Keys() {
+		sa, ok := e.Message.GetSection(name)
+		if !ok {
+			continue
+		}
+
+		old, oldOK := sa.GetSection("old")
+		nw, newOK := sa.GetSection("new")
+		if !oldOK || !newOK {
+			continue
+		}
+
+		rekeys = append(rekeys, IKERekey{
+			Name: name,
+			Old:  parseIKERekeySA(old),
+			New:  parseIKERekeySA(nw),
+		})
+	}
+
+	return rekeys, nil
+}
+
+// ParseChildRekeyEvent returns the CHILD SA rekeyings described by a child-rekey event.
+func ParseChildRekeyEvent(e Event) ([]ChildRekey, error) {
+	if e.Name != "child-rekey" {
+		return nil, fmt.Errorf("%v: %v", errNotRekeyEvent, e.Name)
+	}
+
+	var rekeys []ChildRekey
+
+	for _, name := range e.Message.Keys() {
+		sa, ok := e.Message.GetSection(name)
+		if !ok {
+			continue
+		}
+
+		children, ok := sa.GetSection("child-sas")
+		if !ok {
+			continue
+		}
+
+		for _, ck := range children.Keys() {
+			child, ok := children.GetSection(ck)
+			if !ok {
+				continue
+			}
+
+			old, oldOK := child.GetSection("old")
+			nw, newOK := child.GetSection("new")
+			if !oldOK || !newOK {
+				continue
+			}
+
+			rekeys = append(rekeys, ChildRekey{
+				IKEName:     name,
+				IKEUniqueID: stringField(sa, "uniqueid"),
+				Name:        stringField(nw, "name"),
+				Old:         parseChildRekeySA(old),
+				New:         parseChildRekeySA(nw),
+			})
+		}
+	}
+
+	return rekeys, nil
+}
+
+func parseIKERekeySA(m *Message) IKERekeySA {
+	return IKERekeySA{
+		UniqueID:     stringField(m, "uniqueid"),
+		InitiatorSPI: stringField(m, "initiator-spi"),
+		ResponderSPI: stringField(m, "responder-spi"),
+	}
+}
+
+func parseChildRekeySA(m *Message) ChildRekeySA {
+	return ChildRekeySA{
+		UniqueID: stringField(m, "uniqueid"),
+		SPIIn:    stringField(m, "spi-in"),
+		SPIOut:   stringField(m, "spi-out"),
+	}
+}
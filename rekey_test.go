@@ -0,0 +1,93 @@
+// Copyright (C) 2019 Nick Rosbrook
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package vici
+
+import (
+	"testing"
+)
+
+func TestParseChildRekeyEvent(t *testing.T) {
+	e := Event{
+		Name: "child-rekey",
+		Message: &Message{
+			keys: []string{"gw"},
+			data: map[string]interface{}{
+				"gw": &Message{
+					keys: []string{"uniqueid", "child-sas"},
+					data: map[string]interface{}{
+						"uniqueid": "1",
+						"child-sas": &Message{
+							keys: []string{"net-2"},
+							data: map[string]interface{}{
+								"net-2": &Message{
+									keys: []string{"old", "new"},
+									data: map[string]interface{}{
+										"old": &Message{
+											keys: []string{"name", "uniqueid", "spi-in", "spi-out"},
+											data: map[string]interface{}{
+												"name": "net", "uniqueid": "2", "spi-in": "c1", "spi-out": "c2",
+											},
+										},
+										"new": &Message{
+											keys: []string{"name", "uniqueid", "spi-in", "spi-out"},
+											data: map[string]interface{}{
+												"name": "net", "uniqueid": "3", "spi-in": "c3", "spi-out": "c4",
+											},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	rekeys, err := ParseChildRekeyEvent(e)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing child-rekey event: %v", err)
+	}
+
+	expected := ChildRekey{
+		IKEName:     "gw",
+		IKEUniqueID: "1",
+		Name:        "net",
+		Old:         ChildRekeySA{UniqueID: "2", SPIIn: "c1", SPIOut: "c2"},
+		New:         ChildRekeySA{UniqueID: "3", SPIIn: "c3", SPIOut: "c4"},
+	}
+
+	if len(rekeys) != 1 || rekeys[0] != expected {
+		t.Errorf("Parsed rekeys do not match.\nExpected: %+v\nReceived: %+v", expected, rekeys)
+	}
+
+	if _, err := ParseChildRekeyEvent(Event{Name: "ike-rekey"}); err == nil {
+		t.Errorf("Expected error parsing event of wrong type")
+	}
+}
+
+func TestListenRekeysNoFuncs(t *testing.T) {
+	s := &Session{el: &eventListener{}}
+
+	if err := s.ListenRekeys(nil, nil); err == nil {
+		t.Errorf("Expected error without rekey functions")
+	}
+}
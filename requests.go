@@ -21,6 +21,7 @@
 package vici
 
 import (
+	"context"
 	"errors"
 	"fmt"
 )
@@ -53,23 +54,54 @@ func (s *Session) sendRequest(cmd string, msg *Message) (*Message, error) {
 	return p.msg, nil
 }
 
-func (s *Session) sendStreamedRequest(cmd string, event string, msg *Message) (*MessageStream, error) {
+func (s *Session) sendStreamedRequest(ctx context.Context, cmd string, event string, msg *Message, fn func(*Message) error) (*Message, error) {
 	s.mux.Lock()
 	defer s.mux.Unlock()
 
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := s.ctr.ready(); err != nil {
+		return nil, err
+	}
+
+	stop := s.ctr.watchContext(ctx)
+
+	resp, err := s.registerAndHandleStreamedRequest(cmd, event, msg, fn)
+	stop()
+
+	if err != nil && ctx.Err() != nil {
+		// The request was interrupted, so there may be unread messages on
+		// the transport. Start over with a fresh connection.
+		if rerr := s.ctr.reset(); rerr != nil {
+			return nil, fmt.Errorf("%w: %v", ctx.Err(), rerr)
+		}
+
+		return nil, ctx.Err()
+	}
+
+	return resp, err
+}
+
+func (s *Session) registerAndHandleStreamedRequest(cmd, event string, msg *Message, fn func(*Message) error) (*Message, error) {
 	err := s.streamEventRegisterUnregister(event, true)
 	if err != nil {
 		return nil, err
 	}
 
-	return s.handleStreamedRequest(cmd, event, msg)
+	return s.handleStreamedRequest(cmd, event, msg, fn)
 }
 
-func (s *Session) handleStreamedRequest(cmd, event string, msg *Message) (*MessageStream, error) {
+// handleStreamedRequest sends the command request, and calls fn for each event message
+// received before the command response. The command response is returned once the request
+// is complete. If fn returns an error, fn is not called again, but the remaining messages
+// are still read so that the transport is left in a usable state.
+func (s *Session) handleStreamedRequest(cmd, event string, msg *Message, fn func(*Message) error) (*Message, error) {
 	// nolint
 	defer s.streamEventRegisterUnregister(event, false)
 
-	messages := make([]*Message, 0)
+	var fnErr error
 
 	p := newPacket(pktCmdRequest, cmd, msg)
 
@@ -88,16 +120,29 @@ func (s *Session) handleStreamedRequest(cmd, event string, msg *Message) (*Messa
 			break
 		}
 
-		messages = append(messages, p.msg)
+		if fnErr == nil {
+			fnErr = fn(p.msg)
+		}
 	}
 
 	// Packet type was not event, check if it was command response
 	if p.ptype != pktCmdResponse {
 		return nil, fmt.Errorf("%v: %v", errUnexpectedResponse, p.ptype)
 	}
-	messages = append(messages, p.msg)
 
-	return &MessageStream{messages}, nil
+	if fnErr != nil {
+		return nil, fnErr
+	}
+
+	return p.msg, nil
+}
+
+// reconnect re-establishes the command transport, e.g. after the daemon was restarted.
+func (s *Session) reconnect() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.ctr.reset()
 }
 
 // streamEventRegisterUnregister will (un)register the given event type, based on the register boolean.
@@ -128,6 +173,10 @@ func (s *Session) streamEventRegisterUnregister(event string, register bool) err
 // dedicated transport. It should only be used within a function with the session
 // lock.
 func (s *Session) cmdTransportCommunicate(pkt *packet) (*packet, error) {
+	if err := s.ctr.ready(); err != nil {
+		return nil, err
+	}
+
 	err := s.ctr.send(pkt)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,135 @@
+// Copyright (C) 2019 Nick Rosbrook
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package vici
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+var (
+	// More than one SA matched a lookup by name
+	errAmbiguousSA = errors.New("vici: name matches multiple SAs")
+)
+
+// NotFoundError is returned by lookups of a single SA or connection, e.g. Session.GetSA
+// and Session.GetConn, if nothing matches.
+type NotFoundError struct {
+	// Kind is what was looked up, e.g. "IKE SA" or "connection", and Name
+	// the name it was looked up by.
+	Kind string
+	Name string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("vici: %v %v not found", e.Kind, e.Name)
+}
+
+// GetSA returns the IKE SA of the connection name, using the list-sas command. A
+// *NotFoundError is returned if there is none, and an error if there are several, e.g.
+// during reauthentication, or with multiple peers of a responder connection.
+func (s *Session) GetSA(name string) (IKESA, error) {
+	ikes, err := s.listSAs(name)
+	if err != nil {
+		return IKESA{}, err
+	}
+
+	switch len(ikes) {
+	case 0:
+		return IKESA{}, &NotFoundError{Kind: "IKE SA", Name: name}
+	case 1:
+		return ikes[0], nil
+	default:
+		return IKESA{}, fmt.Errorf("%v: %v", errAmbiguousSA, name)
+	}
+}
+
+// GetConn returns the loaded connection name, using the list-conns command. A
+// *NotFoundError is returned if it is not loaded.
+func (s *Session) GetConn(name string) (Conn, error) {
+	conns, err := s.listConns(name)
+	if err != nil {
+		return Conn{}, err
+	}
+
+	for _, c := range conns {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+
+	return Conn{}, &NotFoundError{Kind: "connection", Name: name}
+}
+
+// SAFilter selects the IKE SAs enumerated by Session.EachSA.
+type SAFilter struct {
+	// IKE and IKEID restrict the IKE SAs to those of the named connection, or
+	// with the given unique ID.
+	IKE   string `vici:"ike,omitempty"`
+	IKEID uint32 `vici:"ike-id,omitempty"`
+}
+
+// EachSA calls fn with each of the IKE SAs selected by filter, using the list-sas command,
+// as they are received from the daemon. If fn returns an error, it is not called again,
+// and that error is returned. The request is aborted once ctx is done.
+func (s *Session) EachSA(ctx context.Context, filter SAFilter, fn func(IKESA) error) error {
+	msg, err := MarshalMessage(filter)
+	if err != nil {
+		return err
+	}
+
+	if err := msg.Set("noblock", "yes"); err != nil {
+		return err
+	}
+
+	resp, err := s.StreamedCommandRequestFuncContext(ctx, "list-sas", "list-sa", msg, func(m *Message) error {
+		for _, ike := range parseIKESAs(m) {
+			if err := fn(*ike); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return resp.Err()
+}
+
+// listSAs returns the IKE SAs known by the daemon, using the list-sas command. If ike is
+// not empty, only the IKE SAs of the connection ike are returned.
+func (s *Session) listSAs(ike string) ([]IKESA, error) {
+	var ikes []IKESA
+
+	err := s.EachSA(context.Background(), SAFilter{IKE: ike}, func(sa IKESA) error {
+		ikes = append(ikes, sa)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ikes, nil
+}
@@ -0,0 +1,153 @@
+// Copyright (C) 2019 Nick Rosbrook
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package vici
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestGetSA(t *testing.T) {
+	client, srvr := net.Pipe()
+	defer client.Close()
+	defer srvr.Close()
+
+	s := &Session{ctr: &transport{conn: client}}
+
+	sa, err := NewMessageFromMap(map[string]interface{}{
+		"gw": map[string]interface{}{"uniqueid": "1", "state": "ESTABLISHED", "remote-host": "192.0.2.1"},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error creating message: %v", err)
+	}
+
+	reqs := serveStreamedCommands(t, srvr, []streamedResponse{
+		{"list-sa", []*Message{sa}, NewMessage()},
+		{"list-sa", nil, NewMessage()},
+	})
+
+	ike, err := s.GetSA("gw")
+	if err != nil {
+		t.Fatalf("Unexpected error getting SA: %v", err)
+	}
+
+	if ike.Name != "gw" || ike.UniqueID != "1" || ike.RemoteHost != "192.0.2.1" {
+		t.Errorf("Unexpected SA: %+v", ike)
+	}
+
+	p := <-reqs
+	if name := stringField(p.msg, "ike"); name != "gw" {
+		t.Errorf("Unexpected ike filter.\nExpected: %v\nReceived: %v", "gw", name)
+	}
+
+	_, err = s.GetSA("gw")
+
+	var nf *NotFoundError
+	if !errors.As(err, &nf) || nf.Name != "gw" {
+		t.Errorf("Expected *NotFoundError: received %v", err)
+	}
+}
+
+func TestGetConn(t *testing.T) {
+	client, srvr := net.Pipe()
+	defer client.Close()
+	defer srvr.Close()
+
+	s := &Session{ctr: &transport{conn: client}}
+
+	conn, err := NewMessageFromMap(map[string]interface{}{
+		"gw": map[string]interface{}{"version": "IKEv2"},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error creating message: %v", err)
+	}
+
+	serveStreamedCommands(t, srvr, []streamedResponse{
+		{"list-conn", []*Message{conn}, NewMessage()},
+		{"list-conn", nil, NewMessage()},
+	})
+
+	c, err := s.GetConn("gw")
+	if err != nil {
+		t.Fatalf("Unexpected error getting connection: %v", err)
+	}
+
+	if c.Name != "gw" || c.Version != "IKEv2" {
+		t.Errorf("Unexpected connection: %+v", c)
+	}
+
+	_, err = s.GetConn("gw")
+
+	var nf *NotFoundError
+	if !errors.As(err, &nf) || nf.Kind != "connection" {
+		t.Errorf("Expected *NotFoundError: received %v", err)
+	}
+}
+
+func TestEachSA(t *testing.T) {
+	client, srvr := net.Pipe()
+	defer client.Close()
+	defer srvr.Close()
+
+	s := &Session{ctr: &transport{conn: client}}
+
+	var events []*Message
+	for _, name := range []string{"gw1", "gw2", "gw3"} {
+		m, err := NewMessageFromMap(map[string]interface{}{name: map[string]interface{}{"uniqueid": name[2:]}})
+		if err != nil {
+			t.Fatalf("Unexpected error creating message: %v", err)
+		}
+		events = append(events, m)
+	}
+
+	reqs := serveStreamedCommand(t, srvr, "list-sa", events, NewMessage())
+
+	stop := errors.New("stop")
+
+	var names []string
+
+	err := s.EachSA(context.Background(), SAFilter{IKEID: 2}, func(ike IKESA) error {
+		names = append(names, ike.Name)
+		if len(names) == 2 {
+			return stop
+		}
+
+		return nil
+	})
+	if err != stop {
+		t.Errorf("Unexpected error.\nExpected: %v\nReceived: %v", stop, err)
+	}
+
+	expected := []string{"gw1", "gw2"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Unexpected SAs.\nExpected: %v\nReceived: %v", expected, names)
+	}
+
+	p := <-reqs
+	expectedReq := map[string]interface{}{"ike-id": "2", "noblock": "yes"}
+
+	if !reflect.DeepEqual(p.msg.ToMap(), expectedReq) {
+		t.Errorf("Unexpected request.\nExpected: %v\nReceived: %v", expectedReq, p.msg.ToMap())
+	}
+}
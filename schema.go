@@ -0,0 +1,316 @@
+// Copyright (C) 2019 Nick Rosbrook
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package vici
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schema describes the elements allowed in a message, and is used by Validate to
+// catch mistakes, e.g. misspelled keys, which the daemon would otherwise silently
+// ignore. Schemas can be expressed in JSON, with the same field names.
+type Schema struct {
+	// Type is one of "string", "bool", "number", "duration", "enum", "list" or
+	// "section". A list may also be given as a key-value pair, in which case the
+	// daemon treats it as a comma-separated list.
+	Type string `json:"type"`
+
+	// Values lists the allowed values of an enum.
+	Values []string `json:"values,omitempty"`
+
+	// Keys describes the elements of a section, by key.
+	Keys map[string]*Schema `json:"keys,omitempty"`
+
+	// Prefixes describes elements of a section whose keys begin with a prefix,
+	// e.g. the "local" and "local-1" authentication rounds of a connection. Keys
+	// are matched exactly before they are matched by prefix.
+	Prefixes map[string]*Schema `json:"prefixes,omitempty"`
+
+	// Each describes the elements of a section whose keys are chosen by the
+	// user, e.g. connection or child SA names.
+	Each *Schema `json:"each,omitempty"`
+}
+
+//go:embed schema/connections.json
+var connectionsSchema []byte
+
+// ConnectionsSchema describes the message sent with load-conn, i.e. a section per
+// connection, with the options documented for connections in swanctl.conf. It is
+// generated from swanctl/spec.json, like the types of the swanctl package, so the
+// two are always in sync. Connection is checked against it by its tests.
+var ConnectionsSchema = mustParseSchema(connectionsSchema)
+
+// mustParseSchema parses a JSON schema, and panics if it is invalid.
+func mustParseSchema(data []byte) *Schema {
+	s := &Schema{}
+	if err := json.Unmarshal(data, s); err != nil {
+		panic(fmt.Sprintf("vici: invalid schema: %v", err))
+	}
+
+	return s
+}
+
+// SchemaError is returned by Validate, and describes each element of the message
+// that does not conform to the schema.
+type SchemaError struct {
+	// Problems are given as the dot-separated path of an element, followed
+	// by what is wrong with it.
+	Problems []string
+}
+
+func (e *SchemaError) Error() string {
+	return "vici: message does not conform to schema: " + strings.Join(e.Problems, "; ")
+}
+
+// Validate checks that m conforms to schema, which must describe a section. If it
+// does not, a *SchemaError is returned. For example, misspelled options of a
+// connection can be found before it is loaded:
+//
+//	if err := vici.Validate(conns, vici.ConnectionsSchema); err != nil {
+//		return err
+//	}
+func Validate(m *Message, schema *Schema) error {
+	var problems []string
+
+	schema.validateSection(m, "", &problems)
+
+	if len(problems) > 0 {
+		return &SchemaError{Problems: problems}
+	}
+
+	return nil
+}
+
+// validateSection validates the elements of the section m, whose path is prefix.
+func (s *Schema) validateSection(m *Message, prefix string, problems *[]string) {
+	for _, k := range m.Keys() {
+		path := k
+		if prefix != "" {
+			path = prefix + "." + k
+		}
+
+		elem := s.lookup(k)
+		if elem == nil {
+			*problems = append(*problems, fmt.Sprintf("%v: unknown key", path))
+			continue
+		}
+
+		elem.validate(m, k, path, problems)
+	}
+}
+
+// lookup returns the schema of the element with key k in the section described by s,
+// or nil if there is none.
+func (s *Schema) lookup(k string) *Schema {
+	if elem, ok := s.Keys[k]; ok {
+		return elem
+	}
+
+	// Prefer the longest matching prefix
+	prefixes := make([]string, 0, len(s.Prefixes))
+	for p := range s.Prefixes {
+		prefixes = append(prefixes, p)
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		return len(prefixes[i]) > len(prefixes[j])
+	})
+
+	for _, p := range prefixes {
+		if strings.HasPrefix(k, p) {
+			return s.Prefixes[p]
+		}
+	}
+
+	return s.Each
+}
+
+// validate validates the element key of the section m, whose path is path.
+func (s *Schema) validate(m *Message, key string, path string, problems *[]string) {
+	v := m.Get(key)
+
+	fail := func(format string, args ...interface{}) {
+		*problems = append(*problems, fmt.Sprintf("%v: ", path)+fmt.Sprintf(format, args...))
+	}
+
+	if s.Type == "section" {
+		section, ok := m.GetSection(key)
+		if !ok {
+			fail("expected section")
+			return
+		}
+
+		s.validateSection(section, path, problems)
+
+		return
+	}
+
+	if s.Type == "list" {
+		switch v.(type) {
+		case []string, string:
+		default:
+			fail("expected list")
+		}
+
+		return
+	}
+
+	value, ok := v.(string)
+	if !ok {
+		fail("expected %v value", s.Type)
+		return
+	}
+
+	switch s.Type {
+	case "bool":
+		if _, ok := parseBool(value); !ok {
+			fail("invalid bool %q", value)
+		}
+
+	case "number":
+		if _, err := strconv.ParseUint(value, 10, 64); err != nil {
+			fail("invalid number %q", value)
+		}
+
+	case "duration":
+		if _, err := parseDuration(value); err != nil {
+			fail("invalid duration %q", value)
+		}
+
+	case "enum":
+		for _, allowed := range s.Values {
+			if value == allowed {
+				return
+			}
+		}
+		fail("invalid value %q, expected one of %v", value, strings.Join(s.Values, ", "))
+	}
+}
+
+// ValidateConnection checks conn, a connection to be loaded as name, without contacting
+// the daemon. conn may be a Connection, or any value accepted by Config.Conns. It is
+// validated against ConnectionsSchema, and checked for combinations of options that the
+// daemon would reject, or that cannot work, e.g. a CHILD SA that is started or trapped
+// without a remote address to initiate to. A *SchemaError is returned describing each
+// problem found.
+func ValidateConnection(name string, conn interface{}) error {
+	msg, err := marshalNamed(name, conn)
+	if err != nil {
+		return err
+	}
+
+	var problems []string
+
+	ConnectionsSchema.validateSection(msg, "", &problems)
+
+	if section, ok := msg.GetSection(name); ok {
+		checkConnection(section, name, &problems)
+	}
+
+	if len(problems) > 0 {
+		return &SchemaError{Problems: problems}
+	}
+
+	return nil
+}
+
+// checkConnection checks the combinations of options of the connection m, whose path is
+// path, that cannot be checked by the schema alone.
+func checkConnection(m *Message, path string, problems *[]string) {
+	fail := func(path, format string, args ...interface{}) {
+		*problems = append(*problems, fmt.Sprintf("%v: ", path)+fmt.Sprintf(format, args...))
+	}
+
+	remote := listField(m, "remote_addrs")
+	initiable := len(remote) > 0
+	for _, addr := range remote {
+		if addr == "%any" || addr == "%any4" || addr == "%any6" {
+			initiable = false
+		}
+	}
+
+	children, _ := m.GetSection("children")
+	if children == nil || len(children.Keys()) == 0 {
+		if v, ok := m.GetString("childless"); ok && v == "never" {
+			fail(path+".childless", "connection without CHILD SAs cannot be childless never")
+		}
+
+		return
+	}
+
+	for _, name := range children.Keys() {
+		child, ok := children.GetSection(name)
+		if !ok {
+			continue
+		}
+
+		childPath := path + ".children." + name
+		mode := stringField(child, "mode")
+		start := stringField(child, "start_action")
+
+		switch {
+		case strings.Contains(start, "start") && (mode == "pass" || mode == "drop"):
+			fail(childPath+".start_action", "%v policy cannot be started", mode)
+		case (start == "trap" || strings.Contains(start, "start")) && !initiable:
+			fail(childPath+".start_action", "%v requires a specific remote address", start)
+		}
+
+		rekey, rok := durationField(child, "rekey_time")
+		life, lok := durationField(child, "life_time")
+		if rok && lok && rekey > 0 && life <= rekey {
+			fail(childPath+".life_time", "must be greater than rekey_time")
+		}
+	}
+}
+
+// listField returns the list value of key in m, which may also be given as a
+// comma-separated string.
+func listField(m *Message, key string) []string {
+	if list, ok := m.GetList(key); ok {
+		return list
+	}
+
+	var list []string
+	for _, v := range strings.Split(stringField(m, key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+
+	return list
+}
+
+// durationField returns the duration value of key in m, and whether it is set and valid.
+func durationField(m *Message, key string) (time.Duration, bool) {
+	v, ok := m.GetString(key)
+	if !ok {
+		return 0, false
+	}
+
+	d, err := parseDuration(v)
+
+	return d, err == nil
+}
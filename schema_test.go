@@ -0,0 +1,195 @@
+// Copyright (C) 2019 Nick Rosbrook
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package vici
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestValidateConnectionsSchema(t *testing.T) {
+	conns := NewMessage()
+	for path, value := range map[string]interface{}{
+		"gw-gw.version":                     "2",
+		"gw-gw.local_addrs":                 []string{"192.168.0.1"},
+		"gw-gw.remote_addrs":                "192.168.0.2",
+		"gw-gw.rekey_time":                  "4h",
+		"gw-gw.local.auth":                  "pubkey",
+		"gw-gw.local-2.auth":                "eap",
+		"gw-gw.remote.revocation":           "strict",
+		"gw-gw.remote.cacert1.file":         "ca.pem",
+		"gw-gw.children.net.esp_proposals":  []string{"aes128gcm16"},
+		"gw-gw.children.net.mode":           "tunnel",
+		"gw-gw.children.net.start_action":   "trap",
+		"gw-gw.children.net.local_ts":       []string{"10.1.0.0/16"},
+		"gw-gw.children.host.replay_window": "32",
+	} {
+		if err := conns.SetPath(path, value); err != nil {
+			t.Fatalf("Unexpected error setting path: %v", err)
+		}
+	}
+
+	if err := Validate(conns, ConnectionsSchema); err != nil {
+		t.Fatalf("Unexpected error validating valid connection: %v", err)
+	}
+
+	for path, value := range map[string]interface{}{
+		"gw-gw.children.net.esp_proposls": []string{"aes128gcm16"},
+		"gw-gw.children.net.mode":         "tunel",
+		"gw-gw.mobike":                    "maybe",
+		"gw-gw.local_port":                "ike",
+		"gw-gw.dpd_delay":                 "soon",
+		"gw-gw.local.auth":                []string{"pubkey"},
+	} {
+		if err := conns.SetPath(path, value); err != nil {
+			t.Fatalf("Unexpected error setting path: %v", err)
+		}
+	}
+
+	err := Validate(conns, ConnectionsSchema)
+	if err == nil {
+		t.Fatalf("Expected error validating invalid connection")
+	}
+
+	se, ok := err.(*SchemaError)
+	if !ok {
+		t.Fatalf("Expected *SchemaError: received %T", err)
+	}
+
+	expected := []string{
+		"gw-gw.mobike: invalid bool \"maybe\"",
+		"gw-gw.local_port: invalid number \"ike\"",
+		"gw-gw.dpd_delay: invalid duration \"soon\"",
+		"gw-gw.local.auth: expected string value",
+		"gw-gw.children.net.mode: invalid value \"tunel\", expected one of tunnel, transport, transport_proxy, beet, pass, drop",
+		"gw-gw.children.net.esp_proposls: unknown key",
+	}
+
+	problems := make(map[string]bool)
+	for _, p := range se.Problems {
+		problems[p] = true
+	}
+
+	for _, p := range expected {
+		if !problems[p] {
+			t.Errorf("Expected problem %q: received %v", p, se.Problems)
+		}
+	}
+
+	if len(se.Problems) != len(expected) {
+		t.Errorf("Unexpected problems.\nExpected: %v\nReceived: %v", expected, se.Problems)
+	}
+}
+
+func TestValidateRawSection(t *testing.T) {
+	conn := NewMessage()
+	if err := conn.Set("mobike", "maybe"); err != nil {
+		t.Fatalf("Unexpected error setting key: %v", err)
+	}
+
+	raw, err := conn.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling section: %v", err)
+	}
+
+	conns := NewMessage()
+	if err := conns.Set("gw-gw", RawMessage(raw)); err != nil {
+		t.Fatalf("Unexpected error setting raw message: %v", err)
+	}
+
+	err = Validate(conns, ConnectionsSchema)
+
+	se, ok := err.(*SchemaError)
+	if !ok {
+		t.Fatalf("Expected *SchemaError: received %v", err)
+	}
+
+	expected := []string{"gw-gw.mobike: invalid bool \"maybe\""}
+	if !reflect.DeepEqual(se.Problems, expected) {
+		t.Errorf("Unexpected problems.\nExpected: %v\nReceived: %v", expected, se.Problems)
+	}
+}
+
+func TestSchemaLookup(t *testing.T) {
+	s := &Schema{
+		Type: "section",
+		Keys: map[string]*Schema{"certs": {Type: "list"}},
+		Prefixes: map[string]*Schema{
+			"cert":   {Type: "section"},
+			"cacert": {Type: "section"},
+		},
+	}
+
+	for k, expected := range map[string]*Schema{
+		"certs":   s.Keys["certs"],
+		"cert1":   s.Prefixes["cert"],
+		"cacert1": s.Prefixes["cacert"],
+		"other":   nil,
+	} {
+		if elem := s.lookup(k); elem != expected {
+			t.Errorf("Unexpected schema for %v.\nExpected: %v\nReceived: %v", k, expected, elem)
+		}
+	}
+}
+
+func TestValidateConnection(t *testing.T) {
+	conn := Connection{
+		RemoteAddrs: []string{"192.0.2.1"},
+		LocalAuth:   []LocalAuth{{Auth: "pubkey"}},
+		Children: []ChildSAConfig{
+			{Name: "net", Mode: "tunnel", StartAction: "trap", RekeyTime: time.Hour},
+		},
+	}
+
+	if err := ValidateConnection("gw", conn); err != nil {
+		t.Fatalf("Unexpected error validating valid connection: %v", err)
+	}
+
+	conn.RemoteAddrs = []string{"%any"}
+	conn.Children = []ChildSAConfig{
+		{Name: "net", Mode: "tunel"},
+		{Name: "host", Mode: "tunnel", StartAction: "start"},
+		{Name: "bypass", Mode: "pass", StartAction: "start"},
+		{Name: "short", RekeyTime: time.Hour, LifeTime: time.Minute},
+	}
+
+	c := Config{Conns: map[string]interface{}{"gw": conn, "bad": 42}}
+
+	err := c.Validate()
+
+	se, ok := err.(*SchemaError)
+	if !ok {
+		t.Fatalf("Expected *SchemaError: received %v", err)
+	}
+
+	expected := []string{
+		"bad: vici: error marshaling message: encountered unsupported type: int",
+		"gw.children.net.mode: invalid value \"tunel\", expected one of tunnel, transport, transport_proxy, beet, pass, drop",
+		"gw.children.host.start_action: start requires a specific remote address",
+		"gw.children.bypass.start_action: pass policy cannot be started",
+		"gw.children.short.life_time: must be greater than rekey_time",
+	}
+
+	if !reflect.DeepEqual(se.Problems, expected) {
+		t.Errorf("Unexpected problems.\nExpected: %q\nReceived: %q", expected, se.Problems)
+	}
+}
@@ -27,6 +27,7 @@
 package vici
 
 import (
+	"context"
 	"sync"
 )
 
@@ -63,6 +64,56 @@ func NewSession() (*Session, error) {
 	return s, nil
 }
 
+// SetDecodeLimits sets the limits applied when decoding messages received from the daemon.
+// If a received message exceeds a limit, a *DecodeLimitError is returned by the request,
+// or by Listen. SetDecodeLimits should not be called while Listen is active.
+func (s *Session) SetDecodeLimits(limits DecodeLimits) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.ctr.opts.limits = limits
+	s.el.opts.limits = limits
+}
+
+// SetZeroCopyDecode enables or disables zero-copy decoding of messages received from the
+// daemon. When enabled, the keys and values of a received Message share memory with the
+// buffer it was received in, instead of each being copied. This reduces allocations for
+// clients that frequently make large requests, e.g. polling list-sas, at the cost of
+// keeping the entire received buffer alive as long as any part of the Message is
+// referenced. SetZeroCopyDecode should not be called while Listen is active.
+func (s *Session) SetZeroCopyDecode(enabled bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.ctr.opts.zeroCopy = enabled
+	s.el.opts.zeroCopy = enabled
+}
+
+// SetLazyDecode enables or disables lazy decoding of messages received from the daemon.
+// When enabled, nested sections are validated when a message is received, but are not
+// decoded until they are first accessed. This avoids materializing very large responses
+// when only a few top-level fields are used. SetLazyDecode should not be called while
+// Listen is active.
+func (s *Session) SetLazyDecode(enabled bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.ctr.opts.lazy = enabled
+	s.el.opts.lazy = enabled
+}
+
+// SetCanonicalEncode enables or disables canonical encoding of messages sent to the daemon.
+// When enabled, the elements of each section are sent ordered by key, rather than in the
+// order they were added, so the wire form of a request does not depend on how its Message
+// was built, e.g. from a map or by merging several sources. The Messages themselves are
+// not modified.
+func (s *Session) SetCanonicalEncode(enabled bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.ctr.encOpts.canonical = enabled
+}
+
 // CommandRequest sends a command request to the server, and returns the server's response.
 // The command is specified by cmd, and its arguments are provided by msg. An error is returned
 // if an error occurs while communicating with the daemon. To determine if a command was successful,
@@ -71,12 +122,81 @@ func (s *Session) CommandRequest(cmd string, msg *Message) (*Message, error) {
 	return s.sendRequest(cmd, msg)
 }
 
+// Call sends the command cmd, with req as its arguments, and returns the response unmarshaled
+// into a Resp. req is marshaled with MarshalMessage, unless it is a *Message, in which case it is
+// sent as is. Likewise, if Resp is *Message the response is returned as is. An error is returned
+// if req cannot be marshaled, the request fails, the command was not successful, or the response
+// cannot be unmarshaled.
+//
+//	resp, err := vici.Call[LoadConnRequest, struct{}](s, "load-conn", req)
+func Call[Req, Resp any](s *Session, cmd string, req Req) (Resp, error) {
+	var resp Resp
+
+	msg, ok := any(req).(*Message)
+	if !ok {
+		var err error
+
+		msg, err = MarshalMessage(req)
+		if err != nil {
+			return resp, err
+		}
+	}
+
+	m, err := s.CommandRequest(cmd, msg)
+	if err != nil {
+		return resp, err
+	}
+
+	if v, ok := any(m).(Resp); ok {
+		return v, nil
+	}
+
+	return UnmarshalMessageTo[Resp](m)
+}
+
 // StreamedCommandRequest sends a streamed command request to the server. StreamedCommandRequest
 // behaves like CommandRequest, but accepts an event argument, which specifies the event type
 // to stream while the command request is active. The complete stream of messages received from
 // the server is returned once the request is complete.
 func (s *Session) StreamedCommandRequest(cmd string, event string, msg *Message) (*MessageStream, error) {
-	return s.sendStreamedRequest(cmd, event, msg)
+	return s.StreamedCommandRequestContext(context.Background(), cmd, event, msg)
+}
+
+// StreamedCommandRequestContext behaves like StreamedCommandRequest, but the request is
+// aborted once ctx is done, in which case ctx.Err() is returned. Because the daemon may
+// still be streaming messages when the request is aborted, the command transport is
+// re-established before the next request.
+func (s *Session) StreamedCommandRequestContext(ctx context.Context, cmd string, event string, msg *Message) (*MessageStream, error) {
+	messages := make([]*Message, 0)
+
+	resp, err := s.sendStreamedRequest(ctx, cmd, event, msg, func(m *Message) error {
+		messages = append(messages, m)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	messages = append(messages, resp)
+
+	return &MessageStream{messages}, nil
+}
+
+// StreamedCommandRequestFunc behaves like StreamedCommandRequest, but instead of accumulating
+// the streamed messages, fn is called with each event message as it is received. This avoids
+// holding large responses, e.g. list-sas on a busy gateway, in memory. The command response is
+// returned once the request is complete.
+//
+// If fn returns an error, it is not called again and that error is returned once the
+// request is complete.
+func (s *Session) StreamedCommandRequestFunc(cmd string, event string, msg *Message, fn func(*Message) error) (*Message, error) {
+	return s.sendStreamedRequest(context.Background(), cmd, event, msg, fn)
+}
+
+// StreamedCommandRequestFuncContext behaves like StreamedCommandRequestFunc, but the request
+// is aborted once ctx is done. See StreamedCommandRequestContext.
+func (s *Session) StreamedCommandRequestFuncContext(ctx context.Context, cmd string, event string, msg *Message, fn func(*Message) error) (*Message, error) {
+	return s.sendStreamedRequest(ctx, cmd, event, msg, fn)
 }
 
 // Listen registers the session to listen for all events given. Listen does not return
@@ -90,5 +210,47 @@ func (s *Session) Listen(events []string) error {
 // blocking call. If there is no event in the event buffer, NextEvent will wait to return until
 // a new event is received. An error is returned if the event channel is closed.
 func (s *Session) NextEvent() (*Message, error) {
+	e, err := s.el.nextEvent()
+	if err != nil {
+		return nil, err
+	}
+
+	return e.Message, nil
+}
+
+// NextNamedEvent behaves like NextEvent, but returns the complete Event, including the
+// name of the event type.
+func (s *Session) NextNamedEvent() (Event, error) {
 	return s.el.nextEvent()
 }
+
+// InjectEvent delivers a fabricated event to the session's event pipeline, as if it had
+// been received from the daemon. The event is passed through any event middleware, and
+// is then returned by NextEvent or NextNamedEvent. This is intended for testing event
+// handlers without a running daemon. An error is returned if the event was dropped by
+// middleware. InjectEvent blocks if the event buffer is full, until there is room, or
+// until Listen returns, in which case an error is returned.
+func (s *Session) InjectEvent(e Event) error {
+	return s.el.inject(e)
+}
+
+// UseEventMiddleware installs middleware on the session's event path. Each event received
+// by the event listener is passed through the middleware, in the order it was installed,
+// before it is returned by NextEvent or NextNamedEvent.
+func (s *Session) UseEventMiddleware(mw ...EventMiddleware) {
+	s.el.use(mw...)
+}
+
+// EventStats returns the number of events received, and the time the last one was
+// received, for each event type received by the session's event listener. Events are
+// counted before any event middleware is applied.
+func (s *Session) EventStats() map[string]EventStats {
+	return s.el.eventStats(false)
+}
+
+// ResetEventStats behaves like EventStats, but also resets the statistics. Calling
+// ResetEventStats periodically gives the number of events received per interval, which
+// can be used to detect e.g. flapping tunnels.
+func (s *Session) ResetEventStats() map[string]EventStats {
+	return s.el.eventStats(true)
+}
@@ -0,0 +1,417 @@
+// Copyright (C) 2019 Nick Rosbrook
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package vici
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveCommand answers a single command request received on conn with resp, and sends
+// the received request on the returned channel.
+func serveCommand(t *testing.T, conn net.Conn, resp *Message) <-chan *packet {
+	reqs := make(chan *packet, 1)
+
+	go func() {
+		defer close(reqs)
+
+		tr := &transport{conn: conn}
+
+		p, err := tr.recv()
+		if err != nil {
+			t.Errorf("Unexpected error receiving request: %v", err)
+			return
+		}
+		reqs <- p
+
+		if err := tr.send(newPacket(pktCmdResponse, "", resp)); err != nil {
+			t.Errorf("Unexpected error sending response: %v", err)
+		}
+	}()
+
+	return reqs
+}
+
+// serveCommands answers a command request received on conn with each of resps in turn,
+// and sends the received requests on the returned channel.
+func serveCommands(t *testing.T, conn net.Conn, resps []*Message) <-chan *packet {
+	reqs := make(chan *packet, len(resps))
+
+	go func() {
+		defer close(reqs)
+
+		tr := &transport{conn: conn}
+
+		for _, resp := range resps {
+			p, err := tr.recv()
+			if err != nil {
+				t.Errorf("Unexpected error receiving request: %v", err)
+				return
+			}
+			reqs <- p
+
+			if err := tr.send(newPacket(pktCmdResponse, "", resp)); err != nil {
+				t.Errorf("Unexpected error sending response: %v", err)
+				return
+			}
+		}
+	}()
+
+	return reqs
+}
+
+// serveStreamedCommand answers a single streamed command request received on conn. The
+// event type is confirmed, each of events is sent as a named event, and finally resp is
+// sent. The received command request is sent on the returned channel.
+func serveStreamedCommand(t *testing.T, conn net.Conn, event string, events []*Message, resp *Message) <-chan *packet {
+	return serveStreamedCommands(t, conn, []streamedResponse{{event, events, resp}})
+}
+
+// streamedResponse is the answer to a streamed command request, or to a plain command
+// request if event is empty.
+type streamedResponse struct {
+	event  string
+	events []*Message
+	resp   *Message
+}
+
+// serveStreamedCommands answers a streamed command request received on conn with each of
+// resps in turn, as described by serveStreamedCommand.
+func serveStreamedCommands(t *testing.T, conn net.Conn, resps []streamedResponse) <-chan *packet {
+	reqs := make(chan *packet, len(resps))
+
+	go func() {
+		defer close(reqs)
+
+		tr := &transport{conn: conn}
+
+		for _, r := range resps {
+			confirm := func(ptype uint8) bool {
+				p, err := tr.recv()
+				if err != nil {
+					t.Errorf("Unexpected error receiving event registration: %v", err)
+					return false
+				}
+
+				if p.ptype != ptype || p.name != r.event {
+					t.Errorf("Unexpected event registration: %v %v", p.ptype, p.name)
+				}
+
+				if err := tr.send(newPacket(pktEventConfirm, "", nil)); err != nil {
+					t.Errorf("Unexpected error confirming event registration: %v", err)
+					return false
+				}
+
+				return true
+			}
+
+			if r.event != "" && !confirm(pktEventRegister) {
+				return
+			}
+
+			p, err := tr.recv()
+			if err != nil {
+				t.Errorf("Unexpected error receiving request: %v", err)
+				return
+			}
+			reqs <- p
+
+			for _, m := range r.events {
+				if err := tr.send(newPacket(pktEvent, r.event, m)); err != nil {
+					t.Errorf("Unexpected error sending event: %v", err)
+					return
+				}
+			}
+
+			if err := tr.send(newPacket(pktCmdResponse, "", r.resp)); err != nil {
+				t.Errorf("Unexpected error sending response: %v", err)
+				return
+			}
+
+			if r.event != "" && !confirm(pktEventUnregister) {
+				return
+			}
+		}
+	}()
+
+	return reqs
+}
+
+func TestCall(t *testing.T) {
+	client, srvr := net.Pipe()
+	defer client.Close()
+	defer srvr.Close()
+
+	s := &Session{ctr: &transport{conn: client}}
+
+	type request struct {
+		IKE string `vici:"ike"`
+	}
+
+	type response struct {
+		Success bool   `vici:"success"`
+		Matches int    `vici:"matches"`
+		Errmsg  string `vici:"errmsg"`
+	}
+
+	resp := NewMessage()
+	for k, v := range map[string]string{"success": "yes", "matches": "2"} {
+		if err := resp.Set(k, v); err != nil {
+			t.Fatalf("Unexpected error setting key: %v", err)
+		}
+	}
+
+	reqs := serveCommand(t, srvr, resp)
+
+	r, err := Call[request, response](s, "terminate", request{IKE: "gw-gw"})
+	if err != nil {
+		t.Fatalf("Unexpected error calling command: %v", err)
+	}
+
+	if !r.Success || r.Matches != 2 {
+		t.Errorf("Unexpected response: %+v", r)
+	}
+
+	p := <-reqs
+	if p.name != "terminate" {
+		t.Errorf("Expected command terminate: received %v", p.name)
+	}
+
+	if ike, _ := p.msg.GetString("ike"); ike != "gw-gw" {
+		t.Errorf("Expected request to be marshaled: received %v", p.msg)
+	}
+
+	// A failed command is returned as an error
+	failed := NewMessage()
+	for k, v := range map[string]string{"success": "no", "errmsg": "no matching SAs"} {
+		if err := failed.Set(k, v); err != nil {
+			t.Fatalf("Unexpected error setting key: %v", err)
+		}
+	}
+
+	serveCommand(t, srvr, failed)
+
+	if _, err := Call[*Message, *Message](s, "terminate", NewMessage()); err == nil {
+		t.Errorf("Expected error from failed command")
+	}
+}
+
+func TestStreamedCommandRequestContextReset(t *testing.T) {
+	first, firstSrvr := net.Pipe()
+	defer first.Close()
+	defer firstSrvr.Close()
+
+	second, secondSrvr := net.Pipe()
+	defer second.Close()
+	defer secondSrvr.Close()
+
+	s := &Session{ctr: &transport{
+		conn: first,
+		dial: func() (net.Conn, error) {
+			return second, nil
+		},
+	}}
+
+	// The first connection confirms the event registration and receives the command,
+	// but never responds.
+	received := make(chan struct{})
+	go func() {
+		tr := &transport{conn: firstSrvr}
+
+		if _, err := tr.recv(); err != nil {
+			t.Errorf("Unexpected error receiving event registration: %v", err)
+		}
+
+		if err := tr.send(newPacket(pktEventConfirm, "", nil)); err != nil {
+			t.Errorf("Unexpected error confirming event registration: %v", err)
+		}
+
+		if _, err := tr.recv(); err != nil {
+			t.Errorf("Unexpected error receiving request: %v", err)
+		}
+		close(received)
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-received
+		cancel()
+	}()
+
+	_, err := s.StreamedCommandRequestContext(ctx, "list-sas", "list-sa", nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled: received %v", err)
+	}
+
+	// The session is used again, with a new connection.
+	resp := NewMessage()
+	if err := resp.Set("daemon", "charon"); err != nil {
+		t.Fatalf("Unexpected error setting key: %v", err)
+	}
+	serveCommand(t, secondSrvr, resp)
+
+	m, err := s.CommandRequest("version", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error after reset: %v", err)
+	}
+
+	if daemon := stringField(m, "daemon"); daemon != "charon" {
+		t.Errorf("Unexpected response.\nExpected: %v\nReceived: %v", "charon", daemon)
+	}
+}
+
+func TestStreamedCommandRequestContextResetFailed(t *testing.T) {
+	client, srvr := net.Pipe()
+	defer client.Close()
+	defer srvr.Close()
+
+	next, nextSrvr := net.Pipe()
+	defer next.Close()
+	defer nextSrvr.Close()
+
+	dialErr := errors.New("daemon not running")
+
+	s := &Session{ctr: &transport{
+		conn: client,
+		dial: func() (net.Conn, error) {
+			if dialErr != nil {
+				return nil, dialErr
+			}
+
+			return next, nil
+		},
+	}}
+
+	// Never confirm the event registration.
+	go func() {
+		tr := &transport{conn: srvr}
+
+		if _, err := tr.recv(); err != nil {
+			t.Errorf("Unexpected error receiving event registration: %v", err)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := s.StreamedCommandRequestContext(ctx, "list-sas", "list-sa", nil)
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "daemon not running") {
+		t.Fatalf("Expected deadline error joined with reset error: received %v", err)
+	}
+
+	if _, err := s.CommandRequest("version", nil); err == nil || !strings.Contains(err.Error(), "daemon not running") {
+		t.Errorf("Expected error while the daemon cannot be reached: received %v", err)
+	}
+
+	// Once the daemon can be reached again, the session recovers.
+	dialErr = nil
+	serveCommand(t, nextSrvr, NewMessage())
+
+	if _, err := s.CommandRequest("version", nil); err != nil {
+		t.Errorf("Unexpected error once the daemon was reachable: %v", err)
+	}
+}
+
+func TestStreamedCommandRequestFunc(t *testing.T) {
+	client, srvr := net.Pipe()
+	defer client.Close()
+	defer srvr.Close()
+
+	s := &Session{ctr: &transport{conn: client}}
+
+	var events []*Message
+	for _, n := range []string{"1", "2", "3"} {
+		e := NewMessage()
+		if err := e.Set("n", n); err != nil {
+			t.Fatalf("Unexpected error setting key: %v", err)
+		}
+		events = append(events, e)
+	}
+
+	ok := NewMessage()
+	if err := ok.Set("success", "yes"); err != nil {
+		t.Fatalf("Unexpected error setting key: %v", err)
+	}
+
+	serveStreamedCommands(t, srvr, []streamedResponse{
+		{"list-sa", events, ok},
+		{"list-sa", events, ok},
+		{"", nil, ok},
+	})
+
+	// Events are passed to fn in order, before the command response is returned
+	var received []string
+
+	resp, err := s.StreamedCommandRequestFunc("list-sas", "list-sa", nil, func(m *Message) error {
+		received = append(received, stringField(m, "n"))
+
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error making request: %v", err)
+	}
+
+	expected := []string{"1", "2", "3"}
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf("Unexpected events.\nExpected: %v\nReceived: %v", expected, received)
+	}
+
+	if stringField(resp, "success") != "yes" {
+		t.Errorf("Unexpected command response: %v", resp)
+	}
+
+	// If fn fails, it is not called again, but the remaining events and the command
+	// response are still read.
+	fnErr := errors.New("stop")
+	calls := 0
+
+	_, err = s.StreamedCommandRequestFunc("list-sas", "list-sa", nil, func(m *Message) error {
+		calls++
+
+		if stringField(m, "n") == "2" {
+			return fnErr
+		}
+
+		return nil
+	})
+	if err != fnErr {
+		t.Errorf("Unexpected error.\nExpected: %v\nReceived: %v", fnErr, err)
+	}
+
+	if calls != 2 {
+		t.Errorf("Unexpected number of callbacks.\nExpected: %v\nReceived: %v", 2, calls)
+	}
+
+	// The transport is left in sync, so the next command receives its own response.
+	resp, err = s.CommandRequest("version", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error making request after callback failed: %v", err)
+	}
+
+	if stringField(resp, "success") != "yes" || stringField(resp, "n") != "" {
+		t.Errorf("Unexpected command response after callback failed: %v", resp)
+	}
+}
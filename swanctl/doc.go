@@ -0,0 +1,47 @@
+// Copyright (C) 2019 Nick Rosbrook
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package swanctl provides Go types for the complete swanctl configuration, i.e. the
+// connections, pools, authorities and secrets of swanctl.conf. The types carry vici
+// struct tags, so that they can be marshaled with vici.MarshalMessage and sent with
+// the load-conn, load-pool and load-authority commands, e.g.:
+//
+//	c, err := vici.MarshalMessage(conn)
+//	if err != nil {
+//		return err
+//	}
+//
+//	msg := vici.NewMessage()
+//	if err := msg.Set("gw", c); err != nil {
+//		return err
+//	}
+//
+//	_, err = session.CommandRequest("load-conn", msg)
+//
+// Fields that are not set are omitted, so that the daemon applies its defaults. For
+// that reason, bool, number and duration options are pointers.
+//
+// The types are generated from spec.json, which follows the strongSwan documentation
+// of swanctl.conf. The same spec generates vici.ConnectionsSchema, so that
+// connections built from these types validate against it. To add or change an
+// option, edit spec.json and run go generate.
+package swanctl
+
+//go:generate go run gen.go
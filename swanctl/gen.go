@@ -0,0 +1,276 @@
+// Copyright (C) 2019 Nick Rosbrook
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build ignore
+
+// gen generates types_gen.go, and the connections schema of the vici package, from
+// spec.json. Run it with go generate.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/doc/comment"
+	"go/format"
+	"log"
+	"os"
+	"strings"
+)
+
+type spec struct {
+	Types []specType `json:"types"`
+}
+
+type specType struct {
+	Name   string      `json:"name"`
+	Doc    string      `json:"doc"`
+	Fields []specField `json:"fields"`
+}
+
+type specField struct {
+	Key    string   `json:"key"`
+	Name   string   `json:"name"`
+	Type   string   `json:"type"`
+	Values []string `json:"values"`
+	Doc    string   `json:"doc"`
+}
+
+// goType returns the Go type and vici tag options for a spec type.
+func goType(typ string) (string, string, error) {
+	switch typ {
+	case "string":
+		return "string", "omitempty", nil
+	case "list":
+		return "[]string", "omitempty", nil
+	case "bool":
+		return "*bool", "omitempty", nil
+	case "number", "size":
+		return "*uint64", "omitempty", nil
+	case "duration":
+		return "*time.Duration", "omitempty", nil
+	}
+
+	kind, name, ok := strings.Cut(typ, ":")
+	if !ok {
+		return "", "", fmt.Errorf("unknown type %q", typ)
+	}
+
+	switch kind {
+	case "struct":
+		return name, "omitempty", nil
+	case "section":
+		return "map[string]" + name, "omitempty", nil
+	case "prefix":
+		return "map[string]" + name, "prefix", nil
+	}
+
+	return "", "", fmt.Errorf("unknown type %q", typ)
+}
+
+// writeDoc writes text as a doc comment, wrapped and indented by indent.
+func writeDoc(buf *bytes.Buffer, text, indent string) {
+	var p comment.Parser
+	pr := comment.Printer{TextPrefix: indent + "// ", TextWidth: 80 - len(indent)}
+
+	buf.Write(pr.Text(p.Parse(text)))
+}
+
+// schemaNode is an element of a vici.Schema, whose keys and prefixes are kept in the
+// order of the spec, so that the generated JSON follows it.
+type schemaNode struct {
+	typ      string
+	values   []string
+	each     *schemaNode
+	keys     []namedNode
+	prefixes []namedNode
+}
+
+type namedNode struct {
+	name string
+	node *schemaNode
+}
+
+// schemaType returns the schema type of a spec field that is not a section.
+func schemaType(f specField) string {
+	if len(f.Values) > 0 {
+		return "enum"
+	}
+
+	// Sizes also accept a unit suffix, e.g. 1G, so they are not validated as numbers
+	if f.Type == "size" {
+		return "string"
+	}
+
+	return f.Type
+}
+
+// newSchema returns the schema of the section described by the spec type name.
+func newSchema(types map[string]specType, name string) *schemaNode {
+	t, ok := types[name]
+	if !ok {
+		log.Fatalf("unknown type %q", name)
+	}
+
+	n := &schemaNode{typ: "section"}
+
+	for _, f := range t.Fields {
+		kind, elem, _ := strings.Cut(f.Type, ":")
+
+		switch kind {
+		case "struct":
+			n.keys = append(n.keys, namedNode{f.Key, newSchema(types, elem)})
+		case "section":
+			n.keys = append(n.keys, namedNode{f.Key, &schemaNode{typ: "section", each: newSchema(types, elem)}})
+		case "prefix":
+			n.prefixes = append(n.prefixes, namedNode{f.Key, newSchema(types, elem)})
+		default:
+			n.keys = append(n.keys, namedNode{f.Key, &schemaNode{typ: schemaType(f), values: f.Values}})
+		}
+	}
+
+	return n
+}
+
+// write writes n as JSON, with sections on multiple lines indented by indent, and other
+// elements on a single line.
+func (n *schemaNode) write(buf *bytes.Buffer, indent string) {
+	if n.typ != "section" {
+		fmt.Fprintf(buf, "{\"type\": %q", n.typ)
+
+		if len(n.values) > 0 {
+			values, err := json.Marshal(n.values)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Fprintf(buf, ", \"values\": %s", bytes.ReplaceAll(values, []byte(`","`), []byte(`", "`)))
+		}
+		buf.WriteString("}")
+
+		return
+	}
+
+	inner := indent + "\t"
+	fmt.Fprintf(buf, "{\n%s\"type\": \"section\"", inner)
+
+	if n.each != nil {
+		fmt.Fprintf(buf, ",\n%s\"each\": ", inner)
+		n.each.write(buf, inner)
+	}
+
+	for _, group := range []struct {
+		name  string
+		nodes []namedNode
+	}{
+		{"keys", n.keys},
+		{"prefixes", n.prefixes},
+	} {
+		if len(group.nodes) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(buf, ",\n%s%q: {", inner, group.name)
+		for i, e := range group.nodes {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			fmt.Fprintf(buf, "\n%s\t%q: ", inner, e.name)
+			e.node.write(buf, inner+"\t")
+		}
+		fmt.Fprintf(buf, "\n%s}", inner)
+	}
+
+	fmt.Fprintf(buf, "\n%s}", indent)
+}
+
+// writeSchema writes the schema of the connections section of the spec, as used by
+// vici.ConnectionsSchema, to path.
+func writeSchema(s spec, path string) {
+	types := make(map[string]specType)
+	for _, t := range s.Types {
+		types[t.Name] = t
+	}
+
+	root := &schemaNode{typ: "section", each: newSchema(types, "Connection")}
+
+	var buf bytes.Buffer
+	root.write(&buf, "")
+	buf.WriteString("\n")
+
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func main() {
+	data, err := os.ReadFile("spec.json")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var s spec
+	if err := json.Unmarshal(data, &s); err != nil {
+		log.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+
+	license, err := os.ReadFile("gen.go")
+	if err != nil {
+		log.Fatal(err)
+	}
+	header, _, _ := strings.Cut(string(license), "//go:build")
+
+	buf.WriteString(header)
+	buf.WriteString("// Code generated by gen.go from spec.json; DO NOT EDIT.\n\n")
+	buf.WriteString("package swanctl\n\nimport \"time\"\n")
+
+	for _, t := range s.Types {
+		buf.WriteString("\n")
+		writeDoc(&buf, t.Doc, "")
+		fmt.Fprintf(&buf, "type %s struct {\n", t.Name)
+
+		for i, f := range t.Fields {
+			typ, opts, err := goType(f.Type)
+			if err != nil {
+				log.Fatalf("%s.%s: %v", t.Name, f.Name, err)
+			}
+
+			if i > 0 {
+				buf.WriteString("\n")
+			}
+			writeDoc(&buf, f.Doc, "\t")
+			fmt.Fprintf(&buf, "\t%s %s `vici:\"%s,%s\"`\n", f.Name, typ, f.Key, opts)
+		}
+
+		buf.WriteString("}\n")
+	}
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := os.WriteFile("types_gen.go", src, 0644); err != nil {
+		log.Fatal(err)
+	}
+
+	writeSchema(s, "../schema/connections.json")
+}
@@ -0,0 +1,540 @@
+// Copyright (C) 2019 Nick Rosbrook
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Code generated by gen.go from spec.json; DO NOT EDIT.
+
+package swanctl
+
+import "time"
+
+// Config is a complete swanctl configuration, as in swanctl.conf.
+type Config struct {
+	// Connections are the IKE connections, keyed by name.
+	Connections map[string]Connection `vici:"connections,omitempty"`
+
+	// Pools are the virtual IP address and attribute pools, keyed by name.
+	Pools map[string]Pool `vici:"pools,omitempty"`
+
+	// Authorities are the certification authorities, keyed by name.
+	Authorities map[string]Authority `vici:"authorities,omitempty"`
+
+	// Secrets are the shared secrets and private key passphrases.
+	Secrets Secrets `vici:"secrets,omitempty"`
+}
+
+// Connection is an IKE connection definition, as in the connections section of
+// swanctl.conf, and as loaded with load-conn.
+type Connection struct {
+	// Version is the IKE major version to use: 0 for any, 1 for IKEv1 or 2 for IKEv2.
+	Version *uint64 `vici:"version,omitempty"`
+
+	// LocalAddrs are the local addresses to use for IKE communication, as IP
+	// addresses, DNS names, CIDR subnets or IP address ranges.
+	LocalAddrs []string `vici:"local_addrs,omitempty"`
+
+	// RemoteAddrs are the remote addresses to use for IKE communication, in the same
+	// format as LocalAddrs.
+	RemoteAddrs []string `vici:"remote_addrs,omitempty"`
+
+	// LocalPort is the local UDP port for IKE communication.
+	LocalPort *uint64 `vici:"local_port,omitempty"`
+
+	// RemotePort is the remote UDP port for IKE communication.
+	RemotePort *uint64 `vici:"remote_port,omitempty"`
+
+	// Proposals are the IKE proposals to offer or accept, e.g. aes128-sha256-x25519,
+	// or default.
+	Proposals []string `vici:"proposals,omitempty"`
+
+	// VIPs are the virtual IPs to request in configuration payloads, e.g. 0.0.0.0 or
+	// ::.
+	VIPs []string `vici:"vips,omitempty"`
+
+	// Aggressive enables IKEv1 Aggressive Mode instead of Main Mode.
+	Aggressive *bool `vici:"aggressive,omitempty"`
+
+	// Pull sets whether IKEv1 Mode Config uses pull mode, rather than push mode.
+	Pull *bool `vici:"pull,omitempty"`
+
+	// DSCP is the Differentiated Services Field Codepoint to set on outgoing IKE
+	// packets, as a six digit binary string.
+	DSCP string `vici:"dscp,omitempty"`
+
+	// Encap enforces UDP encapsulation of ESP, by faking NAT detection payloads.
+	Encap *bool `vici:"encap,omitempty"`
+
+	// MOBIKE enables the IKEv2 MOBIKE protocol.
+	MOBIKE *bool `vici:"mobike,omitempty"`
+
+	// DPDDelay is the interval at which liveness of the peer is checked, if no other
+	// traffic is received.
+	DPDDelay *time.Duration `vici:"dpd_delay,omitempty"`
+
+	// DPDTimeout is the IKEv1 timeout after which the peer is considered dead.
+	DPDTimeout *time.Duration `vici:"dpd_timeout,omitempty"`
+
+	// Fragmentation sets the use of IKE fragmentation: yes, accept, force or no.
+	Fragmentation string `vici:"fragmentation,omitempty"`
+
+	// Childless sets the use of childless IKE_SA initiation: allow, prefer, force or
+	// never.
+	Childless string `vici:"childless,omitempty"`
+
+	// SendCertReq sets whether certificate requests are sent.
+	SendCertReq *bool `vici:"send_certreq,omitempty"`
+
+	// SendCert sets when certificates are sent: always, never or ifasked.
+	SendCert string `vici:"send_cert,omitempty"`
+
+	// PPKID is the identity of the Postquantum Preshared Key to use.
+	PPKID string `vici:"ppk_id,omitempty"`
+
+	// PPKRequired sets whether a Postquantum Preshared Key is required.
+	PPKRequired *bool `vici:"ppk_required,omitempty"`
+
+	// KeyingTries is the number of retransmission sequences before giving up, or 0 to
+	// try forever.
+	KeyingTries *uint64 `vici:"keyingtries,omitempty"`
+
+	// Unique is the uniqueness policy for IKE SAs of the connection: no, never,
+	// keep or replace.
+	Unique string `vici:"unique,omitempty"`
+
+	// ReauthTime is the time to schedule IKE reauthentication, or 0 to disable it.
+	ReauthTime *time.Duration `vici:"reauth_time,omitempty"`
+
+	// RekeyTime is the time to schedule IKE rekeying, or 0 to disable it.
+	RekeyTime *time.Duration `vici:"rekey_time,omitempty"`
+
+	// OverTime is the hard IKE SA lifetime, beyond the rekeying or reauthentication
+	// time.
+	OverTime *time.Duration `vici:"over_time,omitempty"`
+
+	// RandTime is the range of random time subtracted from the rekeying or
+	// reauthentication time.
+	RandTime *time.Duration `vici:"rand_time,omitempty"`
+
+	// Pools are the names of the pools virtual IPs and attributes are assigned from.
+	Pools []string `vici:"pools,omitempty"`
+
+	// IfIDIn is the default inbound XFRM interface ID for the CHILD SAs of the
+	// connection.
+	IfIDIn string `vici:"if_id_in,omitempty"`
+
+	// IfIDOut is the default outbound XFRM interface ID for the CHILD SAs of the
+	// connection.
+	IfIDOut string `vici:"if_id_out,omitempty"`
+
+	// Mediation sets whether the connection is a mediation connection.
+	Mediation *bool `vici:"mediation,omitempty"`
+
+	// MediatedBy is the name of the mediation connection to mediate this connection.
+	MediatedBy string `vici:"mediated_by,omitempty"`
+
+	// MediationPeer is the identity of the peer to request from the mediation server.
+	MediationPeer string `vici:"mediation_peer,omitempty"`
+
+	// LocalAuth are the local authentication rounds, keyed by section name suffix,
+	// e.g. -1 for local-1.
+	LocalAuth map[string]LocalAuth `vici:"local,prefix"`
+
+	// RemoteAuth are the remote authentication rounds, keyed by section name suffix,
+	// e.g. -1 for remote-1.
+	RemoteAuth map[string]RemoteAuth `vici:"remote,prefix"`
+
+	// Children are the CHILD SA configurations of the connection, keyed by name.
+	Children map[string]Child `vici:"children,omitempty"`
+}
+
+// LocalAuth is a local authentication round of a Connection.
+type LocalAuth struct {
+	// Round is the order of the round, if it differs from the order of definition.
+	Round *uint64 `vici:"round,omitempty"`
+
+	// Certs are the certificates to use for authentication, as files in the x509
+	// directory or absolute paths.
+	Certs []string `vici:"certs,omitempty"`
+
+	// Cert are certificates located on tokens, keyed by section name suffix.
+	Cert map[string]CertSource `vici:"cert,prefix"`
+
+	// PubKeys are the raw public keys to use for authentication.
+	PubKeys []string `vici:"pubkeys,omitempty"`
+
+	// Auth is the authentication to perform, e.g. pubkey, psk, xauth or eap-md5.
+	Auth string `vici:"auth,omitempty"`
+
+	// ID is the IKE identity to use for authentication.
+	ID string `vici:"id,omitempty"`
+
+	// EAPID is the client EAP identity to use in EAP-Identity exchanges.
+	EAPID string `vici:"eap_id,omitempty"`
+
+	// AAAID is the server side EAP-Identity to expect in the EAP method.
+	AAAID string `vici:"aaa_id,omitempty"`
+
+	// XAuthID is the client XAuth username used in the XAuth exchange.
+	XAuthID string `vici:"xauth_id,omitempty"`
+}
+
+// RemoteAuth is a remote authentication round of a Connection.
+type RemoteAuth struct {
+	// Round is the order of the round, if it differs from the order of definition.
+	Round *uint64 `vici:"round,omitempty"`
+
+	// ID is the IKE identity to expect for authentication, or %any.
+	ID string `vici:"id,omitempty"`
+
+	// EAPID is the identity to use as peer identity during EAP authentication.
+	EAPID string `vici:"eap_id,omitempty"`
+
+	// Groups are the authorization groups the peer must be a member of.
+	Groups []string `vici:"groups,omitempty"`
+
+	// CertPolicy are the certificate policy OIDs the peer's certificate must have.
+	CertPolicy []string `vici:"cert_policy,omitempty"`
+
+	// Certs are the certificates to accept for authentication, as files in the x509
+	// directory or absolute paths.
+	Certs []string `vici:"certs,omitempty"`
+
+	// Cert are certificates located on tokens, keyed by section name suffix.
+	Cert map[string]CertSource `vici:"cert,prefix"`
+
+	// CACerts are the CA certificates to accept for authentication, as files in the
+	// x509ca directory or absolute paths.
+	CACerts []string `vici:"cacerts,omitempty"`
+
+	// CACert are CA certificates located on tokens, keyed by section name suffix.
+	CACert map[string]CertSource `vici:"cacert,prefix"`
+
+	// CAID is the identity of a CA certificate to accept for authentication.
+	CAID string `vici:"ca_id,omitempty"`
+
+	// PubKeys are the raw public keys to accept for authentication.
+	PubKeys []string `vici:"pubkeys,omitempty"`
+
+	// Revocation is the certificate revocation policy: strict, ifuri or relaxed.
+	Revocation string `vici:"revocation,omitempty"`
+
+	// Auth is the authentication to expect from the peer, e.g. pubkey, psk or
+	// eap-md5.
+	Auth string `vici:"auth,omitempty"`
+}
+
+// CertSource is a certificate to load from a file, or from a PKCS#11 token.
+type CertSource struct {
+	// File is the absolute path to the certificate.
+	File string `vici:"file,omitempty"`
+
+	// Handle is the hex encoded CKA_ID of the certificate on a token.
+	Handle string `vici:"handle,omitempty"`
+
+	// Slot is the slot of the token the certificate is stored on.
+	Slot *uint64 `vici:"slot,omitempty"`
+
+	// Module is the name of the PKCS#11 module of the token.
+	Module string `vici:"module,omitempty"`
+}
+
+// Child is a CHILD SA configuration of a Connection.
+type Child struct {
+	// AHProposals are the AH proposals to offer or accept for the CHILD SA.
+	AHProposals []string `vici:"ah_proposals,omitempty"`
+
+	// ESPProposals are the ESP proposals to offer or accept for the CHILD SA.
+	ESPProposals []string `vici:"esp_proposals,omitempty"`
+
+	// SHA256_96 uses 96-bit truncation for HMAC-SHA-256, instead of 128-bit.
+	SHA256_96 *bool `vici:"sha256_96,omitempty"`
+
+	// LocalTS are the local traffic selectors, e.g. 10.0.1.0/24 or dynamic.
+	LocalTS []string `vici:"local_ts,omitempty"`
+
+	// RemoteTS are the remote traffic selectors, in the same format as LocalTS.
+	RemoteTS []string `vici:"remote_ts,omitempty"`
+
+	// RekeyTime is the time to schedule CHILD SA rekeying, or 0 to disable it.
+	RekeyTime *time.Duration `vici:"rekey_time,omitempty"`
+
+	// LifeTime is the maximum lifetime of the CHILD SA before it is closed.
+	LifeTime *time.Duration `vici:"life_time,omitempty"`
+
+	// RandTime is the range of random time subtracted from RekeyTime.
+	RandTime *time.Duration `vici:"rand_time,omitempty"`
+
+	// RekeyBytes is the number of bytes processed before the CHILD SA is rekeyed,
+	// or 0 to disable it.
+	RekeyBytes *uint64 `vici:"rekey_bytes,omitempty"`
+
+	// LifeBytes is the maximum number of bytes processed before the CHILD SA is
+	// closed.
+	LifeBytes *uint64 `vici:"life_bytes,omitempty"`
+
+	// RandBytes is the range of random bytes subtracted from RekeyBytes.
+	RandBytes *uint64 `vici:"rand_bytes,omitempty"`
+
+	// RekeyPackets is the number of packets processed before the CHILD SA is rekeyed,
+	// or 0 to disable it.
+	RekeyPackets *uint64 `vici:"rekey_packets,omitempty"`
+
+	// LifePackets is the maximum number of packets processed before the CHILD SA is
+	// closed.
+	LifePackets *uint64 `vici:"life_packets,omitempty"`
+
+	// RandPackets is the range of random packets subtracted from RekeyPackets.
+	RandPackets *uint64 `vici:"rand_packets,omitempty"`
+
+	// Updown is the updown script to invoke on CHILD SA up and down events.
+	Updown string `vici:"updown,omitempty"`
+
+	// HostAccess allows access to the local host of the updown script's policies.
+	HostAccess *bool `vici:"hostaccess,omitempty"`
+
+	// Mode is the IPsec mode: tunnel, transport, transport_proxy, beet, pass or drop.
+	Mode string `vici:"mode,omitempty"`
+
+	// Policies sets whether IPsec policies are installed.
+	Policies *bool `vici:"policies,omitempty"`
+
+	// PoliciesFwdOut installs outbound FWD IPsec policies, e.g. to forward traffic
+	// between tunnels.
+	PoliciesFwdOut *bool `vici:"policies_fwd_out,omitempty"`
+
+	// DPDAction is the action to perform on DPD timeout: clear, trap or restart.
+	DPDAction string `vici:"dpd_action,omitempty"`
+
+	// IPComp enables IPComp compression before encryption.
+	IPComp *bool `vici:"ipcomp,omitempty"`
+
+	// Inactivity is the timeout before the CHILD SA is closed if it has not processed
+	// any traffic.
+	Inactivity *time.Duration `vici:"inactivity,omitempty"`
+
+	// ReqID is a fixed reqid to use for the CHILD SA, or 0 to assign one
+	// automatically.
+	ReqID *uint64 `vici:"reqid,omitempty"`
+
+	// Priority is an optional fixed priority for the IPsec policies.
+	Priority *uint64 `vici:"priority,omitempty"`
+
+	// Interface is an optional interface name to restrict the IPsec policies to.
+	Interface string `vici:"interface,omitempty"`
+
+	// MarkIn is the netfilter mark and mask for the inbound IPsec SA and policy, e.g.
+	// 42/0xffffffff.
+	MarkIn string `vici:"mark_in,omitempty"`
+
+	// MarkInSA applies MarkIn to the inbound IPsec SA as well, not only the policy.
+	MarkInSA *bool `vici:"mark_in_sa,omitempty"`
+
+	// MarkOut is the netfilter mark and mask for the outbound IPsec SA and policy.
+	MarkOut string `vici:"mark_out,omitempty"`
+
+	// SetMarkIn is the netfilter mark applied to packets after the inbound IPsec SA
+	// processed them.
+	SetMarkIn string `vici:"set_mark_in,omitempty"`
+
+	// SetMarkOut is the netfilter mark applied to packets after the outbound IPsec SA
+	// processed them.
+	SetMarkOut string `vici:"set_mark_out,omitempty"`
+
+	// IfIDIn is the XFRM interface ID set on the inbound policy and SA.
+	IfIDIn string `vici:"if_id_in,omitempty"`
+
+	// IfIDOut is the XFRM interface ID set on the outbound policy and SA.
+	IfIDOut string `vici:"if_id_out,omitempty"`
+
+	// Label is the optional security label, e.g. an SELinux context, for the IPsec
+	// policies and SAs.
+	Label string `vici:"label,omitempty"`
+
+	// LabelMode is the mode in which Label is used: system, simple or selinux.
+	LabelMode string `vici:"label_mode,omitempty"`
+
+	// TFCPadding is the Traffic Flow Confidentiality padding to add to ESP packets,
+	// in bytes, or mtu.
+	TFCPadding string `vici:"tfc_padding,omitempty"`
+
+	// ReplayWindow is the size of the IPsec replay window, in packets, or 0 to
+	// disable replay protection.
+	ReplayWindow *uint64 `vici:"replay_window,omitempty"`
+
+	// HWOffload enables hardware offload of the IPsec SA: yes, no, auto, crypto or
+	// packet.
+	HWOffload string `vici:"hw_offload,omitempty"`
+
+	// CopyDF sets whether the DF bit is copied from the inner to the outer IP header
+	// in tunnel mode.
+	CopyDF *bool `vici:"copy_df,omitempty"`
+
+	// CopyECN sets whether the ECN bits are copied between the inner and outer IP
+	// headers in tunnel mode.
+	CopyECN *bool `vici:"copy_ecn,omitempty"`
+
+	// CopyDSCP sets how DSCP values are copied between inner and outer IP headers:
+	// out, in, yes or no.
+	CopyDSCP string `vici:"copy_dscp,omitempty"`
+
+	// StartAction is the action to perform after loading the configuration: none,
+	// trap, start or trap|start.
+	StartAction string `vici:"start_action,omitempty"`
+
+	// CloseAction is the action to perform after the peer closes the CHILD SA: none,
+	// trap, start or trap|start.
+	CloseAction string `vici:"close_action,omitempty"`
+
+	// PerCPUSAs enables per-CPU CHILD SAs: yes, no or encap.
+	PerCPUSAs string `vici:"per_cpu_sas,omitempty"`
+}
+
+// Pool is a virtual IP address and attribute pool, as in the pools section of
+// swanctl.conf, and as loaded with load-pool.
+type Pool struct {
+	// Addrs is the subnet or IP address range of the virtual IPs to assign, e.g.
+	// 10.3.0.0/16.
+	Addrs string `vici:"addrs,omitempty"`
+
+	// DNS are the DNS servers to assign.
+	DNS []string `vici:"dns,omitempty"`
+
+	// NBNS are the WINS servers to assign.
+	NBNS []string `vici:"nbns,omitempty"`
+
+	// DHCP are the DHCP servers to assign.
+	DHCP []string `vici:"dhcp,omitempty"`
+
+	// Netmask are the IPv4 netmasks to assign.
+	Netmask []string `vici:"netmask,omitempty"`
+
+	// Server are the internal servers to assign.
+	Server []string `vici:"server,omitempty"`
+
+	// Subnet are the protected subnets to assign.
+	Subnet []string `vici:"subnet,omitempty"`
+
+	// SplitInclude are the Unity split include subnets to assign.
+	SplitInclude []string `vici:"split_include,omitempty"`
+
+	// SplitExclude are the Unity split exclude subnets to assign.
+	SplitExclude []string `vici:"split_exclude,omitempty"`
+}
+
+// Authority is a certification authority, as in the authorities section of
+// swanctl.conf, and as loaded with load-authority.
+type Authority struct {
+	// CACert is the CA certificate of the authority, as a file in the x509ca
+	// directory or an absolute path.
+	CACert string `vici:"cacert,omitempty"`
+
+	// File is the absolute path to the CA certificate, as an alternative to CACert.
+	File string `vici:"file,omitempty"`
+
+	// Handle is the hex encoded CKA_ID of the CA certificate on a token.
+	Handle string `vici:"handle,omitempty"`
+
+	// Slot is the slot of the token the CA certificate is stored on.
+	Slot *uint64 `vici:"slot,omitempty"`
+
+	// Module is the name of the PKCS#11 module of the token.
+	Module string `vici:"module,omitempty"`
+
+	// CRLURIs are the CRL distribution points of the authority.
+	CRLURIs []string `vici:"crl_uris,omitempty"`
+
+	// OCSPURIs are the OCSP URIs of the authority.
+	OCSPURIs []string `vici:"ocsp_uris,omitempty"`
+
+	// CertURIBase is the base URI for Hash and URL encoded certificates issued by the
+	// authority.
+	CertURIBase string `vici:"cert_uri_base,omitempty"`
+}
+
+// Secrets are the shared secrets and private key passphrases of the secrets
+// section of swanctl.conf. Each kind of secret is keyed by section name suffix,
+// e.g. -moon for ike-moon.
+type Secrets struct {
+	// EAP are the EAP secrets.
+	EAP map[string]SharedSecret `vici:"eap,prefix"`
+
+	// XAuth are the XAuth secrets.
+	XAuth map[string]SharedSecret `vici:"xauth,prefix"`
+
+	// NTLM are the NTLM secrets.
+	NTLM map[string]SharedSecret `vici:"ntlm,prefix"`
+
+	// IKE are the IKE preshared secrets.
+	IKE map[string]SharedSecret `vici:"ike,prefix"`
+
+	// PPK are the Postquantum Preshared Keys.
+	PPK map[string]SharedSecret `vici:"ppk,prefix"`
+
+	// Private are the passphrases of private keys in the private directory.
+	Private map[string]KeySecret `vici:"private,prefix"`
+
+	// RSA are the passphrases of private keys in the rsa directory.
+	RSA map[string]KeySecret `vici:"rsa,prefix"`
+
+	// ECDSA are the passphrases of private keys in the ecdsa directory.
+	ECDSA map[string]KeySecret `vici:"ecdsa,prefix"`
+
+	// PKCS8 are the passphrases of private keys in the pkcs8 directory.
+	PKCS8 map[string]KeySecret `vici:"pkcs8,prefix"`
+
+	// PKCS12 are the passphrases of PKCS#12 containers in the pkcs12 directory.
+	PKCS12 map[string]KeySecret `vici:"pkcs12,prefix"`
+
+	// Token are the private keys located on tokens.
+	Token map[string]TokenSecret `vici:"token,prefix"`
+}
+
+// SharedSecret is a shared secret, and the identities it belongs to.
+type SharedSecret struct {
+	// Secret is the value of the secret.
+	Secret string `vici:"secret,omitempty"`
+
+	// ID are the identities the secret belongs to, keyed by key suffix, e.g. -moon
+	// for id-moon.
+	ID map[string]string `vici:"id,prefix"`
+}
+
+// KeySecret is the passphrase of a private key file.
+type KeySecret struct {
+	// File is the private key file, relative to its directory, or an absolute path.
+	File string `vici:"file,omitempty"`
+
+	// Secret is the passphrase of the private key.
+	Secret string `vici:"secret,omitempty"`
+}
+
+// TokenSecret is a private key located on a PKCS#11 token.
+type TokenSecret struct {
+	// Handle is the hex encoded CKA_ID of the private key on the token.
+	Handle string `vici:"handle,omitempty"`
+
+	// Slot is the slot of the token the private key is stored on.
+	Slot *uint64 `vici:"slot,omitempty"`
+
+	// Module is the name of the PKCS#11 module of the token.
+	Module string `vici:"module,omitempty"`
+
+	// PIN is the PIN to access the private key.
+	PIN string `vici:"pin,omitempty"`
+}
@@ -0,0 +1,104 @@
+// Copyright (C) 2019 Nick Rosbrook
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package swanctl
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/strongswan/govici"
+)
+
+func TestConnectionMarshal(t *testing.T) {
+	version := uint64(2)
+	rekey := 4 * time.Hour
+
+	conn := Connection{
+		Version:     &version,
+		RemoteAddrs: []string{"192.0.2.2"},
+		RekeyTime:   &rekey,
+		LocalAuth: map[string]LocalAuth{
+			"-1": {Auth: "pubkey", Certs: []string{"moon.pem"}},
+			"-2": {Auth: "eap"},
+		},
+		RemoteAuth: map[string]RemoteAuth{
+			"": {Auth: "pubkey", Revocation: "strict"},
+		},
+		Children: map[string]Child{
+			"net": {LocalTS: []string{"10.1.0.0/16"}, Mode: "tunnel", StartAction: "trap"},
+		},
+	}
+
+	c, err := vici.MarshalMessage(conn)
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling connection: %v", err)
+	}
+
+	expected := []string{"version", "remote_addrs", "rekey_time", "local-1", "local-2", "remote", "children"}
+	if !reflect.DeepEqual(c.Keys(), expected) {
+		t.Errorf("Unexpected keys.\nExpected: %v\nReceived: %v", expected, c.Keys())
+	}
+
+	if v := c.GetPath("children.net.mode"); v != "tunnel" {
+		t.Errorf("Unexpected CHILD SA mode.\nExpected: %v\nReceived: %v", "tunnel", v)
+	}
+
+	conns := vici.NewMessage()
+	if err := conns.Set("gw", c); err != nil {
+		t.Fatalf("Unexpected error setting connection: %v", err)
+	}
+
+	if err := vici.Validate(conns, vici.ConnectionsSchema); err != nil {
+		t.Errorf("Unexpected error validating connection: %v", err)
+	}
+
+	var u Connection
+	if err := vici.UnmarshalMessage(c, &u); err != nil {
+		t.Fatalf("Unexpected error unmarshaling connection: %v", err)
+	}
+
+	if !reflect.DeepEqual(u, conn) {
+		t.Errorf("Unexpected unmarshaled connection.\nExpected: %+v\nReceived: %+v", conn, u)
+	}
+}
+
+func TestConnectionOmitsUnset(t *testing.T) {
+	c, err := vici.MarshalMessage(Connection{})
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling connection: %v", err)
+	}
+
+	if len(c.Keys()) != 0 {
+		t.Errorf("Expected unset options to be omitted: received %v", c.Keys())
+	}
+
+	disabled := false
+
+	c, err = vici.MarshalMessage(Connection{MOBIKE: &disabled})
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling connection: %v", err)
+	}
+
+	if v, _ := c.GetString("mobike"); v != "no" {
+		t.Errorf("Unexpected value of explicitly disabled option.\nExpected: %v\nReceived: %v", "no", v)
+	}
+}
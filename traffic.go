@@ -0,0 +1,204 @@
+// Copyright (C) 2019 Nick Rosbrook
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package vici
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+var (
+	// A periodic operation was given an interval that is not positive
+	errInvalidInterval = errors.New("vici: invalid interval")
+)
+
+// ChildTraffic is the traffic of a CHILD SA, as reported by list-sas.
+type ChildTraffic struct {
+	// Name and unique ID of the parent IKE SA
+	IKEName     string
+	IKEUniqueID string
+
+	// Name and unique ID of the CHILD SA
+	Name     string
+	UniqueID string
+
+	BytesIn    uint64
+	BytesOut   uint64
+	PacketsIn  uint64
+	PacketsOut uint64
+
+	// Rates per second since the previous sample of the CHILD SA. They are zero
+	// if there is no previous sample, e.g. because the CHILD SA was rekeyed.
+	BytesInRate    float64
+	BytesOutRate   float64
+	PacketsInRate  float64
+	PacketsOutRate float64
+}
+
+// TrafficSample is the traffic of all CHILD SAs at a point in time.
+type TrafficSample struct {
+	Time     time.Time
+	Children []ChildTraffic
+}
+
+// TrafficPoller samples the traffic of CHILD SAs using list-sas, and computes their
+// rates from successive samples.
+type TrafficPoller struct {
+	s *Session
+
+	prev     map[string]ChildTraffic
+	prevTime time.Time
+}
+
+// NewTrafficPoller returns a new TrafficPoller for the SAs of s.
+func NewTrafficPoller(s *Session) *TrafficPoller {
+	return &TrafficPoller{s: s}
+}
+
+// Poll takes a sample of the traffic of all CHILD SAs. Rates are computed relative to
+// the previous sample taken by Poll. The list-sas request is aborted once ctx is done.
+func (p *TrafficPoller) Poll(ctx context.Context) (TrafficSample, error) {
+	var children []ChildTraffic
+
+	resp, err := p.s.StreamedCommandRequestFuncContext(ctx, "list-sas", "list-sa", nil, func(m *Message) error {
+		children = append(children, parseChildTraffic(m)...)
+
+		return nil
+	})
+	if err != nil {
+		return TrafficSample{}, err
+	}
+
+	// A failed list-sas may have listed only some SAs, so the sample is discarded
+	// rather than recorded with misleading rates.
+	if err := resp.Err(); err != nil {
+		return TrafficSample{}, err
+	}
+
+	sample := TrafficSample{Time: time.Now(), Children: children}
+	p.rates(sample)
+
+	return sample, nil
+}
+
+// Run calls fn with a sample taken every interval, until ctx is done, and then returns
+// ctx.Err(). If a sample cannot be taken, fn is called with the error instead, unless it
+// was interrupted by ctx. An error is returned if interval is not positive.
+func (p *TrafficPoller) Run(ctx context.Context, interval time.Duration, fn func(TrafficSample, error)) error {
+	if interval <= 0 {
+		return fmt.Errorf("%v: %v", errInvalidInterval, interval)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		sample, err := p.Poll(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		fn(sample, err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// rates sets the rates of the CHILD SAs in sample, and makes sample the previous sample.
+func (p *TrafficPoller) rates(sample TrafficSample) {
+	elapsed := sample.Time.Sub(p.prevTime).Seconds()
+
+	rate := func(cur, prev uint64) float64 {
+		if cur < prev || elapsed <= 0 {
+			return 0
+		}
+
+		return float64(cur-prev) / elapsed
+	}
+
+	next := make(map[string]ChildTraffic, len(sample.Children))
+
+	for i := range sample.Children {
+		c := &sample.Children[i]
+
+		if prev, ok := p.prev[c.UniqueID]; ok {
+			c.BytesInRate = rate(c.BytesIn, prev.BytesIn)
+			c.BytesOutRate = rate(c.BytesOut, prev.BytesOut)
+			c.PacketsInRate = rate(c.PacketsIn, prev.PacketsIn)
+			c.PacketsOutRate = rate(c.PacketsOut, prev.PacketsOut)
+		}
+		next[c.UniqueID] = *c
+	}
+
+	p.prev = next
+	p.prevTime = sample.Time
+}
+
+// parseChildTraffic parses the traffic of the CHILD SAs in a list-sa message.
+func parseChildTraffic(m *Message) []ChildTraffic {
+	var traffic []ChildTraffic
+
+	for _, name := range m.Keys() {
+		ike, ok := m.GetSection(name)
+		if !ok {
+			continue
+		}
+
+		children, ok := ike.GetSection("child-sas")
+		if !ok {
+			continue
+		}
+
+		for _, k := range children.Keys() {
+			child, ok := children.GetSection(k)
+			if !ok {
+				continue
+			}
+
+			traffic = append(traffic, ChildTraffic{
+				IKEName:     name,
+				IKEUniqueID: stringField(ike, "uniqueid"),
+				Name:        stringField(child, "name"),
+				UniqueID:    stringField(child, "uniqueid"),
+				BytesIn:     uintField(child, "bytes-in"),
+				BytesOut:    uintField(child, "bytes-out"),
+				PacketsIn:   uintField(child, "packets-in"),
+				PacketsOut:  uintField(child, "packets-out"),
+			})
+		}
+	}
+
+	return traffic
+}
+
+// uintField returns the unsigned integer value of key in m, or 0 if it is not set or
+// not a number.
+func uintField(m *Message, key string) uint64 {
+	v, _ := strconv.ParseUint(stringField(m, key), 10, 64)
+
+	return v
+}
@@ -0,0 +1,152 @@
+// Copyright (C) 2019 Nick Rosbrook
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package vici
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTrafficPollerRates(t *testing.T) {
+	newSample := func(m map[string]interface{}) []ChildTraffic {
+		msg, err := NewMessageFromMap(m)
+		if err != nil {
+			t.Fatalf("Unexpected error creating message: %v", err)
+		}
+
+		return parseChildTraffic(msg)
+	}
+
+	listSA := func(bytesIn string) map[string]interface{} {
+		return map[string]interface{}{
+			"gw": map[string]interface{}{
+				"uniqueid": "1",
+				"child-sas": map[string]interface{}{
+					"net-2": map[string]interface{}{
+						"name":        "net",
+						"uniqueid":    "2",
+						"bytes-in":    bytesIn,
+						"bytes-out":   "0",
+						"packets-in":  "0",
+						"packets-out": "0",
+					},
+				},
+			},
+		}
+	}
+
+	p := &TrafficPoller{}
+	start := time.Now()
+
+	first := TrafficSample{Time: start, Children: newSample(listSA("1000"))}
+	p.rates(first)
+
+	if c := first.Children[0]; c.IKEName != "gw" || c.Name != "net" || c.BytesIn != 1000 || c.BytesInRate != 0 {
+		t.Errorf("Unexpected first sample: %+v", c)
+	}
+
+	second := TrafficSample{Time: start.Add(2 * time.Second), Children: newSample(listSA("5000"))}
+	p.rates(second)
+
+	if rate := second.Children[0].BytesInRate; rate != 2000 {
+		t.Errorf("Unexpected rate.\nExpected: %v\nReceived: %v", 2000.0, rate)
+	}
+}
+
+func TestTrafficPollerPollFailed(t *testing.T) {
+	client, srvr := net.Pipe()
+	defer client.Close()
+	defer srvr.Close()
+
+	s := &Session{ctr: &transport{conn: client}}
+
+	failed, err := NewMessageFromMap(map[string]interface{}{"success": "no", "errmsg": "listing SAs failed"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating message: %v", err)
+	}
+
+	serveStreamedCommands(t, srvr, []streamedResponse{{"list-sa", nil, failed}})
+
+	p := NewTrafficPoller(s)
+	if _, err := p.Poll(context.Background()); err == nil {
+		t.Errorf("Expected error when list-sas failed")
+	}
+
+	if p.prev != nil || !p.prevTime.IsZero() {
+		t.Errorf("Expected failed sample not to be recorded")
+	}
+}
+
+func TestTrafficPollerRunCanceled(t *testing.T) {
+	client, srvr := net.Pipe()
+	defer client.Close()
+	defer srvr.Close()
+
+	s := &Session{ctr: &transport{conn: client}}
+
+	// The list-sas request is received, but never answered
+	received := make(chan struct{})
+	go func() {
+		tr := &transport{conn: srvr}
+
+		if _, err := tr.recv(); err != nil {
+			t.Errorf("Unexpected error receiving event registration: %v", err)
+		}
+
+		if err := tr.send(newPacket(pktEventConfirm, "", nil)); err != nil {
+			t.Errorf("Unexpected error confirming event registration: %v", err)
+		}
+
+		if _, err := tr.recv(); err != nil {
+			t.Errorf("Unexpected error receiving request: %v", err)
+		}
+		close(received)
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-received
+		cancel()
+	}()
+
+	p := NewTrafficPoller(s)
+
+	err := p.Run(ctx, time.Second, func(TrafficSample, error) {
+		t.Errorf("Unexpected sample after cancellation")
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled: received %v", err)
+	}
+}
+
+func TestTrafficPollerRunInvalidInterval(t *testing.T) {
+	p := NewTrafficPoller(&Session{})
+
+	err := p.Run(context.Background(), 0, func(TrafficSample, error) {
+		t.Errorf("Unexpected sample with invalid interval")
+	})
+	if err == nil {
+		t.Errorf("Expected error with zero interval")
+	}
+}
@@ -21,11 +21,13 @@
 package vici
 
 import (
-	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"time"
 )
 
 const (
@@ -46,44 +48,140 @@ var (
 
 func newTransport(c net.Conn) (*transport, error) {
 	if c != nil {
-		return &transport{c}, nil
+		return &transport{conn: c}, nil
 	}
 
-	c, err := net.Dial("unix", viciSocket)
-	if err != nil {
-		return nil, fmt.Errorf("%v: %v", errTransport, err)
+	t := &transport{
+		dial: func() (net.Conn, error) {
+			return net.Dial("unix", viciSocket)
+		},
+	}
+
+	if err := t.redial(); err != nil {
+		return nil, err
 	}
 
-	return &transport{c}, nil
+	return t, nil
 }
 
 type transport struct {
 	conn net.Conn
+
+	// dial connects to the daemon, the same way the transport was first
+	// connected. It is nil if the transport was given its connection.
+	dial func() (net.Conn, error)
+
+	// Set if the connection was closed by reset, and could not be re-established
+	broken bool
+
+	// The version of the daemon, once queried over the connection. The daemon
+	// may have been upgraded by the time the connection is re-established, so
+	// it is cleared by redial.
+	version *Version
+
+	// Options for decoding received messages
+	opts decodeOptions
+
+	// Options for encoding sent messages
+	encOpts encodeOptions
 }
 
-func (t *transport) send(pkt *packet) error {
-	buf := bytes.NewBuffer([]byte{})
+// watchContext interrupts any pending reads or writes on the transport once ctx
+// is done. The returned function must be called when the transport is no longer
+// used under ctx, and restores the connection deadline.
+func (t *transport) watchContext(ctx context.Context) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+
+	go func() {
+		defer close(finished)
+
+		select {
+		case <-ctx.Done():
+			// Set a deadline in the past so that blocked calls return immediately
+			// nolint
+			t.conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-finished
+
+		// nolint
+		t.conn.SetDeadline(time.Time{})
+	}
+}
+
+// reset closes the transport's connection, and dials a new one the same way the
+// transport was first connected. This is used when the connection was interrupted
+// mid-request, and its state can no longer be trusted. If a new connection cannot be
+// established, the transport is marked broken until a later reset succeeds.
+func (t *transport) reset() error {
+	if t.conn != nil {
+		// nolint
+		t.conn.Close()
+	}
+
+	t.broken = true
+
+	return t.redial()
+}
 
-	b, err := pkt.bytes()
+// ready re-establishes the connection of a broken transport, so that it can be used
+// again, e.g. once the daemon is reachable again.
+func (t *transport) ready() error {
+	if !t.broken {
+		return nil
+	}
+
+	return t.redial()
+}
+
+// redial dials a new connection for the transport.
+func (t *transport) redial() error {
+	if t.dial == nil {
+		return fmt.Errorf("%v: connection cannot be re-established", errTransport)
+	}
+
+	c, err := t.dial()
 	if err != nil {
-		return err
+		return fmt.Errorf("%v: %v", errTransport, err)
 	}
 
-	// Write the packet length
-	pl := make([]byte, headerLength)
-	binary.BigEndian.PutUint32(pl, uint32(len(b)))
-	_, err = buf.Write(pl)
+	t.conn = c
+	t.broken = false
+	t.version = nil
+
+	return nil
+}
+
+func (t *transport) send(pkt *packet) error {
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	// Reserve space for the packet length, which is filled in below
+	_, err := buf.Write(make([]byte, headerLength))
 	if err != nil {
 		return fmt.Errorf("%v: %v", errTransport, err)
 	}
 
 	// Write the payload
-	_, err = buf.Write(b)
+	err = pkt.writeToWithOptions(buf, t.encOpts)
 	if err != nil {
-		return fmt.Errorf("%v: %v", errTransport, err)
+		return err
 	}
 
-	_, err = t.conn.Write(buf.Bytes())
+	// Write the packet length
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b[:headerLength], uint32(len(b)-headerLength))
+
+	_, err = t.conn.Write(b)
 	if err != nil {
 		return fmt.Errorf("%v: %v", errTransport, err)
 	}
@@ -100,14 +198,38 @@ func (t *transport) recv() (*packet, error) {
 	}
 	pl := binary.BigEndian.Uint32(buf)
 
-	buf = make([]byte, int(pl))
-	_, err = t.conn.Read(buf)
+	// Avoid allocating a buffer for a packet that will not be accepted anyway. The
+	// packet type and name are not part of the message, so allow room for them.
+	if max := t.opts.limits.MaxSize; max > 0 && int(pl) > max+2+maxKeyLength {
+		// Discard the payload, so that the next packet can still be read.
+		if _, err := io.CopyN(io.Discard, t.conn, int64(pl)); err != nil {
+			return nil, fmt.Errorf("%v: %v", errTransport, err)
+		}
+
+		return nil, &DecodeLimitError{Limit: "size", Max: max}
+	}
+
+	if t.opts.zeroCopy {
+		// The decoded message references the payload buffer, so it must
+		// not be re-used.
+		buf = make([]byte, int(pl))
+	} else {
+		// Received messages are copied when decoded, so the payload buffer
+		// can be returned to the pool once the packet is parsed.
+		pbuf := getBuffer()
+		defer putBuffer(pbuf)
+
+		pbuf.Grow(int(pl))
+		buf = pbuf.Bytes()[:int(pl)]
+	}
+
+	_, err = io.ReadFull(t.conn, buf)
 	if err != nil {
 		return nil, fmt.Errorf("%v: %v", errTransport, err)
 	}
 
 	p := &packet{}
-	err = p.parse(buf)
+	err = p.parseWithOptions(buf, t.opts)
 	if err != nil {
 		return nil, err
 	}
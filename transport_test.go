@@ -22,6 +22,8 @@ package vici
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
 	"net"
 	"reflect"
 	"testing"
@@ -37,15 +39,19 @@ func TestTransportSend(t *testing.T) {
 	}
 
 	// Send packet and ensure that what is read matches the gold bytes
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
+
 		b := make([]byte, maxSegment)
 		n, err := srvr.Read(b)
 		if err != nil {
 			t.Errorf("Unexpected error reading bytes: %v", err)
 		}
 
-		if !bytes.Equal(b[:n], goldNamedPacketBytes) {
-			t.Errorf("Received byte stream does not equal gold bytes.\nExpected: %v\nReceived: %v", goldUnnamedPacketBytes, b)
+		// Skip the packet length
+		if !bytes.Equal(b[headerLength:n], goldNamedPacketBytes) {
+			t.Errorf("Received byte stream does not equal gold bytes.\nExpected: %v\nReceived: %v", goldNamedPacketBytes, b[headerLength:n])
 		}
 	}()
 
@@ -53,6 +59,8 @@ func TestTransportSend(t *testing.T) {
 	if err != nil {
 		t.Errorf("Unexpected error sending packet: %v", err)
 	}
+
+	<-done
 }
 
 func TestTransportRecv(t *testing.T) {
@@ -66,7 +74,10 @@ func TestTransportRecv(t *testing.T) {
 
 	// Server sends bytes, client reads a returns a packet. Ensure that the
 	// packet is goldNamedPacket
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
+
 		p, err := tr.recv()
 		if err != nil {
 			t.Errorf("Unexpected error receiving packet: %v", err)
@@ -77,8 +88,84 @@ func TestTransportRecv(t *testing.T) {
 		}
 	}()
 
-	_, err := srvr.Write(goldNamedPacketBytes)
+	// Prefix the packet with its length
+	b := make([]byte, headerLength)
+	binary.BigEndian.PutUint32(b, uint32(len(goldNamedPacketBytes)))
+	b = append(b, goldNamedPacketBytes...)
+
+	_, err := srvr.Write(b)
 	if err != nil {
 		t.Errorf("Unexpected error sending bytes: %v", err)
 	}
+
+	<-done
+}
+
+func TestTransportWatchContext(t *testing.T) {
+	client, srvr := net.Pipe()
+	defer client.Close()
+	defer srvr.Close()
+
+	tr := &transport{
+		conn: client,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := tr.watchContext(ctx)
+	defer stop()
+
+	// Nothing is ever written by the server, so recv should only return
+	// once the context is canceled.
+	cancel()
+
+	_, err := tr.recv()
+	if err == nil {
+		t.Errorf("Expected error receiving packet after context was canceled")
+	}
+}
+
+func TestTransportRecvSizeLimit(t *testing.T) {
+	client, srvr := net.Pipe()
+	defer client.Close()
+	defer srvr.Close()
+
+	tr := &transport{
+		conn: client,
+		opts: decodeOptions{limits: DecodeLimits{MaxSize: 8}},
+	}
+
+	large := NewMessage()
+	if err := large.Set("data", bytes.Repeat([]byte{'a'}, 1024)); err != nil {
+		t.Fatalf("Unexpected error setting key: %v", err)
+	}
+
+	// The server sends a packet exceeding the size limit, followed by one within it.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		st := &transport{conn: srvr}
+
+		for _, m := range []*Message{large, NewMessage()} {
+			if err := st.send(newPacket(pktCmdResponse, "", m)); err != nil {
+				t.Errorf("Unexpected error sending packet: %v", err)
+			}
+		}
+	}()
+
+	_, err := tr.recv()
+	if _, ok := err.(*DecodeLimitError); !ok {
+		t.Fatalf("Expected *DecodeLimitError: received %v", err)
+	}
+
+	p, err := tr.recv()
+	if err != nil {
+		t.Fatalf("Unexpected error receiving packet after oversized packet: %v", err)
+	}
+
+	if p.ptype != pktCmdResponse || len(p.msg.Keys()) != 0 {
+		t.Errorf("Unexpected packet after oversized packet: %+v", p)
+	}
+
+	<-done
 }
@@ -0,0 +1,272 @@
+// Copyright (C) 2019 Nick Rosbrook
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build prometheus
+
+package viciprom
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/strongswan/govici"
+)
+
+const namespace = "strongswan"
+
+var (
+	upDesc = prometheus.NewDesc(namespace+"_up",
+		"Whether the daemon could be scraped.", nil, nil)
+
+	workersDesc = prometheus.NewDesc(namespace+"_workers",
+		"Number of worker threads, by state.", []string{"state"}, nil)
+	activeWorkersDesc = prometheus.NewDesc(namespace+"_workers_active",
+		"Number of active worker threads, by job priority.", []string{"priority"}, nil)
+	queuedJobsDesc = prometheus.NewDesc(namespace+"_jobs_queued",
+		"Number of queued jobs, by job priority.", []string{"priority"}, nil)
+	scheduledJobsDesc = prometheus.NewDesc(namespace+"_jobs_scheduled",
+		"Number of scheduled jobs.", nil, nil)
+	halfOpenDesc = prometheus.NewDesc(namespace+"_ike_sas_half_open",
+		"Number of half-open IKE SAs.", nil, nil)
+
+	ikeSAsDesc = prometheus.NewDesc(namespace+"_ike_sas",
+		"Number of IKE SAs, by state.", []string{"state"}, nil)
+	childSAsDesc = prometheus.NewDesc(namespace+"_child_sas",
+		"Number of CHILD SAs, by state.", []string{"state"}, nil)
+
+	bytesDesc = prometheus.NewDesc(namespace+"_child_sa_bytes_total",
+		"Bytes processed by a CHILD SA, by unique ID.", []string{"ike", "child", "uniqueid", "direction"}, nil)
+	packetsDesc = prometheus.NewDesc(namespace+"_child_sa_packets_total",
+		"Packets processed by a CHILD SA, by unique ID.", []string{"ike", "child", "uniqueid", "direction"}, nil)
+
+	countersDesc = prometheus.NewDesc(namespace+"_ike_events_total",
+		"IKE event counters, by connection. The global counters have an empty conn label.",
+		[]string{"conn", "counter"}, nil)
+	countersUpDesc = prometheus.NewDesc(namespace+"_ike_events_up",
+		"Whether the IKE event counters could be scraped, i.e. the counters plugin is loaded.", nil, nil)
+)
+
+// Collector is a prometheus.Collector that scrapes the stats, get-counters and list-sas
+// commands. get-counters requires the counters plugin; if it is not loaded, the event
+// counters are omitted and strongswan_ike_events_up is 0.
+type Collector struct {
+	s *vici.Session
+}
+
+// NewCollector returns a new Collector for the daemon of s.
+func NewCollector(s *vici.Session) *Collector {
+	return &Collector{s: s}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{
+		upDesc, workersDesc, activeWorkersDesc, queuedJobsDesc, scheduledJobsDesc,
+		halfOpenDesc, ikeSAsDesc, childSAsDesc, bytesDesc, packetsDesc, countersDesc,
+		countersUpDesc,
+	} {
+		ch <- d
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	up := 1.0
+
+	if err := c.collectStats(ch); err != nil {
+		up = 0
+	}
+
+	if err := c.collectSAs(ch); err != nil {
+		up = 0
+	}
+
+	// The counters plugin is optional, so its absence does not fail the scrape,
+	// and is reported separately.
+	countersUp := 1.0
+
+	if err := c.collectCounters(ch); err != nil {
+		countersUp = 0
+	}
+
+	ch <- prometheus.MustNewConstMetric(upDesc, prometheus.GaugeValue, up)
+	ch <- prometheus.MustNewConstMetric(countersUpDesc, prometheus.GaugeValue, countersUp)
+}
+
+func (c *Collector) collectStats(ch chan<- prometheus.Metric) error {
+	stats, err := c.s.DaemonStats()
+	if err != nil {
+		return err
+	}
+
+	gauge := func(desc *prometheus.Desc, v uint64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(v), labels...)
+	}
+
+	gauge(workersDesc, stats.Workers.Total, "total")
+	gauge(workersDesc, stats.Workers.Idle, "idle")
+
+	for _, q := range []struct {
+		priority string
+		active   uint64
+		queued   uint64
+	}{
+		{"critical", stats.Workers.Active.Critical, stats.Queues.Critical},
+		{"high", stats.Workers.Active.High, stats.Queues.High},
+		{"medium", stats.Workers.Active.Medium, stats.Queues.Medium},
+		{"low", stats.Workers.Active.Low, stats.Queues.Low},
+	} {
+		gauge(activeWorkersDesc, q.active, q.priority)
+		gauge(queuedJobsDesc, q.queued, q.priority)
+	}
+
+	gauge(scheduledJobsDesc, stats.Scheduled)
+	gauge(halfOpenDesc, stats.IKESAs.HalfOpen)
+
+	return nil
+}
+
+// childTraffic is the traffic of a single CHILD SA. Traffic is reported per CHILD SA,
+// rather than summed by name, so that the counters do not decrease when a rekeyed
+// CHILD SA is deleted.
+type childTraffic struct {
+	ike      string
+	child    string
+	uniqueid string
+
+	// Bytes in and out, and packets in and out
+	values [4]uint64
+}
+
+// saMetrics accumulates the metrics of the SAs in list-sa messages.
+type saMetrics struct {
+	ikeStates   map[string]int
+	childStates map[string]int
+	traffic     []childTraffic
+}
+
+func newSAMetrics() *saMetrics {
+	return &saMetrics{
+		ikeStates:   make(map[string]int),
+		childStates: make(map[string]int),
+	}
+}
+
+// add accumulates the SAs of the list-sa message m.
+func (sm *saMetrics) add(m *vici.Message) error {
+	for _, name := range m.Keys() {
+		ike, ok := m.GetSection(name)
+		if !ok {
+			continue
+		}
+
+		state, _ := ike.GetString("state")
+		sm.ikeStates[state]++
+
+		children, ok := ike.GetSection("child-sas")
+		if !ok {
+			continue
+		}
+
+		for _, k := range children.Keys() {
+			child, ok := children.GetSection(k)
+			if !ok {
+				continue
+			}
+
+			state, _ := child.GetString("state")
+			sm.childStates[state]++
+
+			t := childTraffic{ike: name}
+			t.child, _ = child.GetString("name")
+			t.uniqueid, _ = child.GetString("uniqueid")
+
+			for i, key := range []string{"bytes-in", "bytes-out", "packets-in", "packets-out"} {
+				s, ok := child.GetString(key)
+				if !ok {
+					continue
+				}
+
+				v, err := strconv.ParseUint(s, 10, 64)
+				if err != nil {
+					return fmt.Errorf("invalid %v of CHILD SA %v: %v", key, t.uniqueid, err)
+				}
+				t.values[i] = v
+			}
+
+			sm.traffic = append(sm.traffic, t)
+		}
+	}
+
+	return nil
+}
+
+func (c *Collector) collectSAs(ch chan<- prometheus.Metric) error {
+	sm := newSAMetrics()
+
+	resp, err := c.s.StreamedCommandRequestFunc("list-sas", "list-sa", nil, sm.add)
+	if err != nil {
+		return err
+	}
+
+	if err := resp.Err(); err != nil {
+		return err
+	}
+
+	for state, n := range sm.ikeStates {
+		ch <- prometheus.MustNewConstMetric(ikeSAsDesc, prometheus.GaugeValue, float64(n), state)
+	}
+
+	for state, n := range sm.childStates {
+		ch <- prometheus.MustNewConstMetric(childSAsDesc, prometheus.GaugeValue, float64(n), state)
+	}
+
+	for _, t := range sm.traffic {
+		for i, m := range []struct {
+			desc      *prometheus.Desc
+			direction string
+		}{
+			{bytesDesc, "in"},
+			{bytesDesc, "out"},
+			{packetsDesc, "in"},
+			{packetsDesc, "out"},
+		} {
+			ch <- prometheus.MustNewConstMetric(m.desc, prometheus.CounterValue, float64(t.values[i]), t.ike, t.child, t.uniqueid, m.direction)
+		}
+	}
+
+	return nil
+}
+
+func (c *Collector) collectCounters(ch chan<- prometheus.Metric) error {
+	counters, err := c.s.GetCounters("", true)
+	if err != nil {
+		return err
+	}
+
+	for conn, cs := range counters {
+		for name, v := range cs {
+			ch <- prometheus.MustNewConstMetric(countersDesc, prometheus.CounterValue, float64(v), conn, name)
+		}
+	}
+
+	return nil
+}
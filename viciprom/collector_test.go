@@ -0,0 +1,129 @@
+// Copyright (C) 2019 Nick Rosbrook
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build prometheus
+
+package viciprom
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/strongswan/govici"
+)
+
+func listSA(t *testing.T, children map[string]interface{}) *vici.Message {
+	m, err := vici.NewMessageFromMap(map[string]interface{}{
+		"gw": map[string]interface{}{
+			"state":     "ESTABLISHED",
+			"child-sas": children,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error building message: %v", err)
+	}
+
+	return m
+}
+
+func TestSAMetricsRekeyedChildren(t *testing.T) {
+	sm := newSAMetrics()
+
+	m := listSA(t, map[string]interface{}{
+		"net-1": map[string]interface{}{
+			"name":        "net",
+			"uniqueid":    "1",
+			"state":       "REKEYED",
+			"bytes-in":    "100",
+			"bytes-out":   "200",
+			"packets-in":  "1",
+			"packets-out": "2",
+		},
+		"net-2": map[string]interface{}{
+			"name":     "net",
+			"uniqueid": "2",
+			"state":    "INSTALLED",
+			"bytes-in": "10",
+		},
+	})
+
+	if err := sm.add(m); err != nil {
+		t.Fatalf("Unexpected error adding SAs: %v", err)
+	}
+
+	if n := sm.ikeStates["ESTABLISHED"]; n != 1 {
+		t.Errorf("Unexpected number of established IKE SAs.\nExpected: %v\nReceived: %v", 1, n)
+	}
+
+	if n := sm.childStates["INSTALLED"] + sm.childStates["REKEYED"]; n != 2 {
+		t.Errorf("Unexpected number of CHILD SAs.\nExpected: %v\nReceived: %v", 2, n)
+	}
+
+	expected := map[string][4]uint64{
+		"1": {100, 200, 1, 2},
+		"2": {10, 0, 0, 0},
+	}
+
+	if len(sm.traffic) != len(expected) {
+		t.Fatalf("Unexpected number of CHILD SA traffic entries.\nExpected: %v\nReceived: %v", len(expected), len(sm.traffic))
+	}
+
+	for _, tr := range sm.traffic {
+		if tr.ike != "gw" || tr.child != "net" {
+			t.Errorf("Unexpected tunnel of CHILD SA %v.\nExpected: %v\nReceived: %v", tr.uniqueid, "gw/net", tr.ike+"/"+tr.child)
+		}
+
+		if tr.values != expected[tr.uniqueid] {
+			t.Errorf("Unexpected traffic of CHILD SA %v.\nExpected: %v\nReceived: %v", tr.uniqueid, expected[tr.uniqueid], tr.values)
+		}
+	}
+}
+
+func TestSAMetricsInvalidCounter(t *testing.T) {
+	sm := newSAMetrics()
+
+	m := listSA(t, map[string]interface{}{
+		"net-1": map[string]interface{}{
+			"name":     "net",
+			"uniqueid": "1",
+			"bytes-in": "lots",
+		},
+	})
+
+	if err := sm.add(m); err == nil {
+		t.Fatalf("Expected error adding SA with invalid bytes-in")
+	}
+}
+
+func TestCollectorDescribe(t *testing.T) {
+	ch := make(chan *prometheus.Desc, 32)
+
+	NewCollector(nil).Describe(ch)
+	close(ch)
+
+	n := 0
+	for range ch {
+		n++
+	}
+
+	if n != 12 {
+		t.Errorf("Unexpected number of descriptors.\nExpected: %v\nReceived: %v", 12, n)
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright (C) 2019 Nick Rosbrook
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package viciprom provides a Prometheus collector for strongSwan, which scrapes the
+// daemon over vici on each collection:
+//
+//	s, err := vici.NewSession()
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//
+//	prometheus.MustRegister(viciprom.NewCollector(s))
+//	http.Handle("/metrics", promhttp.Handler())
+//	log.Fatal(http.ListenAndServe(":9814", nil))
+//
+// The collector depends on github.com/prometheus/client_golang, which is not otherwise
+// required by govici. To keep it optional, the collector is only built with the
+// prometheus build tag, e.g. go build -tags prometheus.
+package viciprom